@@ -41,7 +41,14 @@ func main() {
 	server.SetArgVars(vars)
 	server.SetEnvVars()
 
-	config, err := conf.LoadXmlConfig(configs, configDirs, server.CloneGlobalParams())
+	loadConfig := func() (*conf.Config, error) {
+		config, err := conf.LoadXmlConfig(configs, configDirs, server.CloneGlobalParams())
+		if err != nil {
+			return nil, err
+		}
+		return &config, config.Validate()
+	}
+	config, err := loadConfig()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(2)
@@ -53,7 +60,9 @@ func main() {
 		spew.Config.MaxDepth = 100
 		spew.Fdump(os.Stderr, config)
 	}*/
-	err = server.NewServer(&config).Run()
+	s := server.NewServer(config)
+	s.SetConfigLoader(loadConfig)
+	err = s.RunWithSignals()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, err.Error())
 		os.Exit(3)
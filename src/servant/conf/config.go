@@ -1,5 +1,17 @@
 package conf
 
+import "text/template"
+
+// UnixListenPrefix makes server/listen a unix socket path
+const UnixListenPrefix = "unix:"
+
+// FdListenPrefix makes server/listen a socket passed by systemd socket activation at the fd,
+// SystemdListen is the first socket passed
+const (
+	FdListenPrefix = "fd:"
+	SystemdListen  = "systemd"
+)
+
 type Config struct {
 	Server     Server
 	Users      map[string]*User
@@ -9,31 +21,167 @@ type Config struct {
 	Vars       map[string]*Vars
 	Timers     map[string]*Timer
 	Daemons    map[string]*Daemon
+	Sqls       map[string]string // named sqls shared by queries
 
 	Auth       Auth
-	Log        string
+	Log        Log
 
 	Debug      bool
+	Paths      []string // config files loaded
+
+	loadProblems []string          // found while loading, like duplicates, reported by Validate
+	loadingPath  string            // the file being loaded
+	definedIn    map[string]string // file path by item, for duplicates across files
 }
 
 
 type Server struct {
-	Listen string
+	Listen            string // host:port, or unix:/path of a unix socket
+	SocketMode        string // octal mode of the unix socket
+	GracePeriod       uint32
+	TLS               TLS
+	ReadTimeout       uint32
+	WriteTimeout      uint32
+	IdleTimeout       uint32
+	ReadHeaderTimeout uint32
+	Http2             bool // negotiated over tls
+	Listeners         []Listener // served besides Listen
+	MaxBodyBytes      int64                 // 0 for unlimited
+	ResourceMaxBodyBytes map[string]int64   // per resource type, overrides MaxBodyBytes
+	SlowThreshold     float64               // seconds a request takes to be warned as slow, 0 for no warning
+	ResourceSlowThresholds map[string]float64 // per resource type, overrides SlowThreshold
+	CacheMaxBytes     int64                 // memory of cached responses, 0 disables caching
+	IdempotencyMaxBytes int64               // memory of responses kept by idempotency keys, 0 disables them
+	MaxConns          int    // concurrent connections of all listeners, 0 for unlimited
+	MaxConnsMode      string // wait or refuse when MaxConns is reached
+	Backlog           int    // accept queue length of listeners, 0 for the system default
+	ErrorFormat       string
+	VerboseErrors     bool // server errors are responded in detail rather than by the status text
+	TrustedProxies    []string
+	Gzip              Gzip
+	Metrics           Metrics
+	Readiness         Readiness
+	Maintenance       Maintenance
+	Pprof             Pprof
+	CORS              CORS
+	Describe          Describe
+	RateLimit         *RateLimit            // per client
+	ResourceRateLimits map[string]*RateLimit // per client and resource type
+}
+
+type Gzip struct {
+	Enabled   bool
+	MinSize   int
+}
+
+type Log struct {
+	File      string
+	Format    string // text or json
+	Level     string // debug, info, warn or error
+	MaxSize   int64  // in MB, rotated if larger, 0 for no limit
+	MaxAge    uint32 // in days, rotated if older, 0 for no limit
+	MaxBackups int   // number of rotated files kept, 0 keeps all
+	Compress  bool
+	AccessFormat string // common or combined for an access log, none if empty
+	AccessFile   string // the log file or stdout if empty
+	AuditFile    string // json lines of mutating requests, no audit log if empty
+	AuditReads   bool   // audits reads too
+}
+
+type Metrics struct {
+	Enabled   bool
+	Path      string
+	Auth      bool
+}
+
+// Describe is of descriptions of items responded to OPTIONS requests
+type Describe struct {
+	Permission bool // requires the permission of invoking the item, otherwise authentication only
+}
+
+// Pprof mounts the profiling handlers of net/http/pprof, which are sensitive and off by default
+type Pprof struct {
+	Enabled   bool
+	Path      string // prefix of handlers, ends with /
+	BlockRate int    // block profile rate in nanoseconds, 0 for no block profiling
+}
+
+// Readiness lists what must be up before the server is ready
+type Readiness struct {
+	Databases []string
+	Daemons   []string
+}
+
+// Maintenance mode rejects resource requests with 503, it is on by SIGUSR1 or by a global param
+type Maintenance struct {
+	Param      string // global param like group.item, on if not empty, 0, false or off
+	RetryAfter uint32 // in seconds
+	PauseTasks bool   // stop daemons and timers while on
+}
+
+// CORS is enabled when any origin is allowed
+type CORS struct {
+	Origins     []string // exact or with a * wildcard
+	Methods     []string
+	Headers     []string
+	Credentials bool
+	MaxAge      uint32
+}
+
+// RateLimit is a token bucket refilled by Rate tokens per second, holding at most Burst tokens
+type RateLimit struct {
+	Rate      float64
+	Burst     int
+}
+
+// Listener is an address served besides server/listen, with its own tls and optionally fewer resources
+type Listener struct {
+	Listen     string
+	SocketMode string
+	TLS        TLS
+	Resources  []string // like commands, files or status, all are served if empty
+}
+
+type TLS struct {
+	CertFile  string
+	KeyFile   string
+	ClientCA  string
 }
 
 type Auth struct {
 	Enabled       bool
 	MaxTimeDelta  uint32
+	Realm         string
 }
 
 type User struct {
 	Hosts     []string
+	DenyHosts []string
 	Key       string
+	Tokens    []Token
+	Secret    string
+	Password  string // hex encoded sha256 of the password for basic auth
 	Allows    map[string] []string
+	AllowRules []string // <resource>/<group>/<item> patterns, segments can be globs
+	DenyRules  []string // same as AllowRules, take precedence over any allows
+	CommandRules map[string]map[string]Validators // by group then item, restricts the user to the commands listed of a group, with constraints of params
+	RateLimit *RateLimit // overrides the server one
+}
+
+type Token struct {
+	Hash      string // hex encoded sha256 of the token
+	Expires   int64  // UNIX timestamp, 0 means never
+}
+
+// HostRules limits the hosts can access a resource group. Empty Hosts means all hosts allowed.
+type HostRules struct {
+	Hosts     []string
+	DenyHosts []string
 }
 
 type Commands struct {
 	Commands map[string]*Command
+	HostRules
 }
 
 type Command struct {
@@ -41,20 +189,75 @@ type Command struct {
 	Code         string
 	Timeout      uint32
 	User		 string
+	Cwd          string // working directory, / by default
+	Umask        string // octal, the umask of the server by default
 	Background   bool
+	Async        bool   // started as a job polled by its id
+	JobTtl       uint32 // seconds a job is kept after it ends
 	Validators   Validators
+	Params       Params
+	Methods      []string // allowed http methods, GET and POST by default
 	Lock         Lock
+	Envs         map[string]string // param name -> environment variable name
+	Stdin        bool
+	Template     bool // ${param} in bash code are substituted shell quoted
+	Stderr       string // discard, inline into the output, or trailer
+	IgnoreExitCode bool // non-zero exit codes are not failures
+	MaxOutputBytes int64 // the command is killed when its output exceeds, 0 is unlimited
+	MaxConcurrency  int
+	ConcurrencyWait uint32
+	CacheTtl        uint32 // seconds to cache outputs of GET requests, 0 for no caching
+	IdempotencyTtl  uint32 // seconds the response of an idempotency key is kept, 0 to ignore keys
+	ContentType     string // of the output, auto to sniff the first bytes, unset by default
+	Response        *template.Template `json:"-"` // shapes the output into the response body, nil for the output as is
+	ResponseSource  string // of Response
+	ResponseContentType string
+	Description     string // of the command for clients, described by OPTIONS
+	Headers         map[string]string // response headers by canonical names, values may have ${param}
+	Variants        []*Command // run instead of the command for their methods
+
+	responseErr     error // of parsing the response template
 }
 
 type Database struct {
 	Queries  map[string]*Query
 	Driver   string
 	Dsn      string
+	MaxOpenConns    int
+	MaxIdleConns    int
+	ConnMaxLifetime uint32
+	HostRules
 }
 
 type Query struct {
 	Sqls    []string
+	SqlRefs []string // names of the named sqls by index of Sqls, empty for inline sqls
 	Validators   Validators
+	Params       Params
+	Methods      []string // allowed http methods, GET or POST for transactions by default
+	MaxRows int
+	Timeout uint32
+	Transaction bool
+	Write   bool // sqls are executed as writes, returning affected rows rather than rows
+	CacheTtl uint32 // seconds to cache results of GET requests, 0 for no caching
+	Description string // of the query for clients, described by OPTIONS
+	Paginate *Paginate // nil if the query is not paginated
+	Render   Render
+	Headers  map[string]string // response headers by canonical names, values may have ${param}
+}
+
+// Render is how values of results are rendered. Empty values are the defaults, which keep values as they are.
+type Render struct {
+	Nulls   string // null, or empty as empty strings
+	Numbers string // number, or string for clients losing precision of big numbers, e.g. javascript
+	Times   string // rfc3339, or unix for seconds since the epoch
+}
+
+// Paginate is how results of a query are paged by the limit and offset params, which are bound to
+// ${limit} and ${offset} in sqls
+type Paginate struct {
+	Limit    int // of a request without the limit param
+	MaxLimit int
 }
 
 type Lock struct {
@@ -65,6 +268,7 @@ type Lock struct {
 
 type Files struct {
 	Dirs   map[string]*Dir
+	HostRules
 }
 
 type Dir struct {
@@ -72,10 +276,21 @@ type Dir struct {
 	Allows     []string
 	Patterns   []string
 	Validators Validators
+	Params     Params
+	Symlinks   string // refuse, inside to follow symlinks resolving in the root, or follow
+	MaxSize    int64
+	Writable   bool // post and put are rejected with 403 if not
+	AllowList  bool
+	ContentTypes map[string]string
+	StrongEtag bool
+	UploadTtl  uint32 // seconds a partial upload is kept untouched, 0 for forever
+	Checksum   bool // downloads are responded with the sha256 of the content
+	Headers    map[string]string // response headers by canonical names, values may have ${param}
 }
 
 type Vars struct {
 	Vars map[string]*Var
+	HostRules
 }
 
 type Var struct {
@@ -91,6 +306,12 @@ type Timer struct {
 	User      string
 	Tick      int
 	Deadline  uint32
+	Cron      string
+	Timezone  string
+	Overlap   string // "skip", "queue" or "allow"
+	Jitter    uint32
+	At        string // fires once at the time rather than by cron or tick
+	Missed    string // "skip" or "run" a one-shot timer whose time passed when started
 }
 
 type Daemon struct {
@@ -99,12 +320,40 @@ type Daemon struct {
 	User      string
 	Retries   int
 	Live      int
+	Restart   string // "never", "always" or "on-failure"
+	Health    *Health
+	StopTimeout uint32
+}
+
+// Health is a probe of a daemon, by an url or a command of the daemon's lang
+type Health struct {
+	Url       string
+	Code      string
+	Interval  uint32
+	Threshold int
+	Timeout   uint32
 }
 
 type Validator struct {
 	Name     string
-	//class  string
+	Class    string // "regexp" or "enum"
 	Pattern  string
+	Values   []string
 }
 
 type Validators map[string]Validator
+
+// Param declares a request param, with a default value used if it is absent, or required
+type Param struct {
+	Default    string
+	HasDefault bool
+	Required   bool
+	Raw        bool // substituted without shell quoting into template commands
+	Secret     bool // redacted from logs and errors
+	Description string
+	Type       string   // string, int, float, bool, enum or regex, values are checked and normalized by it
+	Values     []string // allowed of an enum
+	Pattern    string   // the whole value of a regex must match
+}
+
+type Params map[string]Param
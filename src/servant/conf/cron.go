@@ -0,0 +1,161 @@
+package conf
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CronSchedule is a parsed 5 fields cron expression: minute hour day-of-month month day-of-week
+type CronSchedule struct {
+	minutes, hours, days, months, weekdays uint64
+	// when both day-of-month and day-of-week are restricted, either matching is ok
+	anyDay bool
+	loc    *time.Location
+}
+
+type cronField struct {
+	min, max int
+	names    []string
+}
+
+var cronFields = []cronField{
+	{ 0, 59, nil },
+	{ 0, 23, nil },
+	{ 1, 31, nil },
+	{ 1, 12, []string{"jan", "feb", "mar", "apr", "may", "jun", "jul", "aug", "sep", "oct", "nov", "dec"} },
+	{ 0, 7, []string{"sun", "mon", "tue", "wed", "thu", "fri", "sat"} },
+}
+
+// ParseCron parses the cron expression, fire times are computed in loc
+func ParseCron(spec string, loc *time.Location) (*CronSchedule, error) {
+	fields := strings.Fields(spec)
+	if len(fields) != len(cronFields) {
+		return nil, fmt.Errorf("cron %q should have %d fields", spec, len(cronFields))
+	}
+	bits := make([]uint64, len(fields))
+	for i, field := range fields {
+		var err error
+		bits[i], err = parseCronField(field, cronFields[i])
+		if err != nil {
+			return nil, fmt.Errorf("cron %q: %s", spec, err)
+		}
+	}
+	// 7 is sunday too
+	if bits[4] & (1 << 7) != 0 {
+		bits[4] |= 1
+	}
+	if loc == nil {
+		loc = time.Local
+	}
+	return &CronSchedule{
+		minutes: bits[0], hours: bits[1], days: bits[2], months: bits[3], weekdays: bits[4],
+		anyDay: fields[2] != "*" && fields[4] != "*",
+		loc: loc,
+	}, nil
+}
+
+func parseCronField(field string, f cronField) (uint64, error) {
+	var ret uint64
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			var err error
+			step, err = strconv.Atoi(stepPart)
+			if err != nil || step <= 0 {
+				return 0, fmt.Errorf("bad step %q", part)
+			}
+		}
+		lo, hi := f.min, f.max
+		if rangePart != "*" {
+			loPart, hiPart, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = parseCronValue(loPart, f); err != nil {
+				return 0, err
+			}
+			hi = lo
+			if isRange {
+				if hi, err = parseCronValue(hiPart, f); err != nil {
+					return 0, err
+				}
+			} else if hasStep {
+				hi = f.max
+			}
+			if hi < lo {
+				return 0, fmt.Errorf("bad range %q", part)
+			}
+		}
+		for v := lo; v <= hi; v += step {
+			ret |= 1 << uint(v)
+		}
+	}
+	return ret, nil
+}
+
+func parseCronValue(s string, f cronField) (int, error) {
+	for i, name := range f.names {
+		if strings.ToLower(s) == name {
+			return i + f.min, nil
+		}
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < f.min || v > f.max {
+		return 0, fmt.Errorf("bad value %q", s)
+	}
+	return v, nil
+}
+
+func (self *CronSchedule) dayMatches(t time.Time) bool {
+	dayOk := self.days & (1 << uint(t.Day())) != 0
+	weekdayOk := self.weekdays & (1 << uint(t.Weekday())) != 0
+	if self.anyDay {
+		return dayOk || weekdayOk
+	}
+	return dayOk && weekdayOk
+}
+
+// Next returns the first fire time after t. Times are stepped in wall clock of the location,
+// so a time skipped by DST does not fire, and a time repeated by DST fires once.
+// Zero time is returned if nothing matches in 5 years.
+func (self *CronSchedule) Next(t time.Time) time.Time {
+	t = t.In(self.loc)
+	c := time.Date(t.Year(), t.Month(), t.Day(), t.Hour(), t.Minute() + 1, 0, 0, self.loc)
+	limit := t.AddDate(5, 0, 0)
+	for c.Before(limit) {
+		var n time.Time
+		switch {
+		case self.months & (1 << uint(c.Month())) == 0:
+			n = time.Date(c.Year(), c.Month() + 1, 1, 0, 0, 0, 0, self.loc)
+		case !self.dayMatches(c):
+			n = time.Date(c.Year(), c.Month(), c.Day() + 1, 0, 0, 0, 0, self.loc)
+		case self.hours & (1 << uint(c.Hour())) == 0:
+			n = time.Date(c.Year(), c.Month(), c.Day(), c.Hour() + 1, 0, 0, 0, self.loc)
+		case self.minutes & (1 << uint(c.Minute())) == 0 || !c.After(t):
+			// the latter is the earlier one of a repeated wall clock
+			n = time.Date(c.Year(), c.Month(), c.Day(), c.Hour(), c.Minute() + 1, 0, 0, self.loc)
+		default:
+			return c
+		}
+		// a wall clock skipped by DST may normalize to an earlier time, step by absolute time then
+		if !n.After(c) {
+			n = c.Add(time.Minute).Truncate(time.Minute)
+		}
+		c = n
+	}
+	return time.Time{}
+}
+
+// atLayouts are layouts of the time a one-shot timer fires at, those without a zone are in the timezone of the timer
+var atLayouts = []string{ time.RFC3339, "2006-01-02T15:04:05", "2006-01-02 15:04:05", "2006-01-02 15:04" }
+
+// ParseAt parses the time of a one-shot timer, in loc unless it has a zone
+func ParseAt(s string, loc *time.Location) (time.Time, error) {
+	for _, layout := range atLayouts {
+		if t, err := time.ParseInLocation(layout, s, loc); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("at %s, should be like 2006-01-02 15:04:05 or with a zone of RFC 3339", s)
+}
@@ -0,0 +1,84 @@
+package conf
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseCron(t *testing.T) {
+	for _, spec := range []string{"* * * *", "60 * * * *", "*/0 * * * *", "5-1 * * * *", "* * * foo *"} {
+		if _, err := ParseCron(spec, time.UTC); err == nil {
+			t.Errorf("%q should be invalid", spec)
+		}
+	}
+	for _, spec := range []string{"0 3 * * *", "*/15 * * * *", "0 9-17/2 1,15 jan-jun mon-fri", "0 0 * * 7"} {
+		if _, err := ParseCron(spec, time.UTC); err != nil {
+			t.Errorf("%q should be valid: %s", spec, err)
+		}
+	}
+}
+
+func TestParseAt(t *testing.T) {
+	loc, _ := time.LoadLocation("Asia/Shanghai")
+	for s, expected := range map[string]string{
+		"2024-03-01 03:00": "2024-02-29T19:00:00Z",
+		"2024-03-01 03:00:30": "2024-02-29T19:00:30Z",
+		"2024-03-01T03:00:30": "2024-02-29T19:00:30Z",
+		"2024-03-01T03:00:30+01:00": "2024-03-01T02:00:30Z",
+	} {
+		if at, err := ParseAt(s, loc); err != nil || at.UTC().Format(time.RFC3339) != expected {
+			t.Errorf("%s should be at %s: %s %v", s, expected, at.UTC().Format(time.RFC3339), err)
+		}
+	}
+	for _, s := range []string{ "", "tomorrow", "2024-03-01", "2024-13-01 03:00" } {
+		if _, err := ParseAt(s, time.UTC); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestCronNext(t *testing.T) {
+	at := func(s string, loc *time.Location) time.Time {
+		ret, _ := time.ParseInLocation("2006-01-02 15:04", s, loc)
+		return ret
+	}
+	cases := []struct {
+		spec, from, next string
+	}{
+		{ "0 3 * * *", "2024-03-01 02:59", "2024-03-01 03:00" },
+		{ "0 3 * * *", "2024-03-01 03:00", "2024-03-02 03:00" },
+		{ "*/15 * * * *", "2024-03-01 10:07", "2024-03-01 10:15" },
+		{ "*/15 * * * *", "2024-03-01 23:50", "2024-03-02 00:00" },
+		{ "0 0 * * mon", "2024-03-01 12:00", "2024-03-04 00:00" },
+		{ "0 0 31 * *", "2024-04-01 00:00", "2024-05-31 00:00" },
+		// either day of month or day of week
+		{ "0 0 15 * sun", "2024-03-01 00:00", "2024-03-03 00:00" },
+	}
+	for _, c := range cases {
+		schedule, _ := ParseCron(c.spec, time.UTC)
+		if next := schedule.Next(at(c.from, time.UTC)); !next.Equal(at(c.next, time.UTC)) {
+			t.Errorf("next of %q from %s should be %s: %s", c.spec, c.from, c.next, next)
+		}
+	}
+
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no tzdata")
+	}
+	// 02:30 does not exist on 2024-03-10
+	schedule, _ := ParseCron("30 2 * * *", loc)
+	if next := schedule.Next(at("2024-03-10 00:00", loc)); !next.Equal(at("2024-03-11 02:30", loc)) {
+		t.Errorf("skipped time should not fire: %s", next)
+	}
+	// 01:30 repeats on 2024-11-03, fires once
+	schedule, _ = ParseCron("30 1 * * *", loc)
+	first := schedule.Next(at("2024-11-03 00:00", loc))
+	if second := schedule.Next(first); first.Hour() != 1 || second.Day() != 4 {
+		t.Errorf("repeated time should fire once: %s %s", first, second)
+	}
+	// timezone of the schedule
+	schedule, _ = ParseCron("0 3 * * *", loc)
+	if next := schedule.Next(at("2024-03-01 00:00", time.UTC)); !next.Equal(at("2024-03-01 03:00", loc)) {
+		t.Errorf("should fire in the timezone: %s", next)
+	}
+}
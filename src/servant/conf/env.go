@@ -0,0 +1,50 @@
+package conf
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+)
+
+// envRe matches $$ and ${NAME}, ${NAME:-default}, ${NAME:?message} in config values expanded at load
+var envRe = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)(?:(:-|:\?)([^}]*))?\}`)
+
+// ExpandEnv expands environment variables like a shell does: ${NAME} is empty if NAME is unset,
+// ${NAME:-default} is the default if NAME is unset or empty, and ${NAME:?message} is an error then.
+// $$ is a literal $.
+func ExpandEnv(s string) (string, error) {
+	var err error
+	ret := envRe.ReplaceAllStringFunc(s, func(m string) string {
+		if m == "$$" {
+			return "$"
+		}
+		sub := envRe.FindStringSubmatch(m)
+		name, op, arg := sub[1], sub[2], sub[3]
+		v := os.Getenv(name)
+		if v != "" {
+			return v
+		}
+		switch op {
+		case ":-":
+			return arg
+		case ":?":
+			if err == nil {
+				if arg == "" {
+					arg = "not set"
+				}
+				err = fmt.Errorf("environment variable %s %s", name, arg)
+			}
+		}
+		return v
+	})
+	return ret, err
+}
+
+// envValue expands environment variables of a config value, a failure is a problem of the config
+func (self *Config) envValue(name, s string) string {
+	ret, err := ExpandEnv(s)
+	if err != nil {
+		self.loadProblems = append(self.loadProblems, fmt.Sprintf("%s: %s", name, err))
+	}
+	return ret
+}
@@ -0,0 +1,54 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExpandEnv(t *testing.T) {
+	t.Setenv("SERVANT_TEST_HOST", "db.local")
+	t.Setenv("SERVANT_TEST_EMPTY", "")
+	for s, expect := range map[string]string{
+		"tcp(${SERVANT_TEST_HOST}:3306)":         "tcp(db.local:3306)",
+		"${SERVANT_TEST_UNSET}x":                 "x",
+		"${SERVANT_TEST_UNSET:-:2465}":           ":2465",
+		"${SERVANT_TEST_EMPTY:-default}":         "default",
+		"${SERVANT_TEST_HOST:?required}":         "db.local",
+		"pa$$word $${SERVANT_TEST_HOST}":         "pa$word ${SERVANT_TEST_HOST}",
+		"$SERVANT_TEST_HOST ${not-a-name}":       "$SERVANT_TEST_HOST ${not-a-name}",
+	} {
+		if v, err := ExpandEnv(s); err != nil || v != expect {
+			t.Errorf("%s should be expanded to %s: %q %v", s, expect, v, err)
+		}
+	}
+	if _, err := ExpandEnv("${SERVANT_TEST_UNSET:?must be set}"); err == nil || err.Error() != "environment variable SERVANT_TEST_UNSET must be set" {
+		t.Errorf("unset required variable should fail: %v", err)
+	}
+	if _, err := ExpandEnv("${SERVANT_TEST_EMPTY:?}"); err == nil || err.Error() != "environment variable SERVANT_TEST_EMPTY not set" {
+		t.Errorf("empty required variable should fail: %v", err)
+	}
+}
+
+func TestConfigEnv(t *testing.T) {
+	t.Setenv("SERVANT_TEST_PORT", "2465")
+	data := `<config>
+		<server><listen>:${SERVANT_TEST_PORT}</listen></server>
+		<database id="db" driver="mysql" dsn="${SERVANT_TEST_DSN:?}"><query id="q"><sql>select ${id}</sql></query></database>
+		<commands id="c"><command id="echo"><code>echo ${SERVANT_TEST_PORT}</code></command></commands>
+	</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	config := xconf.ToConfig()
+	if config.Server.Listen != ":2465" {
+		t.Errorf("listen should be expanded: %s", config.Server.Listen)
+	}
+	// params of code and sqls are of requests, not expanded at load
+	if config.Commands["c"].Commands["echo"].Code != "echo ${SERVANT_TEST_PORT}" || config.Databases["db"].Queries["q"].Sqls[0] != "select ${id}" {
+		t.Errorf("code and sqls should not be expanded")
+	}
+	if err = config.Validate(); err == nil || !strings.Contains(err.Error(), "database/db/dsn: environment variable SERVANT_TEST_DSN not set") {
+		t.Errorf("missing required variable should be invalid: %v", err)
+	}
+}
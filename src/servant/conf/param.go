@@ -0,0 +1,50 @@
+package conf
+
+import (
+	"fmt"
+	"math"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Coerce checks a value of the param against its type, and returns it normalized,
+// e.g. " 007" of an int is 7 and "1" of a bool is true
+func (self Param) Coerce(v string) (string, error) {
+	switch self.Type {
+	case "", "string":
+		return v, nil
+	case "int":
+		i, err := strconv.ParseInt(strings.TrimSpace(v), 10, 64)
+		if err != nil {
+			return "", fmt.Errorf("should be an integer")
+		}
+		return strconv.FormatInt(i, 10), nil
+	case "float":
+		f, err := strconv.ParseFloat(strings.TrimSpace(v), 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) {
+			return "", fmt.Errorf("should be a number")
+		}
+		return strconv.FormatFloat(f, 'g', -1, 64), nil
+	case "bool":
+		b, err := strconv.ParseBool(strings.TrimSpace(v))
+		if err != nil {
+			return "", fmt.Errorf("should be true or false")
+		}
+		return strconv.FormatBool(b), nil
+	case "enum":
+		for _, value := range self.Values {
+			if v == value {
+				return v, nil
+			}
+		}
+		return "", fmt.Errorf("should be one of %s", strings.Join(self.Values, ", "))
+	case "regex":
+		// the whole value must match, like validators
+		if ok, err := regexp.MatchString("^(?:" + self.Pattern + ")$", v); err != nil || !ok {
+			return "", fmt.Errorf("should match %s", self.Pattern)
+		}
+		return v, nil
+	}
+	return "", fmt.Errorf("has unknown type %s", self.Type)
+}
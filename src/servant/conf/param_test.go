@@ -0,0 +1,37 @@
+package conf
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParamCoerce(t *testing.T) {
+	for _, c := range []struct{ param Param; v string; expected string }{
+		{ Param{}, " as is ", " as is " },
+		{ Param{ Type: "int" }, " 007", "7" },
+		{ Param{ Type: "int" }, "-12", "-12" },
+		{ Param{ Type: "float" }, "1.50", "1.5" },
+		{ Param{ Type: "float" }, "1e3", "1000" },
+		{ Param{ Type: "bool" }, "1", "true" },
+		{ Param{ Type: "bool" }, "False", "false" },
+		{ Param{ Type: "enum", Values: []string{"red", "green"} }, "green", "green" },
+		{ Param{ Type: "regex", Pattern: `[a-z]+-\d` }, "web-1", "web-1" },
+	} {
+		if got, err := c.param.Coerce(c.v); err != nil || got != c.expected {
+			t.Errorf("%s %q should be %q: %q %v", c.param.Type, c.v, c.expected, got, err)
+		}
+	}
+	for _, c := range []struct{ param Param; v string; message string }{
+		{ Param{ Type: "int" }, "abc", "should be an integer" },
+		{ Param{ Type: "int" }, "1.5", "should be an integer" },
+		{ Param{ Type: "float" }, "NaN", "should be a number" },
+		{ Param{ Type: "bool" }, "yes", "should be true or false" },
+		{ Param{ Type: "enum", Values: []string{"red", "green"} }, "blue", "should be one of red, green" },
+		{ Param{ Type: "regex", Pattern: `[a-z]+-\d` }, "web-1; rm", "should match" },
+		{ Param{ Type: "date" }, "x", "unknown type date" },
+	} {
+		if _, err := c.param.Coerce(c.v); err == nil || !strings.Contains(err.Error(), c.message) {
+			t.Errorf("%s %q should fail with %q: %v", c.param.Type, c.v, c.message, err)
+		}
+	}
+}
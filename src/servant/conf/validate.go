@@ -0,0 +1,481 @@
+package conf
+
+import (
+	"fmt"
+	"mime"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+type ValidateError struct {
+	Problems []string
+}
+
+func (self ValidateError) Error() string {
+	return fmt.Sprintf("invalid config:\n  %s", strings.Join(self.Problems, "\n  "))
+}
+
+// ValidatePermissionRule checks a <resource>/<group>/<item> rule, each segment can be a glob
+func ValidatePermissionRule(rule string) error {
+	segs := strings.Split(rule, "/")
+	if len(segs) != 3 {
+		return fmt.Errorf("should be <resource>/<group>/<item>")
+	}
+	for _, seg := range segs {
+		if seg == "" {
+			return fmt.Errorf("empty segment")
+		}
+		if _, err := path.Match(seg, ""); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkDuplicate records an item defined more than once, which overrides the previous one,
+// with the files defining it if it is loaded from files
+func (self *Config) checkDuplicate(exists bool, names ...string) {
+	name := strings.Join(names, "/")
+	if self.definedIn == nil {
+		self.definedIn = make(map[string]string)
+	}
+	definedIn := self.definedIn[name]
+	self.definedIn[name] = self.loadingPath
+	if !exists {
+		return
+	}
+	problem := name + " is defined more than once"
+	if definedIn != "" && self.loadingPath != "" {
+		problem += fmt.Sprintf(", in %s and %s", definedIn, self.loadingPath)
+	}
+	self.loadProblems = append(self.loadProblems, problem)
+}
+
+// Validate checks the whole config and returns a ValidateError listing every problem found
+func (self *Config) Validate() error {
+	problems := make([]string, 0)
+	add := func(format string, v ...interface{}) {
+		problems = append(problems, fmt.Sprintf(format, v...))
+	}
+	validateListen("server/listen", self.Server.Listen, self.Server.SocketMode, add)
+	for i, listener := range self.Server.Listeners {
+		name := fmt.Sprintf("server/listener[%d]", i)
+		validateListen(name, listener.Listen, listener.SocketMode, add)
+		for _, resource := range listener.Resources {
+			if !listenerResources[resource] {
+				add("%s has unknown resource %s", name, resource)
+			}
+		}
+	}
+	if self.Server.Metrics.Enabled && !strings.HasPrefix(self.Server.Metrics.Path, "/") {
+		add("server/metrics path %q should start with /", self.Server.Metrics.Path)
+	}
+	if self.Server.Pprof.Enabled && !strings.HasPrefix(self.Server.Pprof.Path, "/") {
+		add("server/pprof path %q should start with /", self.Server.Pprof.Path)
+	}
+	if self.Log.File != "" {
+		if err := checkWritable(self.Log.File); err != nil {
+			add("server/log %s is not writable: %s", self.Log.File, err)
+		}
+	}
+	if self.Log.Format != "" && self.Log.Format != "text" && self.Log.Format != "json" {
+		add("server/log has unknown format %s", self.Log.Format)
+	}
+	switch self.Log.Level {
+	case "", "debug", "info", "warn", "error":
+	default:
+		add("server/log has unknown level %s", self.Log.Level)
+	}
+	if self.Log.AccessFormat != "" && self.Log.AccessFormat != "common" && self.Log.AccessFormat != "combined" {
+		add("server/log has unknown access format %s", self.Log.AccessFormat)
+	}
+	if self.Log.AccessFile != "" {
+		if err := checkWritable(self.Log.AccessFile); err != nil {
+			add("server/log access file %s is not writable: %s", self.Log.AccessFile, err)
+		}
+	}
+	if self.Log.AuditFile != "" {
+		if err := checkWritable(self.Log.AuditFile); err != nil {
+			add("server/log audit file %s is not writable: %s", self.Log.AuditFile, err)
+		}
+	}
+	if self.Server.CacheMaxBytes < 0 {
+		add("server/cacheMaxBytes should not be negative")
+	}
+	if self.Server.IdempotencyMaxBytes < 0 {
+		add("server/idempotencyMaxBytes should not be negative")
+	}
+	if self.Server.SlowThreshold < 0 {
+		add("server/slowThreshold should not be negative")
+	}
+	for resource, threshold := range self.Server.ResourceSlowThresholds {
+		if threshold < 0 {
+			add("server/slowThreshold of %s should not be negative", resource)
+		}
+	}
+	if self.Server.MaxConns < 0 {
+		add("server/maxConns should not be negative")
+	}
+	if mode := self.Server.MaxConnsMode; mode != "" && mode != "wait" && mode != "refuse" {
+		add("server/maxConns has unknown mode %s", mode)
+	}
+	if self.Server.Backlog < 0 {
+		add("server/backlog should not be negative")
+	}
+	if self.Log.MaxSize < 0 || self.Log.MaxBackups < 0 {
+		add("server/log rotation limits should not be negative")
+	}
+	// echoing any origin with credentials would let any site make requests as the user
+	if self.Server.CORS.Credentials {
+		for _, origin := range self.Server.CORS.Origins {
+			if origin == "*" {
+				add("server/cors allows credentials of any origin")
+			}
+		}
+	}
+	for _, problem := range self.loadProblems {
+		add("%s", problem)
+	}
+	for csname, commands := range self.Commands {
+		for cname, command := range commands.Commands {
+			name := fmt.Sprintf("commands/%s/%s", csname, cname)
+			validateCommand(name, command, add)
+			methods := make(map[string]bool)
+			for _, variant := range command.Variants {
+				for _, method := range variant.Methods {
+					if methods[method] {
+						add("%s has method %s in more than one variant", name, method)
+					}
+					methods[method] = true
+				}
+				validateCommand(fmt.Sprintf("%s variant %s", name, strings.Join(variant.Methods, ",")), variant, add)
+			}
+		}
+	}
+	for fname, files := range self.Files {
+		for dname, dir := range files.Dirs {
+			if dir.Root == "" || dir.Root == "." {
+				add("files/%s/%s has empty root", fname, dname)
+			}
+			validateParams(fmt.Sprintf("files/%s/%s", fname, dname), dir.Params, add)
+			validateMethods(fmt.Sprintf("files/%s/%s", fname, dname), dir.Allows, add)
+			validateHeaders(fmt.Sprintf("files/%s/%s", fname, dname), dir.Headers, add)
+			switch dir.Symlinks {
+			case "", "refuse", "inside", "follow":
+			default:
+				add("files/%s/%s has unknown symlinks mode %s", fname, dname, dir.Symlinks)
+			}
+		}
+	}
+	for dname, database := range self.Databases {
+		if database.Driver == "" {
+			add("database/%s has empty driver", dname)
+		}
+		for qname, query := range database.Queries {
+			for _, ref := range query.SqlRefs {
+				if _, ok := self.Sqls[ref]; ref != "" && !ok {
+					add("database/%s/%s references unknown sql %s", dname, qname, ref)
+				}
+			}
+			if query.CacheTtl > 0 && (query.Transaction || query.Write) {
+				add("database/%s/%s caches a write query", dname, qname)
+			}
+			validateParams(fmt.Sprintf("database/%s/%s", dname, qname), query.Params, add)
+			validateMethods(fmt.Sprintf("database/%s/%s", dname, qname), query.Methods, add)
+			validateHeaders(fmt.Sprintf("database/%s/%s", dname, qname), query.Headers, add)
+			render := query.Render
+			for _, r := range []struct{ name, v, def, other string }{
+				{ "nulls", render.Nulls, "null", "empty" },
+				{ "numbers", render.Numbers, "number", "string" },
+				{ "times", render.Times, "rfc3339", "unix" },
+			} {
+				if r.v != "" && r.v != r.def && r.v != r.other {
+					add("database/%s/%s has unknown %s rendering %s", dname, qname, r.name, r.v)
+				}
+			}
+			if page := query.Paginate; page != nil {
+				if page.Limit < 0 || page.MaxLimit < 0 || page.Limit > page.MaxLimit {
+					add("database/%s/%s paginate limit %d not in 0-%d", dname, qname, page.Limit, page.MaxLimit)
+				}
+				if query.MaxRows > 0 && page.MaxLimit > query.MaxRows {
+					add("database/%s/%s paginate max limit %d exceeds max rows %d", dname, qname, page.MaxLimit, query.MaxRows)
+				}
+				for _, name := range []string{"limit", "offset"} {
+					if _, ok := query.Params[name]; ok {
+						add("database/%s/%s param %s is reserved for pagination", dname, qname, name)
+					}
+				}
+			}
+		}
+	}
+	for name, timer := range self.Timers {
+		if timer.At != "" {
+			loc, err := time.LoadLocation(timer.Timezone)
+			if err != nil {
+				add("timer/%s has invalid timezone %s", name, timer.Timezone)
+			} else if _, err = ParseAt(timer.At, loc); err != nil {
+				add("timer/%s has invalid %s", name, err)
+			}
+			if timer.Cron != "" || timer.Tick > 0 {
+				add("timer/%s has at with cron or tick", name)
+			}
+			if timer.Missed != "skip" && timer.Missed != "run" {
+				add("timer/%s has unknown missed policy %s", name, timer.Missed)
+			}
+		} else if timer.Cron != "" {
+			loc, err := time.LoadLocation(timer.Timezone)
+			if err != nil {
+				add("timer/%s has invalid timezone %s", name, timer.Timezone)
+			} else if _, err = ParseCron(timer.Cron, loc); err != nil {
+				add("timer/%s has invalid %s", name, err)
+			}
+		} else if timer.Tick <= 0 {
+			add("timer/%s has invalid tick %d", name, timer.Tick)
+		}
+		if strings.TrimSpace(timer.Code) == "" {
+			add("timer/%s has empty code", name)
+		}
+		if timer.Overlap != "skip" && timer.Overlap != "queue" && timer.Overlap != "allow" {
+			add("timer/%s has unknown overlap policy %s", name, timer.Overlap)
+		}
+	}
+	for name, daemon := range self.Daemons {
+		if strings.TrimSpace(daemon.Code) == "" {
+			add("daemon/%s has empty code", name)
+		}
+		if daemon.Restart != "never" && daemon.Restart != "always" && daemon.Restart != "on-failure" {
+			add("daemon/%s has unknown restart policy %s", name, daemon.Restart)
+		}
+		if daemon.Health != nil && daemon.Health.Url == "" && daemon.Health.Code == "" {
+			add("daemon/%s health has neither url nor code", name)
+		}
+	}
+	for _, dname := range self.Server.Readiness.Databases {
+		if self.Databases[dname] == nil {
+			add("server/readiness references unknown database %s", dname)
+		}
+	}
+	for _, name := range self.Server.Readiness.Daemons {
+		if self.Daemons[name] == nil {
+			add("server/readiness references unknown daemon %s", name)
+		}
+	}
+	checkRateLimit := func(name string, limit *RateLimit) {
+		if limit != nil && (limit.Rate <= 0 || limit.Burst <= 0) {
+			add("%s has invalid rate limit, rate and burst should be positive", name)
+		}
+	}
+	checkRateLimit("server/rateLimit", self.Server.RateLimit)
+	for resource, limit := range self.Server.ResourceRateLimits {
+		checkRateLimit("server/rateLimit of " + resource, limit)
+	}
+	for uname, user := range self.Users {
+		checkRateLimit("user/" + uname + "/rateLimit", user.RateLimit)
+		for _, rule := range user.AllowRules {
+			if err := ValidatePermissionRule(rule); err != nil {
+				add("user/%s has invalid allow %s: %s", uname, rule, err)
+			}
+		}
+		for _, rule := range user.DenyRules {
+			if err := ValidatePermissionRule(rule); err != nil {
+				add("user/%s has invalid deny %s: %s", uname, rule, err)
+			}
+		}
+		for _, csname := range user.Allows["commands"] {
+			if self.Commands[csname] == nil {
+				add("user/%s references unknown commands %s", uname, csname)
+			}
+		}
+		for csname, rules := range user.CommandRules {
+			for cname := range rules {
+				if cs := self.Commands[csname]; cs != nil && cs.Commands[cname] == nil {
+					add("user/%s references unknown command %s.%s", uname, csname, cname)
+				}
+			}
+		}
+		for _, fname := range user.Allows["files"] {
+			if self.Files[fname] == nil {
+				add("user/%s references unknown files %s", uname, fname)
+			}
+		}
+		for _, dname := range user.Allows["databases"] {
+			if self.Databases[dname] == nil {
+				add("user/%s references unknown database %s", uname, dname)
+			}
+		}
+		for _, vname := range user.Allows["vars"] {
+			if self.Vars[vname] == nil {
+				add("user/%s references unknown vars %s", uname, vname)
+			}
+		}
+	}
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		return ValidateError{ Problems: problems }
+	}
+	return nil
+}
+
+func validLang(lang string) bool {
+	return lang == "" || lang == "bash" || lang == "exec"
+}
+
+func checkWritable(path string) error {
+	if info, err := os.Stat(path); err == nil {
+		if info.IsDir() {
+			return fmt.Errorf("is a directory")
+		}
+		return syscall.Access(path, 2) // W_OK
+	}
+	return syscall.Access(filepath.Dir(path), 2)
+}
+
+// listenerResources are what a listener can be restricted to, health probes are always served
+var listenerResources = map[string]bool{
+	"commands": true, "files": true, "databases": true, "vars": true,
+	"metrics": true, "pprof": true, "status": true, "config": true,
+}
+
+// validateListen checks a host:port or unix:/path address
+func validateListen(name, listen, socketMode string, add func(string, ...interface{})) {
+	if socketPath, ok := strings.CutPrefix(listen, UnixListenPrefix); ok {
+		if !path.IsAbs(socketPath) {
+			add("%s %q should be an absolute socket path", name, listen)
+		} else if info, err := os.Stat(filepath.Dir(socketPath)); err != nil || !info.IsDir() {
+			add("%s %q is in no directory", name, listen)
+		}
+		if mode, err := strconv.ParseUint(socketMode, 8, 32); socketMode != "" && (err != nil || mode > 0777) {
+			add("%s has invalid mode %s", name, socketMode)
+		}
+	} else if fd, ok := strings.CutPrefix(listen, FdListenPrefix); ok {
+		if n, err := strconv.Atoi(fd); err != nil || n < 3 {
+			add("%s %q should be a fd of 3 or above", name, listen)
+		}
+	} else if listen == SystemdListen {
+	} else if _, _, err := net.SplitHostPort(listen); err != nil {
+		add("%s %q is invalid: %s", name, listen, err)
+	}
+}
+
+// validateCommand validates a command or a variant of it
+func validateCommand(name string, command *Command, add func(string, ...interface{})) {
+	if command.Code == "" {
+		add("%s has empty code", name)
+	}
+	if !validLang(command.Lang) {
+		add("%s has unknown lang %s", name, command.Lang)
+	}
+	if command.Stderr != "" && command.Stderr != "discard" && command.Stderr != "inline" && command.Stderr != "trailer" {
+		add("%s has unknown stderr mode %s", name, command.Stderr)
+	}
+	if command.Cwd != "" {
+		if info, err := os.Stat(command.Cwd); err != nil {
+			add("%s cwd %s not found: %s", name, command.Cwd, err)
+		} else if !info.IsDir() {
+			add("%s cwd %s is not a directory", name, command.Cwd)
+		}
+	}
+	if command.Umask != "" {
+		if mask, err := strconv.ParseUint(command.Umask, 8, 32); err != nil || mask > 0777 {
+			add("%s has invalid umask %s", name, command.Umask)
+		}
+	}
+	if command.Template && command.Lang == "exec" {
+		add("%s template is for bash only", name)
+	}
+	if command.MaxOutputBytes < 0 {
+		add("%s has negative maxOutputBytes", name)
+	}
+	if command.CacheTtl > 0 && (command.Background || command.Async) {
+		add("%s caches a background command", name)
+	}
+	if command.responseErr != nil {
+		add("%s has invalid response template: %s", name, command.responseErr)
+	}
+	if command.Response != nil && command.Background {
+		add("%s can not shape the output of a background command", name)
+	}
+	if command.Async && command.Background {
+		add("%s is both async and background", name)
+	}
+	if command.ContentType != "" && command.ContentType != "auto" {
+		if mediaType, _, err := mime.ParseMediaType(command.ContentType); err != nil || !strings.Contains(mediaType, "/") {
+			add("%s has invalid content type %s", name, command.ContentType)
+		}
+	}
+	validateParams(name, command.Params, add)
+	validateMethods(name, command.Methods, add)
+	validateHeaders(name, command.Headers, add)
+}
+
+// validateParams checks param declarations, a required param with a default makes no sense
+func validateParams(name string, params Params, add func(string, ...interface{})) {
+	for pname, param := range params {
+		if pname == "" {
+			add("%s has param without name", name)
+		} else if param.Required && param.HasDefault {
+			add("%s param %s is both required and defaulted", name, pname)
+		}
+		switch param.Type {
+		case "", "string", "int", "float", "bool":
+		case "enum":
+			if len(param.Values) == 0 {
+				add("%s param %s has no enum values", name, pname)
+			}
+		case "regex":
+			if _, err := regexp.Compile(param.Pattern); err != nil {
+				add("%s param %s has invalid pattern: %s", name, pname, err)
+				continue
+			}
+		default:
+			add("%s param %s has unknown type %s", name, pname, param.Type)
+			continue
+		}
+		if param.HasDefault {
+			if _, err := param.Coerce(param.Default); err != nil {
+				add("%s param %s default %s", name, pname, err)
+			}
+		}
+	}
+}
+
+var httpMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE", "PATCH", "OPTIONS"}
+
+// headers of a connection rather than a response, or of the framing, can not be set by items
+var reservedHeaders = []string{
+	"Connection", "Keep-Alive", "Proxy-Authenticate", "Proxy-Authorization", "Proxy-Connection",
+	"Te", "Trailer", "Transfer-Encoding", "Upgrade", "Content-Length",
+}
+
+func validateHeaders(name string, headers map[string]string, add func(string, ...interface{})) {
+	for header := range headers {
+		if header == "" || strings.ContainsAny(header, " \t:") {
+			add("%s has invalid header name %q", name, header)
+		}
+		for _, reserved := range reservedHeaders {
+			if header == reserved {
+				add("%s can not set header %s", name, header)
+			}
+		}
+	}
+}
+
+func validateMethods(name string, methods []string, add func(string, ...interface{})) {
+	for _, method := range methods {
+		found := false
+		for _, m := range httpMethods {
+			found = found || m == method
+		}
+		if !found {
+			add("%s has unknown method %s", name, method)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package conf
+
+import (
+	"testing"
+	"strings"
+)
+
+func TestValidate(t *testing.T) {
+	data := `<?xml version="1.0" encoding="utf-8" ?>
+<config>
+	<server><listen>:2465</listen></server>
+	<commands id="c">
+		<command id="foo"><code>echo foo</code></command>
+	</commands>
+	<user id="u">
+		<commands id="c" />
+	</user>
+</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	conf := xconf.ToConfig()
+	if err := conf.Validate(); err != nil {
+		t.Errorf("config should be valid: %s", err)
+	}
+
+	data = `<?xml version="1.0" encoding="utf-8" ?>
+<config>
+	<server><listen>2465</listen><log>/nonexistent/servant.log</log><maxConns mode="drop">-1</maxConns>
+		<cors credentials="true"><origin>*</origin></cors>
+	</server>
+	<commands id="c">
+		<command id="foo"><code>echo foo</code></command>
+		<command id="foo" lang="perl"><code></code></command>
+		<command id="bar"><code>echo ${a}</code><param name="a" required="true" default="x"/></command>
+		<command id="baz" lang="exec" template="true" stderr="file" maxOutputBytes="-1" cwd="/nonexistent" umask="8"><code>echo baz</code></command>
+		<command id="bg" background="true" cacheTtl="60"><code>echo bg</code></command>
+		<command id="job" background="true" async="true"><code>echo job</code></command>
+		<command id="tpl"><code>echo tpl</code><response>{{.Output</response></command>
+		<command id="hdr"><code>echo hdr</code><header name="transfer-encoding">chunked</header><header name="Bad Name">x</header></command>
+		<command id="var"><code>echo get</code>
+			<variant><code>echo any</code></variant>
+			<variant methods="POST"><code>echo post</code></variant>
+			<variant methods="post,put"><code></code></variant>
+		</command>
+		<command id="ct" contentType="json;"><code>echo ct</code></command>
+		<command id="sh" lang="exec" shell="true"><code>echo sh</code></command>
+		<command id="typed"><code>echo typed</code>
+			<param name="n" type="int" default="x"/>
+			<param name="e" type="enum"/>
+			<param name="r" type="regex" pattern="(["/>
+			<param name="d" type="date"/>
+		</command>
+	</commands>
+	<files id="fs"><dir id="d" symlinks="always"><root>/tmp</root></dir></files>
+	<database id="db" driver="mysql">
+		<query id="page" maxRows="10"><sql>SELECT 1 LIMIT ${limit}</sql><paginate limit="20" maxLimit="10"/></query>
+		<query id="render" times="iso"><sql>SELECT 1</sql></query>
+		<query id="param"><sql>SELECT ${offset}</sql><paginate/><param name="offset" default="0"/></query>
+	</database>
+	<timer id="t"><code>date</code></timer>
+	<timer id="cron" cron="* * *"><code>date</code></timer>
+	<timer id="once" at="tomorrow" tick="5" missed="later"><code>date</code></timer>
+	<user id="u">
+		<commands id="c"><command id="deploy" /></commands>
+		<files id="f" />
+		<allow>commands/*</allow>
+	</user>
+</config>`
+	xconf, err = XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	conf = xconf.ToConfig()
+	err = conf.Validate()
+	verr, ok := err.(ValidateError)
+	if !ok {
+		t.Fatalf("config should be invalid")
+	}
+	expects := []string{
+		"server/listen",
+		"server/log",
+		"server/maxConns should not be negative",
+		"server/maxConns has unknown mode drop",
+		"server/cors allows credentials of any origin",
+		"commands/c/foo is defined more than once",
+		"commands/c/foo has empty code",
+		"commands/c/foo has unknown lang perl",
+		"commands/c/bar param a is both required and defaulted",
+		"commands/c/baz has unknown stderr mode file",
+		"commands/c/baz has negative maxOutputBytes",
+		"commands/c/baz template is for bash only",
+		"commands/c/baz cwd /nonexistent not found",
+		"commands/c/baz has invalid umask 8",
+		"commands/c/bg caches a background command",
+		"commands/c/job is both async and background",
+		"commands/c/tpl has invalid response template",
+		"commands/c/hdr can not set header Transfer-Encoding",
+		`commands/c/hdr has invalid header name "Bad Name"`,
+		"commands/c/var has a variant without methods",
+		"commands/c/var has method POST in more than one variant",
+		"commands/c/var variant POST,PUT has empty code",
+		"commands/c/ct has invalid content type json;",
+		"commands/c/sh has shell true conflicting with lang exec",
+		"commands/c/typed param n default should be an integer",
+		"commands/c/typed param e has no enum values",
+		"commands/c/typed param r has invalid pattern",
+		"commands/c/typed param d has unknown type date",
+		"database/db/page paginate limit 20 not in 0-10",
+		"database/db/param param offset is reserved for pagination",
+		"database/db/render has unknown times rendering iso",
+		"timer/t has invalid tick",
+		"timer/cron has invalid cron",
+		"timer/once has invalid at tomorrow",
+		"timer/once has at with cron or tick",
+		"timer/once has unknown missed policy later",
+		"files/fs/d has unknown symlinks mode always",
+		"user/u references unknown files f",
+		"user/u references unknown command c.deploy",
+		"user/u has invalid allow commands/*",
+	}
+	if len(verr.Problems) != len(expects) {
+		t.Errorf("problems wrong: %s", err)
+	}
+	for _, expect := range expects {
+		if !strings.Contains(err.Error(), expect) {
+			t.Errorf("problem %s not found", expect)
+		}
+	}
+}
+
+func TestValidateUnixListen(t *testing.T) {
+	for listen, expect := range map[string]string{
+		`<listen>unix:/tmp/servant.sock</listen>`: "",
+		`<listen mode="0600">unix:/tmp/servant.sock</listen>`: "",
+		`<listen>unix:servant.sock</listen>`: "should be an absolute socket path",
+		`<listen>unix:/nonexistent/servant.sock</listen>`: "is in no directory",
+		`<listen mode="999">unix:/tmp/servant.sock</listen>`: "invalid mode 999",
+		`<listen>systemd</listen>`: "",
+		`<listen>fd:4</listen>`: "",
+		`<listen>fd:1</listen>`: "should be a fd of 3 or above",
+	} {
+		xconf, err := XConfigFromData([]byte(`<config><server>` + listen + `</server></config>`), map[string]string{})
+		if err != nil {
+			t.Fatalf("parse error: %s", err)
+		}
+		conf := xconf.ToConfig()
+		err = conf.Validate()
+		if expect == "" && err != nil {
+			t.Errorf("%s should be valid: %s", listen, err)
+		} else if expect != "" && (err == nil || !strings.Contains(err.Error(), expect)) {
+			t.Errorf("%s should be invalid for %s: %v", listen, expect, err)
+		}
+	}
+}
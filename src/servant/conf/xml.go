@@ -10,8 +10,54 @@ import (
 	"bytes"
 	"path/filepath"
 	"fmt"
+	"encoding/json"
+	"text/template"
+	"net/textproto"
 )
 
+const DefaultGracePeriod = 30
+const EnvPrefix = "SERVANT_"
+const DefaultMaxTimeDelta = 300
+const DefaultReadTimeout = 10
+const DefaultWriteTimeout = 10
+const DefaultIdleTimeout = 60
+const DefaultReadHeaderTimeout = 10
+const DefaultGzipMinSize = 1024
+const DefaultMaxIdleConns = 2
+const DefaultRestart = "on-failure"
+const DefaultHealthInterval = 10
+const DefaultHealthThreshold = 3
+const DefaultHealthTimeout = 5
+const DefaultStopTimeout = 10
+const DefaultOverlap = "skip"
+const DefaultMissed = "skip"
+const DefaultMetricsPath = "/metrics"
+const DefaultPprofPath = "/debug/pprof/"
+const DefaultPprofBlockRate = 1000000
+const DefaultLogFormat = "text"
+const DefaultStderr = "discard"
+const DefaultSocketMode = "0660"
+const DefaultLogLevel = "info"
+const DefaultCORSMaxAge = 600
+const DefaultRealm = "servant"
+const DefaultMaintenanceRetryAfter = 60
+const DefaultCacheMaxBytes = 64 << 20
+const DefaultIdempotencyMaxBytes = 64 << 20
+const DefaultIdempotencyTtl = 86400
+const DefaultJobTtl = 3600
+const DefaultMaxConnsMode = "wait"
+const DefaultPageLimit = 100
+const DefaultUploadTtl = 86400
+const DefaultSymlinks = "refuse"
+var DefaultRender = Render{ Nulls: "null", Numbers: "number", Times: "rfc3339" }
+const DefaultMaxPageLimit = 1000
+var DefaultCommandMethods = []string{"GET", "POST"}
+var DefaultQueryMethods = []string{"GET"}
+var DefaultTransactionMethods = []string{"POST"}
+var DefaultAsyncMethods = []string{"POST"}
+var DefaultCORSMethods = []string{"GET", "HEAD", "POST", "PUT", "DELETE"}
+var DefaultCORSHeaders = []string{"Authorization", "Content-Type", "X-Request-Id"}
+
 type XConfig struct {
 	XMLName    xml.Name    `xml:"config"`
 	Server     XServer     `xml:"server"`
@@ -22,57 +68,277 @@ type XConfig struct {
 	Vars       []XVars     `xml:"vars"`
 	Timers     []XTimer    `xml:"timer"`
 	Daemons    []XDaemon   `xml:"daemon"`
+	Sqls       []XNamedSql `xml:"sql"`
+	Includes   []string    `xml:"include"`
+}
 
+// XNamedSql is a sql shared by queries of any database, referred by its id
+type XNamedSql struct {
+	Name      string  `xml:"id,attr"`
+	Sql       string  `xml:",chardata"`
 }
 
 type XServer struct {
-	Listen  string      `xml:"listen"`
-	Auth    XAuth       `xml:"auth"`
-	Log     string      `xml:"log"`
+	Listen      XListen `xml:"listen"`
+	Listeners   []XListener `xml:"listener"`
+	Auth        XAuth   `xml:"auth"`
+	Log         XLog    `xml:"log"`
+	GracePeriod uint32  `xml:"gracePeriod"`
+	TLS         XTLS    `xml:"tls"`
+	ReadTimeout       *uint32 `xml:"readTimeout"`
+	WriteTimeout      *uint32 `xml:"writeTimeout"`
+	IdleTimeout       *uint32 `xml:"idleTimeout"`
+	ReadHeaderTimeout *uint32 `xml:"readHeaderTimeout"`
+	Http2             *bool   `xml:"http2"`
+	MaxBodyBytes      []XMaxBodyBytes `xml:"maxBodyBytes"`
+	SlowThresholds    []XSlowThreshold `xml:"slowThreshold"`
+	CacheMaxBytes     *int64  `xml:"cacheMaxBytes"`
+	IdempotencyMaxBytes *int64 `xml:"idempotencyMaxBytes"`
+	MaxConns          XMaxConns `xml:"maxConns"`
+	Backlog           int     `xml:"backlog"`
+	ErrorFormat       string  `xml:"errorFormat"`
+	VerboseErrors     bool    `xml:"verboseErrors"`
+	TrustedProxies    []string `xml:"trustedProxy"`
+	Gzip              XGzip   `xml:"gzip"`
+	Metrics           XMetrics `xml:"metrics"`
+	Readiness         XReadiness `xml:"readiness"`
+	Maintenance       XMaintenance `xml:"maintenance"`
+	Pprof             XPprof  `xml:"pprof"`
+	CORS              XCORS   `xml:"cors"`
+	Describe          XDescribe `xml:"describe"`
+	RateLimits        []XRateLimit `xml:"rateLimit"`
+}
+
+type XListen struct {
+	Addr      string  `xml:",chardata"`
+	Mode      string  `xml:"mode,attr"`
+}
+
+type XListener struct {
+	Listen    XListen `xml:"listen"`
+	TLS       XTLS    `xml:"tls"`
+	Resources string  `xml:"resources,attr"`
+}
+
+type XMaxConns struct {
+	Max       int     `xml:",chardata"`
+	Mode      string  `xml:"mode,attr"`
+}
+
+type XSlowThreshold struct {
+	Resource  string  `xml:"resource,attr"`
+	Seconds   float64 `xml:",chardata"`
+}
+
+type XMaxBodyBytes struct {
+	Resource  string  `xml:"resource,attr"`
+	Bytes     int64   `xml:",chardata"`
+}
+
+type XGzip struct {
+	Enabled   bool    `xml:"enabled,attr"`
+	MinSize   *int    `xml:"minSize,attr"`
+}
+
+type XLog struct {
+	File      string  `xml:",chardata"`
+	Format    string  `xml:"format,attr"`
+	Level     string  `xml:"level,attr"`
+	MaxSize   int64   `xml:"maxSize,attr"`
+	MaxAge    uint32  `xml:"maxAge,attr"`
+	MaxBackups int    `xml:"maxBackups,attr"`
+	Compress  bool    `xml:"compress,attr"`
+	AccessFormat string `xml:"accessFormat,attr"`
+	AccessFile   string `xml:"accessFile,attr"`
+	AuditFile    string `xml:"auditFile,attr"`
+	AuditReads   bool   `xml:"auditReads,attr"`
+}
+
+type XMetrics struct {
+	Enabled   bool    `xml:"enabled,attr"`
+	Path      string  `xml:"path,attr"`
+	Auth      bool    `xml:"auth,attr"`
+}
+
+type XDescribe struct {
+	Permission bool   `xml:"permission,attr"`
+}
+
+type XPprof struct {
+	Enabled   bool    `xml:"enabled,attr"`
+	Path      string  `xml:"path,attr"`
+	BlockRate *int    `xml:"blockRate,attr"`
+}
+
+type XReadiness struct {
+	Databases []string `xml:"database"`
+	Daemons   []string `xml:"daemon"`
+}
+
+type XMaintenance struct {
+	Param      string  `xml:"param,attr"`
+	RetryAfter *uint32 `xml:"retryAfter,attr"`
+	PauseTasks bool    `xml:"pauseTasks,attr"`
+}
+
+type XCORS struct {
+	Origins     []string `xml:"origin"`
+	Methods     []string `xml:"method"`
+	Headers     []string `xml:"header"`
+	Credentials bool     `xml:"credentials,attr"`
+	MaxAge      *uint32  `xml:"maxAge,attr"`
+}
+
+type XRateLimit struct {
+	Resource  string  `xml:"resource,attr"`
+	Rate      float64 `xml:"rate,attr"`
+	Burst     int     `xml:"burst,attr"`
+}
+
+type XTLS struct {
+	CertFile  string  `xml:"cert"`
+	KeyFile   string  `xml:"key"`
+	ClientCA  string  `xml:"clientCA"`
 }
 
 type XAuth struct {
 	Enabled       bool     `xml:"enabled,attr"`
-	MaxTimeDelta  uint32   `xml:"maxTimeDelta"`
+	MaxTimeDelta  *uint32  `xml:"maxTimeDelta"`
+	Realm         string   `xml:"realm,attr"`
 }
 
 type XUser struct {
 	Name      string           `xml:"id,attr"`
 	Hosts     []string         `xml:"host"`
+	DenyHosts []string         `xml:"denyHost"`
 	Key       string           `xml:"key"`
+	Tokens    []XToken         `xml:"token"`
+	Secret    string           `xml:"secret"`
+	Password  string           `xml:"password"`
 	Files     []XUserFiles     `xml:"files"`
 	Commands  []XUserCommands  `xml:"commands"`
 	Databases []XUserDatabases `xml:"databases"`
 	Vars      []XUserVars      `xml:"vars"`
+	Allows    []string         `xml:"allow"`
+	Denies    []string         `xml:"deny"`
+	RateLimit *XRateLimit      `xml:"rateLimit"`
 }
 
 type XCommands struct {
 	Name     string      `xml:"id,attr"`
 	Commands []XCommand  `xml:"command"`
+	XHostRules
+}
+
+type XHostRules struct {
+	Hosts     []string `xml:"host"`
+	DenyHosts []string `xml:"denyHost"`
 }
 
 type XCommand struct {
 	Name         string  `xml:"id,attr"`
 	Lang         string	 `xml:"lang,attr"`
+	Shell        *bool   `xml:"shell,attr"` // false for exec, true for bash, default by lang
 	Code         string  `xml:"code"`
 	Timeout      uint32  `xml:"timeout,attr"`
 	User         string  `xml:"runas,attr"`
+	Cwd          string  `xml:"cwd,attr"`
+	Umask        string  `xml:"umask,attr"`
 	Background   bool    `xml:"background,attr"`
+	Async        bool    `xml:"async,attr"`
+	JobTtl       *uint32 `xml:"jobTtl,attr"`
+	Stdin        bool    `xml:"stdin,attr"`
+	Template     bool    `xml:"template,attr"`
+	Stderr       string  `xml:"stderr,attr"`
+	IgnoreExitCode bool  `xml:"ignoreExitCode,attr"`
+	MaxOutputBytes int64 `xml:"maxOutputBytes,attr"`
+	MaxConcurrency  int     `xml:"maxConcurrency,attr"`
+	ConcurrencyWait uint32  `xml:"concurrencyWait,attr"`
+	CacheTtl     uint32  `xml:"cacheTtl,attr"`
+	IdempotencyTtl *uint32 `xml:"idempotencyTtl,attr"`
+	Methods      string  `xml:"methods,attr"`
+	ContentType  string  `xml:"contentType,attr"`
 	Validator    []XValidator `xml:"validate"`
+	Params       []XParam `xml:"param"`
 	Lock         XLock   `xml:"lock"`
+	Envs         []XEnv  `xml:"env"`
+	Response     *XResponse `xml:"response"`
+	Description  string  `xml:"description"`
+	Headers      []XHeader `xml:"header"`
+	Variants     []XCommand `xml:"variant"` // run instead for the methods of them
+}
+
+// XHeader is a response header of an item
+type XHeader struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:",chardata"`
+}
+
+// XResponse is a text/template shaping the output of a command
+type XResponse struct {
+	Template    string  `xml:",chardata"`
+	ContentType string  `xml:"contentType,attr"`
+}
+
+type XEnv struct {
+	Name  string  `xml:",chardata"`
+	As    string  `xml:"as,attr"`
 }
 
 type XDatabase struct {
 	Name    string    `xml:"id,attr"`
 	Driver  string    `xml:"driver,attr"`
 	Dsn     string    `xml:"dsn,attr"`
+	MaxOpenConns    int     `xml:"maxOpenConns,attr"`
+	MaxIdleConns    *int    `xml:"maxIdleConns,attr"`
+	ConnMaxLifetime uint32  `xml:"connMaxLifetime,attr"`
 	Queries []XQuery  `xml:"query"`
+	XRender
+	XHostRules
+}
+
+// XRender is how values of query results are rendered, of a database or a query overriding the database's
+type XRender struct {
+	Nulls     string   `xml:"nulls,attr"`
+	Numbers   string   `xml:"numbers,attr"`
+	Times     string   `xml:"times,attr"`
+}
+
+func (self XRender) over(base Render) Render {
+	for _, x := range []struct{ v string; p *string }{ { self.Nulls, &base.Nulls }, { self.Numbers, &base.Numbers }, { self.Times, &base.Times } } {
+		if v := strings.TrimSpace(x.v); v != "" {
+			*x.p = v
+		}
+	}
+	return base
 }
 
 type XQuery struct {
 	Name      string   `xml:"id,attr"`
-	Sqls      []string `xml:"sql"`
+	Sqls      []XSql   `xml:"sql"`
 	Validator []XValidator `xml:"validate"`
+	Params    []XParam `xml:"param"`
+	MaxRows   int      `xml:"maxRows,attr"`
+	Timeout   uint32   `xml:"timeout,attr"`
+	Transaction bool   `xml:"transaction,attr"`
+	Write     bool     `xml:"write,attr"`
+	CacheTtl  uint32   `xml:"cacheTtl,attr"`
+	Methods   string   `xml:"methods,attr"`
+	Description string `xml:"description"`
+	Paginate  *XPaginate `xml:"paginate"`
+	Headers   []XHeader `xml:"header"`
+	XRender
+}
+
+type XPaginate struct {
+	Limit     int      `xml:"limit,attr"`
+	MaxLimit  int      `xml:"maxLimit,attr"`
+}
+
+// XSql is a sql of a query, or a reference to a named sql
+type XSql struct {
+	Ref       string  `xml:"ref,attr"`
+	Sql       string  `xml:",chardata"`
 }
 
 type XLock struct {
@@ -84,6 +350,7 @@ type XLock struct {
 type XFiles struct {
 	Name   string       `xml:"id,attr"`
 	Dirs   []XDir       `xml:"dir"`
+	XHostRules
 }
 
 type XDir struct {
@@ -92,11 +359,28 @@ type XDir struct {
 	Allows    []string  `xml:"allow"`
 	Patterns  []string  `xml:"pattern"`
 	Validator []XValidator `xml:"validate"`
+	Params    []XParam  `xml:"param"`
+	Symlinks  string    `xml:"symlinks,attr"`
+	FollowSymlinks bool    `xml:"followSymlinks,attr"` // same as symlinks="follow", kept for old configs
+	MaxSize   int64     `xml:"maxSize,attr"`
+	Writable  *bool     `xml:"writable,attr"` // by default if post or put is allowed
+	AllowList bool      `xml:"allowList,attr"`
+	ContentTypes []XContentType `xml:"contentType"`
+	Headers   []XHeader `xml:"header"`
+	StrongEtag bool     `xml:"strongEtag,attr"`
+	UploadTtl *uint32   `xml:"uploadTtl,attr"`
+	Checksum  bool      `xml:"checksum,attr"`
+}
+
+type XContentType struct {
+	Ext   string `xml:"ext,attr"`
+	Type  string `xml:",chardata"`
 }
 
 type XVars struct {
 	Name    string   `xml:"id,attr"`
 	Vars    []XVar   `xml:"var"`
+	XHostRules
 }
 
 type XVar struct {
@@ -114,6 +398,12 @@ type XTimer struct {
 	User      string `xml:"runas,attr"`
 	Tick      int    `xml:"tick,attr"`
 	Deadline  uint32 `xml:"deadline,attr"`
+	Cron      string `xml:"cron,attr"`
+	Timezone  string `xml:"timezone,attr"`
+	Overlap   string `xml:"overlap,attr"`
+	Jitter    uint32 `xml:"jitter,attr"`
+	At        string `xml:"at,attr"`
+	Missed    string `xml:"missed,attr"`
 }
 
 type XDaemon struct {
@@ -123,6 +413,22 @@ type XDaemon struct {
 	User      string `xml:"runas,attr"`
 	Retries   int    `xml:"retries,attr"`
 	Live      int    `xml:"live,attr"`
+	Restart   string `xml:"restart,attr"`
+	Health    *XHealth `xml:"health"`
+	StopTimeout *uint32 `xml:"stopTimeout,attr"`
+}
+
+type XHealth struct {
+	Url       string  `xml:"url,attr"`
+	Code      string  `xml:",chardata"`
+	Interval  uint32  `xml:"interval,attr"`
+	Threshold int     `xml:"threshold,attr"`
+	Timeout   uint32  `xml:"timeout,attr"`
+}
+
+type XToken struct {
+	Hash     string `xml:",chardata"`
+	Expires  int64  `xml:"expires,attr"`
 }
 
 type XUserFiles struct {
@@ -130,7 +436,14 @@ type XUserFiles struct {
 }
 
 type XUserCommands struct {
-	Name   string   `xml:"id,attr"`
+	Name     string         `xml:"id,attr"`
+	Commands []XUserCommand `xml:"command"`
+}
+
+// XUserCommand is a command of a group the user is restricted to, params validated by the user's rules
+type XUserCommand struct {
+	Name      string       `xml:"id,attr"`
+	Validator []XValidator `xml:"validate"`
 }
 
 type XUserDatabases struct {
@@ -143,10 +456,22 @@ type XUserVars struct {
 
 type XValidator struct {
 	Name     string `xml:"name,attr"`
-	//class  string
+	Class    string `xml:"class,attr"`
 	Pattern  string `xml:",chardata"`
 }
 
+type XParam struct {
+	Name     string  `xml:"name,attr"`
+	Default  *string `xml:"default,attr"`
+	Required bool    `xml:"required,attr"`
+	Raw      bool    `xml:"raw,attr"`
+	Secret   bool    `xml:"secret,attr"`
+	Description string `xml:"description,attr"`
+	Type     string  `xml:"type,attr"`
+	Values   string  `xml:"values,attr"`
+	Pattern  string  `xml:"pattern,attr"`
+}
+
 func XConfigFromData(data []byte, entities map[string]string) (*XConfig, error) {
 	ret := XConfig{}
 	decoder := xml.NewDecoder(bytes.NewReader(data))
@@ -184,14 +509,175 @@ func (conf *XConfig) ToConfig() *Config {
 
 func (conf *XConfig) IntoConfig(ret *Config) {
 	if ret.Server.Listen == "" {
+		if conf.Server.GracePeriod == 0 {
+			conf.Server.GracePeriod = DefaultGracePeriod
+		}
 		ret.Server = Server{
-			Listen: conf.Server.Listen,
+			Listen: ret.envValue("server/listen", strings.TrimSpace(conf.Server.Listen.Addr)),
+			SocketMode: strings.TrimSpace(conf.Server.Listen.Mode),
+			GracePeriod: conf.Server.GracePeriod,
+			TLS: TLS {
+				CertFile: ret.envValue("server/tls/cert", strings.TrimSpace(conf.Server.TLS.CertFile)),
+				KeyFile: ret.envValue("server/tls/key", strings.TrimSpace(conf.Server.TLS.KeyFile)),
+				ClientCA: ret.envValue("server/tls/clientCA", strings.TrimSpace(conf.Server.TLS.ClientCA)),
+			},
+			ReadTimeout: timeoutOrDefault(conf.Server.ReadTimeout, DefaultReadTimeout),
+			WriteTimeout: timeoutOrDefault(conf.Server.WriteTimeout, DefaultWriteTimeout),
+			IdleTimeout: timeoutOrDefault(conf.Server.IdleTimeout, DefaultIdleTimeout),
+			ReadHeaderTimeout: timeoutOrDefault(conf.Server.ReadHeaderTimeout, DefaultReadHeaderTimeout),
+			Http2: conf.Server.Http2 == nil || *conf.Server.Http2,
+			ErrorFormat: strings.TrimSpace(conf.Server.ErrorFormat),
+			VerboseErrors: conf.Server.VerboseErrors,
+			TrustedProxies: trimStrings(conf.Server.TrustedProxies),
+			Gzip: Gzip {
+				Enabled: conf.Server.Gzip.Enabled,
+				MinSize: DefaultGzipMinSize,
+			},
+		}
+		if ret.Server.SocketMode == "" {
+			ret.Server.SocketMode = DefaultSocketMode
+		}
+		ret.Server.MaxConns = conf.Server.MaxConns.Max
+		ret.Server.MaxConnsMode = strings.ToLower(strings.TrimSpace(conf.Server.MaxConns.Mode))
+		if ret.Server.MaxConnsMode == "" {
+			ret.Server.MaxConnsMode = DefaultMaxConnsMode
+		}
+		ret.Server.Backlog = conf.Server.Backlog
+		ret.Server.CacheMaxBytes = DefaultCacheMaxBytes
+		if conf.Server.CacheMaxBytes != nil {
+			ret.Server.CacheMaxBytes = *conf.Server.CacheMaxBytes
+		}
+		ret.Server.IdempotencyMaxBytes = DefaultIdempotencyMaxBytes
+		if conf.Server.IdempotencyMaxBytes != nil {
+			ret.Server.IdempotencyMaxBytes = *conf.Server.IdempotencyMaxBytes
+		}
+		for _, x := range conf.Server.Listeners {
+			listener := Listener{
+				Listen: ret.envValue("server/listener/listen", strings.TrimSpace(x.Listen.Addr)),
+				SocketMode: strings.TrimSpace(x.Listen.Mode),
+				TLS: TLS {
+					CertFile: ret.envValue("server/listener/tls/cert", strings.TrimSpace(x.TLS.CertFile)),
+					KeyFile: ret.envValue("server/listener/tls/key", strings.TrimSpace(x.TLS.KeyFile)),
+					ClientCA: ret.envValue("server/listener/tls/clientCA", strings.TrimSpace(x.TLS.ClientCA)),
+				},
+			}
+			if listener.SocketMode == "" {
+				listener.SocketMode = DefaultSocketMode
+			}
+			for _, resource := range strings.Split(x.Resources, ",") {
+				if resource = strings.TrimSpace(resource); resource != "" {
+					listener.Resources = append(listener.Resources, resource)
+				}
+			}
+			ret.Server.Listeners = append(ret.Server.Listeners, listener)
+		}
+		if conf.Server.Gzip.MinSize != nil {
+			ret.Server.Gzip.MinSize = *conf.Server.Gzip.MinSize
+		}
+		ret.Server.Metrics = Metrics {
+			Enabled: conf.Server.Metrics.Enabled,
+			Path: strings.TrimSpace(conf.Server.Metrics.Path),
+			Auth: conf.Server.Metrics.Auth,
+		}
+		if ret.Server.Metrics.Path == "" {
+			ret.Server.Metrics.Path = DefaultMetricsPath
+		}
+		ret.Server.Pprof = Pprof {
+			Enabled: conf.Server.Pprof.Enabled,
+			Path: strings.TrimSpace(conf.Server.Pprof.Path),
+			BlockRate: DefaultPprofBlockRate,
+		}
+		if ret.Server.Pprof.Path == "" {
+			ret.Server.Pprof.Path = DefaultPprofPath
+		} else if !strings.HasSuffix(ret.Server.Pprof.Path, "/") {
+			ret.Server.Pprof.Path += "/"
+		}
+		if conf.Server.Pprof.BlockRate != nil {
+			ret.Server.Pprof.BlockRate = *conf.Server.Pprof.BlockRate
+		}
+		ret.Server.Describe = Describe{ Permission: conf.Server.Describe.Permission }
+		ret.Server.CORS = CORS {
+			Origins: trimStrings(conf.Server.CORS.Origins),
+			Methods: trimStrings(conf.Server.CORS.Methods),
+			Headers: trimStrings(conf.Server.CORS.Headers),
+			Credentials: conf.Server.CORS.Credentials,
+			MaxAge: timeoutOrDefault(conf.Server.CORS.MaxAge, DefaultCORSMaxAge),
+		}
+		if len(ret.Server.CORS.Methods) == 0 {
+			ret.Server.CORS.Methods = DefaultCORSMethods
+		}
+		if len(ret.Server.CORS.Headers) == 0 {
+			ret.Server.CORS.Headers = DefaultCORSHeaders
+		}
+		for _, x := range conf.Server.MaxBodyBytes {
+			resource := strings.TrimSpace(x.Resource)
+			if resource == "" {
+				ret.Server.MaxBodyBytes = x.Bytes
+				continue
+			}
+			if ret.Server.ResourceMaxBodyBytes == nil {
+				ret.Server.ResourceMaxBodyBytes = make(map[string]int64)
+			}
+			ret.Server.ResourceMaxBodyBytes[resource] = x.Bytes
+		}
+		for _, x := range conf.Server.SlowThresholds {
+			resource := strings.TrimSpace(x.Resource)
+			if resource == "" {
+				ret.Server.SlowThreshold = x.Seconds
+				continue
+			}
+			if ret.Server.ResourceSlowThresholds == nil {
+				ret.Server.ResourceSlowThresholds = make(map[string]float64)
+			}
+			ret.Server.ResourceSlowThresholds[resource] = x.Seconds
+		}
+		for _, x := range conf.Server.RateLimits {
+			resource := strings.TrimSpace(x.Resource)
+			if resource == "" {
+				ret.Server.RateLimit = x.toRateLimit()
+				continue
+			}
+			if ret.Server.ResourceRateLimits == nil {
+				ret.Server.ResourceRateLimits = make(map[string]*RateLimit)
+			}
+			ret.Server.ResourceRateLimits[resource] = x.toRateLimit()
+		}
+		ret.Server.Readiness = Readiness {
+			Databases: trimStrings(conf.Server.Readiness.Databases),
+			Daemons: trimStrings(conf.Server.Readiness.Daemons),
+		}
+		ret.Server.Maintenance = Maintenance {
+			Param: strings.TrimSpace(conf.Server.Maintenance.Param),
+			RetryAfter: timeoutOrDefault(conf.Server.Maintenance.RetryAfter, DefaultMaintenanceRetryAfter),
+			PauseTasks: conf.Server.Maintenance.PauseTasks,
 		}
 		ret.Auth = Auth {
 			Enabled:      conf.Server.Auth.Enabled,
-			MaxTimeDelta: conf.Server.Auth.MaxTimeDelta,
+			MaxTimeDelta: timeoutOrDefault(conf.Server.Auth.MaxTimeDelta, DefaultMaxTimeDelta),
+			Realm: strings.TrimSpace(conf.Server.Auth.Realm),
+		}
+		if ret.Auth.Realm == "" {
+			ret.Auth.Realm = DefaultRealm
+		}
+		ret.Log = Log {
+			File: ret.envValue("server/log", strings.TrimSpace(conf.Server.Log.File)),
+			Format: strings.TrimSpace(conf.Server.Log.Format),
+			Level: strings.ToLower(strings.TrimSpace(conf.Server.Log.Level)),
+			MaxSize: conf.Server.Log.MaxSize,
+			MaxAge: conf.Server.Log.MaxAge,
+			MaxBackups: conf.Server.Log.MaxBackups,
+			Compress: conf.Server.Log.Compress,
+			AccessFormat: strings.ToLower(strings.TrimSpace(conf.Server.Log.AccessFormat)),
+			AccessFile: ret.envValue("server/log/accessFile", strings.TrimSpace(conf.Server.Log.AccessFile)),
+			AuditFile: ret.envValue("server/log/auditFile", strings.TrimSpace(conf.Server.Log.AuditFile)),
+			AuditReads: conf.Server.Log.AuditReads,
+		}
+		if ret.Log.Format == "" {
+			ret.Log.Format = DefaultLogFormat
+		}
+		if ret.Log.Level == "" {
+			ret.Log.Level = DefaultLogLevel
 		}
-		ret.Log = conf.Server.Log
 	}
 	if ret.Files == nil {
 		ret.Files = make(map[string]*Files)
@@ -203,6 +689,7 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 				Dirs: make(map[string]*Dir),
 			}
 		}
+		ret.Files[fname].HostRules.merge(&file.XHostRules)
 		for _, xdir := range file.Dirs {
 			dname := xdir.Name
 			dir := &Dir{
@@ -210,13 +697,28 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 				Allows: make([]string, 0, 4),
 				Patterns: make([]string, 0, 4),
 				Validators: xvalidatorsToValidators(xdir.Validator),
+				Params: xparamsToParams(xdir.Params),
+				Symlinks: xdirSymlinks(xdir),
+				MaxSize: xdir.MaxSize,
+				AllowList: xdir.AllowList,
+				ContentTypes: xcontentTypesToContentTypes(xdir.ContentTypes),
+				StrongEtag: xdir.StrongEtag,
+				UploadTtl: timeoutOrDefault(xdir.UploadTtl, DefaultUploadTtl),
+				Checksum: xdir.Checksum,
+				Headers: xheadersToHeaders(xdir.Headers),
 			}
 			for _, method := range(xdir.Allows) {
-				dir.Allows = append(dir.Allows, strings.ToUpper(strings.TrimSpace(method)))
+				method = strings.ToUpper(strings.TrimSpace(method))
+				dir.Allows = append(dir.Allows, method)
+				dir.Writable = dir.Writable || method == "POST" || method == "PUT"
+			}
+			if xdir.Writable != nil {
+				dir.Writable = *xdir.Writable
 			}
 			for _, pattern := range(xdir.Patterns) {
 				dir.Patterns = append(dir.Patterns, strings.TrimSpace(pattern))
 			}
+			ret.checkDuplicate(ret.Files[fname].Dirs[dname] != nil, "files", fname, dname)
 			ret.Files[fname].Dirs[dname] = dir
 		}
 	}
@@ -230,27 +732,24 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 				Commands: make(map[string]*Command),
 			}
 		}
+		ret.Commands[csname].HostRules.merge(&commands.XHostRules)
 		for _, command := range commands.Commands {
 			cname := command.Name
-			if command.Timeout == 0 {
-				command.Timeout = math.MaxUint32
-			}
-			if command.Lock.Timeout == 0 {
-				command.Lock.Timeout = math.MaxUint32
-			}
-			ret.Commands[csname].Commands[cname] = &Command{
-				Code: strings.TrimSpace(command.Code),
-				Lang: command.Lang,
-				User: command.User,
-				Timeout: command.Timeout,
-				Background: command.Background,
-				Lock: Lock {
-					Name: strings.TrimSpace(command.Lock.Name),
-					Timeout: command.Lock.Timeout,
-					Wait: command.Lock.Wait,
-				},
-				Validators: xvalidatorsToValidators(command.Validator),
+			ret.checkDuplicate(ret.Commands[csname].Commands[cname] != nil, "commands", csname, cname)
+			c := xcommandToCommand(command, cname)
+			ret.checkShell(command, csname, cname)
+			for _, variant := range command.Variants {
+				if strings.TrimSpace(variant.Methods) == "" {
+					ret.loadProblems = append(ret.loadProblems, fmt.Sprintf("commands/%s/%s has a variant without methods", csname, cname))
+					continue
+				}
+				if len(variant.Variants) > 0 {
+					ret.loadProblems = append(ret.loadProblems, fmt.Sprintf("commands/%s/%s has variants nested", csname, cname))
+				}
+				ret.checkShell(variant, csname, cname)
+				c.Variants = append(c.Variants, xcommandToCommand(variant, cname))
 			}
+			ret.Commands[csname].Commands[cname] = c
 		}
 	}
 	if ret.Databases == nil {
@@ -260,18 +759,55 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		dname := database.Name
 		if ret.Databases[dname] == nil {
 			ret.Databases[dname] = &Database{
-				Dsn: database.Dsn,
+				Dsn: ret.envValue("database/" + dname + "/dsn", database.Dsn),
 				Driver: database.Driver,
+				MaxOpenConns: database.MaxOpenConns,
+				MaxIdleConns: DefaultMaxIdleConns,
+				ConnMaxLifetime: database.ConnMaxLifetime,
 				Queries: make(map[string]*Query),
 			}
+			if database.MaxIdleConns != nil {
+				ret.Databases[dname].MaxIdleConns = *database.MaxIdleConns
+			}
 		}
+		ret.Databases[dname].HostRules.merge(&database.XHostRules)
 		for _, query := range database.Queries {
+			queryMethods := DefaultQueryMethods
+			if query.Transaction || query.Write {
+				queryMethods = DefaultTransactionMethods
+			}
+			ret.checkDuplicate(ret.Databases[dname].Queries[query.Name] != nil, "database", dname, query.Name)
+			sqls, sqlRefs := make([]string, 0, len(query.Sqls)), make([]string, 0, len(query.Sqls))
+			for _, sql := range query.Sqls {
+				sqls, sqlRefs = append(sqls, sql.Sql), append(sqlRefs, strings.TrimSpace(sql.Ref))
+			}
 			ret.Databases[dname].Queries[query.Name] = &Query{
-				Sqls: query.Sqls,
+				Sqls: sqls,
+				SqlRefs: sqlRefs,
 				Validators: xvalidatorsToValidators(query.Validator),
+				Params: xparamsToParams(query.Params),
+				Methods: splitMethods(query.Methods, queryMethods),
+				MaxRows: query.MaxRows,
+				Timeout: query.Timeout,
+				Transaction: query.Transaction,
+				Write: query.Write,
+				CacheTtl: query.CacheTtl,
+				Description: strings.TrimSpace(query.Description),
+				Paginate: xpaginateToPaginate(query.Paginate),
+				Render: query.XRender.over(database.XRender.over(DefaultRender)),
+				Headers: xheadersToHeaders(query.Headers),
 			}
 		}
 	}
+	if ret.Sqls == nil {
+		ret.Sqls = make(map[string]string)
+	}
+	for _, sql := range conf.Sqls {
+		ret.checkDuplicate(ret.Sqls[sql.Name] != "", "sql", sql.Name)
+		ret.Sqls[sql.Name] = sql.Sql
+	}
+	// named sqls may be defined in files loaded later, references are resolved on all loaded
+	ret.resolveSqls()
 	if ret.Vars == nil {
 		ret.Vars = make(map[string]*Vars)
 	}
@@ -282,7 +818,9 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 				Vars: make(map[string]*Var),
 			}
 		}
+		ret.Vars[vname].HostRules.merge(&vars.XHostRules)
 		for _, v := range vars.Vars {
+			ret.checkDuplicate(ret.Vars[vname].Vars[v.Name] != nil, "vars", vname, v.Name)
 			ret.Vars[vname].Vars[v.Name] = &Var{
 				Value: v.Value,
 				Patterns: v.Patterns,
@@ -298,12 +836,37 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		if daemon.Live <= 0 {
 			daemon.Live = math.MaxUint32
 		}
+		ret.checkDuplicate(ret.Daemons[daemon.Name] != nil, "daemon", daemon.Name)
 		ret.Daemons[daemon.Name] = &Daemon{
 			Code: daemon.Code,
 			Lang: daemon.Lang,
 			User: daemon.User,
 			Live: daemon.Live,
 			Retries: daemon.Retries,
+			Restart: strings.TrimSpace(daemon.Restart),
+			StopTimeout: timeoutOrDefault(daemon.StopTimeout, DefaultStopTimeout),
+		}
+		if ret.Daemons[daemon.Name].Restart == "" {
+			ret.Daemons[daemon.Name].Restart = DefaultRestart
+		}
+		if daemon.Health != nil {
+			health := &Health{
+				Url: strings.TrimSpace(daemon.Health.Url),
+				Code: strings.TrimSpace(daemon.Health.Code),
+				Interval: daemon.Health.Interval,
+				Threshold: daemon.Health.Threshold,
+				Timeout: daemon.Health.Timeout,
+			}
+			if health.Interval == 0 {
+				health.Interval = DefaultHealthInterval
+			}
+			if health.Threshold <= 0 {
+				health.Threshold = DefaultHealthThreshold
+			}
+			if health.Timeout == 0 {
+				health.Timeout = DefaultHealthTimeout
+			}
+			ret.Daemons[daemon.Name].Health = health
 		}
 	}
 	if ret.Timers == nil {
@@ -313,12 +876,25 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		if timer.Deadline <= 0 {
 			timer.Deadline = math.MaxUint32
 		}
+		ret.checkDuplicate(ret.Timers[timer.Name] != nil, "timer", timer.Name)
 		ret.Timers[timer.Name] = &Timer{
 			Code: timer.Code,
 			Lang: timer.Lang,
 			User: timer.User,
 			Tick: timer.Tick,
 			Deadline: timer.Deadline,
+			Cron: strings.TrimSpace(timer.Cron),
+			Timezone: strings.TrimSpace(timer.Timezone),
+			Overlap: strings.TrimSpace(timer.Overlap),
+			Jitter: timer.Jitter,
+			At: strings.TrimSpace(timer.At),
+			Missed: strings.TrimSpace(timer.Missed),
+		}
+		if ret.Timers[timer.Name].Overlap == "" {
+			ret.Timers[timer.Name].Overlap = DefaultOverlap
+		}
+		if ret.Timers[timer.Name].Missed == "" {
+			ret.Timers[timer.Name].Missed = DefaultMissed
 		}
 	}
 	if ret.Users == nil {
@@ -328,11 +904,25 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		uname := user.Name
 		u := &User{
 			Key: strings.TrimSpace(user.Key),
+			Secret: strings.TrimSpace(user.Secret),
+			Password: strings.ToLower(strings.TrimSpace(user.Password)),
 			Hosts: make([]string, len(user.Hosts)),
 		}
 		for j := range(user.Hosts) {
 			u.Hosts[j] = strings.TrimSpace(user.Hosts[j])
 		}
+		for _, host := range(user.DenyHosts) {
+			u.DenyHosts = append(u.DenyHosts, strings.TrimSpace(host))
+		}
+		for _, token := range(user.Tokens) {
+			u.Tokens = append(u.Tokens, Token{
+				Hash: strings.ToLower(strings.TrimSpace(token.Hash)),
+				Expires: token.Expires,
+			})
+		}
+		if user.RateLimit != nil {
+			u.RateLimit = user.RateLimit.toRateLimit()
+		}
 		u.Allows = make(map[string][]string)
 		u.Allows["commands"] = make([]string, 0, 2)
 		u.Allows["files"] = make([]string, 0, 2)
@@ -340,6 +930,18 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		u.Allows["vars"] = make([]string, 0, 2)
 		for _, command := range(user.Commands) {
 			u.Allows["commands"] = append(u.Allows["commands"], command.Name)
+			if len(command.Commands) == 0 {
+				continue
+			}
+			if u.CommandRules == nil {
+				u.CommandRules = make(map[string]map[string]Validators)
+			}
+			if u.CommandRules[command.Name] == nil {
+				u.CommandRules[command.Name] = make(map[string]Validators)
+			}
+			for _, c := range command.Commands {
+				u.CommandRules[command.Name][c.Name] = xvalidatorsToValidators(c.Validator)
+			}
 		}
 		for _, file := range(user.Files) {
 			u.Allows["files"] = append(u.Allows["files"], file.Name)
@@ -350,6 +952,9 @@ func (conf *XConfig) IntoConfig(ret *Config) {
 		for _, vars := range(user.Vars) {
 			u.Allows["vars"] = append(u.Allows["vars"], vars.Name)
 		}
+		u.AllowRules = trimStrings(user.Allows)
+		u.DenyRules = trimStrings(user.Denies)
+		ret.checkDuplicate(ret.Users[uname] != nil, "user", uname)
 		ret.Users[uname] = u
 	}
 }
@@ -359,14 +964,252 @@ type LoadConfigError struct {
 	errors []error
 }*/
 
+// resolveSqls sets sqls referring named sqls, unknown references are left empty for Validate
+func (self *Config) resolveSqls() {
+	for _, database := range self.Databases {
+		for _, query := range database.Queries {
+			for i, ref := range query.SqlRefs {
+				if ref != "" {
+					query.Sqls[i] = self.Sqls[ref]
+				}
+			}
+		}
+	}
+}
+
+
+// commandLang returns the lang of a command, by its shell attribute if no lang. Commands run
+// without a shell by default, so metacharacters in params are never interpreted, except templates,
+// which are substituted quoted for bash.
+func commandLang(command XCommand) string {
+	if command.Lang != "" {
+		return command.Lang
+	}
+	if command.Shell == nil && command.Template || command.Shell != nil && *command.Shell {
+		return "bash"
+	}
+	return "exec"
+}
+
+// checkShell reports a shell attribute contradicting the lang of the command
+func (self *Config) checkShell(command XCommand, csname, cname string) {
+	if command.Shell == nil || command.Lang == "" {
+		return
+	}
+	if *command.Shell != (command.Lang == "bash") {
+		self.loadProblems = append(self.loadProblems, fmt.Sprintf("commands/%s/%s has shell %t conflicting with lang %s", csname, cname, *command.Shell, command.Lang))
+	}
+}
+
+// xcommandToCommand converts a command, or a variant of it by methods
+func xcommandToCommand(command XCommand, cname string) *Command {
+	if command.Timeout == 0 {
+		command.Timeout = math.MaxUint32
+	}
+	if command.Lock.Timeout == 0 {
+		command.Lock.Timeout = math.MaxUint32
+	}
+	commandMethods := DefaultCommandMethods
+	if command.Async {
+		commandMethods = DefaultAsyncMethods
+	}
+	c := &Command{
+		Code: strings.TrimSpace(command.Code),
+		Lang: commandLang(command),
+		User: command.User,
+		Cwd: strings.TrimSpace(command.Cwd),
+		Umask: strings.TrimSpace(command.Umask),
+		Timeout: command.Timeout,
+		Background: command.Background,
+		Async: command.Async,
+		JobTtl: timeoutOrDefault(command.JobTtl, DefaultJobTtl),
+		Lock: Lock {
+			Name: strings.TrimSpace(command.Lock.Name),
+			Timeout: command.Lock.Timeout,
+			Wait: command.Lock.Wait,
+		},
+		Validators: xvalidatorsToValidators(command.Validator),
+		Params: xparamsToParams(command.Params),
+		Methods: splitMethods(command.Methods, commandMethods),
+		Envs: xenvsToEnvs(command.Envs),
+		Stdin: command.Stdin,
+		Template: command.Template,
+		Stderr: strings.TrimSpace(command.Stderr),
+		IgnoreExitCode: command.IgnoreExitCode,
+		MaxOutputBytes: command.MaxOutputBytes,
+		MaxConcurrency: command.MaxConcurrency,
+		ConcurrencyWait: command.ConcurrencyWait,
+		CacheTtl: command.CacheTtl,
+		IdempotencyTtl: timeoutOrDefault(command.IdempotencyTtl, DefaultIdempotencyTtl),
+		ContentType: strings.TrimSpace(command.ContentType),
+		Description: strings.TrimSpace(command.Description),
+		Headers: xheadersToHeaders(command.Headers),
+	}
+	if c.Stderr == "" {
+		c.Stderr = DefaultStderr
+	}
+	if command.Response != nil {
+		c.Response, c.responseErr = template.New(cname).Funcs(ResponseFuncs).Parse(strings.TrimSpace(command.Response.Template))
+		c.ResponseSource = strings.TrimSpace(command.Response.Template)
+		c.ResponseContentType = strings.TrimSpace(command.Response.ContentType)
+	}
+	return c
+}
+
+func xenvsToEnvs(xs []XEnv) map[string]string {
+	ret := make(map[string]string)
+	for _, x := range xs {
+		name := strings.TrimSpace(x.Name)
+		as := strings.TrimSpace(x.As)
+		if as == "" {
+			as = EnvPrefix + name
+		}
+		ret[name] = as
+	}
+	return ret
+}
+
+// xheadersToHeaders maps canonical header names to values
+func xheadersToHeaders(xs []XHeader) map[string]string {
+	ret := make(map[string]string)
+	for _, x := range xs {
+		ret[textproto.CanonicalMIMEHeaderKey(strings.TrimSpace(x.Name))] = strings.TrimSpace(x.Value)
+	}
+	return ret
+}
+
+// xcontentTypesToContentTypes maps lower cased extensions with leading dot to content types
+func xcontentTypesToContentTypes(xs []XContentType) map[string]string {
+	ret := make(map[string]string)
+	for _, x := range xs {
+		ext := strings.ToLower(strings.TrimSpace(x.Ext))
+		if !strings.HasPrefix(ext, ".") {
+			ext = "." + ext
+		}
+		ret[ext] = strings.TrimSpace(x.Type)
+	}
+	return ret
+}
+
+// ResponseFuncs are functions of response templates besides the builtin ones
+var ResponseFuncs = template.FuncMap{
+	// json encodes a value, e.g. {{json .Output}} for a json string
+	"json": func(v interface{}) (string, error) {
+		buf, err := json.Marshal(v)
+		return string(buf), err
+	},
+	"hostname": os.Hostname,
+}
+
+// splitMethods splits comma separated http methods in upper case, or returns the defaults if none
+func splitMethods(x string, defaults []string) []string {
+	ret := make([]string, 0, 2)
+	for _, method := range strings.Split(x, ",") {
+		if method = strings.ToUpper(strings.TrimSpace(method)); method != "" {
+			ret = append(ret, method)
+		}
+	}
+	if len(ret) == 0 {
+		return defaults
+	}
+	return ret
+}
+
+func trimStrings(xs []string) []string {
+	ret := make([]string, 0, len(xs))
+	for _, x := range xs {
+		ret = append(ret, strings.TrimSpace(x))
+	}
+	return ret
+}
+
+func (rules *HostRules) merge(x *XHostRules) {
+	for _, host := range x.Hosts {
+		rules.Hosts = append(rules.Hosts, strings.TrimSpace(host))
+	}
+	for _, host := range x.DenyHosts {
+		rules.DenyHosts = append(rules.DenyHosts, strings.TrimSpace(host))
+	}
+}
+
+// toRateLimit converts to a RateLimit, burst defaults to the rate of a second
+func (self *XRateLimit) toRateLimit() *RateLimit {
+	ret := &RateLimit{ Rate: self.Rate, Burst: self.Burst }
+	if ret.Burst == 0 {
+		ret.Burst = int(math.Ceil(self.Rate))
+	}
+	return ret
+}
+
+func xdirSymlinks(xdir XDir) string {
+	if symlinks := strings.TrimSpace(xdir.Symlinks); symlinks != "" {
+		return symlinks
+	}
+	if xdir.FollowSymlinks {
+		return "follow"
+	}
+	return DefaultSymlinks
+}
+
+func xpaginateToPaginate(x *XPaginate) *Paginate {
+	if x == nil {
+		return nil
+	}
+	ret := &Paginate{ Limit: x.Limit, MaxLimit: x.MaxLimit }
+	if ret.MaxLimit == 0 {
+		ret.MaxLimit = DefaultMaxPageLimit
+	}
+	if ret.Limit == 0 {
+		ret.Limit = min(DefaultPageLimit, ret.MaxLimit)
+	}
+	return ret
+}
+
+// an absent element takes the default, while an explicit 0 means no timeout
+func timeoutOrDefault(x *uint32, def uint32) uint32 {
+	if x == nil {
+		return def
+	}
+	return *x
+}
 
 func xvalidatorsToValidators(xs []XValidator) Validators {
 	ret := make(map[string]Validator)
 	for _, x := range xs {
-		ret[x.Name] = Validator{
+		v := Validator{
 			Name: x.Name,
+			Class: strings.TrimSpace(x.Class),
 			Pattern: x.Pattern,
 		}
+		if v.Class == "" {
+			v.Class = "regexp"
+		}
+		if v.Class == "enum" {
+			// values are separated by commas
+			for _, value := range strings.Split(x.Pattern, ",") {
+				v.Values = append(v.Values, strings.TrimSpace(value))
+			}
+		}
+		ret[x.Name] = v
+	}
+	return ret
+}
+
+func xparamsToParams(xs []XParam) Params {
+	ret := make(Params)
+	for _, x := range xs {
+		p := Param{ Required: x.Required, Raw: x.Raw, Secret: x.Secret, Description: strings.TrimSpace(x.Description),
+			Type: strings.TrimSpace(x.Type), Pattern: x.Pattern }
+		if p.Type == "enum" && strings.TrimSpace(x.Values) != "" {
+			// values are separated by commas, as of enum validators
+			for _, value := range strings.Split(x.Values, ",") {
+				p.Values = append(p.Values, strings.TrimSpace(value))
+			}
+		}
+		if x.Default != nil {
+			p.Default, p.HasDefault = *x.Default, true
+		}
+		ret[strings.TrimSpace(x.Name)] = p
 	}
 	return ret
 }
@@ -381,14 +1224,9 @@ func (self LoadConfigError) Error() string {
 
 func LoadXmlConfig(files, dirs []string, params map[string]string) (config Config, err error) {
 	for _, confPath := range files {
-		confPath, _ = filepath.Abs(confPath)
-		params["__file__"] = confPath
-		params["__dir__"] = path.Dir(confPath)
-		xconf, err := XConfigFromFile(confPath, params)
-		if err != nil {
-			return config, LoadConfigError{ Path: confPath, Err: err }
+		if err = config.loadXmlFile(confPath, params); err != nil {
+			return
 		}
-		xconf.IntoConfig(&config)
 	}
 	for _, confDirPath := range dirs {
 		filesInfo, err := ioutil.ReadDir(confDirPath)
@@ -401,16 +1239,63 @@ func LoadXmlConfig(files, dirs []string, params map[string]string) (config Confi
 				if fileInfo.IsDir() {
 					continue
 				}
-				confPath := filepath.Join(confDirPath, filename)
-				confPath, _ = filepath.Abs(confPath)
-
-				xconf, err := XConfigFromFile(confPath, params)
-				if err != nil {
-					return config, LoadConfigError{ Path: confPath, Err: err }
+				if err = config.loadXmlFile(filepath.Join(confDirPath, filename), params); err != nil {
+					return config, err
 				}
-				xconf.IntoConfig(&config)
 			}
 		}
 	}
 	return
 }
+
+// loadXmlFile loads a config file, then files it includes in order, each glob in the order of names.
+// Relative includes are of the directory of the including file. A file already loaded is not
+// included again, so includes can not loop.
+func (self *Config) loadXmlFile(confPath string, params map[string]string) error {
+	confPath, _ = filepath.Abs(confPath)
+	xconf, err := XConfigFromFile(confPath, params)
+	if err != nil {
+		return LoadConfigError{ Path: confPath, Err: err }
+	}
+	self.loadingPath = confPath
+	xconf.IntoConfig(self)
+	self.loadingPath = ""
+	self.Paths = append(self.Paths, confPath)
+	for _, include := range xconf.Includes {
+		pattern, err := ExpandEnv(strings.TrimSpace(include))
+		if err != nil {
+			return LoadConfigError{ Path: confPath, Err: fmt.Errorf("bad include %s: %s", include, err) }
+		}
+		if pattern == "" {
+			continue
+		}
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(confPath), pattern)
+		}
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return LoadConfigError{ Path: confPath, Err: fmt.Errorf("bad include %s: %s", include, err) }
+		}
+		if len(matches) == 0 && !strings.ContainsAny(pattern, "*?[") {
+			return LoadConfigError{ Path: confPath, Err: fmt.Errorf("include %s not found", include) }
+		}
+		for _, match := range matches {
+			if info, err := os.Stat(match); (err == nil && info.IsDir()) || self.loaded(match) {
+				continue
+			}
+			if err := self.loadXmlFile(match, params); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (self *Config) loaded(confPath string) bool {
+	for _, p := range self.Paths {
+		if p == confPath {
+			return true
+		}
+	}
+	return false
+}
@@ -4,21 +4,47 @@ import (
 	"testing"
 	"sort"
 	"math"
+	"reflect"
+	"strings"
+	"os"
+	"path/filepath"
 )
 
 func TestConfig(t *testing.T) {
 	data := `<?xml version="1.0" encoding="utf-8" ?>
 <config>
-	<server><listen>:2465</listen></server>
+	<server>
+		<listen>:2465</listen>
+		<tls><cert> /etc/servant.crt </cert><key>/etc/servant.key</key></tls>
+		<writeTimeout>0</writeTimeout>
+		<idleTimeout>5</idleTimeout>
+		<maxConns> 1000 </maxConns>
+		<backlog>512</backlog>
+		<gzip enabled="true"/>
+		<metrics enabled="true" auth="true"/>
+		<maxBodyBytes>1024</maxBodyBytes>
+		<maxBodyBytes resource="files"> 1048576 </maxBodyBytes>
+		<slowThreshold>0.5</slowThreshold>
+		<slowThreshold resource="files">30</slowThreshold>
+		<verboseErrors>true</verboseErrors>
+	</server>
     <commands id="db1">
+        <host>10.0.0.0/8</host>
+        <denyHost> 10.1.0.0/16 </denyHost>
         <command id="foo">
             <code>echo hello</code>
         </command>
         <command id="bar" lang="bash">
             <code>echo world</code>
+            <description> greets the world </description>
+            <param name="region" description="where to greet" />
+            <env>USER_ID</env>
+            <env as="REGION">region</env>
         </command>
-        <command id="sleep" timeout="5">
+        <command id="sleep" timeout="5" methods="post, put">
            <code> sleep 1000</code>
+           <validate name="t">^\d+$</validate>
+           <validate name="region" class="enum">us, eu</validate>
         </command>
     </commands>
     <files id="db1">
@@ -29,6 +55,7 @@ func TestConfig(t *testing.T) {
             <allow>get</allow>
             <allow>delete</allow><!-- put, post -->
             <pattern>log-bin</pattern>
+            <contentType ext="LOG">text/plain</contentType>
         </dir>
     </files>
     <user id="db_ha">
@@ -37,6 +64,12 @@ func TestConfig(t *testing.T) {
         <files id="db1" />
         <commands id="db1" />
     </user>
+    <user id="deployer">
+        <commands id="db1">
+            <command id="foo" />
+            <command id="sleep"><validate name="t" class="enum">1, 2</validate></command>
+        </commands>
+    </user>
 </config>`
 	xconf, err := XConfigFromData([]byte(data), map[string]string{
 		"_var.foo": "FOO",
@@ -56,6 +89,9 @@ func TestConfig(t *testing.T) {
 	if _, ok := conf.Commands["db1"]; !ok {
 		t.Errorf("commands name wrong")
 	}
+	if rules := conf.Commands["db1"].HostRules; len(rules.Hosts) != 1 || rules.DenyHosts[0] != "10.1.0.0/16" {
+		t.Errorf("commands host rules wrong")
+	}
 	if len(conf.Commands["db1"].Commands) != 3 {
 		t.Errorf("commands members wrong")
 		return
@@ -81,17 +117,30 @@ func TestConfig(t *testing.T) {
 	if bar.Timeout != math.MaxUint32 {
 		t.Errorf("timeout code wrong")
 	}
+	if len(bar.Envs) != 2 || bar.Envs["USER_ID"] != "SERVANT_USER_ID" || bar.Envs["region"] != "REGION" {
+		t.Errorf("command envs wrong")
+	}
 	sleep, ok := conf.Commands["db1"].Commands["sleep"]
 
 	if sleep.Code != "sleep 1000" {
 		t.Errorf("command code wrong")
 	}
-	if sleep.Lang != "" {
-		t.Errorf("command lang wrong")
+	// without a shell by default
+	if sleep.Lang != "exec" {
+		t.Errorf("command lang wrong: %s", sleep.Lang)
 	}
 	if sleep.Timeout != 5 {
 		t.Errorf("timeout code wrong")
 	}
+	if len(sleep.Methods) != 2 || sleep.Methods[0] != "POST" || sleep.Methods[1] != "PUT" || len(foo.Methods) != 2 {
+		t.Errorf("command methods wrong: %v %v", sleep.Methods, foo.Methods)
+	}
+	if sleep.Validators["t"].Class != "regexp" || sleep.Validators["t"].Pattern != `^\d+$` {
+		t.Errorf("regexp validator wrong")
+	}
+	if region := sleep.Validators["region"]; region.Class != "enum" || len(region.Values) != 2 || region.Values[1] != "eu" {
+		t.Errorf("enum validator wrong")
+	}
 
 	if len(conf.Files) != 1 {
 		t.Errorf("parse files failed")
@@ -117,6 +166,15 @@ func TestConfig(t *testing.T) {
 	if len(binlog1.Allows) != 2 {
 		t.Errorf("dir allows wrong")
 	}
+	if binlog1.ContentTypes[".log"] != "text/plain" {
+		t.Errorf("dir content types wrong: %v", binlog1.ContentTypes)
+	}
+	if binlog1.Symlinks != DefaultSymlinks {
+		t.Errorf("dir symlinks should be the default: %s", binlog1.Symlinks)
+	}
+	if binlog1.UploadTtl != DefaultUploadTtl {
+		t.Errorf("dir upload ttl should be the default: %d", binlog1.UploadTtl)
+	}
 	sort.Strings(binlog1.Allows)
 	if binlog1.Allows[0] != "DELETE" {
 		t.Errorf("allows 0 not DELETE")
@@ -127,6 +185,42 @@ func TestConfig(t *testing.T) {
 	if conf.Users["db_ha"].Key != "FOO" {
 		t.Error("entity parse wrong")
 	}
+	if bar := conf.Commands["db1"].Commands["bar"]; bar.Description != "greets the world" || bar.Params["region"].Description != "where to greet" {
+		t.Errorf("descriptions parse wrong: %q %v", bar.Description, bar.Params)
+	}
+	if conf.Users["db_ha"].CommandRules != nil {
+		t.Errorf("user granted a whole group should have no command rules")
+	}
+	if rules := conf.Users["deployer"].CommandRules["db1"]; len(rules) != 2 || len(rules["foo"]) != 0 || rules["sleep"]["t"].Values[1] != "2" {
+		t.Errorf("command rules parse wrong: %v", rules)
+	}
+	if conf.Server.TLS.CertFile != "/etc/servant.crt" || conf.Server.TLS.KeyFile != "/etc/servant.key" || conf.Server.TLS.ClientCA != "" {
+		t.Errorf("tls parse wrong")
+	}
+	if conf.Server.SlowThreshold != 0.5 || conf.Server.ResourceSlowThresholds["files"] != 30 {
+		t.Errorf("slow thresholds parse wrong: %v %v", conf.Server.SlowThreshold, conf.Server.ResourceSlowThresholds)
+	}
+	if !conf.Server.VerboseErrors {
+		t.Errorf("verbose errors parse wrong")
+	}
+	if conf.Server.MaxConns != 1000 || conf.Server.MaxConnsMode != DefaultMaxConnsMode || conf.Server.Backlog != 512 {
+		t.Errorf("connection limits parse wrong: %d %s %d", conf.Server.MaxConns, conf.Server.MaxConnsMode, conf.Server.Backlog)
+	}
+	if conf.Server.GracePeriod != DefaultGracePeriod {
+		t.Errorf("grace period default wrong")
+	}
+	if conf.Server.ReadTimeout != DefaultReadTimeout || conf.Server.WriteTimeout != 0 || conf.Server.IdleTimeout != 5 {
+		t.Errorf("timeouts parse wrong")
+	}
+	if !conf.Server.Gzip.Enabled || conf.Server.Gzip.MinSize != DefaultGzipMinSize {
+		t.Errorf("gzip parse wrong: %v", conf.Server.Gzip)
+	}
+	if !conf.Server.Metrics.Enabled || conf.Server.Metrics.Path != DefaultMetricsPath || !conf.Server.Metrics.Auth {
+		t.Errorf("metrics parse wrong: %v", conf.Server.Metrics)
+	}
+	if conf.Server.MaxBodyBytes != 1024 || conf.Server.ResourceMaxBodyBytes["files"] != 1048576 {
+		t.Errorf("max body bytes parse wrong: %d %v", conf.Server.MaxBodyBytes, conf.Server.ResourceMaxBodyBytes)
+	}
 	//fmt.Printf("%v\n", conf)
 }
 
@@ -137,7 +231,7 @@ func TestFile(t *testing.T) {
 		return
 	}
 	//fmt.Printf("%v\n", conf.ToConfig())
-	if conf.Server.Listen == "" {
+	if conf.Server.Listen.Addr == "" {
 		t.Errorf("server/listen should present")
 	}
 }
@@ -155,3 +249,262 @@ func TestFiles(t *testing.T) {
 		t.Errorf("timer conf should present")
 	}
 }
+
+func TestTimerAt(t *testing.T) {
+	data := `<config>
+		<timer id="once" at=" 2024-03-01 03:00 "><code>date</code></timer>
+		<timer id="late" at="2024-03-01 03:00" missed="run"><code>date</code></timer>
+	</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	timers := xconf.ToConfig().Timers
+	if once := timers["once"]; once.At != "2024-03-01 03:00" || once.Missed != DefaultMissed {
+		t.Errorf("one-shot timer parse wrong: %s %s", once.At, once.Missed)
+	}
+	if late := timers["late"]; late.Missed != "run" {
+		t.Errorf("missed policy parse wrong: %s", late.Missed)
+	}
+}
+
+func TestDirSymlinks(t *testing.T) {
+	data := `<config><files id="f">
+		<dir id="legacy" followSymlinks="true"><root>/data</root></dir>
+		<dir id="inside" symlinks=" inside "><root>/data</root></dir>
+	</files></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	dirs := xconf.ToConfig().Files["f"].Dirs
+	if dirs["legacy"].Symlinks != "follow" || dirs["inside"].Symlinks != "inside" {
+		t.Errorf("symlinks parse wrong: %s %s", dirs["legacy"].Symlinks, dirs["inside"].Symlinks)
+	}
+}
+
+func TestCommandShell(t *testing.T) {
+	data := `<config><commands id="c">
+		<command id="argv"><code>echo ${a}</code></command>
+		<command id="sh" shell="true"><code>echo a | wc -c</code></command>
+		<command id="nosh" shell="false"><code>echo</code></command>
+		<command id="tpl" template="true"><code>rm -f ${a}</code></command>
+		<command id="lang" lang="bash" shell="true"><code>echo</code></command>
+	</commands></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	commands := xconf.ToConfig().Commands["c"].Commands
+	for name, lang := range map[string]string{ "argv": "exec", "sh": "bash", "nosh": "exec", "tpl": "bash", "lang": "bash" } {
+		if commands[name].Lang != lang {
+			t.Errorf("lang of %s wrong: %s", name, commands[name].Lang)
+		}
+	}
+}
+
+func TestDirWritable(t *testing.T) {
+	data := `<config><files id="f">
+		<dir id="ro"><root>/data</root><allow>get</allow></dir>
+		<dir id="rw"><root>/data</root><allow>get</allow><allow>put</allow></dir>
+		<dir id="locked" writable="false"><root>/data</root><allow>put</allow></dir>
+	</files></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	dirs := xconf.ToConfig().Files["f"].Dirs
+	if dirs["ro"].Writable || !dirs["rw"].Writable || dirs["locked"].Writable {
+		t.Errorf("writable parse wrong: %v %v %v", dirs["ro"].Writable, dirs["rw"].Writable, dirs["locked"].Writable)
+	}
+}
+
+func TestQueryRender(t *testing.T) {
+	data := `<config><database id="db" driver="mysql" numbers="string" nulls="empty">
+		<query id="db"><sql>SELECT 1</sql></query>
+		<query id="own" nulls="null" times="unix"><sql>SELECT 1</sql><header name="cache-control"> no-store </header></query>
+	</database></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	queries := xconf.ToConfig().Databases["db"].Queries
+	if r := queries["db"].Render; r != (Render{ Nulls: "empty", Numbers: "string", Times: "rfc3339" }) {
+		t.Errorf("query should render as the database: %v", r)
+	}
+	if r := queries["own"].Render; r != (Render{ Nulls: "null", Numbers: "string", Times: "unix" }) {
+		t.Errorf("query should override the database: %v", r)
+	}
+	if h := queries["own"].Headers; len(h) != 1 || h["Cache-Control"] != "no-store" {
+		t.Errorf("headers parse wrong: %v", h)
+	}
+}
+
+func TestListeners(t *testing.T) {
+	data := `<config><server>
+		<listen>:2465</listen>
+		<listener resources="status, metrics"><listen mode="0600">unix:/tmp/admin.sock</listen></listener>
+		<listener resources="disks"><listen>127.0.0.1:2466</listen><tls><cert>a.crt</cert><key>a.key</key></tls></listener>
+	</server></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	config := xconf.ToConfig()
+	expects := []Listener{
+		{ Listen: "unix:/tmp/admin.sock", SocketMode: "0600", Resources: []string{ "status", "metrics" } },
+		{ Listen: "127.0.0.1:2466", SocketMode: DefaultSocketMode, TLS: TLS{ CertFile: "a.crt", KeyFile: "a.key" }, Resources: []string{ "disks" } },
+	}
+	if !reflect.DeepEqual(config.Server.Listeners, expects) {
+		t.Errorf("listeners wrong: %#v", config.Server.Listeners)
+	}
+	if err := config.Validate(); err == nil || !strings.Contains(err.Error(), "server/listener[1] has unknown resource disks") {
+		t.Errorf("unknown resource should be invalid: %v", err)
+	}
+}
+
+func TestNamedSqls(t *testing.T) {
+	data := `<config>
+		<database id="db" driver="mysql">
+			<query id="user"><sql ref="user_by_id"/></query>
+			<query id="user_log"><sql ref="user_by_id"/><sql>SELECT * FROM log WHERE user_id = ${id}</sql><paginate maxLimit="50"/></query>
+		</database>
+	</config>`
+	shared := `<config>
+		<sql id="user_by_id">SELECT * FROM user WHERE id = ${id}</sql>
+	</config>`
+	config := &Config{}
+	for _, d := range []string{ data, shared } {
+		xconf, err := XConfigFromData([]byte(d), map[string]string{})
+		if err != nil {
+			t.Fatalf("parse error: %s", err)
+		}
+		xconf.IntoConfig(config)
+	}
+	queries := config.Databases["db"].Queries
+	if !reflect.DeepEqual(queries["user"].Sqls, []string{ "SELECT * FROM user WHERE id = ${id}" }) {
+		t.Errorf("named sql defined later should be resolved: %v", queries["user"].Sqls)
+	}
+	if !reflect.DeepEqual(queries["user_log"].Sqls, []string{ "SELECT * FROM user WHERE id = ${id}", "SELECT * FROM log WHERE user_id = ${id}" }) {
+		t.Errorf("named and inline sqls should be kept in order: %v", queries["user_log"].Sqls)
+	}
+	if page := queries["user_log"].Paginate; queries["user"].Paginate != nil || page == nil || page.Limit != 50 || page.MaxLimit != 50 {
+		t.Errorf("paginate parse wrong: %v", page)
+	}
+
+	xconf, _ := XConfigFromData([]byte(data), map[string]string{})
+	err := xconf.ToConfig().Validate()
+	if err == nil || !strings.Contains(err.Error(), "database/db/user references unknown sql user_by_id") {
+		t.Errorf("unknown sql reference should be invalid: %v", err)
+	}
+}
+
+func TestAsyncCommand(t *testing.T) {
+	data := `<config>
+		<commands id="c">
+			<command id="job" async="true"><code>sleep 60</code></command>
+			<command id="put" async="true" methods="PUT" jobTtl="60" contentType=" application/json " idempotencyTtl="0"><code>sleep 60</code></command>
+		</commands>
+	</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	commands := xconf.ToConfig().Commands["c"].Commands
+	if job := commands["job"]; !job.Async || job.JobTtl != DefaultJobTtl || !reflect.DeepEqual(job.Methods, DefaultAsyncMethods) || job.IdempotencyTtl != DefaultIdempotencyTtl {
+		t.Errorf("async command should be started by POST by default: %v %d %d", job.Methods, job.JobTtl, job.IdempotencyTtl)
+	}
+	if put := commands["put"]; put.JobTtl != 60 || !reflect.DeepEqual(put.Methods, []string{"PUT"}) || put.ContentType != "application/json" || put.IdempotencyTtl != 0 {
+		t.Errorf("async command attributes wrong: %v %d %s %d", put.Methods, put.JobTtl, put.ContentType, put.IdempotencyTtl)
+	}
+}
+
+func TestCommandVariants(t *testing.T) {
+	data := `<config>
+		<commands id="c">
+			<command id="item" methods="GET"><code>echo read</code>
+				<variant methods="post, put" runas="nobody"><code>echo write</code><param name="a"/></variant>
+			</command>
+		</commands>
+	</config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	item := xconf.ToConfig().Commands["c"].Commands["item"]
+	if len(item.Variants) != 1 {
+		t.Fatalf("variants parse wrong: %v", item.Variants)
+	}
+	variant := item.Variants[0]
+	if _, ok := variant.Params["a"]; !ok || variant.Code != "echo write" || variant.User != "nobody" || !reflect.DeepEqual(variant.Methods, []string{"POST", "PUT"}) {
+		t.Errorf("variant parse wrong: %v", variant)
+	}
+	if variant.Timeout != math.MaxUint32 || variant.Stderr != DefaultStderr {
+		t.Errorf("variant should have defaults of a command: %d %s", variant.Timeout, variant.Stderr)
+	}
+}
+
+func TestParamTypes(t *testing.T) {
+	data := `<config><commands id="c"><command id="x"><code>echo ${n}</code>
+		<param name="n" type=" int " default="1"/>
+		<param name="color" type="enum" values="red, green"/>
+		<param name="host" type="regex" pattern="[a-z]+"/>
+	</command></commands></config>`
+	xconf, err := XConfigFromData([]byte(data), map[string]string{})
+	if err != nil {
+		t.Fatalf("parse error: %s", err)
+	}
+	ps := xconf.ToConfig().Commands["c"].Commands["x"].Params
+	if ps["n"].Type != "int" || !reflect.DeepEqual(ps["color"].Values, []string{"red", "green"}) || ps["host"].Pattern != "[a-z]+" {
+		t.Errorf("param types parse wrong: %v", ps)
+	}
+}
+
+func TestIncludes(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, data string) {
+		os.MkdirAll(filepath.Dir(filepath.Join(dir, name)), 0755)
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	write("main.xml", `<config>
+		<server><listen>:2465</listen></server>
+		<include>conf.d/*.xml</include>
+		<include>/nonexistent/*.xml</include>
+		<commands id="c"><command id="main"><code>echo main</code></command></commands>
+	</config>`)
+	write("conf.d/a.xml", `<config>
+		<include>../main.xml</include>
+		<commands id="c"><command id="a"><code>echo a</code></command></commands>
+	</config>`)
+	write("conf.d/b.xml", `<config><commands id="c"><command id="b"><code>echo b</code></command></commands></config>`)
+	config, err := LoadXmlConfig([]string{ filepath.Join(dir, "main.xml") }, nil, map[string]string{})
+	if err != nil {
+		t.Fatalf("load failed: %s", err)
+	}
+	expects := []string{ filepath.Join(dir, "main.xml"), filepath.Join(dir, "conf.d/a.xml"), filepath.Join(dir, "conf.d/b.xml") }
+	if !reflect.DeepEqual(config.Paths, expects) {
+		t.Errorf("files should be loaded in order and once: %v", config.Paths)
+	}
+	if commands := config.Commands["c"].Commands; len(commands) != 3 || commands["a"] == nil || commands["b"] == nil {
+		t.Errorf("commands of included files should be merged: %v", commands)
+	}
+	if err = config.Validate(); err != nil {
+		t.Errorf("config should be valid: %s", err)
+	}
+
+	write("conf.d/c.xml", `<config><commands id="c"><command id="b"><code>echo c</code></command></commands></config>`)
+	config, _ = LoadXmlConfig([]string{ filepath.Join(dir, "main.xml") }, nil, map[string]string{})
+	err = config.Validate()
+	expect := "commands/c/b is defined more than once, in " + filepath.Join(dir, "conf.d/b.xml") + " and " + filepath.Join(dir, "conf.d/c.xml")
+	if err == nil || !strings.Contains(err.Error(), expect) {
+		t.Errorf("duplicate across files should name the files: %v", err)
+	}
+
+	write("conf.d/d.xml", `<config><include>missing.xml</include></config>`)
+	_, err = LoadXmlConfig([]string{ filepath.Join(dir, "main.xml") }, nil, map[string]string{})
+	if err == nil || !strings.Contains(err.Error(), "include missing.xml not found") || !strings.Contains(err.Error(), "d.xml") {
+		t.Errorf("missing include should fail: %v", err)
+	}
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"servant/conf"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// accessLogger writes one line per request in the NCSA common or combined log format, nil for no access log
+var accessLogger *log.Logger
+
+var accessLogCombined = false
+
+// accessLogFile is the access log file if it is not written to the log
+var accessLogFile *rotatingFile
+
+const accessLogTimeFormat = "02/Jan/2006:15:04:05 -0700"
+
+// configureAccessLog sets the access logger per the log config, logOut is the output of the log
+func configureAccessLog(logConf conf.Log, logOut io.Writer) {
+	accessLogger, accessLogFile = nil, nil
+	if logConf.AccessFormat == "" {
+		return
+	}
+	out := logOut
+	if logConf.AccessFile != "" {
+		maxAge := time.Duration(logConf.MaxAge) * 24 * time.Hour
+		file, err := openRotatingFile(logConf.AccessFile, logConf.MaxSize * 1024 * 1024, maxAge, logConf.MaxBackups, logConf.Compress)
+		if err != nil {
+			logger.Printf("can not open access log file %s", logConf.AccessFile)
+		} else {
+			out, accessLogFile = file, file
+		}
+	}
+	accessLogCombined = logConf.AccessFormat == "combined"
+	accessLogger = log.New(out, "", 0)
+}
+
+// writeAccessLog logs the finished request, with bytes sent to the client after compression
+func (self *Session) writeAccessLog(start time.Time) {
+	if accessLogger == nil {
+		return
+	}
+	user := self.username
+	if user == "" {
+		user = "-"
+	}
+	size := "-"
+	if n := self.responseBytes(); n > 0 {
+		size = strconv.FormatInt(n, 10)
+	}
+	line := fmt.Sprintf(`%s - %s [%s] "%s" %d %s`, accessLogField(self.remoteHost()), accessLogField(user),
+		start.Format(accessLogTimeFormat), accessLogField(self.req.Method + " " + self.redactedUri(self.req.RequestURI) + " " + self.req.Proto), self.responseStatus(), size)
+	if accessLogCombined {
+		line += fmt.Sprintf(` "%s" "%s"`, accessLogFieldOr(self.req.Referer()), accessLogFieldOr(self.req.UserAgent()))
+	}
+	accessLogger.Println(line)
+}
+
+// accessLogField escapes quotes, backslashes and unprintable bytes like apache
+func accessLogField(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == '"' || r == '\\':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == utf8.RuneError && size == 1, r < 0x20, r == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, s[i])
+		default:
+			b.WriteString(s[i:i + size])
+		}
+		i += size
+	}
+	return b.String()
+}
+
+func accessLogFieldOr(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return accessLogField(s)
+}
@@ -0,0 +1,202 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"os"
+	"servant/conf"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// auditLog writes mutating requests as json lines, nil for no audit log
+var auditLog *auditLogger
+
+// auditLogger chains events by the hash of the previous line, so a line modified or removed
+// breaks the chain at the line after it
+type auditLogger struct {
+	lock     sync.Mutex
+	file     *rotatingFile
+	reads    bool
+	lastHash string // of the last line written, empty for a new file
+}
+
+type auditEvent struct {
+	Timestamp  time.Time         `json:"timestamp"`
+	RequestId  string            `json:"request_id,omitempty"`
+	Username   string            `json:"username,omitempty"`
+	RemoteAddr string            `json:"remote_addr"`
+	Method     string            `json:"method"`
+	Resource   string            `json:"resource"`
+	Group      string            `json:"group,omitempty"`
+	Item       string            `json:"item,omitempty"`
+	Params     map[string]string `json:"params,omitempty"`
+	Status     int               `json:"status"`
+	ExitCode   *int              `json:"exit_code,omitempty"`
+	Error      string            `json:"error,omitempty"`
+	PrevHash   string            `json:"prev_hash"` // hex encoded sha256 of the previous line
+}
+
+// configureAuditLog opens the audit log per the log config, the chain continues from the last line of the file
+func configureAuditLog(logConf conf.Log) {
+	auditLog = nil
+	if logConf.AuditFile == "" {
+		return
+	}
+	lastLine, err := readLastLine(logConf.AuditFile)
+	if err != nil && !os.IsNotExist(err) {
+		logger.Printf("can not read audit log file %s: %s", logConf.AuditFile, err)
+		return
+	}
+	file, err := openRotatingFile(logConf.AuditFile, 0, 0, 0, false)
+	if err != nil {
+		logger.Printf("can not open audit log file %s", logConf.AuditFile)
+		return
+	}
+	auditLog = &auditLogger{ file: file, reads: logConf.AuditReads }
+	if lastLine != nil {
+		auditLog.lastHash = lineHash(lastLine)
+	}
+}
+
+func lineHash(line []byte) string {
+	sum := sha256.Sum256(line)
+	return hex.EncodeToString(sum[:])
+}
+
+// readLastLine returns the last line of a file without the newline, nil if the file is empty
+func readLastLine(path string) ([]byte, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	end := info.Size()
+	last := make([]byte, 1)
+	if end > 0 {
+		if _, err := file.ReadAt(last, end - 1); err != nil {
+			return nil, err
+		}
+		if last[0] == '\n' {
+			end--
+		}
+	}
+	// read backwards by chunks until the newline before the last line
+	var line []byte
+	buf := make([]byte, 4096)
+	for pos := end; pos > 0; {
+		n := min(int64(len(buf)), pos)
+		pos -= n
+		if _, err := file.ReadAt(buf[:n], pos); err != nil && err != io.EOF {
+			return nil, err
+		}
+		if i := bytes.LastIndexByte(buf[:n], '\n'); i >= 0 {
+			return append(append([]byte(nil), buf[i + 1:n]...), line...), nil
+		}
+		line = append(append([]byte(nil), buf[:n]...), line...)
+	}
+	if len(line) == 0 {
+		return nil, nil
+	}
+	return line, nil
+}
+
+func (self *auditLogger) write(event auditEvent) error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	event.PrevHash = self.lastHash
+	line, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	// written unbuffered, an event is in the file once the request ends
+	if _, err := self.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	self.lastHash = lineHash(line)
+	return nil
+}
+
+// audited reports whether the request mutates, or reads are audited too. Commands are actions
+// except polls of jobs and descriptions, database queries mutate if they write, others if not read by the method.
+func (self *Session) audited() bool {
+	if auditLog.reads {
+		return true
+	}
+	read := self.req.Method == "GET" || self.req.Method == "HEAD" || self.req.Method == "OPTIONS"
+	switch self.resource {
+	case "commands":
+		return !(read && (self.describing() || self.req.URL.Query().Get("job") != ""))
+	case "databases":
+		_, queryConf := (DatabaseServer{ Session: self }).findDatabaseQueryConfig()
+		return queryConf != nil && (queryConf.Write || queryConf.Transaction)
+	}
+	return !read
+}
+
+// captureAuditBody keeps params of a form or json body for the audit log, as the handler may consume the body
+func (self *Session) captureAuditBody() {
+	if auditLog != nil && self.audited() {
+		self.auditBody = bodyParams(self.req)
+	}
+}
+
+// auditParams returns params of the query string and the body, with values of secret params redacted
+func (self *Session) auditParams() map[string]string {
+	ps := self.itemParams()
+	ret := make(map[string]string)
+	for k, v := range self.auditBody {
+		ret[k] = v
+	}
+	// the query string overrides the body
+	for k, vs := range self.req.URL.Query() {
+		if len(vs) > 0 {
+			ret[k] = vs[0]
+		}
+	}
+	for k, v := range ret {
+		if ps[k].Secret {
+			ret[k] = redactedSecret
+		} else {
+			ret[k] = self.redact(v)
+		}
+	}
+	return ret
+}
+
+// writeAuditLog logs the finished request to the audit log if it is audited
+func (self *Session) writeAuditLog(start time.Time) {
+	if auditLog == nil || !self.audited() {
+		return
+	}
+	header := self.resp.Header()
+	event := auditEvent{
+		Timestamp:  start,
+		RequestId:  self.requestId,
+		Username:   self.username,
+		RemoteAddr: self.remoteHost(),
+		Method:     self.req.Method,
+		Resource:   self.resource,
+		Group:      self.group,
+		Item:       self.item,
+		Params:     self.auditParams(),
+		Status:     self.responseStatus(),
+		Error:      self.errMessage,
+	}
+	if self.resource == "commands" {
+		if code, err := strconv.Atoi(header.Get(ExitCodeHeader)); err == nil {
+			event.ExitCode = &code
+		}
+	}
+	if err := auditLog.write(event); err != nil {
+		self.log("server", "ERROR", "write audit log failed: %s", err)
+	}
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"servant/conf"
+	"strings"
+	"testing"
+)
+
+func TestAuditLog(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "audit.log")
+	configureAuditLog(conf.Log{ AuditFile: path })
+	defer configureAuditLog(conf.Log{})
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"login": &conf.Command{ Lang: "bash", Code: "echo ${user}; exit 3", Template: true,
+					Params: conf.Params{ "token": conf.Param{ Secret: true } } },
+			} },
+		},
+		Vars: map[string]*conf.Vars{
+			"v": &conf.Vars{ Vars: map[string]*conf.Var{ "x": &conf.Var{ Patterns: []string{".*"} } } },
+		},
+	})
+	serve := func(method, path, body string) {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		s.ServeHTTP(httptest.NewRecorder(), req)
+	}
+	serve("POST", "/commands/c/login?token=s3cr3t", "user=u")
+	serve("GET", "/vars/v/x", "")
+	serve("PUT", "/vars/v/x", "1")
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("audit log should be written: %s", err)
+	}
+	if bytes.Contains(data, []byte("s3cr3t")) {
+		t.Errorf("secret should be redacted: %s", data)
+	}
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("reads should not be audited: %s", data)
+	}
+	events := make([]auditEvent, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("line should be json: %s", line)
+		}
+	}
+	if e := events[0]; e.Resource != "commands" || e.Group != "c" || e.Item != "login" || e.Status != http.StatusOK || e.Error == "" ||
+		e.ExitCode == nil || *e.ExitCode != 3 || e.Params["token"] != "***" || e.Params["user"] != "u" || e.RemoteAddr != "192.0.2.1" || e.PrevHash != "" {
+		t.Errorf("command event wrong: %s", lines[0])
+	}
+	if e := events[1]; e.Resource != "vars" || e.Method != "PUT" || e.Status != http.StatusOK || e.ExitCode != nil || e.PrevHash != lineHash([]byte(lines[0])) {
+		t.Errorf("var event wrong: %s", lines[1])
+	}
+
+	// the chain continues from the last line after reopened
+	configureAuditLog(conf.Log{ AuditFile: path, AuditReads: true })
+	serve("GET", "/vars/v/x", "")
+	data, _ = os.ReadFile(path)
+	lines = strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	var e auditEvent
+	if len(lines) != 3 || json.Unmarshal([]byte(lines[2]), &e) != nil || e.Method != "GET" || e.PrevHash != lineHash([]byte(lines[1])) {
+		t.Errorf("read should be audited in the chain: %s", data)
+	}
+}
+
+func TestReadLastLine(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "f")
+	long := strings.Repeat("x", 10000)
+	for content, expected := range map[string]string{
+		"": "",
+		"a": "a",
+		"a\n": "a",
+		"a\nb\n": "b",
+		"a\n" + long + "\n": long,
+		long + "\nb": "b",
+	} {
+		os.WriteFile(path, []byte(content), 0644)
+		if line, err := readLastLine(path); err != nil || string(line) != expected {
+			t.Errorf("last line of %.10q should be %.10q: %.10q %v", content, expected, line, err)
+		}
+	}
+}
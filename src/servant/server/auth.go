@@ -4,14 +4,27 @@ import (
 	"strconv"
 	"fmt"
 	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/hmac"
+	"io/ioutil"
+	"bytes"
 	"encoding/hex"
 	"time"
 	"net"
+	"servant/conf"
+	"net/http"
+	"path"
+	"sort"
 )
 
 /*
  Authorization: user ts sha1(user + key + ts + method + uri)
+ Authorization: Bearer token
+ Authorization: Basic base64(user:password)
+ Authorization: HMAC-SHA256 user ts hex(hmac_sha256(secret, method + "\n" + uri + "\n" + ts + "\n" + hex(sha256(body))))
 
+ Without the Authorization header, the CN of a verified tls client certificate is used as username.
  */
 func (self *Session) auth() (username string, err error) {
 	defer func() {
@@ -24,22 +37,33 @@ func (self *Session) auth() (username string, err error) {
 		return "", nil
 	}
 	authStr := self.req.Header.Get("Authorization")
+	if strings.HasPrefix(authStr, bearerPrefix) {
+		return self.authBearer(strings.TrimSpace(authStr[len(bearerPrefix):]))
+	}
+	if strings.HasPrefix(authStr, basicPrefix) {
+		return self.authBasic()
+	}
+	if strings.HasPrefix(authStr, hmacPrefix) {
+		return self.authHmac(strings.TrimSpace(authStr[len(hmacPrefix):]))
+	}
+	if authStr == "" && self.req.TLS != nil && len(self.req.TLS.PeerCertificates) > 0 {
+		return self.authClientCert()
+	}
 	reqUser, reqHash, ts, err := parseAuthHeader(authStr)
 	if err != nil {
 		return "", err
 	}
 	user, ok := self.config.Users[reqUser]
-	if !ok {
+	// a user without key passes by the name alone, which is only for users without any credentials,
+	// otherwise naming a user of tokens, password or secret would bypass them
+	if !ok || (user.Key == "" && hasCredentials(user)) {
 		return "", fmt.Errorf("user %s not found", reqUser)
 	}
-	remoteHost := strings.Split(self.req.RemoteAddr, ":")[0]
-	if ! checkHosts(remoteHost, user.Hosts) {
-		return reqUser, fmt.Errorf("remote host %s is denied", self.req.RemoteAddr)
+	if err := self.checkUserHosts(user); err != nil {
+		return reqUser, err
 	}
 	if user.Key != "" {
-		nowTs := time.Now().Unix()
-		maxDelta := self.config.Auth.MaxTimeDelta
-		if nowTs - ts > int64(maxDelta) || ts - nowTs > int64(maxDelta) {
+		if !self.checkTimeDelta(ts) {
 			return reqUser, fmt.Errorf("timestamp delta too large")
 		}
 		strToHash := reqUser + user.Key + strconv.FormatInt(ts, 10) + self.req.Method + self.req.RequestURI
@@ -52,6 +76,161 @@ func (self *Session) auth() (username string, err error) {
 	return reqUser, nil
 }
 
+func hasCredentials(user *conf.User) bool {
+	return len(user.Tokens) > 0 || user.Password != "" || user.Secret != ""
+}
+
+const bearerPrefix = "Bearer "
+
+// authBearer accepts a token valid for any user holding it. Expired or host denied matches are skipped,
+// and the failure of the first user by name is returned if none is valid, so the outcome does not depend
+// on the order of users.
+func (self *Session) authBearer(token string) (string, error) {
+	sum := sha256.Sum256([]byte(token))
+	hash := []byte(hex.EncodeToString(sum[:]))
+	names := make([]string, 0, len(self.config.Users))
+	for name := range self.config.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	failedName, err := "", fmt.Errorf("bad token")
+	for _, name := range names {
+		user := self.config.Users[name]
+		for _, t := range user.Tokens {
+			if subtle.ConstantTimeCompare(hash, []byte(t.Hash)) != 1 {
+				continue
+			}
+			var matchErr error
+			if t.Expires > 0 && time.Now().Unix() >= t.Expires {
+				matchErr = fmt.Errorf("token of user %s expired", name)
+			} else {
+				matchErr = self.checkUserHosts(user)
+			}
+			if matchErr == nil {
+				return name, nil
+			}
+			if failedName == "" {
+				failedName, err = name, matchErr
+			}
+		}
+	}
+	return failedName, err
+}
+
+func (self *Session) checkTimeDelta(ts int64) bool {
+	nowTs := time.Now().Unix()
+	maxDelta := int64(self.config.Auth.MaxTimeDelta)
+	return nowTs - ts <= maxDelta && ts - nowTs <= maxDelta
+}
+
+const basicPrefix = "Basic "
+
+func (self *Session) authBasic() (string, error) {
+	reqUser, password, ok := self.req.BasicAuth()
+	if !ok {
+		return "", fmt.Errorf("bad basic credentials")
+	}
+	user, ok := self.config.Users[reqUser]
+	if !ok || user.Password == "" {
+		return "", fmt.Errorf("user %s not found", reqUser)
+	}
+	sum := sha256.Sum256([]byte(password))
+	if subtle.ConstantTimeCompare([]byte(hex.EncodeToString(sum[:])), []byte(user.Password)) != 1 {
+		return reqUser, fmt.Errorf("bad password")
+	}
+	if err := self.checkUserHosts(user); err != nil {
+		return reqUser, err
+	}
+	return reqUser, nil
+}
+
+// authChallenge sets WWW-Authenticate headers of the schemes configured for users.
+// Basic is only offered if a user has a password, so browsers prompt for credentials then.
+func (self *Session) authChallenge() {
+	var basic, bearer, hmac bool
+	for _, user := range self.config.Users {
+		basic = basic || user.Password != ""
+		bearer = bearer || len(user.Tokens) > 0
+		hmac = hmac || user.Secret != ""
+	}
+	realm := fmt.Sprintf("realm=%q", self.config.Auth.Realm)
+	header := self.resp.Header()
+	if basic {
+		header.Add("WWW-Authenticate", "Basic " + realm + `, charset="UTF-8"`)
+	}
+	if bearer {
+		header.Add("WWW-Authenticate", "Bearer " + realm)
+	}
+	if hmac {
+		header.Add("WWW-Authenticate", strings.TrimSpace(hmacPrefix) + " " + realm)
+	}
+	if !basic && !bearer && !hmac {
+		header.Add("WWW-Authenticate", "Servant " + realm)
+	}
+}
+
+// hostDeniedError is an auth error of a known user from a denied host, which is forbidden rather than unauthorized
+type hostDeniedError struct {
+	host string
+}
+
+func (self hostDeniedError) Error() string {
+	return fmt.Sprintf("remote host %s is denied", self.host)
+}
+
+const hmacPrefix = "HMAC-SHA256 "
+
+func (self *Session) authHmac(authStr string) (string, error) {
+	reqUser, reqSig, ts, err := parseAuthHeader(authStr)
+	if err != nil {
+		return "", err
+	}
+	user, ok := self.config.Users[reqUser]
+	if !ok || user.Secret == "" {
+		return "", fmt.Errorf("user %s not found", reqUser)
+	}
+	if err := self.checkUserHosts(user); err != nil {
+		return reqUser, err
+	}
+	if !self.checkTimeDelta(ts) {
+		return reqUser, fmt.Errorf("timestamp delta too large")
+	}
+	// the body is buffered to be hashed, and restored for the handlers
+	var body []byte
+	if self.req.Body != nil {
+		body, err = ioutil.ReadAll(self.req.Body)
+		if err != nil {
+			return reqUser, fmt.Errorf("read body failed: %s", err)
+		}
+		self.req.Body = ioutil.NopCloser(bytes.NewReader(body))
+	}
+	realSig := hmacSignature(user.Secret, self.req.Method, self.req.RequestURI, ts, body)
+	if !hmac.Equal([]byte(reqSig), []byte(realSig)) {
+		return reqUser, fmt.Errorf("bad signature")
+	}
+	return reqUser, nil
+}
+
+func hmacSignature(secret, method, uri string, ts int64, body []byte) string {
+	bodySum := sha256.Sum256(body)
+	strToSign := method + "\n" + uri + "\n" + strconv.FormatInt(ts, 10) + "\n" + hex.EncodeToString(bodySum[:])
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strToSign))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (self *Session) authClientCert() (string, error) {
+	reqUser := self.req.TLS.PeerCertificates[0].Subject.CommonName
+	user, ok := self.config.Users[reqUser]
+	if !ok {
+		return "", fmt.Errorf("user %s not found", reqUser)
+	}
+	if err := self.checkUserHosts(user); err != nil {
+		return reqUser, err
+	}
+	return reqUser, nil
+}
+
 func parseAuthHeader(authStr string) (user, hash string, ts int64, err error){
 	segs := strings.SplitN(authStr, " ", 3)
 	user = segs[0]
@@ -77,30 +256,155 @@ func checkPermission(group string, allows []string) bool {
 }
 
 
+// checkPermission denies the request if any deny rule matches, otherwise allows it
+// if the user is granted the group, or any allow rule matches
 func (self *Session) checkPermission() bool {
 	if self.username == "" {
 		return true
 	}
-	return checkPermission(self.group, self.UserConfig().Allows[self.resource])
+	user := self.UserConfig()
+	for _, rule := range user.DenyRules {
+		if matchPermissionRule(rule, self.resource, self.group, self.item) {
+			return false
+		}
+	}
+	if checkPermission(self.group, user.Allows[self.resource]) {
+		return true
+	}
+	for _, rule := range user.AllowRules {
+		if matchPermissionRule(rule, self.resource, self.group, self.item) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchPermissionRule matches a <resource>/<group>/<item> rule segment by segment, each can be a glob like *
+func matchPermissionRule(rule, resource, group, item string) bool {
+	segs := strings.Split(rule, "/")
+	if len(segs) != 3 {
+		return false
+	}
+	for i, name := range []string{resource, group, item} {
+		if ok, err := path.Match(segs[i], name); err != nil || !ok {
+			return false
+		}
+	}
+	return true
 }
 
 func checkHosts(remoteAddr string, hosts []string) bool {
 	if len(hosts) <= 0 {
 		return true
 	}
-	ok := false
+	return matchHosts(remoteAddr, hosts)
+}
+
+// matchHosts reports whether the address is in one of the hosts, which can be CIDRs or IPs
+func matchHosts(remoteAddr string, hosts []string) bool {
+	ip := net.ParseIP(remoteAddr)
+	if ip == nil {
+		return false
+	}
 	for _, host := range (hosts) {
 		_, allowedNet, err := net.ParseCIDR(host)
 		if err != nil {
+			if hostIp := net.ParseIP(host); hostIp != nil && hostIp.Equal(ip) {
+				return true
+			}
 			continue
 		}
-		if allowedNet.Contains(net.ParseIP(remoteAddr)) {
-			ok = true
+		if allowedNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkHostRules reports whether the address is not denied and is allowed, empty allows means allow all
+func checkHostRules(remoteAddr string, allows, denies []string) bool {
+	return !matchHosts(remoteAddr, denies) && checkHosts(remoteAddr, allows)
+}
+
+// remoteHost returns the ip of the client without port, ipv6 addresses are supported.
+// The ip is resolved from X-Forwarded-For when the peer is a trusted proxy.
+func (self *Session) remoteHost() string {
+	if self.clientIp == "" {
+		self.clientIp = resolveClientIp(self.req, self.config.Server.TrustedProxies)
+	}
+	return self.clientIp
+}
+
+func peerHost(remoteAddr string) string {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return remoteAddr
+	}
+	return host
+}
+
+// resolveClientIp returns the right-most untrusted address of X-Forwarded-For if the peer is a
+// trusted proxy, otherwise the header is ignored to prevent spoofing and the peer is returned
+func resolveClientIp(req *http.Request, trustedProxies []string) string {
+	ip := peerHost(req.RemoteAddr)
+	trusted := matchHosts(ip, trustedProxies)
+	// peers of a unix socket have no address, they are trusted if unix is listed
+	if _, ok := req.Context().Value(http.LocalAddrContextKey).(*net.UnixAddr); ok {
+		ip, trusted = UnixPeer, false
+		for _, proxy := range trustedProxies {
+			trusted = trusted || proxy == UnixPeer
+		}
+	}
+	if !trusted {
+		return ip
+	}
+	hops := make([]string, 0, 2)
+	for _, header := range req.Header.Values("X-Forwarded-For") {
+		hops = append(hops, strings.Split(header, ",")...)
+	}
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if net.ParseIP(hop) == nil {
+			break
+		}
+		ip = hop
+		if !matchHosts(ip, trustedProxies) {
 			break
 		}
 	}
-	if !ok {
-		return false
+	return ip
+}
+
+func (self *Session) checkUserHosts(user *conf.User) error {
+	if !checkHostRules(self.remoteHost(), user.Hosts, user.DenyHosts) {
+		return hostDeniedError{ host: self.remoteHost() }
 	}
-	return true
+	return nil
+}
+
+// checkGroupHosts checks the remote host against the host rules of the requested resource group
+func (self *Session) checkGroupHosts() bool {
+	var rules *conf.HostRules
+	switch self.resource {
+	case "commands":
+		if g, ok := self.config.Commands[self.group]; ok {
+			rules = &g.HostRules
+		}
+	case "files":
+		if g, ok := self.config.Files[self.group]; ok {
+			rules = &g.HostRules
+		}
+	case "databases":
+		if g, ok := self.config.Databases[self.group]; ok {
+			rules = &g.HostRules
+		}
+	case "vars":
+		if g, ok := self.config.Vars[self.group]; ok {
+			rules = &g.HostRules
+		}
+	}
+	if rules == nil {
+		return true
+	}
+	return checkHostRules(self.remoteHost(), rules.Hosts, rules.DenyHosts)
 }
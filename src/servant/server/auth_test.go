@@ -1,5 +1,19 @@
 package server
-import "testing"
+import (
+	"testing"
+	"servant/conf"
+	"net/http"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"strconv"
+	"time"
+	"io/ioutil"
+	"net/http/httptest"
+)
 
 func TestCheckPermission(t *testing.T) {
 	if ! checkPermission("a", []string{"a","b","c"}) {
@@ -16,6 +30,79 @@ func TestCheckPermission(t *testing.T) {
 	}
 }
 
+func TestMatchPermissionRule(t *testing.T) {
+	cases := []struct {
+		rule, resource, group, item string
+		expected bool
+	}{
+		{ "commands/deploy/start", "commands", "deploy", "start", true },
+		{ "commands/deploy/start", "commands", "deploy", "stop", false },
+		{ "commands/deploy/*", "commands", "deploy", "stop", true },
+		{ "commands/deploy/*", "commands", "build", "stop", false },
+		{ "files/*/*", "files", "logs", "app", true },
+		{ "files/*/*", "commands", "logs", "app", false },
+		{ "*/*/status", "commands", "web", "status", true },
+		{ "commands/web_*/status", "commands", "web_1", "status", true },
+		{ "commands/web_*/status", "commands", "db_1", "status", false },
+		{ "commands/deploy", "commands", "deploy", "start", false },
+		{ "commands/[/x", "commands", "deploy", "start", false },
+	}
+	for _, c := range cases {
+		if matchPermissionRule(c.rule, c.resource, c.group, c.item) != c.expected {
+			t.Errorf("rule %s on %s/%s/%s should be %v", c.rule, c.resource, c.group, c.item, c.expected)
+		}
+	}
+}
+
+func TestSessionCheckPermission(t *testing.T) {
+	config := &conf.Config{ Users: map[string]*conf.User{
+		"u": &conf.User{
+			Allows: map[string][]string{ "commands": []string{"db"} },
+			AllowRules: []string{ "commands/deploy/*", "commands/*/status" },
+		},
+	} }
+	// overlapping rules and group grants, any of them allows
+	for target, expected := range map[string]bool{
+		"commands/db/backup": true,
+		"commands/deploy/start": true,
+		"commands/deploy/status": true,
+		"commands/web/status": true,
+		"commands/web/restart": false,
+		"files/deploy/start": false,
+	} {
+		segs := strings.Split(target, "/")
+		sess := Session{ config: config, username: "u", resource: segs[0], group: segs[1], item: segs[2] }
+		if sess.checkPermission() != expected {
+			t.Errorf("permission of %s should be %v", target, expected)
+		}
+	}
+}
+
+func TestSessionCheckPermissionDeny(t *testing.T) {
+	config := &conf.Config{ Users: map[string]*conf.User{
+		"u": &conf.User{
+			Allows: map[string][]string{ "commands": []string{"db"} },
+			AllowRules: []string{ "commands/deploy/*", "commands/deploy/rollback" },
+			DenyRules: []string{ "commands/deploy/drop_*", "commands/db/drop", "*/*/rollback" },
+		},
+	} }
+	// deny wins over group grants and allow rules, even more specific ones
+	for target, expected := range map[string]bool{
+		"commands/deploy/start": true,
+		"commands/deploy/drop_all": false,
+		"commands/deploy/rollback": false,
+		"commands/db/backup": true,
+		"commands/db/drop": false,
+		"files/x/y": false,
+	} {
+		segs := strings.Split(target, "/")
+		sess := Session{ config: config, username: "u", resource: segs[0], group: segs[1], item: segs[2] }
+		if sess.checkPermission() != expected {
+			t.Errorf("permission of %s should be %v", target, expected)
+		}
+	}
+}
+
 func TestCheckHosts(t *testing.T) {
 	if ! checkHosts("10.11.12.13", []string{"10.0.0.0/8"}) {
 		t.Fail()
@@ -62,3 +149,240 @@ func TestParseAuthHeader(t *testing.T)  {
 		t.Fail()
 	}
 }
+
+func TestAuthClientCert(t *testing.T) {
+	config := &conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Users: map[string]*conf.User{
+			"user1": &conf.User{},
+		},
+	}
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.TLS = &tls.ConnectionState{
+		PeerCertificates: []*x509.Certificate{
+			&x509.Certificate{ Subject: pkix.Name{ CommonName: "user1" } },
+		},
+	}
+	sess := Session{ config: config, req: req }
+	if username, err := sess.auth(); err != nil || username != "user1" {
+		t.Errorf("client cert auth failed: %s %v", username, err)
+	}
+}
+
+func TestAuthBearer(t *testing.T) {
+	sum := sha256.Sum256([]byte("secret"))
+	hash := hex.EncodeToString(sum[:])
+	config := &conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Users: map[string]*conf.User{
+			"ci": &conf.User{ Tokens: []conf.Token{ { Hash: hash } } },
+			"old": &conf.User{ Tokens: []conf.Token{ { Hash: "x" }, { Hash: hash, Expires: 1 } } },
+		},
+	}
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	req.RemoteAddr = "127.0.0.1:12345"
+	req.Header.Set("Authorization", "Bearer secret")
+	sess := Session{ config: config, req: req }
+	// the expired token of another user does not fail the valid one, whatever the order of users
+	for i := 0; i < 20; i++ {
+		if username, err := sess.authBearer("secret"); err != nil || username != "ci" {
+			t.Fatalf("bearer auth should pass as ci: %s %v", username, err)
+		}
+	}
+	delete(config.Users, "ci")
+	if _, err := sess.authBearer("secret"); err == nil || !strings.Contains(err.Error(), "expired") {
+		t.Errorf("expired token should fail: %v", err)
+	}
+	if _, err := sess.authBearer("wrong"); err == nil {
+		t.Errorf("wrong token should fail")
+	}
+	config.Users["ci"] = &conf.User{ Tokens: []conf.Token{ { Hash: hash } } }
+	delete(config.Users, "old")
+	if username, err := sess.auth(); err != nil || username != "ci" {
+		t.Errorf("bearer auth failed: %s %v", username, err)
+	}
+}
+
+func TestAuthBasic(t *testing.T) {
+	sum := sha256.Sum256([]byte("pass"))
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true, Realm: "ops" },
+		Users: map[string]*conf.User{
+			"web": &conf.User{ Password: hex.EncodeToString(sum[:]), Allows: map[string][]string{ "vars": []string{"v"} } },
+		},
+	})
+	serve := func(path string, setAuth func(req *http.Request)) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		if setAuth != nil {
+			setAuth(req)
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := serve("/vars/v/x", nil)
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") != `Basic realm="ops", charset="UTF-8"` {
+		t.Errorf("missing credentials should be challenged: %d %v", resp.Code, resp.Header())
+	}
+	resp = serve("/vars/v/x", func(req *http.Request) { req.SetBasicAuth("web", "wrong") })
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("wrong password should be challenged: %d", resp.Code)
+	}
+	resp = serve("/vars/v/x", func(req *http.Request) { req.SetBasicAuth("web", "pass") })
+	if resp.Code == http.StatusUnauthorized || resp.Code == http.StatusForbidden {
+		t.Errorf("basic auth should pass: %d %v", resp.Code, resp.Header())
+	}
+	resp = serve("/vars/other/x", func(req *http.Request) { req.SetBasicAuth("web", "pass") })
+	if resp.Code != http.StatusForbidden || resp.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("permission denied should be 403: %d", resp.Code)
+	}
+}
+
+func TestAuthFailureStatus(t *testing.T) {
+	sum := sha256.Sum256([]byte("token"))
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true, Realm: "ops" },
+		Users: map[string]*conf.User{
+			"ci": &conf.User{ Tokens: []conf.Token{ { Hash: hex.EncodeToString(sum[:]) } }, Hosts: []string{"10.0.0.0/8"} },
+		},
+	})
+	serve := func(auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/vars/v/x", nil)
+		req.Header.Set("Authorization", auth)
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := serve("Bearer wrong")
+	if resp.Code != http.StatusUnauthorized || resp.Header().Get("WWW-Authenticate") != `Bearer realm="ops"` ||
+		!strings.Contains(resp.Header().Get(ServantErrHeader), "authentication failed") {
+		t.Errorf("unknown client should be unauthorized: %d %v", resp.Code, resp.Header())
+	}
+	resp = serve("Bearer token")
+	if resp.Code != http.StatusForbidden || resp.Header().Get("WWW-Authenticate") != "" {
+		t.Errorf("known user from denied host should be forbidden: %d %v", resp.Code, resp.Header())
+	}
+}
+
+func TestAuthLegacyKeyless(t *testing.T) {
+	config := &conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Users: map[string]*conf.User{
+			"open": &conf.User{},
+			"ci": &conf.User{ Tokens: []conf.Token{ { Hash: "x" } } },
+			"web": &conf.User{ Password: "x" },
+			"svc": &conf.User{ Secret: "x" },
+		},
+	}
+	for name, ok := range map[string]bool{ "open": true, "ci": false, "web": false, "svc": false } {
+		req, _ := http.NewRequest("GET", "/vars/v/x", nil)
+		req.RemoteAddr = "127.0.0.1:12345"
+		req.Header.Set("Authorization", name + " 0 anything")
+		sess := Session{ config: config, req: req }
+		username, err := sess.auth()
+		if ok && (err != nil || username != name) {
+			t.Errorf("keyless user %s without credentials should pass: %s %v", name, username, err)
+		}
+		if !ok && err == nil {
+			t.Errorf("keyless user %s with credentials should not pass the legacy scheme", name)
+		}
+	}
+}
+
+func TestAuthHmac(t *testing.T) {
+	config := &conf.Config{
+		Auth: conf.Auth{ Enabled: true, MaxTimeDelta: 300 },
+		Users: map[string]*conf.User{
+			"svc": &conf.User{ Secret: "s3cret" },
+		},
+	}
+	ts := time.Now().Unix()
+	req, _ := http.NewRequest("POST", "/commands/a/b?x=1", strings.NewReader("body"))
+	req.RequestURI = "/commands/a/b?x=1"
+	req.RemoteAddr = "127.0.0.1:12345"
+	sig := hmacSignature("s3cret", "POST", "/commands/a/b?x=1", ts, []byte("body"))
+	req.Header.Set("Authorization", "HMAC-SHA256 svc " + strconv.FormatInt(ts, 10) + " " + sig)
+	sess := Session{ config: config, req: req }
+	if username, err := sess.auth(); err != nil || username != "svc" {
+		t.Errorf("hmac auth failed: %s %v", username, err)
+	}
+	if body, _ := ioutil.ReadAll(req.Body); string(body) != "body" {
+		t.Errorf("body should be restored")
+	}
+	old := strconv.FormatInt(ts - 1000, 10)
+	if _, err := sess.authHmac("svc " + old + " " + hmacSignature("s3cret", "POST", "/commands/a/b?x=1", ts - 1000, []byte{})); err == nil {
+		t.Errorf("old timestamp should fail")
+	}
+	req.Body = ioutil.NopCloser(strings.NewReader("tampered"))
+	if _, err := sess.authHmac("svc " + strconv.FormatInt(ts, 10) + " " + sig); err == nil {
+		t.Errorf("tampered body should fail")
+	}
+}
+
+func TestCheckHostRules(t *testing.T) {
+	if ! checkHostRules("10.1.1.1", nil, nil) {
+		t.Error("empty rules should allow all")
+	}
+	if checkHostRules("10.1.1.1", nil, []string{"10.0.0.0/8"}) {
+		t.Error("denied host should fail")
+	}
+	if checkHostRules("10.1.1.1", []string{"10.0.0.0/8"}, []string{"10.1.1.1"}) {
+		t.Error("deny should take precedence")
+	}
+	if ! checkHostRules("10.2.1.1", []string{"10.0.0.0/8"}, []string{"10.1.0.0/16"}) {
+		t.Error("allowed host should ok")
+	}
+	if ! checkHostRules("fd00::1", []string{"fd00::/8"}, nil) {
+		t.Error("ipv6 should be supported")
+	}
+	if checkHostRules("::1", []string{"fd00::/8"}, nil) {
+		t.Error("ipv6 not allowed")
+	}
+}
+
+func TestResolveClientIp(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/", nil)
+	req.RemoteAddr = "[fd00::1]:2465"
+	if ip := resolveClientIp(req, nil); ip != "fd00::1" {
+		t.Errorf("ipv6 remote host wrong: %s", ip)
+	}
+	req.RemoteAddr = "10.1.1.1:2465"
+	if ip := resolveClientIp(req, nil); ip != "10.1.1.1" {
+		t.Errorf("ipv4 remote host wrong: %s", ip)
+	}
+	req.Header.Add("X-Forwarded-For", "1.1.1.1, 2.2.2.2")
+	req.Header.Add("X-Forwarded-For", "10.0.0.2")
+	if ip := resolveClientIp(req, nil); ip != "10.1.1.1" {
+		t.Errorf("X-Forwarded-For from untrusted peer should be ignored: %s", ip)
+	}
+	if ip := resolveClientIp(req, []string{"10.0.0.0/8"}); ip != "2.2.2.2" {
+		t.Errorf("right-most untrusted address should be used: %s", ip)
+	}
+	req.Header.Set("X-Forwarded-For", "10.0.0.3")
+	if ip := resolveClientIp(req, []string{"10.0.0.0/8"}); ip != "10.0.0.3" {
+		t.Errorf("left-most address should be used if all trusted: %s", ip)
+	}
+	req.Header.Set("X-Forwarded-For", "bad, 3.3.3.3")
+	if ip := resolveClientIp(req, []string{"10.0.0.0/8"}); ip != "3.3.3.3" {
+		t.Errorf("bad address should stop resolving: %s", ip)
+	}
+}
+
+func TestCheckGroupHosts(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/internal/foo", nil)
+	req.RemoteAddr = "192.168.1.1:1234"
+	sess := Session{ req: req, resource: "commands", group: "internal", config: &conf.Config{
+		Commands: map[string]*conf.Commands{
+			"internal": &conf.Commands{ HostRules: conf.HostRules{ Hosts: []string{"10.0.0.0/8"} } },
+		},
+	} }
+	if sess.checkGroupHosts() {
+		t.Error("host out of group hosts should be denied")
+	}
+	req.RemoteAddr = "10.1.1.1:1234"
+	sess.clientIp = ""
+	if ! sess.checkGroupHosts() {
+		t.Error("host in group hosts should be allowed")
+	}
+}
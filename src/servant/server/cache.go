@@ -0,0 +1,216 @@
+package server
+
+import (
+	"bufio"
+	"container/list"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// CacheHeader tells whether a cacheable response is a HIT served from the cache or a MISS
+const CacheHeader = "X-Servant-Cache"
+
+// headers of a response not cached, as they are of the transfer rather than the content
+var uncachedHeaders = []string{ "Trailer", "Content-Encoding", "Content-Length", "Vary" }
+
+// responseCache is an in-memory cache of successful responses, entries expire by their ttl and
+// the least recently used are evicted when the total bytes exceed maxBytes
+type responseCache struct {
+	lock     sync.Mutex
+	maxBytes int64
+	size     int64
+	entries  map[string]*list.Element
+	lru      *list.List // of *cacheEntry, the most recently used at front
+}
+
+type cacheEntry struct {
+	key     string
+	status  int    // of responses kept by idempotency keys, cached ones are 200
+	request string // method and uri of responses kept by idempotency keys
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (self *cacheEntry) size() int64 {
+	n := len(self.key) + len(self.request) + len(self.body)
+	for k, vs := range self.header {
+		n += len(k)
+		for _, v := range vs {
+			n += len(v)
+		}
+	}
+	return int64(n)
+}
+
+func newResponseCache(maxBytes int64) *responseCache {
+	return &responseCache{
+		maxBytes: maxBytes,
+		entries: make(map[string]*list.Element),
+		lru: list.New(),
+	}
+}
+
+// get returns the entry of the key if not expired, nil otherwise
+func (self *responseCache) get(key string) *cacheEntry {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	elem, ok := self.entries[key]
+	if !ok {
+		return nil
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !time.Now().Before(entry.expires) {
+		self.remove(elem)
+		return nil
+	}
+	self.lru.MoveToFront(elem)
+	return entry
+}
+
+// put adds or replaces the entry, evicting the least recently used ones to make room
+func (self *responseCache) put(entry *cacheEntry) {
+	size := entry.size()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if elem, ok := self.entries[entry.key]; ok {
+		self.remove(elem)
+	}
+	if size > self.maxBytes {
+		return
+	}
+	self.entries[entry.key] = self.lru.PushFront(entry)
+	self.size += size
+	for self.size > self.maxBytes {
+		self.remove(self.lru.Back())
+	}
+}
+
+func (self *responseCache) remove(elem *list.Element) {
+	entry := self.lru.Remove(elem).(*cacheEntry)
+	delete(self.entries, entry.key)
+	self.size -= entry.size()
+}
+
+// clear drops all entries, as outputs of the old config may differ
+func (self *responseCache) clear() {
+	if self == nil {
+		return
+	}
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.entries = make(map[string]*list.Element)
+	self.lru.Init()
+	self.size = 0
+}
+
+// cacheWriter passes the response through while keeping a copy of the body, until it exceeds max
+type cacheWriter struct {
+	http.ResponseWriter
+	max      int64
+	status   int
+	body     []byte
+	overflow bool
+}
+
+func (self *cacheWriter) WriteHeader(code int) {
+	if self.status == 0 && code >= 200 {
+		self.status = code
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *cacheWriter) Write(p []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	if !self.overflow {
+		if int64(len(self.body) + len(p)) > self.max {
+			self.overflow, self.body = true, nil
+		} else {
+			self.body = append(self.body, p...)
+		}
+	}
+	return self.ResponseWriter.Write(p)
+}
+
+// Unwrap makes http.ResponseController reach the underlying writer
+func (self *cacheWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+func (self *cacheWriter) Flush() {
+	http.NewResponseController(self.ResponseWriter).Flush()
+}
+
+func (self *cacheWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(self.ResponseWriter).Hijack()
+}
+
+// cacheTtl returns how long the response of the requested item is cached, 0 if it is not cacheable.
+// Only GET requests are cacheable.
+func (self *Session) cacheTtl() time.Duration {
+	// event streams are not cached, the key is the same as of plain output
+	if self.server.cache == nil || self.req.Method != "GET" || wantsEventStream(self.req) {
+		return 0
+	}
+	var ttl uint32
+	switch self.resource {
+	case "commands":
+		if cmdConf := (CommandServer{ Session: self }).findCommandConfig(); cmdConf != nil {
+			ttl = cmdConf.CacheTtl
+		}
+	case "databases":
+		if _, queryConf := (DatabaseServer{ Session: self }).findDatabaseQueryConfig(); queryConf != nil {
+			ttl = queryConf.CacheTtl
+		}
+	}
+	return time.Duration(ttl) * time.Second
+}
+
+// cacheKey identifies a response by the user, the item, and the query string sorted by names.
+// Params from headers or the body are not in the key, items depending on them should not be cached.
+func (self *Session) cacheKey() string {
+	return self.username + "\x00" + self.req.URL.Path + "?" + self.req.URL.Query().Encode()
+}
+
+// serveCached serves the response from the cache if there is one, or serves by the handler
+// and caches the response if it is ok and complete
+func (self *Session) serveCached(handler Handler, ttl time.Duration) {
+	cache := self.server.cache
+	key := self.cacheKey()
+	header := self.resp.Header()
+	if entry := cache.get(key); entry != nil {
+		for k, vs := range entry.header {
+			header[k] = append([]string(nil), vs...)
+		}
+		header.Set(CacheHeader, "HIT")
+		self.resp.WriteHeader(http.StatusOK)
+		self.resp.Write(entry.body)
+		self.GoodEnd("served from cache")
+		return
+	}
+	// headers set before serving, like cors ones, are of the request rather than the content
+	header.Set(CacheHeader, "MISS")
+	preset := make(map[string]bool, len(header))
+	for k := range header {
+		preset[k] = true
+	}
+	w := &cacheWriter{ ResponseWriter: self.resp, max: cache.maxBytes }
+	self.resp = w
+	handler.serve()
+	self.resp = w.ResponseWriter
+	// errors after the output started are only in the trailer
+	if w.status != http.StatusOK || w.overflow || header.Get(ServantErrHeader) != "" {
+		return
+	}
+	entry := &cacheEntry{ key: key, header: make(http.Header), body: w.body, expires: time.Now().Add(ttl) }
+	for k, vs := range header {
+		if !preset[k] && !contains(uncachedHeaders, k) {
+			entry.header[k] = append([]string(nil), vs...)
+		}
+	}
+	cache.put(entry)
+}
@@ -0,0 +1,78 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"servant/conf"
+	"testing"
+	"time"
+)
+
+func TestResponseCache(t *testing.T) {
+	cache := newResponseCache(10)
+	entry := func(key, body string, ttl time.Duration) *cacheEntry {
+		return &cacheEntry{ key: key, header: http.Header{}, body: []byte(body), expires: time.Now().Add(ttl) }
+	}
+	cache.put(entry("a", "1234", time.Minute))
+	cache.put(entry("b", "1234", time.Minute))
+	if cache.get("a") == nil {
+		t.Errorf("a should be cached")
+	}
+	// b is the least recently used now
+	cache.put(entry("c", "1234", time.Minute))
+	if cache.get("b") != nil || cache.get("a") == nil || cache.get("c") == nil || cache.size != 10 {
+		t.Errorf("b should be evicted: %d", cache.size)
+	}
+	cache.put(entry("d", "much too large", time.Minute))
+	if cache.get("d") != nil {
+		t.Errorf("entry larger than the cache should not be cached")
+	}
+	cache.put(entry("a", "1", -time.Second))
+	if cache.get("a") != nil || cache.size != 5 {
+		t.Errorf("expired entry should be removed: %d", cache.size)
+	}
+	cache.clear()
+	if cache.get("c") != nil || cache.size != 0 {
+		t.Errorf("cache should be cleared")
+	}
+}
+
+func TestServeCached(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ CacheMaxBytes: 1024 },
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"now": &conf.Command{ Lang: "bash", Code: "date +%s%N", CacheTtl: 60 },
+				"fail": &conf.Command{ Lang: "bash", Code: "date +%s%N; exit 1", CacheTtl: 60 },
+				"big": &conf.Command{ Lang: "bash", Code: "head -c 2000 /dev/zero", CacheTtl: 60 },
+			} },
+		},
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		return resp
+	}
+	first := serve("GET", "/commands/c/now?b=2&a=1")
+	if first.Code != http.StatusOK || first.Header().Get(CacheHeader) != "MISS" {
+		t.Fatalf("first request should miss: %d %v", first.Code, first.Header())
+	}
+	resp := serve("GET", "/commands/c/now?a=1&b=2")
+	if resp.Header().Get(CacheHeader) != "HIT" || resp.Body.String() != first.Body.String() || resp.Header().Get(ExitCodeHeader) != "0" {
+		t.Errorf("same params in another order should hit: %v %q %q", resp.Header(), resp.Body.String(), first.Body.String())
+	}
+	if resp = serve("GET", "/commands/c/now?a=2"); resp.Header().Get(CacheHeader) != "MISS" {
+		t.Errorf("other params should miss: %v", resp.Header())
+	}
+	if resp = serve("POST", "/commands/c/now?a=1&b=2"); resp.Header().Get(CacheHeader) != "" || resp.Body.String() == first.Body.String() {
+		t.Errorf("POST should not be cached: %v", resp.Header())
+	}
+	serve("GET", "/commands/c/fail")
+	if resp = serve("GET", "/commands/c/fail"); resp.Header().Get(CacheHeader) != "MISS" {
+		t.Errorf("failed execution should not be cached: %v", resp.Header())
+	}
+	serve("GET", "/commands/c/big")
+	if resp = serve("GET", "/commands/c/big"); resp.Header().Get(CacheHeader) != "MISS" || resp.Body.Len() != 2000 {
+		t.Errorf("output larger than the cache should not be cached: %v %d", resp.Header(), resp.Body.Len())
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+)
+
+// ChecksumHeader is the sha256 of a file in hex, verified on uploads and responded on downloads
+const ChecksumHeader = "X-Checksum-SHA256"
+
+// checksums are the hashes of an upload expected by the request, computed as the body is written
+type checksums struct {
+	hashes []hash.Hash
+	names  []string
+	wants  [][]byte
+}
+
+// requestChecksums returns the checksums in the Content-MD5 (base64) and X-Checksum-SHA256 (hex or base64)
+// headers, nil if there are none
+func requestChecksums(req *http.Request) (*checksums, *ServantError) {
+	var ret *checksums
+	for _, c := range []struct{ header string; name string; size int; new func() hash.Hash }{
+		{ "Content-MD5", "md5", md5.Size, md5.New },
+		{ ChecksumHeader, "sha256", sha256.Size, sha256.New },
+	} {
+		s := req.Header.Get(c.header)
+		if s == "" {
+			continue
+		}
+		want, err := hex.DecodeString(s)
+		if err != nil || len(want) != c.size {
+			want, err = base64.StdEncoding.DecodeString(s)
+		}
+		if err != nil || len(want) != c.size {
+			servantErr := NewServantError(http.StatusBadRequest, "invalid %s %s", c.header, s)
+			return nil, &servantErr
+		}
+		if ret == nil {
+			ret = &checksums{}
+		}
+		ret.hashes = append(ret.hashes, c.new())
+		ret.names = append(ret.names, c.name)
+		ret.wants = append(ret.wants, want)
+	}
+	return ret, nil
+}
+
+// tee returns a writer writing to w and the hashes, w itself if no checksums
+func (self *checksums) tee(w io.Writer) io.Writer {
+	if self == nil {
+		return w
+	}
+	ws := []io.Writer{ w }
+	for _, h := range self.hashes {
+		ws = append(ws, h)
+	}
+	return io.MultiWriter(ws...)
+}
+
+// verify compares the hashes of the bytes written with the expected ones
+func (self *checksums) verify() error {
+	if self == nil {
+		return nil
+	}
+	for i, h := range self.hashes {
+		if got := h.Sum(nil); !bytes.Equal(got, self.wants[i]) {
+			return fmt.Errorf("%s mismatch: got %x, expected %x", self.names[i], got, self.wants[i])
+		}
+	}
+	return nil
+}
+
+// fileSha256 returns the sha256 of the content in hex, the file is seeked back to the start after hashing
+func fileSha256(file *os.File) (string, error) {
+	hash := sha256.New()
+	if _, err := io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
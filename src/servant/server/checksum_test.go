@@ -0,0 +1,77 @@
+package server
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"servant/conf"
+	"strings"
+	"testing"
+)
+
+func TestServeWriteChecksum(t *testing.T) {
+	root := t.TempDir()
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"rw": &conf.Dir{ Root: root, Allows: []string{"GET", "PUT"}, Writable: true, Checksum: true },
+			} },
+		},
+	})
+	serve := func(method, uri, body string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, uri, strings.NewReader(body))
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		server.ServeHTTP(resp, req)
+		return resp
+	}
+	md5sum := md5.Sum([]byte("hello"))
+	sha := sha256.Sum256([]byte("hello"))
+	good := map[string]string{
+		"Content-MD5": base64.StdEncoding.EncodeToString(md5sum[:]),
+		ChecksumHeader: hex.EncodeToString(sha[:]),
+	}
+	if resp := serve("PUT", "/files/g/rw/a.txt", "hello", good); resp.Code != http.StatusCreated {
+		t.Errorf("upload with matched checksums should be created: %d %s", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	if resp := serve("PUT", "/files/g/rw/a.txt", "hellO", good); resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("upload with mismatched checksums should be 422: %d", resp.Code)
+	}
+	if resp := serve("PUT", "/files/g/rw/a.txt", "hello", map[string]string{ ChecksumHeader: "xyz" }); resp.Code != http.StatusBadRequest {
+		t.Errorf("invalid checksum should be 400: %d", resp.Code)
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "hello" {
+		t.Errorf("corrupted upload should not replace the file: %q", data)
+	}
+	if entries, _ := os.ReadDir(root); len(entries) != 1 {
+		t.Errorf("temp files left: %v", entries)
+	}
+	if resp := serve("GET", "/files/g/rw/a.txt", "", nil); resp.Header().Get(ChecksumHeader) != hex.EncodeToString(sha[:]) {
+		t.Errorf("download should have the checksum: %v", resp.Header())
+	}
+
+	// checksums of the last chunk are of the whole file
+	chunk := func(contentRange, body, sum string) int {
+		return serve("PUT", "/files/g/rw/b.txt", body, map[string]string{ "Content-Range": contentRange, ChecksumHeader: sum }).Code
+	}
+	if code := chunk("bytes 0-1/5", "he", "ignored"); code != http.StatusAccepted {
+		t.Errorf("first chunk should be accepted: %d", code)
+	}
+	if code := chunk("bytes 2-4/5", "lLo", hex.EncodeToString(sha[:])); code != http.StatusUnprocessableEntity {
+		t.Errorf("corrupted upload should be 422: %d", code)
+	}
+	if _, err := os.Stat(uploadPath(filepath.Join(root, "b.txt"))); !os.IsNotExist(err) {
+		t.Errorf("corrupted partial upload should be removed")
+	}
+	chunk("bytes 0-1/5", "he", "")
+	if code := chunk("bytes 2-4/5", "llo", hex.EncodeToString(sha[:])); code != http.StatusCreated {
+		t.Errorf("upload with matched checksum should be created: %d", code)
+	}
+}
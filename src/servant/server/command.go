@@ -10,10 +10,19 @@ import (
 	"syscall"
 	"strconv"
 	"io"
-	"io/ioutil"
 	"strings"
+	"context"
+	"math"
+	"os"
+	"errors"
+	"fmt"
+	"sync"
+	"slices"
 )
 
+// RequestIdEnv passes the request id to commands
+const RequestIdEnv = conf.EnvPrefix + "REQUEST_ID"
+
 var argRe, _ = regexp.Compile(`("[^"]*"|'[^']*'|[^\s"']+)`)
 
 type CommandServer struct {
@@ -26,6 +35,7 @@ func NewCommandServer(sess *Session) Handler {
 	}
 }
 
+// findCommandConfig returns the variant of the command for the method of the request, the command itself if none
 func (self CommandServer) findCommandConfig() *conf.Command {
 	cmdsConf, ok := self.config.Commands[self.group]
 	if !ok {
@@ -35,13 +45,46 @@ func (self CommandServer) findCommandConfig() *conf.Command {
 	if !ok {
 		return nil
 	}
+	for _, variant := range cmdConf.Variants {
+		if slices.Contains(variant.Methods, self.req.Method) {
+			return variant
+		}
+	}
 	return cmdConf
 }
 
+/*
+ Languages of a command, by lang, or by shell="false" for exec and shell="true" for bash:
+
+ exec: the code is split into an argv array and executed directly, without a shell. Params are
+       substituted into single arguments, so shell metacharacters in params are never interpreted.
+       This is the default of a command without lang or shell, unless it is a template.
+ bash: the code is executed by `bash -c`. Params are never substituted into the code, use env to
+       pass params into a bash command. Unless the command is a template, in which case each ${param}
+       is substituted single quoted, so it is one literal word to the shell. Params declared raw are
+       substituted as is, for trusted values only.
+
+ In both languages, params are validated by the validators before the process is spawned.
+ */
 func getCmdBashArgs(code string, query ParamFunc) (string, []string) {
 	return "bash", []string{"-c", code}
 }
 
+// templateBashCode substitutes params of the code quoted for the shell, except raw ones
+func templateBashCode(code string, query ParamFunc, params conf.Params) (string, bool) {
+	return varExpandNamed(code, query, func(name, v string) string {
+		if params[name].Raw {
+			return v
+		}
+		return shellQuote(v)
+	})
+}
+
+// shellQuote quotes the value in single quotes, in which nothing but a single quote is special
+func shellQuote(v string) string {
+	return "'" + strings.ReplaceAll(v, "'", `'\''`) + "'"
+}
+
 func replaceCmdParams(arg string, query ParamFunc) (string, bool) {
 	return VarExpand(arg, query, func(s string) string { return s })
 }
@@ -65,20 +108,139 @@ func getCmdExecArgs(code string, query ParamFunc) (string, []string, bool) {
 	return args[0], args[1:], true
 }
 
+// cmdEnv returns the inherited environment with the configured params appended. The params
+// are exported as SERVANT_<name> by default, so they do not override inherited variables
+// unless the name is configured explicitly.
+func cmdEnv(envs map[string]string, params ParamFunc) ([]string, error) {
+	env := os.Environ()
+	for name, envName := range envs {
+		if !paramNameRe.MatchString(name) {
+			return nil, NewServantError(http.StatusBadRequest, "bad env param name: %s", name)
+		}
+		if v, ok := params(name); ok {
+			env = append(env, envName + "=" + v)
+		}
+	}
+	return env, nil
+}
+
 func (self CommandServer) serve() {
 	urlPath := self.req.URL.Path
-	method := self.req.Method
-
-	if method != "GET" && method != "POST" {
-		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
-		return
-	}
 	cmdConf := self.findCommandConfig()
 	if cmdConf == nil {
 		self.ErrorEnd(http.StatusNotFound, "command %s not found", urlPath)
-		self.resp.WriteHeader(http.StatusNotFound)
 		return
 	}
+	// jobs of an async command are polled by GET with the job id
+	if id := self.req.URL.Query().Get("job"); cmdConf.Async && id != "" {
+		self.serveJob(id)
+		return
+	}
+	if !self.methodAllowed(commandMethods(cmdConf)) {
+		return
+	}
+	if err := self.checkUserCommand(cmdConf); err != nil {
+		self.ErrorEnd(err.HttpCode, "%s", err.Message)
+		return
+	}
+	if cmdConf.Async {
+		self.startJob(cmdConf)
+		return
+	}
+	ok := self.withConcurrency(cmdConf, func() {
+		self.serveWithLock(cmdConf)
+	})
+	if !ok {
+		self.concurrencyLimited(cmdConf)
+	}
+}
+
+// concurrencyLimited rejects the request waited no free execution slot with 429, telling the client when to retry
+func (self CommandServer) concurrencyLimited(cmdConf *conf.Command) {
+	if self.req.Context().Err() != nil {
+		self.ErrorEnd(http.StatusTooManyRequests, "client disconnected while waiting for an execution slot of command %s.%s", self.group, self.item)
+		return
+	}
+	self.resp.Header().Set("Retry-After", strconv.FormatUint(uint64(max(cmdConf.ConcurrencyWait, 1)), 10))
+	self.ErrorEnd(http.StatusTooManyRequests, "concurrency limit %d of command %s.%s reached", cmdConf.MaxConcurrency, self.group, self.item)
+}
+
+// commandMethods returns the methods allowed of the command and its variants, async ones are not started
+// by GET by default
+func commandMethods(cmdConf *conf.Command) []string {
+	methods := cmdConf.Methods
+	if len(methods) == 0 {
+		methods = conf.DefaultCommandMethods
+		if cmdConf.Async {
+			methods = conf.DefaultAsyncMethods
+		}
+	}
+	if len(cmdConf.Variants) == 0 {
+		return methods
+	}
+	ret := slices.Clone(methods)
+	for _, variant := range cmdConf.Variants {
+		for _, method := range variant.Methods {
+			if !slices.Contains(ret, method) {
+				ret = append(ret, method)
+			}
+		}
+	}
+	return ret
+}
+
+// checkUserCommand applies command rules of the user after the permission check. A group with rules
+// restricts the user to the commands listed, and their params to the constraints of the rules.
+func (self CommandServer) checkUserCommand(cmdConf *conf.Command) *ServantError {
+	user := self.UserConfig()
+	if user == nil {
+		return nil
+	}
+	rules, ok := user.CommandRules[self.group]
+	if !ok {
+		return nil
+	}
+	validators, ok := rules[self.item]
+	if !ok {
+		err := NewServantError(http.StatusForbidden, "user %s is not allowed to run command %s.%s", self.username, self.group, self.item)
+		return &err
+	}
+	if len(validators) == 0 {
+		return nil
+	}
+	params, perr := self.declaredParams(cmdConf.Params)
+	if perr != nil {
+		return perr
+	}
+	for name, vd := range validators {
+		v, exists := params(name)
+		if !exists {
+			err := NewServantError(http.StatusForbidden, "param %s of command %s.%s is required for user %s", name, self.group, self.item, self.username)
+			return &err
+		}
+		if !validateParam(&vd, v) {
+			err := NewServantError(http.StatusForbidden, "param %s=%s of command %s.%s is not allowed for user %s", name, v, self.group, self.item, self.username)
+			return &err
+		}
+	}
+	return nil
+}
+
+// withConcurrency calls f in an execution slot of the command, false if no slot is free in time
+func (self CommandServer) withConcurrency(cmdConf *conf.Command, f func()) bool {
+	if cmdConf.MaxConcurrency <= 0 {
+		f()
+		return true
+	}
+	sem := self.server.commandSemaphore(self.group + "." + self.item, cmdConf.MaxConcurrency)
+	if cmdConf.ConcurrencyWait > 0 {
+		// a waiter gives up the wait once the client disconnects
+		return sem.WaitWith(self.req.Context(), time.Duration(cmdConf.ConcurrencyWait) * time.Second, f)
+	}
+	return sem.TryWith(f)
+}
+
+func (self CommandServer) serveWithLock(cmdConf *conf.Command) {
 	if cmdConf.Lock.Name == "" {
 		self.serveCommand(cmdConf)
 	} else {
@@ -94,6 +256,8 @@ func (self CommandServer) serve() {
 	}
 }
 
+// setCmdUser makes the command run as the system user with its primary and supplementary groups.
+// Switching to another user needs root, fail rather than run the command as servant itself.
 func setCmdUser(cmd *exec.Cmd, username string) error {
 	sysUser, err := user.Lookup(username)
 	if err != nil {
@@ -107,36 +271,95 @@ func setCmdUser(cmd *exec.Cmd, username string) error {
 	if err != nil {
 		return err
 	}
-	cred := syscall.Credential{ Uid: uint32(uid), Gid: uint32(gid) }
+	euid := os.Geteuid()
+	if euid != 0 {
+		if uid == euid {
+			return nil
+		}
+		return fmt.Errorf("servant runs as uid %d, not privileged to run as %s", euid, username)
+	}
+	groupIds, err := sysUser.GroupIds()
+	if err != nil {
+		return err
+	}
+	groups := make([]uint32, 0, len(groupIds))
+	for _, groupId := range groupIds {
+		g, err := strconv.Atoi(groupId)
+		if err != nil {
+			return err
+		}
+		groups = append(groups, uint32(g))
+	}
+	cred := syscall.Credential{ Uid: uint32(uid), Gid: uint32(gid), Groups: groups }
 
 	cmd.SysProcAttr.Credential = &cred
 	return nil
 }
 
 func (self CommandServer) serveCommand(cmdConf *conf.Command) {
-	outBuf, err := self.execCommand(cmdConf)
-	if err != nil {
-		self.ErrorEnd(err.(ServantError).HttpCode, err.(ServantError).Message)
+	if cmdConf.Response != nil {
+		self.serveResponseTemplate(cmdConf)
+		return
+	}
+	if wantsEventStream(self.req) {
+		self.serveEventStream(cmdConf, sseHeartbeatInterval)
 		return
 	}
-	_, err = self.resp.Write(outBuf) // may log errors
+	out := &flushWriter{ sess: self.Session }
+	switch cmdConf.ContentType {
+	case "":
+	case "auto":
+		out.sniff = true
+	default:
+		self.resp.Header().Set("Content-Type", cmdConf.ContentType)
+	}
+	// errors after the output started can only be reported in the trailer
+	self.resp.Header().Set("Trailer", ServantErrHeader + ", " + ExitCodeHeader + ", " + StderrHeader + ", " + TruncatedHeader)
+	err := self.execCommand(cmdConf, out)
 	if err != nil {
-		self.BadEnd("io error: %s", err)
-	} else {
-		self.GoodEnd("execution done")
+		servantErr := err.(ServantError)
+		if out.written {
+			self.setError(servantErr.HttpCode, self.redact(servantErr.Message))
+			self.BadEnd("%s", servantErr.Message)
+		} else {
+			self.ErrorEnd(servantErr.HttpCode, "%s", servantErr.Message)
+		}
+		return
 	}
+	self.GoodEnd("execution done")
 }
 
+// flushWriter writes command output to the response and flushes it at once, so clients
+// see the output while the command is running
+type flushWriter struct {
+	sess    *Session
+	written bool
+	sniff   bool // sets the Content-Type by the first bytes written
+}
+
+func (self *flushWriter) Write(p []byte) (int, error) {
+	if self.sniff && !self.written && len(p) > 0 {
+		self.sess.resp.Header().Set("Content-Type", http.DetectContentType(p))
+	}
+	self.written = true
+	self.sess.resetWriteDeadline()
+	n, err := self.sess.resp.Write(p)
+	if flusher, ok := self.sess.resp.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return n, err
+}
 
-func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (cmd *exec.Cmd, out io.ReadCloser, err error) {
+
+func cmdFromConf(ctx context.Context, cmdConf *conf.Command, params ParamFunc, input io.Reader, output io.Writer) (cmd *exec.Cmd, err error) {
 	var name string
 	var args []string
 	if !ValidateParams(cmdConf.Validators, params) {
-		return nil, nil, NewServantError(http.StatusBadRequest, "validate params failed")
+		return nil, NewServantError(http.StatusBadRequest, "validate params failed")
 	}
 	code := strings.TrimSpace(cmdConf.Code)
 	if code == "" {
-		return nil, nil, NewServantError(http.StatusInternalServerError, "command code is empty")
+		return nil, NewServantError(http.StatusInternalServerError, "command code is empty")
 	}
 	switch cmdConf.Lang {
 	case "exec":
@@ -147,14 +370,25 @@ func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (
 			return
 		}
 	case "bash", "":
+		if cmdConf.Template {
+			var exists bool
+			code, exists = templateBashCode(code, params, cmdConf.Params)
+			if !exists {
+				err = NewServantError(http.StatusBadRequest, "some params missing")
+				return
+			}
+		}
 		name, args = getCmdBashArgs(code, params)
 	default:
 		err = NewServantError(http.StatusInternalServerError, "unknown language")
 		return
 	}
-	cmd = exec.Command(name, args...)
+	cmd = exec.CommandContext(ctx, name, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{}
 	cmd.Dir = "/"
+	if cmdConf.Cwd != "" {
+		cmd.Dir = cmdConf.Cwd
+	}
 	if cmdConf.User != "" {
 		err = setCmdUser(cmd, cmdConf.User)
 		if err != nil {
@@ -162,6 +396,12 @@ func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (
 			return
 		}
 	}
+	if len(cmdConf.Envs) > 0 {
+		cmd.Env, err = cmdEnv(cmdConf.Envs, params)
+		if err != nil {
+			return
+		}
+	}
 	cmd.Stdin = input
 	cmd.Stderr = nil
 	if cmdConf.Background {
@@ -172,67 +412,235 @@ func cmdFromConf(cmdConf *conf.Command, params ParamFunc, input io.ReadCloser) (
 	} else {
 		cmd.SysProcAttr.Setpgid = true
 		cmd.SysProcAttr.Pgid = 0
-		out, err = cmd.StdoutPipe()
-		if err != nil {
-			err = NewServantError(http.StatusInternalServerError, "pipe stdout failed: %s", err.Error())
-			return
+		cmd.Stdout = output
+		// children escaped from the process group may hold stdout open, do not wait for them forever
+		cmd.WaitDelay = cmdWaitDelay
+	}
+	return cmd, nil
+}
+
+const ExitCodeHeader = "X-Servant-Exit-Code"
+const StderrHeader = "X-Servant-Stderr"
+
+// stderrTrailerBytes is how much of the end of stderr is kept for the trailer
+const stderrTrailerBytes = 4096
+
+// tailBuffer keeps the last max bytes written
+type tailBuffer struct {
+	buf []byte
+	max int
+}
+
+func (self *tailBuffer) Write(p []byte) (int, error) {
+	self.buf = append(self.buf, p...)
+	if len(self.buf) > self.max {
+		self.buf = self.buf[len(self.buf) - self.max:]
+	}
+	return len(p), nil
+}
+
+// headerValue returns the content escaped like a go string, so newlines fit in a header
+func (self *tailBuffer) headerValue() string {
+	quoted := strconv.Quote(string(self.buf))
+	return quoted[1:len(quoted) - 1]
+}
+
+// outputTruncatedMarker ends the output of a command killed for exceeding maxOutputBytes
+const outputTruncatedMarker = "\n[output truncated at %d bytes]\n"
+
+var errOutputLimit = errors.New("output limit exceeded")
+
+// outputLimitWriter passes at most remaining bytes to out, and calls exceeded once when more is written
+type outputLimitWriter struct {
+	out       io.Writer
+	remaining int64
+	exceeded  func()
+	truncated bool
+}
+
+func (self *outputLimitWriter) Write(p []byte) (int, error) {
+	if self.truncated {
+		return 0, errOutputLimit
+	}
+	if int64(len(p)) <= self.remaining {
+		n, err := self.out.Write(p)
+		self.remaining -= int64(n)
+		return n, err
+	}
+	n, _ := self.out.Write(p[:self.remaining])
+	self.remaining = 0
+	self.truncated = true
+	self.exceeded()
+	return n, errOutputLimit
+}
+
+// umaskLock guards the umask of the process, which is inherited by commands when they are started
+var umaskLock sync.RWMutex
+
+// startCmd starts the command with the octal umask, or the umask of the server if empty.
+// The umask is process wide, so no other command is started until it is restored.
+func startCmd(cmd *exec.Cmd, umask string) error {
+	if umask == "" {
+		umaskLock.RLock()
+		defer umaskLock.RUnlock()
+		return cmd.Start()
+	}
+	mask, err := strconv.ParseUint(umask, 8, 32)
+	if err != nil {
+		return fmt.Errorf("bad umask %s", umask)
+	}
+	umaskLock.Lock()
+	defer umaskLock.Unlock()
+	defer syscall.Umask(syscall.Umask(int(mask)))
+	return cmd.Start()
+}
+
+const cmdKillGrace = 2 * time.Second
+const cmdWaitDelay = cmdKillGrace + 1 * time.Second
+
+// killGroupOnCancel makes canceling cmd terminate its whole process group, or session as both have the
+// id of the pid, so children are stopped too, and kills the group if still alive after grace.
+// The returned func must be called once cmd is waited: it kills what is left of a canceled group at once
+// and stops the pending kill, which would otherwise fire on an id that may be reused by then.
+func killGroupOnCancel(cmd *exec.Cmd, grace time.Duration) (waited func()) {
+	var lock sync.Mutex
+	var kill *time.Timer
+	done := false
+	cmd.Cancel = func() error {
+		pgid := cmd.Process.Pid
+		lock.Lock()
+		if !done {
+			kill = time.AfterFunc(grace, func() {
+				syscall.Kill(-pgid, syscall.SIGKILL)
+			})
+		}
+		lock.Unlock()
+		return syscall.Kill(-pgid, syscall.SIGTERM)
+	}
+	return func() {
+		lock.Lock()
+		defer lock.Unlock()
+		done = true
+		if kill != nil && kill.Stop() {
+			syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
 		}
 	}
-	return cmd, out, nil
 }
 
-func (self CommandServer) execCommand(cmdConf *conf.Command) (outBuf []byte, err error) {
-	var input io.ReadCloser = nil
-	if self.req.Method == "POST" {
-		input = self.req.Body
+func (self CommandServer) execCommand(cmdConf *conf.Command, out io.Writer) (err error) {
+	// params are read before stdin, since a form or json body is parsed and restored for the command
+	params, perr := self.declaredParams(cmdConf.Params)
+	if perr != nil {
+		return *perr
+	}
+	// without stdin, the command reads an empty input instead of blocking
+	var input io.Reader = http.NoBody
+	if cmdConf.Stdin && self.req.Body != nil {
+		maxBody := self.maxBodyBytes()
+		if maxBody > 0 {
+			if self.req.ContentLength > maxBody {
+				return NewServantError(http.StatusRequestEntityTooLarge, "request body too large")
+			}
+			input = http.MaxBytesReader(self.resp, self.req.Body, maxBody)
+		} else {
+			input = self.req.Body
+		}
+	}
+	// the request context is canceled when the client disconnects
+	ctx := self.req.Context()
+	if cmdConf.Background {
+		ctx = context.Background()
+	} else if cmdConf.Timeout > 0 && cmdConf.Timeout != math.MaxUint32 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cmdConf.Timeout) * time.Second)
+		defer cancel()
 	}
-	params := requestParams(self.req)
-	cmd, out, err := cmdFromConf(cmdConf, params, input)
+	// the process group is terminated like a timeout once the output exceeds the limit
+	var limited *outputLimitWriter
+	if cmdConf.MaxOutputBytes > 0 && !cmdConf.Background {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithCancel(ctx)
+		defer cancel()
+		limited = &outputLimitWriter{ out: out, remaining: cmdConf.MaxOutputBytes, exceeded: cancel }
+		out = limited
+	}
+	cmd, err := cmdFromConf(ctx, cmdConf, params, input, out)
 	if err != nil {
 		return
 	}
-	self.info("command: %v", cmd.Args)
-	if out != nil {
-		defer out.Close()
+	if self.requestId != "" {
+		if cmd.Env == nil {
+			cmd.Env = os.Environ()
+		}
+		cmd.Env = append(cmd.Env, RequestIdEnv + "=" + self.requestId)
 	}
-	err = cmd.Start()
+	var stderr *tailBuffer
+	if !cmdConf.Background {
+		// on timeout or client disconnect, terminate the whole process group of the command
+		waited := killGroupOnCancel(cmd, cmdKillGrace)
+		defer waited()
+		switch cmdConf.Stderr {
+		case "inline":
+			// the same writer for both, so exec writes them one at a time
+			cmd.Stderr = out
+		case "trailer":
+			stderr = &tailBuffer{ max: stderrTrailerBytes }
+			cmd.Stderr = stderr
+		}
+	}
+	self.debug("command: %v", cmd.Args)
+	err = startCmd(cmd, cmdConf.Umask)
 	if err != nil {
 		err = NewServantError(http.StatusBadGateway, "execution error: %s", err)
 		return
 	}
 	self.info("process started. pid: %d", cmd.Process.Pid)
+	t0 := time.Now()
 	if cmdConf.Background {
 		go func() {
-			err = cmd.Wait()
+			err := cmd.Wait()
 			if err != nil {
 				self.warn("background process %d ended with error: %s", cmd.Process.Pid, err.Error())
 			} else {
 				self.info("background process %d ended", cmd.Process.Pid)
 			}
 		}()
-	} else {
-		ch := make(chan error, 1)
-		go func() {
-			if out != nil {
-				outBuf, err = ioutil.ReadAll(out)
-				if err != nil {
-					ch <- err
-					cmd.Wait()
-					return
-				}
-			}
-			err = cmd.Wait()
-			ch <- err
-		}()
-		timeout := time.Duration(cmdConf.Timeout)
-		select {
-		case err = <-ch:
-			if err != nil {
-				err = NewServantError(http.StatusBadGateway, "execution error: %s", err)
-			}
-		case <-time.After(timeout * time.Second):
-			cmd.Process.Kill()
-			err = NewServantError(http.StatusGatewayTimeout, "command execution timeout: %d", timeout)
+		return
+	}
+	err = cmd.Wait()
+	commandName := self.group + "." + self.item
+	commandDuration.observe(time.Since(t0), commandName)
+	commandExits.inc(commandName, strconv.Itoa(cmd.ProcessState.ExitCode()))
+	// headers set after the output started are sent as trailers
+	if self.resp != nil {
+		self.resp.Header().Set(ExitCodeHeader, strconv.Itoa(cmd.ProcessState.ExitCode()))
+		if stderr != nil && len(stderr.buf) > 0 {
+			self.resp.Header().Set(StderrHeader, self.redact(stderr.headerValue()))
+		}
+	}
+	if limited != nil && limited.truncated {
+		self.warn("process %d killed since output exceeded %d bytes", cmd.Process.Pid, cmdConf.MaxOutputBytes)
+		io.WriteString(limited.out, fmt.Sprintf(outputTruncatedMarker, cmdConf.MaxOutputBytes))
+		if self.resp != nil {
+			self.resp.Header().Set(TruncatedHeader, "true")
+		}
+		return nil
+	}
+	switch ctx.Err() {
+	case context.DeadlineExceeded:
+		err = NewServantError(http.StatusGatewayTimeout, "command execution timeout: %d", cmdConf.Timeout)
+	case context.Canceled:
+		self.warn("process %d killed due to client disconnect", cmd.Process.Pid)
+		err = NewServantError(http.StatusBadGateway, "command killed: client disconnected")
+	default:
+		var maxBytesErr *http.MaxBytesError
+		var exitErr *exec.ExitError
+		if errors.As(err, &maxBytesErr) {
+			err = NewServantError(http.StatusRequestEntityTooLarge, "request body too large")
+		} else if errors.As(err, &exitErr) && exitErr.Exited() && cmdConf.IgnoreExitCode {
+			err = nil
+		} else if err != nil {
+			err = NewServantError(http.StatusBadGateway, "execution error: %s", err)
 		}
 	}
 	return
@@ -3,6 +3,21 @@ package server
 import (
 	"testing"
 	"reflect"
+	"servant/conf"
+	"net/http"
+	"time"
+	"bytes"
+	"net/http/httptest"
+	"strings"
+	"context"
+	"os"
+	"fmt"
+	"net/url"
+	"syscall"
+	"os/user"
+	"text/template"
+	"crypto/sha256"
+	"encoding/hex"
 )
 
 func TestGetCmdExecArgs(t *testing.T) {
@@ -19,3 +34,515 @@ func TestGetCmdExecArgs(t *testing.T) {
 		t.Error("args wrong")
 	}
 }
+
+func TestExecCommandTimeout(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	cmdConf := &conf.Command{
+		Lang: "bash",
+		Code: "echo partial; sleep 30 & sleep 30",
+		Timeout: 1,
+	}
+	t0 := time.Now()
+	out := &bytes.Buffer{}
+	err := s.execCommand(cmdConf, out)
+	if time.Since(t0) > 1 * time.Second + 500 * time.Millisecond {
+		t.Errorf("command not killed in time")
+	}
+	if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusGatewayTimeout {
+		t.Errorf("should timeout: %v", err)
+	}
+	if out.String() != "partial\n" {
+		t.Errorf("partial output lost: %q", out.String())
+	}
+}
+
+func TestServeCommandStream(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	resp := httptest.NewRecorder()
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: resp } }
+	s.serveCommand(&conf.Command{
+		Lang: "bash",
+		Code: "echo a; exit 1",
+	})
+	if resp.Code != http.StatusOK || resp.Body.String() != "a\n" || !resp.Flushed {
+		t.Errorf("output should be streamed: %d %q", resp.Code, resp.Body.String())
+	}
+	// the detail of the server error is only logged
+	if resp.Result().Trailer.Get(ServantErrHeader) != "bad gateway" {
+		t.Errorf("error should be in trailer: %q", resp.Result().Trailer.Get(ServantErrHeader))
+	}
+}
+
+func TestExecCommandClientDisconnect(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req.WithContext(ctx) } }
+	time.AfterFunc(200 * time.Millisecond, cancel)
+	t0 := time.Now()
+	err := s.execCommand(&conf.Command{ Lang: "bash", Code: "sleep 30" }, &bytes.Buffer{})
+	if time.Since(t0) > 1 * time.Second {
+		t.Errorf("command not killed in time")
+	}
+	if e, ok := err.(ServantError); !ok || !strings.Contains(e.Message, "client disconnected") {
+		t.Errorf("should be killed by disconnect: %v", err)
+	}
+}
+
+func TestCmdEnv(t *testing.T) {
+	params := func(k string) (string, bool) {
+		if k == "a" {
+			return "A", true
+		}
+		return "", false
+	}
+	env, err := cmdEnv(map[string]string{ "a": "SERVANT_a", "b": "SERVANT_b" }, params)
+	if err != nil {
+		t.Error(err)
+	}
+	last := env[len(env) - 1]
+	if last != "SERVANT_a=A" || len(env) != len(os.Environ()) + 1 {
+		t.Errorf("env wrong: %s", last)
+	}
+	if _, err = cmdEnv(map[string]string{ "a.b": "SERVANT_a" }, params); err == nil {
+		t.Errorf("bad name should be rejected")
+	}
+}
+
+func TestExecCommandStdin(t *testing.T) {
+	cat := &conf.Command{ Lang: "exec", Code: "cat", Stdin: true }
+	config := &conf.Config{ Server: conf.Server{ MaxBodyBytes: 5 } }
+
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: config, req: req, resp: httptest.NewRecorder() } }
+	out := &bytes.Buffer{}
+	if err := s.execCommand(cat, out); err != nil || out.Len() != 0 {
+		t.Errorf("GET without body should read empty stdin: %v", err)
+	}
+
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader("hello"))
+	s.req = req
+	out.Reset()
+	if err := s.execCommand(cat, out); err != nil || out.String() != "hello" {
+		t.Errorf("body should be piped to stdin: %v %q", err, out.String())
+	}
+
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader("hello world"))
+	s.req = req
+	err := s.execCommand(cat, out)
+	if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("too large body should be rejected: %v", err)
+	}
+
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader("hello"))
+	s.req = req
+	out.Reset()
+	if err := s.execCommand(&conf.Command{ Lang: "exec", Code: "cat" }, out); err != nil || out.Len() != 0 {
+		t.Errorf("body should not be piped without stdin: %v", err)
+	}
+}
+
+func TestCommandConcurrencyLimit(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"g": &conf.Commands{
+				Commands: map[string]*conf.Command{
+					"sleep": &conf.Command{ Lang: "exec", Code: "sleep 0.5", MaxConcurrency: 1 },
+				},
+			},
+		},
+	})
+	serve := func() *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/commands/g/sleep", nil)
+		resp := httptest.NewRecorder()
+		NewCommandServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	ch := make(chan int, 1)
+	go func() {
+		ch <- serve().Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if code := serve().Code; code != http.StatusTooManyRequests {
+		t.Errorf("second execution should be rejected: %d", code)
+	}
+	if code := <-ch; code != http.StatusOK {
+		t.Errorf("first execution should ok: %d", code)
+	}
+}
+
+func TestCommandConcurrencyWait(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"g": &conf.Commands{
+				Commands: map[string]*conf.Command{
+					"sleep": &conf.Command{ Lang: "exec", Code: "sleep 0.3", MaxConcurrency: 1, ConcurrencyWait: 1 },
+					"long": &conf.Command{ Lang: "exec", Code: "sleep 1.5", MaxConcurrency: 1, ConcurrencyWait: 1 },
+				},
+			},
+		},
+	})
+	serve := func(ctx context.Context, item string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequestWithContext(ctx, "GET", "/commands/g/" + item, nil)
+		resp := httptest.NewRecorder()
+		NewCommandServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	ch := make(chan int, 1)
+	go func() {
+		ch <- serve(context.Background(), "sleep").Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if code := serve(context.Background(), "sleep").Code; code != http.StatusOK {
+		t.Errorf("waiting execution should proceed once the slot is free: %d", code)
+	}
+	<-ch
+
+	go func() {
+		ch <- serve(context.Background(), "long").Code
+	}()
+	time.Sleep(100 * time.Millisecond)
+	resp := serve(context.Background(), "long")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "1" {
+		t.Errorf("execution should be rejected after the wait: %d %q", resp.Code, resp.Header().Get("Retry-After"))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(100 * time.Millisecond, cancel)
+	t0 := time.Now()
+	if resp = serve(ctx, "long"); resp.Code != http.StatusTooManyRequests || time.Since(t0) > 500 * time.Millisecond {
+		t.Errorf("waiting should end once the client disconnects: %d %s", resp.Code, time.Since(t0))
+	}
+	<-ch
+}
+
+func TestExecCommandParams(t *testing.T) {
+	echo := &conf.Command{ Lang: "exec", Code: "echo ${name} ${greeting}", Params: conf.Params{
+		"name": conf.Param{ Required: true },
+		"greeting": conf.Param{ Default: "hi", HasDefault: true },
+	} }
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: httptest.NewRecorder() } }
+	out := &bytes.Buffer{}
+	err := s.execCommand(echo, out)
+	if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusBadRequest || !strings.Contains(e.Message, "name") {
+		t.Errorf("missing required param should be rejected: %v", err)
+	}
+
+	s.req, _ = http.NewRequest("GET", "/commands/a/b?name=bob", nil)
+	if err := s.execCommand(echo, out); err != nil || out.String() != "bob hi\n" {
+		t.Errorf("default should be substituted: %v %q", err, out.String())
+	}
+}
+
+func TestExecCommandBodyParams(t *testing.T) {
+	cat := &conf.Command{ Lang: "exec", Code: "cat - ${name}", Stdin: true }
+	req, _ := http.NewRequest("POST", "/commands/a/b", strings.NewReader(`{"name":"/dev/null"}`))
+	req.Header.Set("Content-Type", "application/json")
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: httptest.NewRecorder() } }
+	out := &bytes.Buffer{}
+	if err := s.execCommand(cat, out); err != nil || out.String() != `{"name":"/dev/null"}` {
+		t.Errorf("body should be both params and stdin: %v %q", err, out.String())
+	}
+}
+
+func TestServeCommandMethods(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"any": &conf.Command{ Lang: "exec", Code: "echo ok" },
+				"post": &conf.Command{ Lang: "exec", Code: "echo ok", Methods: []string{"POST"} },
+			} },
+		},
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		return resp
+	}
+	if resp := serve("GET", "/commands/c/any"); resp.Code != http.StatusOK {
+		t.Errorf("GET should be allowed by default: %d", resp.Code)
+	}
+	if resp := serve("DELETE", "/commands/c/any"); resp.Code != http.StatusMethodNotAllowed || resp.Header().Get("Allow") != "GET, POST" {
+		t.Errorf("DELETE should not be allowed by default: %d %q", resp.Code, resp.Header().Get("Allow"))
+	}
+	if resp := serve("GET", "/commands/c/post"); resp.Code != http.StatusMethodNotAllowed || resp.Header().Get("Allow") != "POST" {
+		t.Errorf("GET should not be allowed: %d %q", resp.Code, resp.Header().Get("Allow"))
+	}
+	if resp := serve("POST", "/commands/c/post"); resp.Code != http.StatusOK {
+		t.Errorf("POST should be allowed: %d", resp.Code)
+	}
+}
+
+func TestServeCommandVariants(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"item": &conf.Command{ Lang: "exec", Code: "echo read", Methods: []string{"GET"}, Variants: []*conf.Command{
+					&conf.Command{ Lang: "exec", Code: "echo write", Methods: []string{"POST", "PUT"} },
+					&conf.Command{ Lang: "exec", Code: "echo delete", Methods: []string{"DELETE"} },
+				} },
+			} },
+		},
+	})
+	serve := func(method string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(method, "/commands/c/item", nil))
+		return resp
+	}
+	for method, expected := range map[string]string{ "GET": "read\n", "POST": "write\n", "PUT": "write\n", "DELETE": "delete\n" } {
+		if resp := serve(method); resp.Code != http.StatusOK || resp.Body.String() != expected {
+			t.Errorf("%s should run its variant: %d %q", method, resp.Code, resp.Body.String())
+		}
+	}
+	if resp := serve("PATCH"); resp.Code != http.StatusMethodNotAllowed || resp.Header().Get("Allow") != "GET, POST, PUT, DELETE" {
+		t.Errorf("unmapped method should not be allowed: %d %q", resp.Code, resp.Header().Get("Allow"))
+	}
+}
+
+func TestServeCommandContentType(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"json": &conf.Command{ Lang: "bash", Code: `echo '{"a": 1}'`, ContentType: "application/json" },
+				"auto": &conf.Command{ Lang: "bash", Code: "echo '<html><body>hi</body></html>'", ContentType: "auto" },
+			} },
+		},
+	})
+	for item, expected := range map[string]string{ "json": "application/json", "auto": "text/html; charset=utf-8" } {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", "/commands/c/" + item, nil))
+		if got := resp.Header().Get("Content-Type"); resp.Code != http.StatusOK || got != expected {
+			t.Errorf("content type of %s wrong: %d %q", item, resp.Code, got)
+		}
+	}
+}
+
+func TestServeCommandExitCode(t *testing.T) {
+	serve := func(cmdConf *conf.Command) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+		resp := httptest.NewRecorder()
+		s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: resp } }
+		s.serveCommand(cmdConf)
+		return resp
+	}
+	resp := serve(&conf.Command{ Lang: "bash", Code: "echo oops >&2; exit 3", Stderr: "trailer" })
+	if resp.Code != http.StatusBadGateway || resp.Header().Get(ExitCodeHeader) != "3" || resp.Header().Get(StderrHeader) != `oops\n` {
+		t.Errorf("exit code and stderr should be in headers: %d %v", resp.Code, resp.Header())
+	}
+
+	resp = serve(&conf.Command{ Lang: "bash", Code: "echo out; echo err >&2; exit 3", Stderr: "trailer" })
+	trailer := resp.Result().Trailer
+	if resp.Code != http.StatusOK || resp.Body.String() != "out\n" || trailer.Get(ExitCodeHeader) != "3" || trailer.Get(StderrHeader) != `err\n` {
+		t.Errorf("exit code and stderr should be in trailers after output: %d %q %v", resp.Code, resp.Body.String(), trailer)
+	}
+
+	resp = serve(&conf.Command{ Lang: "bash", Code: "echo out; echo err >&2; exit 1", Stderr: "inline", IgnoreExitCode: true })
+	trailer = resp.Result().Trailer
+	if resp.Body.String() != "out\nerr\n" || trailer.Get(ExitCodeHeader) != "1" || trailer.Get(ServantErrHeader) != "" {
+		t.Errorf("ignored exit code should not fail: %q %v", resp.Body.String(), trailer)
+	}
+
+	resp = serve(&conf.Command{ Lang: "bash", Code: "echo err >&2", Stderr: "discard" })
+	if resp.Code != http.StatusOK || resp.Header().Get(ExitCodeHeader) != "0" || resp.Body.Len() != 0 {
+		t.Errorf("stderr should be discarded: %d %q %v", resp.Code, resp.Body.String(), resp.Header())
+	}
+}
+
+func TestServeCommandMaxOutputBytes(t *testing.T) {
+	serve := func(cmdConf *conf.Command) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+		resp := httptest.NewRecorder()
+		s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: resp } }
+		s.serveCommand(cmdConf)
+		return resp
+	}
+	t0 := time.Now()
+	resp := serve(&conf.Command{ Lang: "exec", Code: "yes", MaxOutputBytes: 10 })
+	if time.Since(t0) > 2 * time.Second {
+		t.Errorf("command should be killed at once")
+	}
+	if resp.Code != http.StatusOK || resp.Body.String() != "y\ny\ny\ny\ny\n" + fmt.Sprintf(outputTruncatedMarker, 10) {
+		t.Errorf("output should be truncated: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp.Result().Trailer.Get(TruncatedHeader) != "true" {
+		t.Errorf("truncated trailer should be set: %v", resp.Result().Trailer)
+	}
+
+	resp = serve(&conf.Command{ Lang: "bash", Code: "echo -n 0123456789", MaxOutputBytes: 10 })
+	if resp.Body.String() != "0123456789" || resp.Header().Get(TruncatedHeader) != "" || resp.Result().Trailer.Get(TruncatedHeader) != "" {
+		t.Errorf("output within the limit should not be truncated: %q %v", resp.Body.String(), resp.Result().Trailer)
+	}
+
+	out := &bytes.Buffer{}
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	if err := s.execCommand(&conf.Command{ Lang: "bash", Code: "yes >&2", Stderr: "inline", MaxOutputBytes: 4 }, out); err != nil || out.String() != "y\ny\n" + fmt.Sprintf(outputTruncatedMarker, 4) {
+		t.Errorf("buffered stderr should be truncated too: %v %q", err, out.String())
+	}
+}
+
+func TestExecCommandCwdUmask(t *testing.T) {
+	dir := t.TempDir()
+	serverUmask := syscall.Umask(022)
+	syscall.Umask(serverUmask)
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	out := &bytes.Buffer{}
+	err := s.execCommand(&conf.Command{ Lang: "bash", Code: "pwd; umask; touch f", Cwd: dir, Umask: "027" }, out)
+	if err != nil || out.String() != dir + "\n0027\n" {
+		t.Errorf("command should run in cwd with the umask: %v %q", err, out.String())
+	}
+	if info, err := os.Stat(dir + "/f"); err != nil || info.Mode().Perm() != 0640 {
+		t.Errorf("file should be created with the umask: %v", err)
+	}
+	old := syscall.Umask(serverUmask)
+	if old != serverUmask {
+		t.Errorf("umask of the server should be restored: %o", old)
+	}
+
+	out.Reset()
+	if err := s.execCommand(&conf.Command{ Lang: "exec", Code: "pwd" }, out); err != nil || out.String() != "/\n" {
+		t.Errorf("command should run in / by default: %v %q", err, out.String())
+	}
+}
+
+func TestExecCommandRunAs(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	out := &bytes.Buffer{}
+	err := s.execCommand(&conf.Command{ Lang: "exec", Code: "id -u", User: "nonexistent-servant-user" }, out)
+	if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusInternalServerError {
+		t.Errorf("unknown user should fail with 500: %v", err)
+	}
+
+	err = s.execCommand(&conf.Command{ Lang: "exec", Code: "id -u", User: "nobody" }, out)
+	if os.Geteuid() != 0 {
+		if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusInternalServerError || !strings.Contains(e.Message, "not privileged") {
+			t.Errorf("running as another user without root should fail with 500: %v", err)
+		}
+		return
+	}
+	nobody, _ := user.Lookup("nobody")
+	if nobody == nil {
+		t.Skip("no user nobody")
+	}
+	if err != nil || out.String() != nobody.Uid + "\n" {
+		t.Errorf("command should run as nobody: %v %q", err, out.String())
+	}
+	out.Reset()
+	// the supplementary groups of servant are not inherited
+	expects := map[string]bool{ nobody.Gid: true }
+	groupIds, _ := nobody.GroupIds()
+	for _, g := range groupIds {
+		expects[g] = true
+	}
+	err = s.execCommand(&conf.Command{ Lang: "exec", Code: "id -G", User: "nobody" }, out)
+	groups := map[string]bool{}
+	for _, g := range strings.Fields(out.String()) {
+		groups[g] = true
+	}
+	if err != nil || !reflect.DeepEqual(groups, expects) {
+		t.Errorf("command should run with the groups of nobody: %v %q", err, out.String())
+	}
+}
+
+func TestExecCommandTemplate(t *testing.T) {
+	if q := shellQuote(`it's $HOME`); q != `'it'\''s $HOME'` {
+		t.Errorf("value should be single quoted: %s", q)
+	}
+	cmdConf := &conf.Command{
+		Lang: "bash",
+		Code: `printf '[%s]\n' ${a} ${b}; echo ${c}`,
+		Template: true,
+		Params: conf.Params{ "c": { Raw: true } },
+	}
+	req, _ := http.NewRequest("GET", "/commands/a/b?a=" + url.QueryEscape("x y; rm -rf /") + "&b=" + url.QueryEscape(`'$(id)'`) + "&c=" + url.QueryEscape("$((1+2))"), nil)
+	s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	out := &bytes.Buffer{}
+	if err := s.execCommand(cmdConf, out); err != nil || out.String() != "[x y; rm -rf /]\n['$(id)']\n3\n" {
+		t.Errorf("params should be single words, raw params as is: %v %q", err, out.String())
+	}
+
+	req, _ = http.NewRequest("GET", "/commands/a/b?a=1", nil)
+	s = CommandServer{ Session: &Session{ config: &conf.Config{}, req: req } }
+	err := s.execCommand(cmdConf, out)
+	if e, ok := err.(ServantError); !ok || e.HttpCode != http.StatusBadRequest {
+		t.Errorf("missing params should fail with 400: %v", err)
+	}
+}
+
+func TestServeCommandResponseTemplate(t *testing.T) {
+	tpl := template.Must(template.New("t").Funcs(conf.ResponseFuncs).Parse(
+		`{"output":{{json .Output}},"exit_code":{{.ExitCode}},"name":{{json .Params.name}},"fast":{{lt .Duration 5.0}}}`))
+	serve := func(cmdConf *conf.Command, uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		s := CommandServer{ Session: &Session{ config: &conf.Config{}, req: req, resp: resp } }
+		s.serveCommand(cmdConf)
+		return resp
+	}
+	params := conf.Params{ "name": conf.Param{ Default: "x", HasDefault: true } }
+	resp := serve(&conf.Command{ Lang: "exec", Code: "echo ${name}", Params: params, Response: tpl, ResponseContentType: "application/json" }, "/commands/a/b?name=foo")
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "application/json" ||
+		resp.Body.String() != `{"output":"foo\n","exit_code":0,"name":"foo","fast":true}` {
+		t.Errorf("output should be shaped by the template: %d %v %s", resp.Code, resp.Header(), resp.Body.String())
+	}
+	resp = serve(&conf.Command{ Lang: "bash", Code: "echo oops; exit 2", Params: params, Response: tpl }, "/commands/a/b")
+	if resp.Code != http.StatusBadGateway || resp.Header().Get(ServantErrHeader) == "" ||
+		resp.Body.String() != `{"output":"oops\n","exit_code":2,"name":"x","fast":true}` {
+		t.Errorf("failed execution should be shaped too: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = serve(&conf.Command{ Lang: "exec", Code: "echo ${missing}", Response: tpl }, "/commands/a/b")
+	if resp.Code != http.StatusBadRequest || resp.Body.Len() != 0 {
+		t.Errorf("execution not started should fail as usual: %d %s", resp.Code, resp.Body.String())
+	}
+}
+
+func TestServeCommandUserRules(t *testing.T) {
+	sum := sha256.Sum256([]byte("pass"))
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Commands: map[string]*conf.Commands{
+			"ops": &conf.Commands{ Commands: map[string]*conf.Command{
+				"deploy": &conf.Command{ Lang: "bash", Code: "echo ${env}", Template: true, Params: conf.Params{ "env": conf.Param{ Default: "staging", HasDefault: true } } },
+				"status": &conf.Command{ Lang: "exec", Code: "echo ok" },
+				"drop": &conf.Command{ Lang: "exec", Code: "echo dropped" },
+			} },
+		},
+		Users: map[string]*conf.User{
+			"a": &conf.User{ Password: hex.EncodeToString(sum[:]), Allows: map[string][]string{ "commands": []string{"ops"} },
+				CommandRules: map[string]map[string]conf.Validators{ "ops": {
+					"deploy": conf.Validators{ "env": conf.Validator{ Class: "enum", Values: []string{"staging"} } },
+					"status": nil,
+				} } },
+			"b": &conf.User{ Password: hex.EncodeToString(sum[:]), Allows: map[string][]string{ "commands": []string{"ops"} } },
+		},
+	})
+	serve := func(user, path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.SetBasicAuth(user, "pass")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := serve("a", "/commands/ops/deploy"); resp.Code != http.StatusOK || resp.Body.String() != "staging\n" {
+		t.Errorf("deploy to the default env should be allowed: %d %s", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	if resp := serve("a", "/commands/ops/deploy?env=staging"); resp.Code != http.StatusOK {
+		t.Errorf("deploy to staging should be allowed: %d", resp.Code)
+	}
+	resp := serve("a", "/commands/ops/deploy?env=prod")
+	if resp.Code != http.StatusForbidden || resp.Header().Get(ServantErrHeader) != "param env=prod of command ops.deploy is not allowed for user a" {
+		t.Errorf("deploy to prod should be forbidden: %d %q", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	if resp := serve("a", "/commands/ops/status"); resp.Code != http.StatusOK {
+		t.Errorf("command listed without constraints should be allowed: %d", resp.Code)
+	}
+	resp = serve("a", "/commands/ops/drop")
+	if resp.Code != http.StatusForbidden || resp.Header().Get(ServantErrHeader) != "user a is not allowed to run command ops.drop" {
+		t.Errorf("command not listed should be forbidden: %d %q", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	if resp := serve("b", "/commands/ops/drop"); resp.Code != http.StatusOK {
+		t.Errorf("user without rules should run any command of the group: %d", resp.Code)
+	}
+}
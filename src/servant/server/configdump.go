@@ -0,0 +1,86 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"regexp"
+	"servant/conf"
+)
+
+const ConfigPath = "/config"
+
+// redacted replaces secrets in the config dumped
+const redacted = "[redacted]"
+
+// serveConfig serves the config in effect in json, with secrets redacted, authenticated like resources
+func (self *Session) serveConfig() {
+	if !self.authenticate() {
+		return
+	}
+	if self.req.Method != "GET" && self.req.Method != "HEAD" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not supported method %s", self.req.Method)
+		return
+	}
+	// the config of the session is the one in effect when the request came, reloaded or not
+	buf, err := json.MarshalIndent(redactConfig(self.config), "", "  ")
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "encode config failed: %s", err)
+		return
+	}
+	self.resp.Header().Set("Content-Type", "application/json")
+	if self.req.Method == "GET" {
+		self.resp.Write(append(buf, '\n'))
+	}
+	self.GoodEnd("config served")
+}
+
+// redactConfig returns a copy of the config with keys, secrets, password and token hashes of users
+// and passwords in dsns redacted. Items not redacted are shared with the config.
+func redactConfig(config *conf.Config) *conf.Config {
+	ret := *config
+	ret.Users = make(map[string]*conf.User, len(config.Users))
+	for name, user := range config.Users {
+		u := *user
+		u.Key, u.Secret, u.Password = redactSecret(u.Key), redactSecret(u.Secret), redactSecret(u.Password)
+		u.Tokens = make([]conf.Token, len(user.Tokens))
+		for i, token := range user.Tokens {
+			token.Hash = redactSecret(token.Hash)
+			u.Tokens[i] = token
+		}
+		ret.Users[name] = &u
+	}
+	ret.Databases = make(map[string]*conf.Database, len(config.Databases))
+	for name, database := range config.Databases {
+		d := *database
+		d.Dsn = redactDsn(d.Dsn)
+		ret.Databases[name] = &d
+	}
+	return &ret
+}
+
+func redactSecret(s string) string {
+	if s == "" {
+		return ""
+	}
+	return redacted
+}
+
+// dsnUserRe matches the password of a dsn like user:password@tcp(host)/db of mysql
+var dsnUserRe = regexp.MustCompile(`^([^:@/]*):([^@]*)@`)
+
+// dsnPasswordRe matches the password of a dsn like host=h password=p of postgres
+var dsnPasswordRe = regexp.MustCompile(`(?i)\b(password|pwd)=('[^']*'|[^\s;&]*)`)
+
+// redactDsn redacts the password of a dsn in url, mysql or key=value forms
+func redactDsn(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), "redacted")
+		}
+		u.RawQuery = dsnPasswordRe.ReplaceAllString(u.RawQuery, "${1}=redacted")
+		return u.String()
+	}
+	dsn = dsnUserRe.ReplaceAllString(dsn, "${1}:" + redacted + "@")
+	return dsnPasswordRe.ReplaceAllString(dsn, "${1}=" + redacted)
+}
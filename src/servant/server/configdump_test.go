@@ -0,0 +1,74 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"servant/conf"
+	"strings"
+	"testing"
+)
+
+func TestRedactDsn(t *testing.T) {
+	for dsn, expect := range map[string]string{
+		"root:secret@tcp(127.0.0.1:3306)/test":                 "root:[redacted]@tcp(127.0.0.1:3306)/test",
+		"root@tcp(127.0.0.1:3306)/test":                        "root@tcp(127.0.0.1:3306)/test",
+		"postgres://app:secret@db:5432/app?sslmode=disable":    "postgres://app:redacted@db:5432/app?sslmode=disable",
+		"host=db user=app password=secret dbname=app":          "host=db user=app password=[redacted] dbname=app",
+		"sqlserver://db?database=app&password=secret":          "sqlserver://db?database=app&password=[redacted]",
+		"/var/lib/app.db":                                      "/var/lib/app.db",
+	} {
+		if v := redactDsn(dsn); v != expect {
+			t.Errorf("dsn %s should be redacted as %s: %s", dsn, expect, v)
+		}
+	}
+}
+
+func TestServeConfig(t *testing.T) {
+	config := &conf.Config{
+		Users: map[string]*conf.User{
+			"u": &conf.User{ Key: "k3y", Password: "5e884898", Tokens: []conf.Token{ { Hash: "0123abcd" } } },
+		},
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "mysql", Dsn: "root:secret@tcp(127.0.0.1:3306)/test" },
+		},
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{ "old": &conf.Command{ Code: "echo old" } } },
+		},
+	}
+	s := NewServer(config)
+	serve := func() (*httptest.ResponseRecorder, *conf.Config) {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", ConfigPath, nil))
+		var dumped conf.Config
+		json.Unmarshal(resp.Body.Bytes(), &dumped)
+		return resp, &dumped
+	}
+	resp, dumped := serve()
+	if resp.Code != http.StatusOK || dumped.Commands["c"].Commands["old"] == nil {
+		t.Fatalf("config should be served: %d %s", resp.Code, resp.Body.String())
+	}
+	for _, secret := range []string{ "k3y", "5e884898", "0123abcd", "secret" } {
+		if strings.Contains(resp.Body.String(), secret) {
+			t.Errorf("secret %s should be redacted: %s", secret, resp.Body.String())
+		}
+	}
+	if dumped.Users["u"].Key != redacted || dumped.Databases["db"].Dsn != "root:[redacted]@tcp(127.0.0.1:3306)/test" {
+		t.Errorf("secrets should be marked redacted: %v %s", dumped.Users["u"], dumped.Databases["db"].Dsn)
+	}
+	if config.Users["u"].Key != "k3y" || config.Users["u"].Tokens[0].Hash != "0123abcd" || config.Databases["db"].Dsn == dumped.Databases["db"].Dsn {
+		t.Errorf("config in effect should not be redacted")
+	}
+
+	s.SetConfigLoader(func() (*conf.Config, error) {
+		return &conf.Config{ Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{ "new": &conf.Command{ Code: "echo new" } } },
+		} }, nil
+	})
+	if err := s.Reload(); err != nil {
+		t.Fatalf("reload failed: %s", err)
+	}
+	if _, dumped = serve(); dumped.Commands["c"].Commands["new"] == nil || dumped.Commands["c"].Commands["old"] != nil {
+		t.Errorf("reloaded config should be served: %v", dumped.Commands["c"])
+	}
+}
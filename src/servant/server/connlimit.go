@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net"
+	"sync"
+)
+
+// connLimitListener limits connections open of listeners sharing the slots. At the limit, it either
+// stops accepting until a connection is closed, so new ones wait in the backlog, or refuses them by closing.
+type connLimitListener struct {
+	net.Listener
+	slots     chan struct{} // nil for no limit
+	refuse    bool
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+func newConnLimitListener(ln net.Listener, slots chan struct{}, refuse bool) *connLimitListener {
+	return &connLimitListener{ Listener: ln, slots: slots, refuse: refuse, done: make(chan struct{}) }
+}
+
+func (self *connLimitListener) Accept() (net.Conn, error) {
+	for {
+		if self.slots != nil && !self.refuse {
+			select {
+			case self.slots <- struct{}{}:
+			case <-self.done:
+				return nil, net.ErrClosed
+			}
+		}
+		conn, err := self.Listener.Accept()
+		if err != nil {
+			if self.slots != nil && !self.refuse {
+				<-self.slots
+			}
+			return nil, err
+		}
+		if self.slots != nil && self.refuse {
+			select {
+			case self.slots <- struct{}{}:
+			default:
+				// not warned, a flood would flood the log too
+				logger.Printf("DEBUG (_) [server] connection from %s refused, max connections %d reached", conn.RemoteAddr(), cap(self.slots))
+				conn.Close()
+				continue
+			}
+		}
+		activeConns.add(1)
+		return &limitedConn{ Conn: conn, release: self.release }, nil
+	}
+}
+
+func (self *connLimitListener) release() {
+	activeConns.add(-1)
+	if self.slots != nil {
+		<-self.slots
+	}
+}
+
+func (self *connLimitListener) Close() error {
+	self.closeOnce.Do(func() { close(self.done) })
+	return self.Listener.Close()
+}
+
+// limitedConn frees its slot once closed, the http server may close a connection more than once
+type limitedConn struct {
+	net.Conn
+	release   func()
+	closeOnce sync.Once
+}
+
+func (self *limitedConn) Close() error {
+	err := self.Conn.Close()
+	self.closeOnce.Do(self.release)
+	return err
+}
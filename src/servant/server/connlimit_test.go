@@ -0,0 +1,88 @@
+package server
+
+import (
+	"errors"
+	"io"
+	"net"
+	"servant/conf"
+	"testing"
+	"time"
+)
+
+func TestConnLimitListenerWait(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := setBacklog(inner, 16); err != nil {
+		t.Errorf("backlog should be set: %s", err)
+	}
+	ln := newConnLimitListener(inner, make(chan struct{}, 1), false)
+	defer ln.Close()
+	accepted := make(chan net.Conn, 2)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	for i := 0; i < 2; i++ {
+		client, err := net.Dial("tcp", inner.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer client.Close()
+	}
+	first := <-accepted
+	s := NewServer(&conf.Config{ Server: conf.Server{ MaxConns: 1 } })
+	if report := s.statusReport(); report.Connections != 1 || report.MaxConnections != 1 {
+		t.Errorf("connections should be reported: %d %d", report.Connections, report.MaxConnections)
+	}
+	select {
+	case <-accepted:
+		t.Fatalf("connection beyond the limit should wait")
+	case <-time.After(100 * time.Millisecond):
+	}
+	first.Close()
+	first.Close()
+	select {
+	case conn := <-accepted:
+		conn.Close()
+	case <-time.After(time.Second):
+		t.Fatalf("waiting connection should be accepted once a slot is free")
+	}
+}
+
+func TestConnLimitListenerRefuse(t *testing.T) {
+	inner, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln := newConnLimitListener(inner, make(chan struct{}, 1), true)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+	first, _ := net.Dial("tcp", inner.Addr().String())
+	defer first.Close()
+	second, _ := net.Dial("tcp", inner.Addr().String())
+	defer second.Close()
+	second.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := second.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("connection beyond the limit should be closed: %v", err)
+	}
+	(<-accepted).Close()
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("accept should fail once closed: %v", err)
+	}
+}
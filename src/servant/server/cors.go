@@ -0,0 +1,75 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// headers of servant responses readable by browser scripts
+var corsExposedHeaders = strings.Join([]string{ServantErrHeader, TruncatedHeader, RequestIdHeader, ExitCodeHeader, StderrHeader, CacheHeader}, ", ")
+
+// corsOriginAllowed reports whether the origin matches one of the patterns, which can be
+// exact origins, * for any, or an origin with a * wildcard like https://*.example.com
+func corsOriginAllowed(origin string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if pattern == "*" || pattern == origin {
+			return true
+		}
+		prefix, suffix, ok := strings.Cut(pattern, "*")
+		if ok && len(origin) > len(prefix) + len(suffix) && strings.HasPrefix(origin, prefix) && strings.HasSuffix(origin, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// cors adds the cors headers for an allowed origin, and answers preflight requests.
+// Other origins get no cors headers, so browsers block them. It returns true if the request is done.
+func (self *Session) cors() bool {
+	corsConf := &self.config.Server.CORS
+	origin := self.req.Header.Get("Origin")
+	if len(corsConf.Origins) == 0 || origin == "" {
+		return false
+	}
+	header := self.resp.Header()
+	header.Add("Vary", "Origin")
+	preflight := self.req.Method == "OPTIONS" && self.req.Header.Get("Access-Control-Request-Method") != ""
+	allowed := corsOriginAllowed(origin, corsConf.Origins)
+	if allowed {
+		// credentials are not allowed with *
+		if !corsConf.Credentials && contains(corsConf.Origins, "*") {
+			header.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			header.Set("Access-Control-Allow-Origin", origin)
+		}
+		if corsConf.Credentials {
+			header.Set("Access-Control-Allow-Credentials", "true")
+		}
+	}
+	if !preflight {
+		if allowed {
+			header.Set("Access-Control-Expose-Headers", corsExposedHeaders)
+		}
+		return false
+	}
+	if allowed {
+		header.Set("Access-Control-Allow-Methods", strings.Join(corsConf.Methods, ", "))
+		header.Set("Access-Control-Allow-Headers", strings.Join(corsConf.Headers, ", "))
+		header.Set("Access-Control-Max-Age", strconv.FormatUint(uint64(corsConf.MaxAge), 10))
+		self.GoodEnd("preflight of %s allowed", origin)
+	} else {
+		self.BadEnd("preflight of %s not allowed", origin)
+	}
+	self.resp.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+func contains(xs []string, x string) bool {
+	for _, s := range xs {
+		if s == x {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,70 @@
+package server
+
+import (
+	"testing"
+	"servant/conf"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestCorsOriginAllowed(t *testing.T) {
+	patterns := []string{"https://app.example.com", "https://*.example.org"}
+	for origin, expected := range map[string]bool{
+		"https://app.example.com": true,
+		"https://evil.example.com": false,
+		"https://a.example.org": true,
+		"https://example.org": false,
+		"http://a.example.org": false,
+	} {
+		if corsOriginAllowed(origin, patterns) != expected {
+			t.Errorf("origin %s allowed should be %v", origin, expected)
+		}
+	}
+	if !corsOriginAllowed("http://any", []string{"*"}) {
+		t.Errorf("* should allow any origin")
+	}
+}
+
+func TestServeCors(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Server: conf.Server{ CORS: conf.CORS{
+			Origins: []string{"https://app.example.com"},
+			Methods: []string{"GET", "POST"},
+			Headers: []string{"Authorization"},
+			Credentials: true,
+			MaxAge: 60,
+		} },
+	})
+	request := func(method, origin string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/commands/a/b", nil)
+		req.Header.Set("Origin", origin)
+		if method == "OPTIONS" {
+			req.Header.Set("Access-Control-Request-Method", "POST")
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := request("OPTIONS", "https://app.example.com")
+	h := resp.Header()
+	if resp.Code != http.StatusNoContent || h.Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		h.Get("Access-Control-Allow-Methods") != "GET, POST" || h.Get("Access-Control-Allow-Headers") != "Authorization" ||
+		h.Get("Access-Control-Allow-Credentials") != "true" || h.Get("Access-Control-Max-Age") != "60" {
+		t.Errorf("preflight should be answered before auth: %d %v", resp.Code, h)
+	}
+	resp = request("OPTIONS", "https://evil.example.com")
+	if resp.Code != http.StatusNoContent || resp.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("preflight of other origins should get no cors headers: %v", resp.Header())
+	}
+	// auth is still required for actual requests
+	resp = request("GET", "https://app.example.com")
+	if resp.Code == http.StatusOK || resp.Header().Get("Access-Control-Allow-Origin") != "https://app.example.com" ||
+		resp.Header().Get("Access-Control-Expose-Headers") == "" {
+		t.Errorf("actual request should get cors headers: %d %v", resp.Code, resp.Header())
+	}
+	resp = request("GET", "https://evil.example.com")
+	if resp.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Errorf("other origins should get no cors headers: %v", resp.Header())
+	}
+}
@@ -0,0 +1,117 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"servant/conf"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// description is responded to OPTIONS of an item, so clients know how to invoke it without the config
+type description struct {
+	Resource    string             `json:"resource"`
+	Group       string             `json:"group"`
+	Item        string             `json:"item"`
+	Description string             `json:"description,omitempty"`
+	Methods     []string           `json:"methods"`
+	Params      []paramDescription `json:"params"`
+}
+
+type paramDescription struct {
+	Name        string   `json:"name"`
+	Type        string   `json:"type"`
+	Required    bool     `json:"required"`
+	Default     *string  `json:"default,omitempty"`
+	Description string   `json:"description,omitempty"`
+	Enum        []string `json:"enum,omitempty"`
+	Pattern     string   `json:"pattern,omitempty"`
+}
+
+// describing reports whether the request asks for the description of a command or query.
+// Preflights of cors are OPTIONS too, but are answered before.
+func (self *Session) describing() bool {
+	return self.req.Method == "OPTIONS" && (self.resource == "commands" || self.resource == "databases")
+}
+
+// paramTypes are json schema types of param types
+var paramTypes = map[string]string{
+	"": "string", "string": "string", "enum": "string", "regex": "string",
+	"int": "integer", "float": "number", "bool": "boolean",
+}
+
+// describeParams describes declared and validated params sorted by names
+func describeParams(ps conf.Params, vs conf.Validators) []paramDescription {
+	names := make([]string, 0, len(ps) + len(vs))
+	for name := range ps {
+		names = append(names, name)
+	}
+	for name := range vs {
+		if _, ok := ps[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	ret := make([]paramDescription, 0, len(names))
+	for _, name := range names {
+		p, vd := ps[name], vs[name]
+		d := paramDescription{ Name: name, Type: paramTypes[p.Type], Required: p.Required, Description: p.Description }
+		if p.HasDefault {
+			def := p.Default
+			d.Default = &def
+		}
+		// a validated param without a default is required to pass the validation
+		if _, ok := vs[name]; ok && !p.HasDefault {
+			d.Required = true
+		}
+		switch {
+		case p.Type == "enum":
+			d.Enum = p.Values
+		case p.Type == "regex":
+			d.Pattern = "^(?:" + p.Pattern + ")$"
+		case vd.Class == "enum":
+			d.Enum = vd.Values
+		case vd.Class == "regexp":
+			d.Pattern = "^(?:" + vd.Pattern + ")$"
+		}
+		ret = append(ret, d)
+	}
+	return ret
+}
+
+// serveDescription responds the description of the requested command or query in json
+func (self *Session) serveDescription() {
+	d := description{ Resource: self.resource, Group: self.group, Item: self.item }
+	switch self.resource {
+	case "commands":
+		cmdConf := (CommandServer{ Session: self }).findCommandConfig()
+		if cmdConf == nil {
+			self.ErrorEnd(http.StatusNotFound, "command %s not found", self.req.URL.Path)
+			return
+		}
+		d.Description, d.Methods = cmdConf.Description, commandMethods(cmdConf)
+		d.Params = describeParams(cmdConf.Params, cmdConf.Validators)
+	case "databases":
+		dbConf, queryConf := (DatabaseServer{ Session: self }).findDatabaseQueryConfig()
+		if dbConf == nil || queryConf == nil {
+			self.ErrorEnd(http.StatusNotFound, "query %s not found", self.req.URL.Path)
+			return
+		}
+		d.Description, d.Methods = queryConf.Description, queryMethods(queryConf)
+		d.Params = describeParams(queryConf.Params, queryConf.Validators)
+		if page := queryConf.Paginate; page != nil {
+			limit, offset := strconv.Itoa(page.Limit), "0"
+			d.Params = append(d.Params,
+				paramDescription{ Name: "limit", Type: "integer", Default: &limit, Description: fmt.Sprintf("rows of a page, at most %d", page.MaxLimit) },
+				paramDescription{ Name: "offset", Type: "integer", Default: &offset, Description: "rows skipped before the page" })
+		}
+	}
+	buf, _ := json.Marshal(d)
+	header := self.resp.Header()
+	header.Set("Allow", strings.Join(append(append([]string(nil), d.Methods...), "OPTIONS"), ", "))
+	header.Set("Content-Type", "application/json")
+	self.resp.Write(buf)
+	self.GoodEnd("described")
+}
@@ -0,0 +1,86 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"servant/conf"
+	"testing"
+)
+
+func TestServeDescription(t *testing.T) {
+	sum := sha256.Sum256([]byte("pass"))
+	config := &conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Commands: map[string]*conf.Commands{
+			"ops": &conf.Commands{ Commands: map[string]*conf.Command{
+				"deploy": &conf.Command{ Lang: "bash", Code: "echo ${env} ${tag}", Template: true, Description: "deploys a tag",
+					Methods: []string{"POST"},
+					Params: conf.Params{
+						"tag": conf.Param{ Required: true, Description: "git tag" },
+						"env": conf.Param{ Default: "staging", HasDefault: true },
+					},
+					Validators: conf.Validators{
+						"env": conf.Validator{ Class: "enum", Values: []string{"staging", "prod"} },
+						"dry": conf.Validator{ Class: "regexp", Pattern: "^(0|1)$" },
+					} },
+			} },
+		},
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Queries: map[string]*conf.Query{
+				"insert": &conf.Query{ Sqls: []string{"insert into t values (${v})"}, Write: true },
+			} },
+		},
+		Users: map[string]*conf.User{
+			"u": &conf.User{ Password: hex.EncodeToString(sum[:]) },
+		},
+	}
+	s := NewServer(config)
+	serve := func(path string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("OPTIONS", path, nil)
+		req.SetBasicAuth("u", "pass")
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := serve("/commands/ops/deploy")
+	var d description
+	if err := json.Unmarshal(resp.Body.Bytes(), &d); resp.Code != http.StatusOK || err != nil {
+		t.Fatalf("description should be served without permission of the command: %d %s", resp.Code, resp.Body.String())
+	}
+	staging := "staging"
+	expected := description{
+		Resource: "commands", Group: "ops", Item: "deploy", Description: "deploys a tag", Methods: []string{"POST"},
+		Params: []paramDescription{
+			{ Name: "dry", Type: "string", Required: true, Pattern: "^(?:^(0|1)$)$" },
+			{ Name: "env", Type: "string", Default: &staging, Enum: []string{"staging", "prod"} },
+			{ Name: "tag", Type: "string", Required: true, Description: "git tag" },
+		},
+	}
+	if !reflect.DeepEqual(d, expected) {
+		t.Errorf("description wrong: %s", resp.Body.String())
+	}
+	if allow := resp.Header().Get("Allow"); allow != "POST, OPTIONS" {
+		t.Errorf("allow wrong: %s", allow)
+	}
+	resp = serve("/databases/db/insert")
+	if err := json.Unmarshal(resp.Body.Bytes(), &d); err != nil || !reflect.DeepEqual(d.Methods, conf.DefaultTransactionMethods) || len(d.Params) != 0 {
+		t.Errorf("query description wrong: %s", resp.Body.String())
+	}
+	if resp = serve("/commands/ops/none"); resp.Code != http.StatusNotFound {
+		t.Errorf("unknown command should not be found: %d", resp.Code)
+	}
+	req := httptest.NewRequest("OPTIONS", "/commands/ops/deploy", nil)
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("description should require authentication: %d", resp.Code)
+	}
+	config.Server.Describe.Permission = true
+	if resp = serve("/commands/ops/deploy"); resp.Code != http.StatusForbidden {
+		t.Errorf("description should require the permission if configured: %d", resp.Code)
+	}
+}
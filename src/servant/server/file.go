@@ -4,7 +4,6 @@ import (
 	"net/http"
 	"regexp"
 	"servant/conf"
-	"path"
 	"strings"
 	"os"
 	"io"
@@ -12,6 +11,9 @@ import (
 	"errors"
 	"strconv"
 	"path/filepath"
+	"encoding/json"
+	"time"
+	"mime"
 )
 
 type FileServer struct {
@@ -24,21 +26,30 @@ func NewFileServer(sess *Session) Handler {
 	}
 }
 
-func (self FileServer) findDirConfig() (*conf.Dir, string) {
+func (self FileServer) findDirConfig() *conf.Dir {
 	filesConf, ok := self.config.Files[self.group]
 	if !ok {
-		return nil, ""
+		return nil
 	}
 	dirConf, ok := filesConf.Dirs[self.item]
 	if !ok {
-		return nil, ""
+		return nil
 	}
-	return dirConf, self.tail
+	return dirConf
+}
+
+// dirMethods returns the methods allowed by the dir, HEAD is allowed along with GET
+func dirMethods(dirConf *conf.Dir) []string {
+	ret := dirConf.Allows
+	if contains(ret, "GET") && !contains(ret, "HEAD") {
+		ret = append(append(make([]string, 0, len(ret) + 1), ret...), "HEAD")
+	}
+	return ret
 }
 
 func checkDirAllow(dirConf *conf.Dir, relPath string, method string) error {
 	ok := false
-	for _, allowed := range(dirConf.Allows) {
+	for _, allowed := range(dirMethods(dirConf)) {
 		if allowed == method {
 			ok = true
 			break
@@ -72,87 +83,206 @@ func (self FileServer) openFileError(err error, method, filePath  string) {
 }
 
 func (self FileServer) serveGet(filePath string) {
+	self.serveRead("GET", filePath)
+}
+
+// serveRead serves GET and HEAD alike, HEAD gets the same headers without the body
+func (self FileServer) serveRead(method, filePath string) {
 	file, err := os.Open(filePath)
 	if err != nil {
-		self.openFileError(err, "GET", filePath)
+		self.openFileError(err, method, filePath)
 		return
 	}
 	defer file.Close()
 	info, err := file.Stat()
-	if err != nil || info.IsDir() {
-		self.openFileError(err, "GET", filePath)
+	if err == nil && info.IsDir() && self.findDirConfig().AllowList {
+		self.serveList(filePath)
 		return
 	}
-	rangeStr := self.req.Header.Get("Range")
-	ranges, err := parseRange(rangeStr, info.Size())
-	if err != nil || len(ranges) > 1 {
-		self.ErrorEnd(http.StatusBadRequest, "bad range format or too many ranges(%s) %v", rangeStr, err)
+	if err != nil || info.IsDir() {
+		self.openFileError(err, method, filePath)
 		return
 	}
-	length := info.Size()
-	if ranges != nil && len(ranges) == 1 {
-		length = ranges[0].length
-		if _, err = file.Seek(ranges[0].start, os.SEEK_SET); err != nil {
-			self.openFileError(err, "GET", filePath)
+	if method == "HEAD" {
+		self.resp.Header().Add("X-Servant-File-Size", strconv.FormatInt(info.Size(), 10))
+		self.resp.Header().Add("X-Servant-File-Mtime", info.ModTime().String())
+		self.resp.Header().Add("X-Servant-File-Mode", info.Mode().String())
+	}
+	if contentType, ok := self.findDirConfig().ContentTypes[strings.ToLower(filepath.Ext(filePath))]; ok {
+		self.resp.Header().Set("Content-Type", contentType)
+	}
+	if self.req.URL.Query().Get("download") == "1" {
+		self.resp.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{ "filename": info.Name() }))
+	}
+	dirConf := self.findDirConfig()
+	// the strong etag and the checksum are the same sha256, hashed once
+	sum := ""
+	if dirConf.StrongEtag || dirConf.Checksum {
+		if sum, err = fileSha256(file); err != nil {
+			self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
 			return
 		}
-		self.resp.Header().Set("Content-Range", ranges[0].contentRange(info.Size()))
 	}
-	_, err = io.CopyN(self.resp, file, length)
-	if err != nil {
-		self.BadEnd("io error: %s", err)
-	} else {
-		self.GoodEnd("GET done")
+	if dirConf.Checksum {
+		self.resp.Header().Set(ChecksumHeader, sum)
 	}
+	self.resp.Header().Set("ETag", fileEtag(info, sum))
+	// ServeContent handles Range, If-Range, If-None-Match, If-Modified-Since etc.
+	// Without the Content-Type set above, it uses mime.TypeByExtension, then sniffs the first 512 bytes.
+	// for HEAD, ServeContent writes Content-Length and the other headers but no body
+	http.ServeContent(deadlineWriter{ self.resp, self.Session }, self.req, info.Name(), info.ModTime(), file)
+	self.GoodEnd("%s done", method)
 }
 
-func (self FileServer) serveHead(filePath string) {
-	file, err := os.Open(filePath)
+// fileEtag makes a strong etag from the sha256 of the content if it is hashed, or a weak one from size and mtime
+func fileEtag(info os.FileInfo, sum string) string {
+	if sum == "" {
+		return fmt.Sprintf(`W/"%x-%x"`, info.Size(), info.ModTime().UnixNano())
+	}
+	return `"` + sum + `"`
+}
+
+type dirEntry struct {
+	Name  string    `json:"name"`
+	Size  int64     `json:"size"`
+	Mode  string    `json:"mode"`
+	Mtime time.Time `json:"mtime"`
+}
+
+// serveList responds entries of the directory sorted by name, as json array or newline separated names if format=text
+func (self FileServer) serveList(dirPath string) {
+	entries, err := os.ReadDir(dirPath)
 	if err != nil {
-		self.openFileError(err, "HEAD", filePath)
+		self.openFileError(err, "GET", dirPath)
 		return
 	}
-	defer file.Close()
-	info, err := file.Stat()
-	if err != nil || info.IsDir() {
-		self.openFileError(err, "HEAD", filePath)
+	list := make([]dirEntry, 0, len(entries))
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil {
+			// removed since read
+			continue
+		}
+		list = append(list, dirEntry{ Name: entry.Name(), Size: info.Size(), Mode: info.Mode().String(), Mtime: info.ModTime() })
+	}
+	if self.req.URL.Query().Get("format") == "text" {
+		self.resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		for _, entry := range list {
+			io.WriteString(self.resp, entry.Name + "\n")
+		}
+		self.GoodEnd("list done")
 		return
 	}
-	self.resp.Header().Add("X-Servant-File-Size", strconv.FormatInt(info.Size(), 10))
-	self.resp.Header().Add("X-Servant-File-Mtime", info.ModTime().String())
-	self.resp.Header().Add("X-Servant-File-Mode", info.Mode().String())
-	self.resp.Header().Add("Connection", "close")
-	self.GoodEnd("HEAD done")
-}
-
-func (self FileServer) servePost(filePath string) {
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0664)
+	buf, err := json.Marshal(list)
 	if err != nil {
-		self.openFileError(err, "POST", filePath)
+		self.ErrorEnd(http.StatusInternalServerError, "json marshal failed: %s", err)
 		return
 	}
-	defer file.Close()
-	_, err = io.Copy(file, self.req.Body)
-	if err != nil {
-		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
-	} else {
-		self.GoodEnd("POST done")
+	self.resp.Header().Set("Content-Type", "application/json")
+	self.resp.Write(buf)
+	self.GoodEnd("list done")
+}
+
+// serveHead also tells the offset of an upload in progress to the file, which may not exist yet
+func (self FileServer) serveHead(filePath string) {
+	if offset, ok := self.uploadOffset(filePath); ok {
+		self.resp.Header().Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+		if _, err := os.Stat(filePath); os.IsNotExist(err) {
+			self.resp.WriteHeader(http.StatusNoContent)
+			self.GoodEnd("upload offset served")
+			return
+		}
+	}
+	self.serveRead("HEAD", filePath)
+}
+
+// writable rejects writes to a dir not writable with 403
+func (self FileServer) writable() bool {
+	if !self.findDirConfig().Writable {
+		self.ErrorEnd(http.StatusForbidden, "dir %s is not writable", self.item)
+		return false
 	}
+	return true
+}
+
+func (self FileServer) servePost(filePath string) {
+	self.serveWrite("POST", filePath, true)
 }
 
 func (self FileServer) servePut(filePath string) {
-	file, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0664)
-	if err != nil {
-		self.openFileError(err, "PUT", filePath)
+	if self.req.Header.Get("Content-Range") != "" {
+		self.serveUpload(filePath)
 		return
 	}
-	defer file.Close()
-	_, err = io.Copy(file, self.req.Body)
+	self.serveWrite("PUT", filePath, false)
+}
+
+// serveWrite writes the body into a temp file in the same directory, then moves it into place,
+// so readers never see partial files. exclusive refuses to replace an existing file.
+// Checksums in the request are verified before the file is moved.
+func (self FileServer) serveWrite(method, filePath string, exclusive bool) {
+	sums, perr := requestChecksums(self.req)
+	if perr != nil {
+		self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
+		return
+	}
+	var body io.Reader = self.req.Body
+	if maxSize := self.findDirConfig().MaxSize; maxSize > 0 {
+		if self.req.ContentLength > maxSize {
+			self.ErrorEnd(http.StatusRequestEntityTooLarge, "file size %d exceeds limit %d", self.req.ContentLength, maxSize)
+			return
+		}
+		body = http.MaxBytesReader(self.resp, self.req.Body, maxSize)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filePath), "." + filepath.Base(filePath) + ".tmp")
 	if err != nil {
+		self.openFileError(err, method, filePath)
+		return
+	}
+	defer os.Remove(tmp.Name())
+	_, err = io.Copy(sums.tee(tmp), body)
+	if err == nil {
+		err = tmp.Close()
+	} else {
+		tmp.Close()
+	}
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		self.ErrorEnd(http.StatusRequestEntityTooLarge, "file size exceeds limit %d", maxBytesErr.Limit)
+		return
+	} else if err != nil {
 		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	}
+	if err = sums.verify(); err != nil {
+		self.ErrorEnd(http.StatusUnprocessableEntity, "upload of %s corrupted: %s", filePath, err)
+		return
+	}
+	// CreateTemp makes the file 0600
+	if err = os.Chmod(tmp.Name(), 0664); err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	}
+	status := http.StatusCreated
+	if exclusive {
+		// link fails if the target exists, the temp file is removed by the defer
+		err = os.Link(tmp.Name(), filePath)
+		if os.IsExist(err) {
+			self.ErrorEnd(http.StatusConflict, "file %s already exists", filePath)
+			return
+		}
 	} else {
-		self.GoodEnd("PUT done")
+		if _, statErr := os.Stat(filePath); statErr == nil {
+			status = http.StatusNoContent
+		}
+		err = os.Rename(tmp.Name(), filePath)
+	}
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "move file %s into place failed: %s", filePath, err)
+		return
 	}
+	self.resp.WriteHeader(status)
+	self.GoodEnd("%s done", method)
 }
 
 func (self FileServer) serveDelete(filePath string) {
@@ -172,17 +302,40 @@ func (self FileServer) serve() {
 	method := self.req.Method
 	urlPath := self.req.URL.Path
 
-	dirConf, relPath := self.findDirConfig()
+	dirConf := self.findDirConfig()
 	if dirConf == nil {
 		self.ErrorEnd(http.StatusNotFound, "dir of %s not found", urlPath)
 		return
 	}
-	err := checkDirAllow(dirConf, relPath, method)
+	// the segments after the dir item map to subdirectories of the root
+	segments, err := self.tailSegments()
 	if err != nil {
-		self.ErrorEnd(http.StatusForbidden, err.Error())
+		self.ErrorEnd(http.StatusForbidden, "bad path %s: %s", urlPath, err)
+		return
+	}
+	relPath := "/" + strings.Join(segments, "/")
+	// the root itself can only be listed
+	if len(segments) == 0 && !((method == "GET" || method == "HEAD") && dirConf.AllowList) {
+		self.ErrorEnd(http.StatusForbidden, "attempt to %s the root", method)
+		return
+	}
+	// writes to a dir not writable are forbidden, before the methods allowed are told
+	if (method == "POST" || method == "PUT") && !self.writable() {
+		return
+	}
+	if !self.methodAllowed(dirMethods(dirConf)) {
+		return
+	}
+	err = checkDirAllow(dirConf, relPath, method)
+	if err != nil {
+		self.ErrorEnd(http.StatusForbidden, "%s", err.Error())
+		return
+	}
+	params, perr := self.declaredParams(dirConf.Params)
+	if perr != nil {
+		self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
 		return
 	}
-	params := requestParams(self.req)
 	if !ValidateParams(dirConf.Validators, params) {
 		self.ErrorEnd(http.StatusBadRequest, "validate params failed")
 		return
@@ -193,14 +346,100 @@ func (self FileServer) serve() {
 		self.ErrorEnd(http.StatusBadRequest, "some params missing")
 		return
 	}
-	filePath := path.Clean(filepath.Join(rootDir, relPath))
-	if ! strings.HasPrefix(filePath, path.Clean(rootDir) + "/") {
-		self.ErrorEnd(http.StatusForbidden, "attempt to %s out of root: %s", method, relPath)
+	filePath := filepath.Clean(rootDir)
+	if len(segments) > 0 {
+		filePath, err = resolveFilePath(rootDir, segments, dirConf.Symlinks)
+	}
+	if err == nil {
+		err = checkFileType(filePath)
+	}
+	if err != nil {
+		self.ErrorEnd(http.StatusForbidden, "attempt to %s %s: %s", method, relPath, err)
 		return
 	}
+	self.debug("resolved path: %s", filePath)
 	self.funcByMethod(method)(filePath)
 }
 
+// resolveFilePath joins the segments to the root, and makes sure the result is inside the root.
+// Symlinks under the root are refused by default, followed if resolving inside the root by "inside",
+// or followed anywhere by "follow". The root itself may be a symlink.
+func resolveFilePath(rootDir string, segments []string, symlinks string) (string, error) {
+	root := filepath.Clean(rootDir)
+	filePath := filepath.Join(append([]string{root}, segments...)...)
+	if !isInDir(filePath, root) {
+		return "", fmt.Errorf("out of root")
+	}
+	if symlinks == "follow" {
+		return filePath, nil
+	}
+	realRoot, err := filepath.EvalSymlinks(root)
+	if err != nil {
+		return "", err
+	}
+	realPath, err := evalSymlinksOfExisting(filePath)
+	if err != nil {
+		return "", err
+	}
+	if symlinks == "inside" {
+		if !isInDir(realPath, realRoot) {
+			return "", fmt.Errorf("symlink out of root")
+		}
+		return filePath, nil
+	}
+	rel, _ := filepath.Rel(root, filePath)
+	if realPath != filepath.Join(realRoot, rel) {
+		return "", fmt.Errorf("symlink refused")
+	}
+	return filePath, nil
+}
+
+// checkFileType refuses files other than regular files and directories, e.g. reading a fifo blocks forever,
+// and devices or sockets are not files to be served. Files not existing yet are left to the methods.
+func checkFileType(filePath string) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return nil
+	}
+	mode := info.Mode()
+	var kind string
+	switch {
+	case mode.IsRegular() || mode.IsDir():
+		return nil
+	case mode & os.ModeNamedPipe != 0:
+		kind = "fifo"
+	case mode & os.ModeSocket != 0:
+		kind = "socket"
+	case mode & os.ModeDevice != 0:
+		kind = "device"
+	default:
+		kind = "special file"
+	}
+	return fmt.Errorf("%s is a %s, not a regular file", filepath.Base(filePath), kind)
+}
+
+// isInDir reports whether the path is under the dir, both should be cleaned
+func isInDir(p, dir string) bool {
+	rel, err := filepath.Rel(dir, p)
+	if err != nil {
+		return false
+	}
+	return rel != "." && rel != ".." && !strings.HasPrefix(rel, "../") && !filepath.IsAbs(rel)
+}
+
+// evalSymlinksOfExisting evaluates symlinks of the path, or of its parent if the path not exists yet
+func evalSymlinksOfExisting(p string) (string, error) {
+	realPath, err := filepath.EvalSymlinks(p)
+	if os.IsNotExist(err) {
+		realDir, err := filepath.EvalSymlinks(filepath.Dir(p))
+		if err != nil {
+			return "", err
+		}
+		return filepath.Join(realDir, filepath.Base(p)), nil
+	}
+	return realPath, err
+}
+
 func (self FileServer) funcByMethod(method string) func(string) {
 	switch method {
 	case "HEAD":
@@ -216,71 +455,3 @@ func (self FileServer) funcByMethod(method string) func(string) {
 	}
 	return self.serveUnknown
 }
-
-// copied from go source
-// httpRange specifies the byte range to be sent to the client.
-type httpRange struct {
-	start, length int64
-}
-
-func (r httpRange) contentRange(size int64) string {
-	return fmt.Sprintf("bytes %d-%d/%d", r.start, r.start+r.length-1, size)
-}
-// parseRange parses a Range header string as per RFC 2616.
-func parseRange(s string, size int64) ([]httpRange, error) {
-	if s == "" {
-		return nil, nil // header not present
-	}
-	const b = "bytes="
-	var badRange = errors.New("invalid range")
-	if !strings.HasPrefix(s, b) {
-		return nil, badRange
-	}
-	ranges := make([]httpRange, 0, 1)
-	for _, ra := range strings.Split(s[len(b):], ",") {
-		ra = strings.TrimSpace(ra)
-		if ra == "" {
-			continue
-		}
-		i := strings.Index(ra, "-")
-		if i < 0 {
-			return nil, badRange
-		}
-		start, end := strings.TrimSpace(ra[:i]), strings.TrimSpace(ra[i+1:])
-		var r httpRange
-		if start == "" {
-			// If no start is specified, end specifies the
-			// range start relative to the end of the file.
-			i, err := strconv.ParseInt(end, 10, 64)
-			if err != nil {
-				return nil, badRange
-			}
-			if i > size {
-				i = size
-			}
-			r.start = size - i
-			r.length = size - r.start
-		} else {
-			i, err := strconv.ParseInt(start, 10, 64)
-			if err != nil || i >= size || i < 0 {
-				return nil, badRange
-			}
-			r.start = i
-			if end == "" {
-				// If no end is specified, range extends to end of the file.
-				r.length = size - r.start
-			} else {
-				i, err := strconv.ParseInt(end, 10, 64)
-				if err != nil || r.start > i {
-					return nil, badRange
-				}
-				if i >= size {
-					i = size - 1
-				}
-				r.length = i - r.start + 1
-			}
-		}
-		ranges = append(ranges, r)
-	}
-	return ranges, nil
-}
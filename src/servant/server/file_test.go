@@ -4,6 +4,17 @@ import (
 	"testing"
 	"servant/conf"
 	"reflect"
+	"path/filepath"
+	"os"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"encoding/json"
+	"fmt"
+	"crypto/sha256"
+	"net"
+	"syscall"
+	"time"
 )
 
 func TestCheckDirAllow(t *testing.T) {
@@ -26,8 +37,8 @@ func TestCheckDirAllow(t *testing.T) {
 	if checkDirAllow(&dirConf, "aaa", "DELETE") == nil {
 		t.Errorf("DELETE should be denied")
 	}
-	if checkDirAllow(&dirConf, "", "HEAD") == nil {
-		t.Errorf("HEAD should be denied")
+	if checkDirAllow(&dirConf, "", "HEAD") != nil {
+		t.Errorf("HEAD should be allowed along with GET")
 	}
 	dirConf = conf.Dir {
 		Allows: []string {
@@ -63,44 +74,381 @@ func TestCheckDirAllow(t *testing.T) {
 	}
 }
 
-func TestParseRange(t *testing.T) {
-	rgs, err := parseRange("", 1)
-	if err != nil || rgs != nil {
+func TestFuncByMethod(t *testing.T) {
+	s := FileServer{}
+	if reflect.ValueOf(s.funcByMethod("XXX")).Pointer() != reflect.ValueOf(s.serveUnknown).Pointer() {
 		t.Fail()
 	}
-	rgs, err = parseRange("111", 1)
-	if err == nil || rgs != nil {
+	if reflect.ValueOf(s.funcByMethod("GET")).Pointer() != reflect.ValueOf(s.serveGet).Pointer() {
 		t.Fail()
 	}
-	rgs, err = parseRange("bytes=0-10", 20)
-	if len(rgs)!=1 || rgs[0].start != 0 || rgs[0].length != 11 {
-		t.Fail()
+}
+
+func TestResolveFilePath(t *testing.T) {
+	root, _ := filepath.EvalSymlinks(t.TempDir())
+	outside := t.TempDir()
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("x"), 0644)
+	os.Symlink(outside, filepath.Join(root, "out"))
+	os.Symlink(filepath.Join(root, "sub"), filepath.Join(root, "in"))
+
+	if p, err := resolveFilePath(root, []string{"sub", "a.txt"}, "inside"); err != nil || p != root + "/sub/a.txt" {
+		t.Errorf("path in root should be ok: %s %v", p, err)
+	}
+	if p, err := resolveFilePath(root, []string{"in", "a.txt"}, "inside"); err != nil || p != root + "/in/a.txt" {
+		t.Errorf("symlink in root should be ok: %s %v", p, err)
+	}
+	if _, err := resolveFilePath(root, []string{"..", "etc", "passwd"}, "inside"); err == nil {
+		t.Errorf("parent dir should be refused")
+	}
+	if _, err := resolveFilePath(root, []string{"sub", "..", ".."}, "inside"); err == nil {
+		t.Errorf("parent dir should be refused")
 	}
+	if _, err := resolveFilePath(root, []string{}, "inside"); err == nil {
+		t.Errorf("root itself should be refused")
+	}
+	// absolute paths are joined under the root
+	if p, err := resolveFilePath(root, []string{"/etc/passwd"}, "follow"); err != nil || p != root + "/etc/passwd" {
+		t.Errorf("absolute path should be under root: %s %v", p, err)
+	}
+	if _, err := resolveFilePath(root, []string{"out", "secret"}, "inside"); err == nil {
+		t.Errorf("symlink out of root should be refused")
+	}
+	if _, err := resolveFilePath(root, []string{"out", "new"}, "inside"); err == nil {
+		t.Errorf("new file in symlink out of root should be refused")
+	}
+	if _, err := resolveFilePath(root, []string{"out", "secret"}, "follow"); err != nil {
+		t.Errorf("symlink out of root should be followed: %v", err)
+	}
+	if p, err := resolveFilePath(root, []string{"sub", "a.txt"}, "refuse"); err != nil || p != root + "/sub/a.txt" {
+		t.Errorf("path without symlinks should be ok: %s %v", p, err)
+	}
+	if _, err := resolveFilePath(root, []string{"in", "a.txt"}, "refuse"); err == nil {
+		t.Errorf("symlink in root should be refused")
+	}
+	if _, err := resolveFilePath(root, []string{"out", "secret"}, "refuse"); err == nil {
+		t.Errorf("symlink out of root should be refused")
+	}
+	// a root through a symlink is of the config
+	if p, err := resolveFilePath(filepath.Join(root, "in"), []string{"a.txt"}, "refuse"); err != nil || p != root + "/in/a.txt" {
+		t.Errorf("symlink root should be ok: %s %v", p, err)
+	}
+}
 
-	rgs, err = parseRange("bytes=-10", 20)
-	if len(rgs)!=1 || rgs[0].start != 10 || rgs[0].length != 10 {
-		t.Fail()
+func TestServeFileTraversal(t *testing.T) {
+	root := t.TempDir()
+	config := &conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"i": &conf.Dir{ Root: root, Allows: []string{"GET"} },
+			} },
+		},
+	}
+	server := NewServer(config)
+	for _, uri := range []string{"/files/g/i/../../etc/passwd", "/files/g/i/%2e%2e/%2e%2e/etc/passwd", "/files/g/i/a%2F..%2F..%2Fb"} {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		if resp.Code != http.StatusForbidden {
+			t.Errorf("%s should be forbidden: %d", uri, resp.Code)
+		}
 	}
+}
 
-	rgs, err = parseRange("bytes=1-", 20)
-	if len(rgs)!=1 || rgs[0].start != 1 || rgs[0].length != 19 {
-		t.Fail()
+func TestServeFileTypes(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	os.WriteFile(filepath.Join(root, "file"), []byte("x"), 0644)
+	os.WriteFile(filepath.Join(outside, "secret"), []byte("s"), 0644)
+	os.Mkdir(filepath.Join(root, "dir"), 0755)
+	os.Symlink("file", filepath.Join(root, "link"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(root, "outlink"))
+	os.Symlink("/dev/null", filepath.Join(root, "device"))
+	if err := syscall.Mkfifo(filepath.Join(root, "fifo"), 0644); err != nil {
+		t.Fatalf("mkfifo failed: %s", err)
+	}
+	ln, err := net.Listen("unix", filepath.Join(root, "socket"))
+	if err != nil {
+		t.Fatalf("listen failed: %s", err)
+	}
+	defer ln.Close()
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"refuse": &conf.Dir{ Root: root, Allows: []string{"GET", "PUT", "DELETE"}, Writable: true, AllowList: true },
+				"inside": &conf.Dir{ Root: root, Allows: []string{"GET"}, Symlinks: "inside" },
+				"follow": &conf.Dir{ Root: root, Allows: []string{"GET"}, Symlinks: "follow" },
+			} },
+		},
+	})
+	serve := func(method, uri string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		done := make(chan bool)
+		go func() {
+			server.ServeHTTP(resp, httptest.NewRequest(method, uri, strings.NewReader("y")))
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(3 * time.Second):
+			t.Fatalf("%s %s hangs", method, uri)
+		}
+		return resp
+	}
+	for _, c := range []struct{ method, uri string; code int }{
+		{ "GET", "/files/g/refuse/file", http.StatusOK },
+		{ "GET", "/files/g/refuse/dir", http.StatusOK },
+		{ "GET", "/files/g/refuse/link", http.StatusForbidden },
+		{ "GET", "/files/g/inside/link", http.StatusOK },
+		{ "GET", "/files/g/inside/outlink", http.StatusForbidden },
+		{ "GET", "/files/g/follow/outlink", http.StatusOK },
+		{ "GET", "/files/g/refuse/fifo", http.StatusForbidden },
+		{ "PUT", "/files/g/refuse/fifo", http.StatusForbidden },
+		{ "DELETE", "/files/g/refuse/fifo", http.StatusForbidden },
+		{ "GET", "/files/g/refuse/socket", http.StatusForbidden },
+		{ "GET", "/files/g/follow/device", http.StatusForbidden },
+	} {
+		if resp := serve(c.method, c.uri); resp.Code != c.code {
+			t.Errorf("%s %s should be %d: %d %s", c.method, c.uri, c.code, resp.Code, resp.Header().Get(ServantErrHeader))
+		}
+	}
+	if resp := serve("GET", "/files/g/refuse/fifo"); resp.Header().Get(ServantErrHeader) != "attempt to GET /fifo: fifo is a fifo, not a regular file" {
+		t.Errorf("refused special file should be told: %s", resp.Header().Get(ServantErrHeader))
 	}
 }
 
-func TestContentRange(t *testing.T) {
-	r := httpRange{ 2, 3 }.contentRange(5)
-	if r != "bytes 2-4/5" {
-		t.Fail()
+func TestServeGetRange(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "test.txt"), []byte("0123456789"), 0644)
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"i": &conf.Dir{ Root: root, Allows: []string{"GET"} },
+			} },
+		},
+	})
+	get := func(rangeStr string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", "/files/g/i/test.txt", nil)
+		if rangeStr != "" {
+			req.Header.Set("Range", rangeStr)
+		}
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := get("")
+	if resp.Code != http.StatusOK || resp.Body.String() != "0123456789" || resp.Header().Get("Accept-Ranges") != "bytes" {
+		t.Errorf("full get wrong: %d %s", resp.Code, resp.Body.String())
+	}
+	resp = get("bytes=2-4")
+	if resp.Code != http.StatusPartialContent || resp.Body.String() != "234" || resp.Header().Get("Content-Range") != "bytes 2-4/10" {
+		t.Errorf("range get wrong: %d %s %s", resp.Code, resp.Body.String(), resp.Header().Get("Content-Range"))
+	}
+	resp = get("bytes=x-y")
+	if resp.Code != http.StatusRequestedRangeNotSatisfiable {
+		t.Errorf("malformed range should be 416: %d", resp.Code)
 	}
 }
 
-func TestFuncByMethod(t *testing.T) {
-	s := FileServer{}
-	if reflect.ValueOf(s.funcByMethod("XXX")).Pointer() != reflect.ValueOf(s.serveUnknown).Pointer() {
-		t.Fail()
+func TestServeWrite(t *testing.T) {
+	root := t.TempDir()
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"rw": &conf.Dir{ Root: root, Allows: []string{"GET", "POST", "PUT"}, Writable: true, MaxSize: 5 },
+				"ro": &conf.Dir{ Root: root, Allows: []string{"GET"} },
+				"locked": &conf.Dir{ Root: root, Allows: []string{"GET", "PUT"}, Writable: false },
+			} },
+		},
+	})
+	write := func(method, uri, body string) int {
+		req, _ := http.NewRequest(method, uri, strings.NewReader(body))
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		return resp.Code
 	}
-	if reflect.ValueOf(s.funcByMethod("GET")).Pointer() != reflect.ValueOf(s.serveGet).Pointer() {
-		t.Fail()
+	content := func() string {
+		data, _ := os.ReadFile(filepath.Join(root, "a.txt"))
+		return string(data)
+	}
+	if code := write("PUT", "/files/g/rw/a.txt", "abc"); code != http.StatusCreated || content() != "abc" {
+		t.Errorf("put create wrong: %d %s", code, content())
+	}
+	if code := write("PUT", "/files/g/rw/a.txt", "defg"); code != http.StatusNoContent || content() != "defg" {
+		t.Errorf("put overwrite wrong: %d %s", code, content())
+	}
+	if code := write("POST", "/files/g/rw/a.txt", "x"); code != http.StatusConflict || content() != "defg" {
+		t.Errorf("post existing should conflict: %d %s", code, content())
+	}
+	if code := write("PUT", "/files/g/rw/a.txt", "toolong"); code != http.StatusRequestEntityTooLarge || content() != "defg" {
+		t.Errorf("put too large should be 413: %d %s", code, content())
+	}
+	if code := write("PUT", "/files/g/ro/a.txt", "x"); code != http.StatusForbidden {
+		t.Errorf("put to read only dir should be 403: %d", code)
+	}
+	if code := write("PUT", "/files/g/locked/a.txt", "x"); code != http.StatusForbidden || content() != "defg" {
+		t.Errorf("put to not writable dir should be 403: %d %s", code, content())
+	}
+	if code := write("POST", "/files/g/rw/b.txt", "new"); code != http.StatusCreated {
+		t.Errorf("post create wrong: %d", code)
+	}
+	entries, _ := os.ReadDir(root)
+	if len(entries) != 2 {
+		t.Errorf("temp files left: %v", entries)
+	}
+}
+
+func TestServeList(t *testing.T) {
+	root := t.TempDir()
+	os.Mkdir(filepath.Join(root, "sub"), 0755)
+	os.WriteFile(filepath.Join(root, "b.txt"), []byte("bb"), 0644)
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"list": &conf.Dir{ Root: root, Allows: []string{"GET"}, AllowList: true },
+				"nolist": &conf.Dir{ Root: root, Allows: []string{"GET", "DELETE"} },
+			} },
+		},
+	})
+	serve := func(method, uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest(method, uri, nil)
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := serve("GET", "/files/g/list")
+	var entries []dirEntry
+	if err := json.Unmarshal(resp.Body.Bytes(), &entries); err != nil || resp.Code != http.StatusOK {
+		t.Fatalf("list root failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if len(entries) != 3 || entries[0].Name != "a.txt" || entries[1].Name != "b.txt" || entries[1].Size != 2 || entries[2].Name != "sub" {
+		t.Errorf("list entries wrong: %v", entries)
+	}
+	if resp = serve("GET", "/files/g/list/sub?format=text"); resp.Code != http.StatusOK || resp.Body.String() != "" {
+		t.Errorf("list empty sub wrong: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp = serve("GET", "/files/g/list?format=text"); resp.Body.String() != "a.txt\nb.txt\nsub\n" {
+		t.Errorf("text list wrong: %q", resp.Body.String())
+	}
+	if resp = serve("GET", "/files/g/nolist/sub"); resp.Code == http.StatusOK {
+		t.Errorf("list should not be allowed")
+	}
+	if resp = serve("DELETE", "/files/g/nolist"); resp.Code != http.StatusForbidden {
+		t.Errorf("delete root should be forbidden: %d", resp.Code)
+	}
+}
+
+func TestServeGetContentType(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.json"), []byte("{}"), 0644)
+	os.WriteFile(filepath.Join(root, "a.LOG"), []byte("log"), 0644)
+	os.WriteFile(filepath.Join(root, "noext"), []byte("<html><body>x</body></html>"), 0644)
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"i": &conf.Dir{ Root: root, Allows: []string{"GET"}, ContentTypes: map[string]string{ ".log": "text/plain; charset=utf-8" } },
+			} },
+		},
+	})
+	get := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	for uri, expected := range map[string]string{
+		"/files/g/i/a.json": "application/json",
+		"/files/g/i/a.LOG": "text/plain; charset=utf-8",
+		"/files/g/i/noext": "text/html; charset=utf-8",
+	} {
+		if resp := get(uri); resp.Header().Get("Content-Type") != expected || resp.Header().Get("Content-Disposition") != "" {
+			t.Errorf("content type of %s wrong: %s", uri, resp.Header().Get("Content-Type"))
+		}
+	}
+	if resp := get("/files/g/i/a.json?download=1"); resp.Header().Get("Content-Disposition") != "attachment; filename=a.json" {
+		t.Errorf("disposition wrong: %s", resp.Header().Get("Content-Disposition"))
+	}
+}
+
+func TestServeGetEtag(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "test.txt"), []byte("0123456789"), 0644)
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"weak": &conf.Dir{ Root: root, Allows: []string{"GET"} },
+				"strong": &conf.Dir{ Root: root, Allows: []string{"GET"}, StrongEtag: true },
+			} },
+		},
+	})
+	get := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		NewFileServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	for _, item := range []string{"weak", "strong"} {
+		uri := "/files/g/" + item + "/test.txt"
+		etag := get(uri, nil).Header().Get("ETag")
+		if etag == "" || strings.HasPrefix(etag, "W/") != (item == "weak") {
+			t.Errorf("%s etag wrong: %s", item, etag)
+		}
+		if resp := get(uri, map[string]string{ "If-None-Match": etag }); resp.Code != http.StatusNotModified {
+			t.Errorf("%s etag matched should be 304: %d", item, resp.Code)
+		}
+		if resp := get(uri, map[string]string{ "If-None-Match": `"other"` }); resp.Code != http.StatusOK || resp.Body.String() != "0123456789" {
+			t.Errorf("%s etag not matched should be 200: %d", item, resp.Code)
+		}
+	}
+	etag := `"` + fmt.Sprintf("%x", sha256.Sum256([]byte("0123456789"))) + `"`
+	if resp := get("/files/g/strong/test.txt", map[string]string{ "Range": "bytes=2-4", "If-Range": etag }); resp.Code != http.StatusPartialContent || resp.Body.String() != "234" {
+		t.Errorf("if-range with strong etag should be partial: %d %s", resp.Code, resp.Body.String())
+	}
+	if resp := get("/files/g/strong/test.txt", map[string]string{ "Range": "bytes=2-4", "If-Range": `"old"` }); resp.Code != http.StatusOK {
+		t.Errorf("if-range with old etag should be full: %d", resp.Code)
+	}
+}
+
+func TestServeHead(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "test.txt"), []byte("0123456789"), 0644)
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"ro": &conf.Dir{ Root: root, Allows: []string{"GET"} },
+				"rw": &conf.Dir{ Root: root, Allows: []string{"PUT"}, Writable: true },
+			} },
+		},
+	})
+	head := func(uri string, headers map[string]string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("HEAD", uri, nil)
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+		resp := httptest.NewRecorder()
+		server.ServeHTTP(resp, req)
+		return resp
+	}
+	resp := head("/files/g/ro/test.txt", nil)
+	h := resp.Header()
+	if resp.Code != http.StatusOK || resp.Body.Len() != 0 {
+		t.Errorf("head should be ok without body: %d %q", resp.Code, resp.Body.String())
+	}
+	if h.Get("Content-Length") != "10" || !strings.HasPrefix(h.Get("Content-Type"), "text/plain") ||
+		h.Get("Last-Modified") == "" || h.Get("ETag") == "" || h.Get("X-Servant-File-Size") != "10" {
+		t.Errorf("head should have headers of get: %v", h)
+	}
+	if resp := head("/files/g/ro/test.txt", map[string]string{ "If-None-Match": h.Get("ETag") }); resp.Code != http.StatusNotModified {
+		t.Errorf("head with matched etag should be 304: %d", resp.Code)
+	}
+	if resp := head("/files/g/ro/missing.txt", nil); resp.Code == http.StatusOK {
+		t.Errorf("head of a missing file should fail")
+	}
+	if resp := head("/files/g/rw/test.txt", nil); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("head should need get or head allowed: %d", resp.Code)
 	}
 }
@@ -0,0 +1,155 @@
+package server
+
+import (
+	"compress/gzip"
+	"net/http"
+	"strings"
+	"strconv"
+)
+
+// content types not worth compressing again
+var compressedTypes = []string{
+	"image/", "video/", "audio/",
+	"application/gzip", "application/x-gzip", "application/zip", "application/x-bzip2",
+	"application/x-xz", "application/zstd", "application/x-7z-compressed",
+}
+
+// acceptsGzip reports whether the client accepts gzip encoding
+func acceptsGzip(req *http.Request) bool {
+	for _, value := range req.Header.Values("Accept-Encoding") {
+		for _, coding := range strings.Split(value, ",") {
+			name, params, _ := strings.Cut(coding, ";")
+			if strings.ToLower(strings.TrimSpace(name)) != "gzip" {
+				continue
+			}
+			params = strings.ReplaceAll(params, " ", "")
+			if q, ok := strings.CutPrefix(params, "q="); ok {
+				weight, err := strconv.ParseFloat(q, 64)
+				return err == nil && weight > 0
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// gzipWriter compresses the response if it is ok and larger than minSize.
+// The body is buffered until minSize bytes written, a flush, or Close, to decide whether to compress.
+type gzipWriter struct {
+	http.ResponseWriter
+	minSize  int
+	status   int
+	buf      []byte
+	decided  bool
+	gz       *gzip.Writer
+}
+
+func newGzipWriter(resp http.ResponseWriter, minSize int) *gzipWriter {
+	return &gzipWriter{
+		ResponseWriter: resp,
+		minSize: minSize,
+	}
+}
+
+func (self *gzipWriter) WriteHeader(code int) {
+	// superfluous calls are ignored, like the underlying writer does
+	if self.decided || self.status != 0 {
+		return
+	}
+	self.status = code
+	// only full successful responses are compressed, others are passed through now
+	if code != http.StatusOK {
+		self.decide(false)
+	}
+}
+
+func (self *gzipWriter) Write(p []byte) (int, error) {
+	if !self.decided {
+		if self.status == 0 {
+			self.status = http.StatusOK
+		}
+		self.buf = append(self.buf, p...)
+		if len(self.buf) < self.minSize {
+			return len(p), nil
+		}
+		return len(p), self.decide(true)
+	}
+	if self.gz != nil {
+		return self.gz.Write(p)
+	}
+	return self.ResponseWriter.Write(p)
+}
+
+// Flush decides to compress if not yet, as the size of streaming output is unknown
+func (self *gzipWriter) Flush() {
+	if !self.decided {
+		self.decide(len(self.buf) > 0)
+	}
+	if self.gz != nil {
+		self.gz.Flush()
+	}
+	http.NewResponseController(self.ResponseWriter).Flush()
+}
+
+// Close writes out the buffered or compressed remaining, must be called when the response is done
+func (self *gzipWriter) Close() error {
+	if !self.decided {
+		if self.status == 0 {
+			return nil
+		}
+		self.decide(len(self.buf) > 0 && len(self.buf) >= self.minSize)
+	}
+	if self.gz != nil {
+		return self.gz.Close()
+	}
+	return nil
+}
+
+// Unwrap makes http.ResponseController reach the underlying writer
+func (self *gzipWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+func (self *gzipWriter) decide(compress bool) error {
+	self.decided = true
+	header := self.Header()
+	if compress && len(self.buf) > 0 && header.Get("Content-Type") == "" {
+		header.Set("Content-Type", http.DetectContentType(self.buf))
+	}
+	if compress && self.compressible() {
+		header.Set("Content-Encoding", "gzip")
+		header.Del("Content-Length")
+		header.Add("Vary", "Accept-Encoding")
+		self.gz = gzip.NewWriter(self.ResponseWriter)
+	}
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	self.ResponseWriter.WriteHeader(self.status)
+	buf := self.buf
+	self.buf = nil
+	if len(buf) == 0 {
+		return nil
+	}
+	var err error
+	if self.gz != nil {
+		_, err = self.gz.Write(buf)
+	} else {
+		_, err = self.ResponseWriter.Write(buf)
+	}
+	return err
+}
+
+func (self *gzipWriter) compressible() bool {
+	header := self.Header()
+	if header.Get("Content-Encoding") != "" || header.Get("Content-Range") != "" {
+		return false
+	}
+	contentType := strings.ToLower(header.Get("Content-Type"))
+	for _, t := range compressedTypes {
+		if strings.HasPrefix(contentType, t) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,89 @@
+package server
+
+import (
+	"testing"
+	"compress/gzip"
+	"io"
+	"strings"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestAcceptsGzip(t *testing.T) {
+	for value, expected := range map[string]bool{
+		"": false,
+		"gzip": true,
+		"deflate, GZIP;q=0.5": true,
+		"gzip;q=0": false,
+		"br": false,
+	} {
+		req, _ := http.NewRequest("GET", "/", nil)
+		req.Header.Set("Accept-Encoding", value)
+		if acceptsGzip(req) != expected {
+			t.Errorf("accepts gzip of %q should be %v", value, expected)
+		}
+	}
+}
+
+func gunzipString(t *testing.T, r io.Reader) string {
+	reader, err := gzip.NewReader(r)
+	if err != nil {
+		t.Errorf("gzip reader failed: %s", err)
+		return ""
+	}
+	data, _ := io.ReadAll(reader)
+	return string(data)
+}
+
+func TestGzipWriter(t *testing.T) {
+	large := strings.Repeat("hello servant\n", 100)
+
+	resp := httptest.NewRecorder()
+	gw := newGzipWriter(resp, 100)
+	gw.Header().Set("Content-Length", "1400")
+	io.WriteString(gw, large)
+	gw.Close()
+	if resp.Header().Get("Content-Encoding") != "gzip" || resp.Header().Get("Content-Length") != "" || gunzipString(t, resp.Body) != large {
+		t.Errorf("large text should be compressed: %v", resp.Header())
+	}
+
+	resp = httptest.NewRecorder()
+	gw = newGzipWriter(resp, 100)
+	io.WriteString(gw, "small")
+	gw.Close()
+	if resp.Header().Get("Content-Encoding") != "" || resp.Body.String() != "small" {
+		t.Errorf("small body should not be compressed: %v", resp.Header())
+	}
+
+	resp = httptest.NewRecorder()
+	gw = newGzipWriter(resp, 100)
+	gw.Header().Set("Content-Type", "image/png")
+	io.WriteString(gw, large)
+	gw.Close()
+	if resp.Header().Get("Content-Encoding") != "" || resp.Body.String() != large {
+		t.Errorf("image should not be compressed: %v", resp.Header())
+	}
+
+	resp = httptest.NewRecorder()
+	gw = newGzipWriter(resp, 100)
+	gw.WriteHeader(http.StatusNotFound)
+	io.WriteString(gw, large)
+	gw.Close()
+	if resp.Code != http.StatusNotFound || resp.Header().Get("Content-Encoding") != "" || resp.Body.String() != large {
+		t.Errorf("error response should not be compressed: %d %v", resp.Code, resp.Header())
+	}
+
+	// streaming output is compressed at the first flush
+	resp = httptest.NewRecorder()
+	gw = newGzipWriter(resp, 100)
+	io.WriteString(gw, "line1\n")
+	gw.Flush()
+	if !resp.Flushed || resp.Header().Get("Content-Encoding") != "gzip" {
+		t.Errorf("flushed output should be compressed: %v", resp.Header())
+	}
+	io.WriteString(gw, "line2\n")
+	gw.Close()
+	if s := gunzipString(t, resp.Body); s != "line1\nline2\n" {
+		t.Errorf("streaming output wrong: %q", s)
+	}
+}
@@ -0,0 +1,100 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// headerValueReplacer keeps params from splitting a header value into lines
+var headerValueReplacer = strings.NewReplacer("\r", " ", "\n", " ")
+
+// headerWriter sets the headers of the item before the response starts, unless it is an error.
+// Headers set by the handler, like Content-Type, are overridden.
+type headerWriter struct {
+	http.ResponseWriter
+	header  map[string]string
+	applied bool
+}
+
+func (self *headerWriter) apply(code int) {
+	if self.applied || code < 200 {
+		return
+	}
+	self.applied = true
+	if code >= 400 {
+		return
+	}
+	header := self.ResponseWriter.Header()
+	for k, v := range self.header {
+		header.Set(k, v)
+	}
+}
+
+func (self *headerWriter) WriteHeader(code int) {
+	self.apply(code)
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *headerWriter) Write(p []byte) (int, error) {
+	self.apply(http.StatusOK)
+	return self.ResponseWriter.Write(p)
+}
+
+// Unwrap makes http.ResponseController reach the underlying writer
+func (self *headerWriter) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+func (self *headerWriter) Flush() {
+	self.apply(http.StatusOK)
+	http.NewResponseController(self.ResponseWriter).Flush()
+}
+
+func (self *headerWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(self.ResponseWriter).Hijack()
+}
+
+// itemHeaders returns the response headers declared by the requested item, nil if unknown
+func (self *Session) itemHeaders() map[string]string {
+	switch self.resource {
+	case "commands":
+		if cmdConf := (CommandServer{ Session: self }).findCommandConfig(); cmdConf != nil {
+			return cmdConf.Headers
+		}
+	case "databases":
+		if _, queryConf := (DatabaseServer{ Session: self }).findDatabaseQueryConfig(); queryConf != nil {
+			return queryConf.Headers
+		}
+	case "files":
+		if dirConf := (FileServer{ Session: self }).findDirConfig(); dirConf != nil {
+			return dirConf.Headers
+		}
+	}
+	return nil
+}
+
+// withItemHeaders makes the response set the headers of the item, with ${param} replaced by params of the request.
+// Params are resolved before the handler reads the body. Headers with params missing are not set.
+func (self *Session) withItemHeaders() {
+	headers := self.itemHeaders()
+	if len(headers) == 0 {
+		return
+	}
+	params, perr := self.declaredParams(self.itemParams())
+	if perr != nil {
+		// the handler fails the request by it
+		return
+	}
+	resolved := make(map[string]string, len(headers))
+	for k, v := range headers {
+		value, ok := VarExpand(v, params, func(s string) string { return s })
+		if !ok {
+			self.warn("header %s not set, params of %s missing", k, v)
+			continue
+		}
+		resolved[k] = headerValueReplacer.Replace(value)
+	}
+	self.resp = &headerWriter{ ResponseWriter: self.resp, header: resolved }
+}
@@ -0,0 +1,49 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"servant/conf"
+	"testing"
+)
+
+func TestItemHeaders(t *testing.T) {
+	root := t.TempDir()
+	os.WriteFile(filepath.Join(root, "a.txt"), []byte("a"), 0644)
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"ok": &conf.Command{ Lang: "bash", Code: "echo ok", Headers: map[string]string{
+					"Cache-Control": "max-age=60", "X-Tenant": "${tenant}", "X-Missing": "${nope}",
+				} },
+				"fail": &conf.Command{ Lang: "bash", Code: "exit 1", Headers: map[string]string{ "Cache-Control": "max-age=60" } },
+			} },
+		},
+		Files: map[string]*conf.Files{
+			"f": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"d": &conf.Dir{ Root: root, Allows: []string{"GET"}, Headers: map[string]string{ "Content-Type": "application/x-custom" } },
+			} },
+		},
+	})
+	serve := func(uri string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", uri, nil))
+		return resp
+	}
+	resp := serve("/commands/c/ok?tenant=a%0D%0AX-Evil:%201")
+	h := resp.Header()
+	if resp.Code != http.StatusOK || h.Get("Cache-Control") != "max-age=60" || h.Get("X-Tenant") != "a  X-Evil: 1" || h.Get("X-Evil") != "" {
+		t.Errorf("headers should be set with params in one line: %d %v", resp.Code, h)
+	}
+	if _, ok := h["X-Missing"]; ok {
+		t.Errorf("header with params missing should not be set: %v", h)
+	}
+	if resp = serve("/commands/c/fail"); resp.Header().Get("Cache-Control") != "" {
+		t.Errorf("headers should not be set on errors: %d %v", resp.Code, resp.Header())
+	}
+	if resp = serve("/files/f/d/a.txt"); resp.Header().Get("Content-Type") != "application/x-custom" || resp.Body.String() != "a" {
+		t.Errorf("content type should be overridden: %v", resp.Header())
+	}
+}
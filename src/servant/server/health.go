@@ -0,0 +1,99 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const HealthPath = "/healthz"
+const ReadyPath = "/readyz"
+
+// readyCheckTimeout bounds each database ping of readiness checks
+var readyCheckTimeout = 2 * time.Second
+
+// serveHealth serves liveness, the process is up if it answers
+func (self *Session) serveHealth() {
+	self.resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	self.resp.Write([]byte("ok\n"))
+}
+
+// serveReady serves readiness, 503 with the failing checks until the server has started and
+// configured databases and daemons are up, or when the server is shutting down or in maintenance
+func (self *Session) serveReady() {
+	problems := self.server.readinessProblems(self.req.Context())
+	self.resp.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if len(problems) == 0 {
+		self.resp.Write([]byte("ok\n"))
+		return
+	}
+	self.warn("not ready: %s", strings.Join(problems, ", "))
+	self.resp.WriteHeader(http.StatusServiceUnavailable)
+	self.resp.Write([]byte(strings.Join(problems, "\n") + "\n"))
+}
+
+func (self *Server) setReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&self.ready, v)
+}
+
+func (self *Server) readinessProblems(ctx context.Context) []string {
+	if atomic.LoadInt32(&self.ready) == 0 {
+		return []string{"server not serving"}
+	}
+	if self.inMaintenance() {
+		return []string{"server in maintenance"}
+	}
+	config := self.Config()
+	problems := make([]string, 0)
+	// databases unreachable are not ready until they answer a ping, even if not listed
+	databases := config.Server.Readiness.Databases
+	for _, name := range self.unreachableDatabases() {
+		if !contains(databases, name) {
+			databases = append(databases[:len(databases):len(databases)], name)
+		}
+	}
+	for _, name := range databases {
+		if err := self.pingDatabase(ctx, name); err != nil {
+			problems = append(problems, fmt.Sprintf("database %s: %s", name, err))
+		}
+	}
+	statuses := DaemonStatuses()
+	for _, name := range config.Server.Readiness.Daemons {
+		status := statuses[name]
+		if !status.Running {
+			problems = append(problems, fmt.Sprintf("daemon %s: not running", name))
+		} else if daemonConf := config.Daemons[name]; daemonConf != nil && daemonConf.Health != nil && !status.Healthy {
+			problems = append(problems, fmt.Sprintf("daemon %s: not healthy", name))
+		}
+	}
+	return problems
+}
+
+// pingDatabase pings the database and records whether it is reachable
+func (self *Server) pingDatabase(ctx context.Context, name string) error {
+	dbConf := self.Config().Databases[name]
+	if dbConf == nil {
+		return fmt.Errorf("not defined")
+	}
+	db, err := self.database(name, dbConf)
+	if err == nil {
+		ctx, cancel := context.WithTimeout(ctx, readyCheckTimeout)
+		err = db.PingContext(ctx)
+		cancel()
+	}
+	self.databasesLock.Lock()
+	if err != nil {
+		self.unreachableDbs[name] = true
+	} else {
+		delete(self.unreachableDbs, name)
+	}
+	self.databasesLock.Unlock()
+	return err
+}
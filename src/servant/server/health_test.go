@@ -0,0 +1,109 @@
+package server
+
+import (
+	"testing"
+	"servant/conf"
+	"context"
+	"strings"
+	"time"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestServeHealth(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Server: conf.Server{ Readiness: conf.Readiness{ Databases: []string{"good", "bad"}, Daemons: []string{"ready_d"} } },
+		Databases: map[string]*conf.Database{
+			"good": &conf.Database{ Driver: "servanttest" },
+			"bad": &conf.Database{ Driver: "nonexistent" },
+		},
+		Daemons: map[string]*conf.Daemon{
+			"ready_d": &conf.Daemon{ Lang: "bash", Code: "sleep 30", Restart: "never" },
+		},
+	})
+	get := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp
+	}
+	if resp := get(HealthPath); resp.Code != http.StatusOK {
+		t.Errorf("healthz should be ok without auth: %d", resp.Code)
+	}
+	if resp := get(ReadyPath); resp.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Body.String(), "not serving") {
+		t.Errorf("readyz should fail before serving: %d %q", resp.Code, resp.Body.String())
+	}
+
+	s.setReady(true)
+	resp := get(ReadyPath)
+	body := resp.Body.String()
+	if resp.Code != http.StatusServiceUnavailable || !strings.Contains(body, "database bad") || strings.Contains(body, "database good") ||
+		!strings.Contains(body, "daemon ready_d: not running") {
+		t.Errorf("readyz should list failed checks: %d %q", resp.Code, body)
+	}
+
+	// a database failed a ping is not ready until it answers, even if not listed
+	s.config.Server.Readiness.Databases = []string{"good"}
+	if resp := get(ReadyPath); resp.Code != http.StatusServiceUnavailable || !strings.Contains(resp.Body.String(), "database bad") {
+		t.Errorf("readyz should fail for the unreachable database: %d %q", resp.Code, resp.Body.String())
+	}
+	delete(s.config.Databases, "bad")
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		RunDaemon(ctx, "ready_d", s.config.Daemons["ready_d"])
+		close(done)
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for !DaemonStatuses()["ready_d"].Running && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if resp := get(ReadyPath); resp.Code != http.StatusOK {
+		t.Errorf("readyz should be ok: %d %q", resp.Code, resp.Body.String())
+	}
+	cancel()
+	<-done
+	if resp := get(ReadyPath); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("readyz should fail after the daemon stopped: %d", resp.Code)
+	}
+}
+
+func TestOpenDatabases(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"good": &conf.Database{ Driver: "servanttest", Dsn: "open" },
+			"bad": &conf.Database{ Driver: "nonexistent" },
+		},
+	})
+	s.setReady(true)
+	s.openDatabases()
+	s.databasesLock.Lock()
+	pool := s.databases["good"]
+	s.databasesLock.Unlock()
+	if pool == nil {
+		t.Fatalf("database should be opened at start")
+	}
+	if db, _ := s.database("good", s.config.Databases["good"]); db != pool.db {
+		t.Errorf("requests should reuse the pool opened at start")
+	}
+	if names := s.unreachableDatabases(); len(names) != 1 || names[0] != "bad" {
+		t.Errorf("bad should be unreachable: %v", names)
+	}
+	if problems := s.readinessProblems(context.Background()); len(problems) != 1 || !strings.HasPrefix(problems[0], "database bad") {
+		t.Errorf("unreachable database should fail readiness: %v", problems)
+	}
+	if statuses := s.databaseStatuses(); !statuses["good"].Reachable {
+		t.Errorf("good should be reachable in status: %v", statuses)
+	}
+
+	// databases removed are closed and not checked any more
+	delete(s.config.Databases, "bad")
+	delete(s.config.Databases, "good")
+	s.openDatabases()
+	if len(s.unreachableDatabases()) != 0 || len(s.databaseStatuses()) != 0 {
+		t.Errorf("removed databases should be dropped")
+	}
+	if problems := s.readinessProblems(context.Background()); len(problems) != 0 {
+		t.Errorf("should be ready: %v", problems)
+	}
+}
@@ -0,0 +1,144 @@
+package server
+
+import (
+	"net/http"
+	"sync"
+	"time"
+)
+
+// IdempotencyKeyHeader makes a repeated request of a command respond the result of the first one,
+// rather than executing the command again
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotentReplayedHeader tells the response is of an earlier request with the same key
+const IdempotentReplayedHeader = "Idempotent-Replayed"
+
+// maxIdempotencyKeyLen keeps keys from taking memory, uuids are 36
+const maxIdempotencyKeyLen = 255
+
+// idempotencyStore keeps responses by keys until their ttl, and the keys of requests in progress,
+// which requests with the same key wait for
+type idempotencyStore struct {
+	lock     sync.Mutex
+	done     *responseCache
+	inflight map[string]chan struct{}
+}
+
+func newIdempotencyStore(maxBytes int64) *idempotencyStore {
+	return &idempotencyStore{
+		done: newResponseCache(maxBytes),
+		inflight: make(map[string]chan struct{}),
+	}
+}
+
+// acquire returns the response of the key, or nil and a release func if the caller is to serve
+// the request. It waits while a request of the key is in progress, false if the client gave up.
+func (self *idempotencyStore) acquire(req *http.Request, key string) (*cacheEntry, func(), bool) {
+	for {
+		self.lock.Lock()
+		if entry := self.done.get(key); entry != nil {
+			self.lock.Unlock()
+			return entry, nil, true
+		}
+		wait, ok := self.inflight[key]
+		if !ok {
+			ch := make(chan struct{})
+			self.inflight[key] = ch
+			self.lock.Unlock()
+			return nil, func() {
+				self.lock.Lock()
+				delete(self.inflight, key)
+				self.lock.Unlock()
+				close(ch)
+			}, true
+		}
+		self.lock.Unlock()
+		select {
+		case <-wait:
+			// kept, or not if the first request was not executed, so this one is
+		case <-req.Context().Done():
+			return nil, nil, false
+		}
+	}
+}
+
+// idempotencyTtl returns how long the response of the idempotency key of the request is kept,
+// 0 if the request has no key or the item does not take them
+func (self *Session) idempotencyTtl() time.Duration {
+	if self.server.idempotency == nil || self.resource != "commands" || self.req.Header.Get(IdempotencyKeyHeader) == "" || wantsEventStream(self.req) {
+		return 0
+	}
+	if cmdConf := (CommandServer{ Session: self }).findCommandConfig(); cmdConf != nil {
+		return time.Duration(cmdConf.IdempotencyTtl) * time.Second
+	}
+	return 0
+}
+
+// idempotencyKey scopes the key of the request by the user and the item
+func (self *Session) idempotencyKey() string {
+	return self.username + "\x00" + self.group + "/" + self.item + "\x00" + self.req.Header.Get(IdempotencyKeyHeader)
+}
+
+// replayable reports whether a response is kept for the key. Responses of requests rejected before the
+// command is executed, like by the concurrency limit, are not, so a retry with the key executes it.
+func replayable(status int) bool {
+	return status != http.StatusTooManyRequests && status != http.StatusServiceUnavailable
+}
+
+// serveIdempotent responds the response kept of the idempotency key of the request if there is one,
+// or serves by the handler and keeps the response. Requests of the key wait for the one in progress.
+func (self *Session) serveIdempotent(handler Handler, ttl time.Duration) {
+	key := self.req.Header.Get(IdempotencyKeyHeader)
+	if len(key) > maxIdempotencyKeyLen {
+		self.ErrorEnd(http.StatusBadRequest, "%s longer than %d", IdempotencyKeyHeader, maxIdempotencyKeyLen)
+		return
+	}
+	store := self.server.idempotency
+	entry, release, ok := store.acquire(self.req, self.idempotencyKey())
+	if !ok {
+		self.BadEnd("client gone waiting for the request of %s %s", IdempotencyKeyHeader, key)
+		return
+	}
+	header := self.resp.Header()
+	if entry != nil {
+		// a key is of one request, reusing it for another is a client bug
+		if entry.request != self.req.Method + " " + self.req.URL.RequestURI() {
+			self.ErrorEnd(http.StatusUnprocessableEntity, "%s %s was used by another request", IdempotencyKeyHeader, key)
+			return
+		}
+		for k, vs := range entry.header {
+			header[k] = append([]string(nil), vs...)
+		}
+		header.Set(IdempotentReplayedHeader, "true")
+		self.resp.WriteHeader(entry.status)
+		self.resp.Write(entry.body)
+		self.GoodEnd("replayed response of %s %s", IdempotencyKeyHeader, key)
+		return
+	}
+	defer release()
+	// headers set before serving, like cors ones, are of the request rather than the response
+	preset := make(map[string]bool, len(header))
+	for k := range header {
+		preset[k] = true
+	}
+	w := &cacheWriter{ ResponseWriter: self.resp, max: store.done.maxBytes }
+	self.resp = w
+	handler.serve()
+	self.resp = w.ResponseWriter
+	// a command without output responds 200 by nothing written
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if !replayable(w.status) || w.overflow {
+		return
+	}
+	// values of trailers are known by now, so they are replayed as headers
+	entry = &cacheEntry{ key: self.idempotencyKey(), status: w.status, header: make(http.Header), body: w.body,
+		request: self.req.Method + " " + self.req.URL.RequestURI(), expires: time.Now().Add(ttl) }
+	for k, vs := range header {
+		if !preset[k] && !contains(uncachedHeaders, k) {
+			entry.header[k] = append([]string(nil), vs...)
+		}
+	}
+	store.done.put(entry)
+}
@@ -0,0 +1,85 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"servant/conf"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestServeIdempotent(t *testing.T) {
+	dir := t.TempDir()
+	runs := filepath.Join(dir, "runs")
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ IdempotencyMaxBytes: 1024 },
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"run": &conf.Command{ Lang: "bash", Code: "echo run >> " + runs + "; sleep 0.2; date +%s%N; exit 3", IdempotencyTtl: 60 },
+				"other": &conf.Command{ Lang: "bash", Code: "echo other >> " + runs, IdempotencyTtl: 60 },
+				"ignored": &conf.Command{ Lang: "bash", Code: "echo ignored >> " + runs },
+			} },
+		},
+	})
+	serve := func(uri, key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("POST", uri, nil)
+		if key != "" {
+			req.Header.Set(IdempotencyKeyHeader, key)
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	count := func(name string) int {
+		data, _ := os.ReadFile(runs)
+		return strings.Count(string(data), name + "\n")
+	}
+
+	// concurrent duplicates wait for the first one
+	resps := make([]*httptest.ResponseRecorder, 3)
+	var wg sync.WaitGroup
+	for i := range resps {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resps[i] = serve("/commands/c/run", "k1")
+		}(i)
+	}
+	wg.Wait()
+	if n := count("run"); n != 1 {
+		t.Fatalf("command should be executed once: %d", n)
+	}
+	replayed := 0
+	for _, resp := range resps {
+		if resp.Body.String() != resps[0].Body.String() || resp.Header().Get(ExitCodeHeader) != "3" {
+			t.Errorf("responses of a key should be the same: %q %q %v", resp.Body.String(), resps[0].Body.String(), resp.Header())
+		}
+		if resp.Header().Get(IdempotentReplayedHeader) == "true" {
+			replayed++
+		}
+	}
+	if replayed != 2 {
+		t.Errorf("duplicates should be replayed: %d", replayed)
+	}
+	if resp := serve("/commands/c/run?a=1", "k1"); resp.Code != http.StatusUnprocessableEntity {
+		t.Errorf("key reused by another request should be rejected: %d", resp.Code)
+	}
+	// keys are scoped per item
+	serve("/commands/c/other", "k1")
+	serve("/commands/c/other", "k1")
+	if n := count("other"); n != 1 {
+		t.Errorf("command of another item should be executed once by the key: %d", n)
+	}
+	serve("/commands/c/ignored", "k1")
+	serve("/commands/c/ignored", "k1")
+	serve("/commands/c/other", "")
+	if count("ignored") != 2 || count("other") != 2 {
+		t.Errorf("requests without keys, or of items not taking them, should be executed")
+	}
+	if resp := serve("/commands/c/other", strings.Repeat("k", 256)); resp.Code != http.StatusBadRequest {
+		t.Errorf("too long key should be rejected: %d", resp.Code)
+	}
+}
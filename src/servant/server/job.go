@@ -0,0 +1,215 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/url"
+	"servant/conf"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// jobMaxOutputBytes is how much output of a job is kept for polling, the rest is dropped
+const jobMaxOutputBytes = 1 << 20
+
+// job is an execution of an async command. It is the response writer of the execution,
+// so the status, headers and output are kept as a synchronous execution would respond them.
+type job struct {
+	lock      sync.Mutex
+	id        string
+	command   string // <group>.<item>
+	username  string
+	ttl       time.Duration
+	header    http.Header
+	status    int
+	output    []byte
+	truncated bool
+	started   time.Time
+	ended     time.Time // zero while running
+}
+
+// jobStatus is the json of a job polled
+type jobStatus struct {
+	Id        string     `json:"id"`
+	State     string     `json:"state"` // running, done or failed
+	Started   time.Time  `json:"started"`
+	Ended     *time.Time `json:"ended,omitempty"`
+	ExitCode  *int       `json:"exit_code,omitempty"`
+	Error     string     `json:"error,omitempty"`
+	Output    string     `json:"output"`
+	Truncated bool       `json:"truncated,omitempty"`
+}
+
+// Header is only used by the execution, the header is read by polls once the job ended,
+// as ending under the lock orders the writes before them
+func (self *job) Header() http.Header {
+	return self.header
+}
+
+func (self *job) WriteHeader(code int) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.status == 0 && code >= 200 {
+		self.status = code
+	}
+}
+
+func (self *job) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	if n := jobMaxOutputBytes - len(self.output); len(p) > n {
+		self.output = append(self.output, p[:n]...)
+		self.truncated = true
+	} else {
+		self.output = append(self.output, p...)
+	}
+	return len(p), nil
+}
+
+func (self *job) end() {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.ended = time.Now()
+}
+
+func (self *job) expired(now time.Time) bool {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	return !self.ended.IsZero() && now.Sub(self.ended) >= self.ttl
+}
+
+// snapshot returns the state of the job, failed if the execution responded an error
+func (self *job) snapshot() jobStatus {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	ret := jobStatus{
+		Id:        self.id,
+		State:     "running",
+		Started:   self.started,
+		Output:    string(self.output),
+		Truncated: self.truncated,
+	}
+	if self.ended.IsZero() {
+		return ret
+	}
+	ret.Truncated = ret.Truncated || self.header.Get(TruncatedHeader) == "true"
+	if code, err := strconv.Atoi(self.header.Get(ExitCodeHeader)); err == nil {
+		ret.ExitCode = &code
+	}
+	ended := self.ended
+	ret.Ended = &ended
+	ret.State = "done"
+	if ret.Error = self.header.Get(ServantErrHeader); ret.Error != "" || self.status >= 400 {
+		ret.State = "failed"
+	}
+	return ret
+}
+
+// addJob keeps the job for polling, and removes jobs expired
+func (self *Server) addJob(j *job) {
+	now := time.Now()
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	for id, other := range self.jobs {
+		if other.expired(now) {
+			delete(self.jobs, id)
+		}
+	}
+	self.jobs[j.id] = j
+}
+
+func (self *Server) getJob(id string) *job {
+	self.jobsLock.Lock()
+	defer self.jobsLock.Unlock()
+	j, ok := self.jobs[id]
+	if !ok || j.expired(time.Now()) {
+		delete(self.jobs, id)
+		return nil
+	}
+	return j
+}
+
+// startJob executes the command in background in an execution slot, and responds 202 with the job id
+// once the execution started. The request body is read at first, as it is closed when the request ends.
+func (self CommandServer) startJob(cmdConf *conf.Command) {
+	var body []byte
+	if self.req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(self.req.Body); err != nil {
+			var maxBytesErr *http.MaxBytesError
+			if errors.As(err, &maxBytesErr) {
+				self.ErrorEnd(http.StatusRequestEntityTooLarge, "request body too large")
+			} else {
+				self.ErrorEnd(http.StatusBadRequest, "read request body failed: %s", err)
+			}
+			return
+		}
+	}
+	j := &job{
+		id:       newUuid(),
+		command:  self.group + "." + self.item,
+		username: self.username,
+		ttl:      time.Duration(cmdConf.JobTtl) * time.Second,
+		header:   make(http.Header),
+		started:  time.Now(),
+	}
+	// the job outlives the request, so it is not canceled when the client disconnects
+	jobSess := *self.Session
+	jobSess.req = self.req.WithContext(context.WithoutCancel(self.req.Context()))
+	jobSess.req.Body = io.NopCloser(bytes.NewReader(body))
+	jobSess.recorder = &responseRecorder{ ResponseWriter: j }
+	jobSess.resp = jobSess.recorder
+	jobServer := CommandServer{ Session: &jobSess }
+	started := make(chan bool, 1)
+	go func() {
+		defer j.end()
+		ok := jobServer.withConcurrency(cmdConf, func() {
+			started <- true
+			jobServer.serveWithLock(cmdConf)
+		})
+		if !ok {
+			started <- false
+		}
+	}()
+	if !<-started {
+		self.concurrencyLimited(cmdConf)
+		return
+	}
+	self.server.addJob(j)
+	self.resp.Header().Set("Location", self.req.URL.Path + "?job=" + url.QueryEscape(j.id))
+	self.writeJob(http.StatusAccepted, j)
+	self.GoodEnd("job %s started", j.id)
+}
+
+// serveJob responds the status and output of a job, which is only visible to the user started it
+func (self CommandServer) serveJob(id string) {
+	if self.req.Method != "GET" && self.req.Method != "HEAD" {
+		self.resp.Header().Set("Allow", "GET, HEAD")
+		self.ErrorEnd(http.StatusMethodNotAllowed, "method %s not allowed for jobs", self.req.Method)
+		return
+	}
+	j := self.server.getJob(id)
+	if j == nil || j.command != self.group + "." + self.item || j.username != self.username {
+		self.ErrorEnd(http.StatusNotFound, "job %s not found", id)
+		return
+	}
+	self.writeJob(http.StatusOK, j)
+	self.GoodEnd("job %s served", id)
+}
+
+func (self CommandServer) writeJob(code int, j *job) {
+	buf, _ := json.Marshal(j.snapshot())
+	self.resp.Header().Set("Content-Type", "application/json")
+	self.resp.WriteHeader(code)
+	if self.req.Method != "HEAD" {
+		self.resp.Write(buf)
+	}
+}
@@ -0,0 +1,122 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"servant/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAsyncCommand(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"slow": &conf.Command{ Lang: "bash", Code: "sleep 0.3; echo ${a}; exit 3", Template: true, Async: true, JobTtl: 60, MaxConcurrency: 1 },
+			} },
+		},
+	})
+	serve := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		var body *strings.Reader
+		if method == "POST" {
+			body = strings.NewReader("a=hi")
+		} else {
+			body = strings.NewReader("")
+		}
+		req := httptest.NewRequest(method, path, body)
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	poll := func(path string) (int, jobStatus) {
+		resp := serve("GET", path)
+		var status jobStatus
+		json.Unmarshal(resp.Body.Bytes(), &status)
+		return resp.Code, status
+	}
+	resp := serve("POST", "/commands/c/slow")
+	var started jobStatus
+	if err := json.Unmarshal(resp.Body.Bytes(), &started); resp.Code != http.StatusAccepted || err != nil || started.Id == "" || started.State != "running" {
+		t.Fatalf("job should be started: %d %s", resp.Code, resp.Body.String())
+	}
+	location := resp.Header().Get("Location")
+	if location != "/commands/c/slow?job=" + started.Id {
+		t.Errorf("location wrong: %s", location)
+	}
+	if resp = serve("POST", "/commands/c/slow"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("concurrency limit should apply to jobs: %d", resp.Code)
+	}
+	if resp = serve("GET", "/commands/c/slow"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("async command should not be started by GET: %d", resp.Code)
+	}
+	if code, _ := poll("/commands/c/slow?job=nonexistent"); code != http.StatusNotFound {
+		t.Errorf("unknown job should not be found: %d", code)
+	}
+	if code, status := poll(location); code != http.StatusOK || status.State != "running" {
+		t.Errorf("job should be running: %d %v", code, status)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	var status jobStatus
+	for time.Now().Before(deadline) {
+		if _, status = poll(location); status.State != "running" {
+			break
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if status.State != "failed" || status.ExitCode == nil || *status.ExitCode != 3 || status.Output != "hi\n" || status.Error == "" || status.Ended == nil {
+		t.Errorf("job should fail with the exit code and output: %+v", status)
+	}
+	if resp = serve("POST", "/commands/c/slow"); resp.Code != http.StatusAccepted {
+		t.Errorf("another job should be started after the first ended: %d", resp.Code)
+	}
+}
+
+func TestJobPollWhileRunning(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{
+				"ticks": &conf.Command{ Lang: "bash", Code: "for i in 1 2 3 4 5; do echo $i; sleep 0.05; done; exit 2", Async: true, JobTtl: 60 },
+			} },
+		},
+	})
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("POST", "/commands/c/ticks", nil))
+	if resp.Code != http.StatusAccepted {
+		t.Fatalf("job should be started: %d %s", resp.Code, resp.Body.String())
+	}
+	location := resp.Header().Get("Location")
+	// polls read the job while the execution sets its headers, which must not race
+	deadline := time.Now().Add(5 * time.Second)
+	var status jobStatus
+	for time.Now().Before(deadline) {
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", location, nil))
+		json.Unmarshal(resp.Body.Bytes(), &status)
+		if status.State != "running" {
+			break
+		}
+		if status.ExitCode != nil {
+			t.Fatalf("running job should have no exit code: %+v", status)
+		}
+	}
+	if status.State != "failed" || status.ExitCode == nil || *status.ExitCode != 2 || status.Output != "1\n2\n3\n4\n5\n" {
+		t.Errorf("job should end with the exit code and output: %+v", status)
+	}
+}
+
+func TestJobExpired(t *testing.T) {
+	s := NewServer(&conf.Config{})
+	j := &job{ id: "a", header: make(http.Header), ttl: time.Minute }
+	s.addJob(j)
+	if s.getJob("a") == nil {
+		t.Errorf("running job should be kept")
+	}
+	j.end()
+	j.ended = j.ended.Add(-time.Hour)
+	if s.getJob("a") != nil {
+		t.Errorf("expired job should be removed")
+	}
+}
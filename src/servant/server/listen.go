@@ -0,0 +1,146 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"servant/conf"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// UnixPeer is the client ip of requests through a unix socket, listed in trustedProxy to trust them
+const UnixPeer = "unix"
+
+// listenFdsStart is the first fd of sockets passed by systemd, SD_LISTEN_FDS_START
+const listenFdsStart = 3
+
+// listen listens on a tcp host:port, or on a unix socket if the address is unix:/path.
+// The socket file is removed when the listener is closed. A socket passed by systemd is
+// used as is if the address is systemd or fd:N.
+func listen(addr string, socketMode string) (net.Listener, error) {
+	if addr == conf.SystemdListen {
+		return activatedListener(listenFdsStart)
+	}
+	if fd, ok := strings.CutPrefix(addr, conf.FdListenPrefix); ok {
+		n, err := strconv.Atoi(fd)
+		if err != nil {
+			return nil, fmt.Errorf("bad fd %s", fd)
+		}
+		return activatedListener(n)
+	}
+	path, ok := strings.CutPrefix(addr, conf.UnixListenPrefix)
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if socketMode == "" {
+		socketMode = conf.DefaultSocketMode
+	}
+	mode, err := strconv.ParseUint(socketMode, 8, 32)
+	if err != nil {
+		return nil, fmt.Errorf("bad socket mode %s", socketMode)
+	}
+	// a socket left by a killed servant is removed, but never other files
+	if info, err := os.Lstat(path); err == nil {
+		if info.Mode() & os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	// no one but servant can connect until the mode is set
+	umaskLock.Lock()
+	oldMask := syscall.Umask(0177)
+	ln, err := net.Listen("unix", path)
+	syscall.Umask(oldMask)
+	umaskLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, os.FileMode(mode)); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
+
+// activatedListener returns the listener of the socket at the fd passed by systemd socket activation,
+// per LISTEN_PID and LISTEN_FDS. It is bound by systemd, so kept across restarts of servant.
+func activatedListener(fd int) (net.Listener, error) {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	n, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if pid != os.Getpid() || fd < listenFdsStart || fd >= listenFdsStart + n {
+		return nil, fmt.Errorf("no socket passed by systemd at fd %d", fd)
+	}
+	// the listener has a dup with close-on-exec, the fd passed is closed so commands do not inherit it
+	file := os.NewFile(uintptr(fd), fmt.Sprintf("fd:%d", fd))
+	defer file.Close()
+	return net.FileListener(file)
+}
+
+// activated reports whether the listen address is of a socket passed by systemd
+func activated(addr string) bool {
+	return addr == conf.SystemdListen || strings.HasPrefix(addr, conf.FdListenPrefix)
+}
+
+// unsetListenEnv keeps commands from taking the sockets passed by systemd as passed to them
+func unsetListenEnv() {
+	for _, k := range []string{ "LISTEN_PID", "LISTEN_FDS", "LISTEN_FDNAMES" } {
+		os.Unsetenv(k)
+	}
+}
+
+// setBacklog sets the accept queue length of a listening socket, by listen(2) again which updates
+// the backlog on linux, as net.Listen always uses the system default
+func setBacklog(ln net.Listener, backlog int) error {
+	sc, ok := ln.(syscall.Conn)
+	if !ok {
+		return fmt.Errorf("backlog of %s listener can not be set", ln.Addr().Network())
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var listenErr error
+	if err := raw.Control(func(fd uintptr) { listenErr = syscall.Listen(int(fd), backlog) }); err != nil {
+		return err
+	}
+	return listenErr
+}
+
+// listenerConfs returns server/listen followed by the other listeners
+func (self *Server) listenerConfs() []conf.Listener {
+	serverConf := &self.Config().Server
+	main := conf.Listener{ Listen: serverConf.Listen, SocketMode: serverConf.SocketMode, TLS: serverConf.TLS }
+	return append([]conf.Listener{ main }, serverConf.Listeners...)
+}
+
+// listenerResourcesKey is the context key of resources served by the listener of a request
+type listenerResourcesKey struct{}
+
+// listenerAllows reports whether the listener the request comes from serves the resource
+func (self *Session) listenerAllows() bool {
+	resources, ok := self.req.Context().Value(listenerResourcesKey{}).([]string)
+	if !ok {
+		return true
+	}
+	resource := self.resource
+	switch serverConf := self.config.Server; {
+	case serverConf.Metrics.Enabled && self.req.URL.Path == serverConf.Metrics.Path:
+		resource = "metrics"
+	case serverConf.Pprof.Enabled && strings.HasPrefix(self.req.URL.Path, serverConf.Pprof.Path):
+		resource = "pprof"
+	case self.req.URL.Path == StatusPath:
+		resource = "status"
+	case self.req.URL.Path == ConfigPath:
+		resource = "config"
+	}
+	for _, allowed := range resources {
+		if allowed == resource {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,233 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"servant/conf"
+	"strconv"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestListenUnix(t *testing.T) {
+	sock := t.TempDir() + "/servant.sock"
+	// a stale socket is replaced
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+	os.Chmod(sock, 0644)
+
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			Listen: "unix:" + sock,
+			SocketMode: "0600",
+			TrustedProxies: []string{ UnixPeer },
+		},
+		Commands: map[string]*conf.Commands{
+			"c": { Commands: map[string]*conf.Command{
+				"ip": { Lang: "exec", Code: "echo ${_remote.ip}" },
+			} },
+		},
+	})
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.Run()
+	}()
+	for i := 0; i < 50; i++ {
+		if info, err := os.Stat(sock); err == nil && info.Mode().Perm() != 0644 {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if info, err := os.Stat(sock); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("socket should be created with the mode: %v", err)
+	}
+
+	client := &http.Client{ Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+		},
+	} }
+	req, _ := http.NewRequest("GET", "http://servant/commands/c/ip", nil)
+	req.Header.Set("X-Forwarded-For", "1.2.3.4")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatalf("request through the socket failed: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "1.2.3.4\n" {
+		t.Errorf("client ip should be forwarded by the trusted unix peer: %d %q", resp.StatusCode, body)
+	}
+
+	s.Shutdown(context.Background())
+	<-ch
+	if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+		t.Errorf("socket should be removed on shutdown: %v", err)
+	}
+}
+
+func TestListenUnixNotSocket(t *testing.T) {
+	path := t.TempDir() + "/servant.sock"
+	os.WriteFile(path, []byte("data"), 0600)
+	if _, err := listen("unix:" + path, "0660"); err == nil {
+		t.Errorf("a file not a socket should not be replaced")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Errorf("the file should be kept")
+	}
+}
+
+func TestMultipleListeners(t *testing.T) {
+	dir := t.TempDir()
+	mainSock, adminSock := dir + "/main.sock", dir + "/admin.sock"
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			Listen: "unix:" + mainSock,
+			Listeners: []conf.Listener{
+				{ Listen: "unix:" + adminSock, Resources: []string{ "status" } },
+			},
+		},
+		Commands: map[string]*conf.Commands{
+			"c": { Commands: map[string]*conf.Command{
+				"echo": { Lang: "exec", Code: "echo hello" },
+			} },
+		},
+	})
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.Run()
+	}()
+	get := func(sock, path string) int {
+		client := &http.Client{ Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, "unix", sock)
+			},
+		} }
+		var resp *http.Response
+		var err error
+		for i := 0; i < 50; i++ {
+			if resp, err = client.Get("http://servant" + path); err == nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if err != nil {
+			t.Fatalf("get %s from %s failed: %s", path, sock, err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if code := get(mainSock, "/commands/c/echo"); code != http.StatusOK {
+		t.Errorf("main listener should serve commands: %d", code)
+	}
+	if code := get(mainSock, StatusPath); code != http.StatusOK {
+		t.Errorf("main listener should serve status: %d", code)
+	}
+	if code := get(adminSock, StatusPath); code != http.StatusOK {
+		t.Errorf("admin listener should serve status: %d", code)
+	}
+	if code := get(adminSock, "/commands/c/echo"); code != http.StatusNotFound {
+		t.Errorf("admin listener should not serve commands: %d", code)
+	}
+	if code := get(adminSock, HealthPath); code != http.StatusOK {
+		t.Errorf("probes should be served on all listeners: %d", code)
+	}
+
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+	if err := <-ch; err != http.ErrServerClosed {
+		t.Errorf("run should return ErrServerClosed: %v", err)
+	}
+	for _, sock := range []string{ mainSock, adminSock } {
+		if _, err := os.Lstat(sock); !os.IsNotExist(err) {
+			t.Errorf("socket %s should be removed on shutdown: %v", sock, err)
+		}
+	}
+}
+
+func TestMultipleListenersFailure(t *testing.T) {
+	mainSock := t.TempDir() + "/main.sock"
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			Listen: "unix:" + mainSock,
+			Listeners: []conf.Listener{ { Listen: "unix:/nonexistent/admin.sock" } },
+		},
+	})
+	if err := s.Run(); err == nil || err == http.ErrServerClosed {
+		t.Errorf("run should fail if any listener fails: %v", err)
+	}
+	if _, err := os.Lstat(mainSock); !os.IsNotExist(err) {
+		t.Errorf("listeners opened should be closed: %v", err)
+	}
+}
+
+func TestListenActivated(t *testing.T) {
+	// a socket bound by the test plays the one passed by systemd
+	bound, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer bound.Close()
+	file, err := bound.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the fd is closed by the server once listened
+	fd, err := syscall.Dup(int(file.Fd()))
+	file.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", strconv.Itoa(fd - listenFdsStart + 1))
+
+	if _, err := listen("fd:" + strconv.Itoa(fd + 1), ""); err == nil {
+		t.Errorf("fd not passed should not be listened")
+	}
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ Listen: "fd:" + strconv.Itoa(fd) },
+		Commands: map[string]*conf.Commands{
+			"c": { Commands: map[string]*conf.Command{
+				"env": { Lang: "bash", Code: "echo \"pid=$LISTEN_PID\"" },
+			} },
+		},
+	})
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.Run()
+	}()
+	var resp *http.Response
+	for i := 0; i < 50; i++ {
+		if resp, err = http.Get("http://" + bound.Addr().String() + "/commands/c/env"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatalf("request to the passed socket failed: %s", err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "pid=\n" {
+		t.Errorf("commands should not inherit the activation env: %q", body)
+	}
+	s.Shutdown(context.Background())
+	if err := <-ch; err != http.ErrServerClosed {
+		t.Errorf("run should return ErrServerClosed: %v", err)
+	}
+
+	t.Setenv("LISTEN_PID", "1")
+	if _, err := listen(conf.SystemdListen, ""); err == nil {
+		t.Errorf("sockets passed to another process should not be listened")
+	}
+}
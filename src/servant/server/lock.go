@@ -1,5 +1,6 @@
 package server
 import (
+	"context"
 	"time"
 	"sync"
 )
@@ -9,6 +10,7 @@ type Lock interface {
 	With(func())
 	TryWith(func()) bool
 	TimeoutWith(d time.Duration, f func()) bool
+	WaitWith(ctx context.Context, d time.Duration, f func()) bool
 }
 
 type ChanLock chan struct{}
@@ -17,6 +19,11 @@ func NewChanLock() ChanLock {
 	return make(chan struct{}, 1)
 }
 
+// NewChanSemaphore returns a lock which can be held by n holders at the same time
+func NewChanSemaphore(n int) ChanLock {
+	return make(chan struct{}, n)
+}
+
 var locks = make(map[string]Lock)
 var lockMapMutex sync.Mutex
 
@@ -84,3 +91,19 @@ func (self ChanLock) TimeoutWith(d time.Duration, f func()) bool {
 	f()
 	return true
 }
+
+// WaitWith is TimeoutWith giving up as soon as the context is done too
+func (self ChanLock) WaitWith(ctx context.Context, d time.Duration, f func()) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case self <- struct{}{}:
+	case <-timer.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+	defer self.unlock()
+	f()
+	return true
+}
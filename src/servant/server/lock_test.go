@@ -56,3 +56,16 @@ func TestLock(t *testing.T) {
 	}
 	time.Sleep(200 * time.Millisecond)
 }
+
+func TestSemaphore(t *testing.T) {
+	sem := NewChanSemaphore(2)
+	sem.With(func() {
+		if ! sem.TryWith(func() {
+			if sem.TryWith(func() {}) {
+				t.Error("third holder should fail")
+			}
+		}) {
+			t.Error("second holder should ok")
+		}
+	})
+}
@@ -3,16 +3,212 @@ import (
 	"os"
 	"log"
 	"fmt"
+	"io"
+	"time"
+	"regexp"
+	"encoding/json"
+	"strings"
+	"bytes"
+	"strconv"
+	"servant/conf"
 )
 var logger = log.New(os.Stdout, "", log.LstdFlags)
 
-func (self *Session) log(topic string, level string, format string, v ...interface{}) {
-	prefix := fmt.Sprintf("%s (%d) [%s] ", level, self.id, topic)
-	if len(v) == 0 {
-		logger.Println(prefix + format)
+// logJson is set when logs are written as one json object per line
+var logJson = false
+
+type logLevel int
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevels = map[string]logLevel{
+	"DEBUG": levelDebug,
+	"INFO":  levelInfo,
+	"WARN":  levelWarn,
+	"ERROR": levelError,
+	"CRIT":  levelError,
+}
+
+// logThreshold is the lowest level logged
+var logThreshold = levelInfo
+
+// logEnabled reports whether messages of the level are logged, unknown levels are always logged
+func logEnabled(level string) bool {
+	l, ok := logLevels[level]
+	return !ok || l >= logThreshold
+}
+
+// logFile is the log file if logs are not written to stdout
+var logFile *rotatingFile
+
+// reopenLog reopens the log file, after it is rotated by others
+func reopenLog() {
+	if logFile != nil {
+		if err := logFile.Reopen(); err != nil {
+			logger.Printf("WARN (_) [server] reopen log file failed: %s", err)
+		}
+	}
+	if accessLogFile != nil {
+		if err := accessLogFile.Reopen(); err != nil {
+			logger.Printf("WARN (_) [server] reopen access log file failed: %s", err)
+		}
+	}
+	if auditLog != nil {
+		if err := auditLog.file.Reopen(); err != nil {
+			logger.Printf("WARN (_) [server] reopen audit log file failed: %s", err)
+		}
+	}
+}
+
+// configureLogger sets the output and format of the logger per the log config
+func configureLogger(logConf conf.Log) {
+	var out io.Writer = os.Stdout
+	logFile = nil
+	if logConf.File != "" {
+		maxAge := time.Duration(logConf.MaxAge) * 24 * time.Hour
+		file, err := openRotatingFile(logConf.File, logConf.MaxSize * 1024 * 1024, maxAge, logConf.MaxBackups, logConf.Compress)
+		if err == nil {
+			out = file
+			logFile = file
+		} else {
+			logger.Printf("can not open log file %s", logConf.File)
+			out = logger.Writer()
+		}
+	}
+	configureAccessLog(logConf, out)
+	configureAuditLog(logConf)
+	logThreshold = levelInfo
+	if l, ok := logLevels[strings.ToUpper(logConf.Level)]; ok {
+		logThreshold = l
+	}
+	logJson = logConf.Format == "json"
+	if logJson {
+		logger.SetFlags(0)
+		out = jsonLogWriter{ out: out }
 	} else {
-		logger.Printf(prefix + format, v...)
+		logger.SetFlags(log.LstdFlags)
+	}
+	if logThreshold > levelInfo {
+		// logs without a session are formatted before reaching here, filter them by the level in the line
+		out = levelLogWriter{ out: out }
 	}
+	logger.SetOutput(out)
+}
+
+// logEvent is a log line in json format, request fields are set for session logs only
+type logEvent struct {
+	Timestamp  string   `json:"timestamp"`
+	Level      string   `json:"level"`
+	Session    string   `json:"session"`
+	RequestId  string   `json:"request_id,omitempty"`
+	Topic      string   `json:"topic"`
+	Message    string   `json:"message"`
+	Username   string   `json:"username,omitempty"`
+	Resource   string   `json:"resource,omitempty"`
+	Method     string   `json:"method,omitempty"`
+	Path       string   `json:"path,omitempty"`
+	RemoteAddr string   `json:"remote_addr,omitempty"`
+	Status     int      `json:"status,omitempty"`
+	Duration   float64  `json:"duration,omitempty"`
+	Bytes      int64    `json:"bytes,omitempty"`
+}
+
+var linePrefixRe = regexp.MustCompile(`^(?:\d{4}/\d\d/\d\d \d\d:\d\d:\d\d )?([A-Z]+) \(`)
+
+// levelLogWriter drops lines below the threshold
+type levelLogWriter struct {
+	out io.Writer
+}
+
+func (self levelLogWriter) Write(p []byte) (int, error) {
+	if !bytes.HasPrefix(p, []byte("{")) {
+		if m := linePrefixRe.FindSubmatch(p); m != nil && !logEnabled(string(m[1])) {
+			return len(p), nil
+		}
+	}
+	return self.out.Write(p)
+}
+
+var logLineRe = regexp.MustCompile(`^([A-Z]+) \(([^)]*)\) \[([^\]]*)\] (.*)$`)
+
+// jsonLogWriter converts text lines logged without a session, like daemon and timer logs, into json.
+// Lines already in json are written as is.
+type jsonLogWriter struct {
+	out io.Writer
+}
+
+func (self jsonLogWriter) Write(p []byte) (int, error) {
+	if len(p) > 0 && p[0] == '{' {
+		return self.out.Write(p)
+	}
+	line := string(p)
+	if n := len(line); n > 0 && line[n - 1] == '\n' {
+		line = line[:n - 1]
+	}
+	event := logEvent{ Timestamp: time.Now().Format(time.RFC3339Nano), Message: line }
+	if m := logLineRe.FindStringSubmatch(line); m != nil {
+		event.Level, event.Session, event.Topic, event.Message = m[1], m[2], m[3], m[4]
+	}
+	buf, _ := json.Marshal(event)
+	if _, err := self.out.Write(append(buf, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (self *Session) log(topic string, level string, format string, v ...interface{}) {
+	self.logStatus(topic, level, 0, format, v...)
+}
+
+// logStatus logs with the response status, which is only set at the end of a session
+func (self *Session) logStatus(topic string, level string, status int, format string, v ...interface{}) {
+	if !logEnabled(level) {
+		return
+	}
+	msg := format
+	if len(v) > 0 {
+		msg = fmt.Sprintf(format, v...)
+	}
+	msg = self.redact(msg)
+	if !logJson {
+		id := strconv.FormatUint(self.id, 10)
+		if self.requestId != "" {
+			id += " " + self.requestId
+		}
+		logger.Println(fmt.Sprintf("%s (%s) [%s] ", level, id, topic) + msg)
+		return
+	}
+	event := logEvent{
+		Timestamp: time.Now().Format(time.RFC3339Nano),
+		Level:     level,
+		Session:   fmt.Sprint(self.id),
+		RequestId: self.requestId,
+		Topic:     topic,
+		Message:   msg,
+		Username:  self.username,
+		Resource:  self.resource,
+	}
+	if self.req != nil {
+		event.Method, event.Path, event.RemoteAddr = self.req.Method, self.req.URL.Path, self.remoteHost()
+	}
+	if status != 0 {
+		event.Status = status
+		event.Bytes = self.responseBytes()
+		if !self.start.IsZero() {
+			event.Duration = time.Since(self.start).Seconds()
+		}
+	}
+	buf, _ := json.Marshal(event)
+	logger.Println(string(buf))
+}
+
+func (self *Session) debug(format string, v ...interface{}) {
+	self.log(self.resource, "DEBUG", format, v...)
 }
 
 func (self *Session) info(format string, v ...interface{}) {
@@ -4,6 +4,12 @@ import (
 	"testing"
 	"bytes"
 	"strings"
+	"log"
+	"servant/conf"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
 )
 
 func TestLog(t *testing.T) {
@@ -23,3 +29,138 @@ func TestLog(t *testing.T) {
 		t.Fail()
 	}
 }
+
+func TestLogJson(t *testing.T) {
+	bb := &bytes.Buffer{}
+	logJson = true
+	logger.SetFlags(0)
+	logger.SetOutput(jsonLogWriter{ out: bb })
+	defer func() {
+		logJson = false
+		logger.SetFlags(log.LstdFlags)
+	}()
+	req := httptest.NewRequest("GET", "/commands/a/b?x=1", nil)
+	resp := httptest.NewRecorder()
+	sess := NewServer(&conf.Config{}).newSession(resp, req)
+	sess.username = "u"
+	sess.info("hello %s", "world")
+	sess.ErrorEnd(http.StatusNotFound, "not found")
+	logger.Printf("INFO (_) [daemon] %s started", "d")
+	lines := strings.Split(strings.TrimSpace(bb.String()), "\n")
+	if len(lines) != 3 {
+		t.Fatalf("should log 3 lines: %q", bb.String())
+	}
+	events := make([]map[string]interface{}, len(lines))
+	for i, line := range lines {
+		if err := json.Unmarshal([]byte(line), &events[i]); err != nil {
+			t.Fatalf("line should be json: %s", line)
+		}
+	}
+	if e := events[0]; e["level"] != "INFO" || e["message"] != "hello world" || e["username"] != "u" || e["resource"] != "commands" ||
+		e["method"] != "GET" || e["path"] != "/commands/a/b" || e["remote_addr"] != "192.0.2.1" || e["status"] != nil || e["timestamp"] == nil {
+		t.Errorf("session event wrong: %v", e)
+	}
+	if e := events[1]; e["level"] != "WARN" || e["status"] != float64(404) || e["duration"] == nil {
+		t.Errorf("end event should have status and duration: %v", e)
+	}
+	if e := events[2]; e["level"] != "INFO" || e["session"] != "_" || e["topic"] != "daemon" || e["message"] != "d started" {
+		t.Errorf("text line should be converted: %v", e)
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	bb := &bytes.Buffer{}
+	logThreshold = levelWarn
+	logger.SetOutput(levelLogWriter{ out: bb })
+	defer func() {
+		logThreshold = levelInfo
+	}()
+	sess := Session{ id: 1, config: &conf.Config{}, resp: httptest.NewRecorder() }
+	sess.debug("debug")
+	sess.info("info")
+	sess.warn("warn")
+	sess.crit("crit")
+	sess.ErrorEnd(http.StatusBadGateway, "bad gateway")
+	logger.Printf("INFO (_) [daemon] started")
+	logger.Printf("WARN (_) [daemon] exited")
+	s := bb.String()
+	if strings.Contains(s, "debug") || strings.Contains(s, "info") || strings.Contains(s, "started") {
+		t.Errorf("lines below threshold should be dropped: %q", s)
+	}
+	for _, expected := range []string{"WARN (1) [] warn", "CRIT (1) [] crit", "ERROR (1) [] - bad gateway", "WARN (_) [daemon] exited"} {
+		if !strings.Contains(s, expected) {
+			t.Errorf("%s should be logged: %q", expected, s)
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	bb := &bytes.Buffer{}
+	configureAccessLog(conf.Log{ AccessFormat: "combined" }, bb)
+	defer configureAccessLog(conf.Log{}, nil)
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"c": { Commands: map[string]*conf.Command{
+				"echo": { Lang: "exec", Code: "echo hello" },
+			} },
+		},
+	})
+	req := httptest.NewRequest("GET", "/commands/c/echo?a=1", nil)
+	req.Header.Set("Referer", "http://example.com/")
+	req.Header.Set("User-Agent", `curl "7"`)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	line := bb.String()
+	expect := regexp.MustCompile(`^192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET /commands/c/echo\?a=1 HTTP/1\.1" 200 6 "http://example\.com/" "curl \\"7\\""\n$`)
+	if !expect.MatchString(line) {
+		t.Errorf("combined access log line wrong: %q", line)
+	}
+
+	bb.Reset()
+	configureAccessLog(conf.Log{ AccessFormat: "common" }, bb)
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/commands/c/none", nil))
+	expect = regexp.MustCompile(`^192\.0\.2\.1 - - \[[^\]]+\] "GET /commands/c/none HTTP/1\.1" 404 -\n$`)
+	if line := bb.String(); !expect.MatchString(line) {
+		t.Errorf("common access log line wrong: %q", line)
+	}
+
+	bb.Reset()
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", HealthPath, nil))
+	if bb.Len() != 0 {
+		t.Errorf("probes should not be logged: %q", bb.String())
+	}
+
+	if field := accessLogField("a\"b\\c\x01\xff"); field != `a\"b\\c\x01\xff` {
+		t.Errorf("field should be escaped: %s", field)
+	}
+}
+
+func TestLogSlow(t *testing.T) {
+	bb := &bytes.Buffer{}
+	out := logger.Writer()
+	logger.SetOutput(bb)
+	defer logger.SetOutput(out)
+	config := &conf.Config{
+		Server: conf.Server{ SlowThreshold: 0.1 },
+		Commands: map[string]*conf.Commands{
+			"c": { Commands: map[string]*conf.Command{
+				"sleep": { Lang: "exec", Code: "sleep 0.2" },
+				"fast": { Lang: "exec", Code: "true" },
+			} },
+		},
+	}
+	s := NewServer(config)
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/commands/c/fast", nil))
+	if strings.Contains(bb.String(), "slow request") {
+		t.Errorf("fast request should not be warned: %s", bb.String())
+	}
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/commands/c/sleep?x=1", nil))
+	if n := strings.Count(bb.String(), "WARN"); n != 1 || !regexp.MustCompile(`WARN \(\d+ [^)]+\) \[commands\] slow request GET /commands/c/sleep\?x=1 took 0\.\d{3}s, threshold 100ms`).MatchString(bb.String()) {
+		t.Errorf("slow request should be warned once: %s", bb.String())
+	}
+	bb.Reset()
+	config.Server.ResourceSlowThresholds = map[string]float64{ "commands": 10 }
+	s.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/commands/c/sleep", nil))
+	if strings.Contains(bb.String(), "slow request") {
+		t.Errorf("threshold of the resource type should override: %s", bb.String())
+	}
+}
@@ -0,0 +1,197 @@
+package server
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// backupTimeFormat is the suffix of rotated log files, sorted by name as by time
+const backupTimeFormat = "20060102-150405"
+
+// logFileCheckInterval is how often the log file is checked for being moved or truncated by others
+var logFileCheckInterval = time.Second
+
+// rotatingFile is a log file rotated by size and age. Rotated files are renamed with a time suffix,
+// and compressed if configured. The file is reopened if it is moved away or truncated by logrotate.
+type rotatingFile struct {
+	lock       sync.Mutex
+	path       string
+	maxSize    int64
+	maxAge     time.Duration
+	maxBackups int
+	compress   bool
+	file       *os.File
+	size       int64
+	openedAt   time.Time
+	checkedAt  time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, maxAge time.Duration, maxBackups int, compress bool) (*rotatingFile, error) {
+	ret := &rotatingFile{
+		path: path,
+		maxSize: maxSize,
+		maxAge: maxAge,
+		maxBackups: maxBackups,
+		compress: compress,
+	}
+	if err := ret.open(); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (self *rotatingFile) open() error {
+	file, err := os.OpenFile(self.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	self.file, self.size = file, info.Size()
+	self.openedAt, self.checkedAt = time.Now(), time.Now()
+	// age of an existing file counts from its last rotation, close enough by its mtime on restart
+	if self.size > 0 {
+		self.openedAt = info.ModTime()
+	}
+	return nil
+}
+
+func (self *rotatingFile) Write(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file == nil {
+		if err := self.open(); err != nil {
+			return 0, err
+		}
+	}
+	if time.Since(self.checkedAt) >= logFileCheckInterval {
+		self.check()
+	}
+	if (self.maxSize > 0 && self.size + int64(len(p)) > self.maxSize && self.size > 0) ||
+		(self.maxAge > 0 && time.Since(self.openedAt) >= self.maxAge && self.size > 0) {
+		if err := self.rotate(); err != nil {
+			fmt.Fprintf(os.Stderr, "rotate log %s failed: %s\n", self.path, err)
+		}
+	}
+	if self.file == nil {
+		return 0, fmt.Errorf("log %s not opened", self.path)
+	}
+	n, err := self.file.Write(p)
+	self.size += int64(n)
+	return n, err
+}
+
+// check reopens the file if it is not at the path any more, and follows the size if truncated
+func (self *rotatingFile) check() {
+	self.checkedAt = time.Now()
+	info, err := self.file.Stat()
+	if err != nil {
+		return
+	}
+	pathInfo, err := os.Stat(self.path)
+	if err != nil || !os.SameFile(info, pathInfo) {
+		self.file.Close()
+		if err := self.open(); err != nil {
+			fmt.Fprintf(os.Stderr, "reopen log %s failed: %s\n", self.path, err)
+		}
+		return
+	}
+	if info.Size() < self.size {
+		self.size = info.Size()
+	}
+}
+
+// Reopen closes and opens the file again, for rotation by others
+func (self *rotatingFile) Reopen() error {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if self.file != nil {
+		self.file.Close()
+		self.file = nil
+	}
+	return self.open()
+}
+
+func (self *rotatingFile) rotate() error {
+	self.file.Close()
+	self.file = nil
+	backup := self.path + "." + time.Now().Format(backupTimeFormat)
+	for i := 1; backupExists(backup); i++ {
+		backup = fmt.Sprintf("%s.%s.%d", self.path, time.Now().Format(backupTimeFormat), i)
+	}
+	renameErr := os.Rename(self.path, backup)
+	if err := self.open(); err != nil {
+		return err
+	}
+	if renameErr != nil {
+		return renameErr
+	}
+	go func() {
+		if self.compress {
+			if err := compressFile(backup); err != nil {
+				fmt.Fprintf(os.Stderr, "compress log %s failed: %s\n", backup, err)
+			}
+		}
+		self.removeBackups()
+	}()
+	return nil
+}
+
+func backupExists(backup string) bool {
+	for _, name := range []string{backup, backup + ".gz"} {
+		if _, err := os.Lstat(name); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// removeBackups removes the oldest rotated files more than maxBackups
+func (self *rotatingFile) removeBackups() {
+	if self.maxBackups <= 0 {
+		return
+	}
+	backups, err := filepath.Glob(self.path + ".[0-9]*")
+	if err != nil {
+		return
+	}
+	sort.Strings(backups)
+	for len(backups) > self.maxBackups {
+		os.Remove(backups[0])
+		backups = backups[1:]
+	}
+}
+
+func compressFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(path + ".gz", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0664)
+	if err != nil {
+		return err
+	}
+	gz := gzip.NewWriter(out)
+	_, err = io.Copy(gz, in)
+	if err == nil {
+		err = gz.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,115 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servant.log")
+	f, err := openRotatingFile(path, 10, 0, 2, false)
+	if err != nil {
+		t.Fatalf("open failed: %s", err)
+	}
+	// backups are named by seconds, colliding names get a counter
+	for i := 0; i < 5; i++ {
+		f.Write([]byte("12345678\n"))
+	}
+	time.Sleep(100 * time.Millisecond)
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("should keep 2 backups: %v", backups)
+	}
+	if data, _ := os.ReadFile(path); string(data) != "12345678\n" {
+		t.Errorf("current file wrong: %q", data)
+	}
+
+	// compressed backups
+	path = filepath.Join(dir, "gz.log")
+	f, _ = openRotatingFile(path, 10, 0, 0, true)
+	f.Write([]byte("12345678\n"))
+	f.Write([]byte("12345678\n"))
+	time.Sleep(100 * time.Millisecond)
+	backups, _ = filepath.Glob(path + ".*")
+	if len(backups) != 1 || !strings.HasSuffix(backups[0], ".gz") {
+		t.Errorf("backup should be compressed: %v", backups)
+	}
+
+	// rotated by age
+	path = filepath.Join(dir, "age.log")
+	f, _ = openRotatingFile(path, 0, time.Hour, 0, false)
+	f.Write([]byte("old\n"))
+	f.openedAt = time.Now().Add(-2 * time.Hour)
+	f.Write([]byte("new\n"))
+	if data, _ := os.ReadFile(path); string(data) != "new\n" {
+		t.Errorf("old file should be rotated: %q", data)
+	}
+}
+
+func TestRotatingFileReopen(t *testing.T) {
+	logFileCheckInterval = 0
+	defer func() {
+		logFileCheckInterval = time.Second
+	}()
+	dir := t.TempDir()
+	path := filepath.Join(dir, "servant.log")
+	f, _ := openRotatingFile(path, 20, 0, 0, false)
+	f.Write([]byte("before\n"))
+	// moved away by logrotate
+	os.Rename(path, path + ".1")
+	f.Write([]byte("after move\n"))
+	if data, _ := os.ReadFile(path); string(data) != "after move\n" {
+		t.Errorf("moved file should be reopened: %q", data)
+	}
+	// truncated by logrotate copytruncate, the size starts over
+	os.Truncate(path, 0)
+	f.Write([]byte("after truncate\n"))
+	if data, _ := os.ReadFile(path); string(data) != "after truncate\n" {
+		t.Errorf("truncated file should not be rotated: %q", data)
+	}
+	os.Rename(path, path + ".2")
+	f.Reopen()
+	f.Write([]byte("reopened\n"))
+	if data, _ := os.ReadFile(path); string(data) != "reopened\n" {
+		t.Errorf("file should be reopened: %q", data)
+	}
+}
+
+func TestRotatingFileReopenConcurrent(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "servant.log")
+	f, _ := openRotatingFile(path, 0, 0, 0, false)
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				f.Write([]byte("line\n"))
+			}
+		}()
+	}
+	// moved away and reopened while written, no line is lost or torn
+	for i := 0; i < 5; i++ {
+		os.Rename(path, fmt.Sprintf("%s.%d", path, i))
+		f.Reopen()
+	}
+	wg.Wait()
+	lines := 0
+	files, _ := filepath.Glob(path + "*")
+	for _, file := range files {
+		data, _ := os.ReadFile(file)
+		if strings.Count(string(data), "line\n") * 5 != len(data) {
+			t.Errorf("torn lines in %s", file)
+		}
+		lines += strings.Count(string(data), "line\n")
+	}
+	if lines != 800 {
+		t.Errorf("lines lost on reopen: %d", lines)
+	}
+}
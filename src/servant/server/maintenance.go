@@ -0,0 +1,85 @@
+package server
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// maintenanceCheckInterval is how often the maintenance param is checked for pausing tasks
+var maintenanceCheckInterval = time.Second
+
+// SetMaintenance turns maintenance mode on or off, as SIGUSR1 does. It takes effect at once,
+// and daemons and timers are paused or resumed if configured.
+func (self *Server) SetMaintenance(on bool) {
+	var v int32
+	if on {
+		v = 1
+	}
+	atomic.StoreInt32(&self.maintenance, v)
+	self.applyMaintenance()
+}
+
+// inMaintenance reports whether maintenance mode is on by SetMaintenance or by the param
+func (self *Server) inMaintenance() bool {
+	if atomic.LoadInt32(&self.maintenance) != 0 {
+		return true
+	}
+	param := self.Config().Server.Maintenance.Param
+	if param == "" {
+		return false
+	}
+	v, _ := GetGlobalParam(param)
+	switch strings.ToLower(strings.TrimSpace(v)) {
+	case "", "0", "false", "off":
+		return false
+	}
+	return true
+}
+
+// isMaintenanceVar reports whether the request is to the var switching maintenance mode,
+// which is still served so that maintenance mode can be turned off by the vars api
+func (self *Session) isMaintenanceVar() bool {
+	param := self.config.Server.Maintenance.Param
+	return param != "" && self.resource == "vars" && self.group + "." + self.item == param
+}
+
+// applyMaintenance pauses daemons and timers when maintenance mode turns on, and resumes them when off
+func (self *Server) applyMaintenance() {
+	if !self.Config().Server.Maintenance.PauseTasks {
+		return
+	}
+	self.maintenanceLock.Lock()
+	defer self.maintenanceLock.Unlock()
+	on := self.inMaintenance()
+	if on == self.tasksPaused {
+		return
+	}
+	self.tasksPaused = on
+	if on {
+		logger.Println("INFO (_) [server] maintenance mode on, pausing daemons and timers")
+		self.StopTasks()
+	} else {
+		logger.Println("INFO (_) [server] maintenance mode off, resuming daemons and timers")
+		self.StartDaemons()
+		self.StartTimers()
+	}
+}
+
+// startTasks starts daemons and timers unless they are paused for maintenance
+func (self *Server) startTasks() {
+	self.maintenanceLock.Lock()
+	defer self.maintenanceLock.Unlock()
+	if self.tasksPaused {
+		return
+	}
+	self.StartDaemons()
+	self.StartTimers()
+}
+
+// watchMaintenance follows the maintenance param, which may be changed by the vars api at any time
+func (self *Server) watchMaintenance() {
+	for range time.Tick(maintenanceCheckInterval) {
+		self.applyMaintenance()
+	}
+}
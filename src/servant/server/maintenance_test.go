@@ -0,0 +1,80 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"servant/conf"
+)
+
+func TestMaintenance(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			Metrics: conf.Metrics{ Enabled: true, Path: "/metrics" },
+			Maintenance: conf.Maintenance{ Param: "servant.maintenance", RetryAfter: 30, PauseTasks: true },
+		},
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{ "echo": &conf.Command{ Lang: "exec", Code: "echo ok" } } },
+		},
+		Vars: map[string]*conf.Vars{
+			"servant": &conf.Vars{ Vars: map[string]*conf.Var{ "maintenance": &conf.Var{ Patterns: []string{".*"} } } },
+		},
+		Daemons: map[string]*conf.Daemon{
+			"d": &conf.Daemon{ Lang: "bash", Code: "sleep 30", Restart: "never" },
+		},
+	})
+	defer DeleteGlobalParam("servant.maintenance")
+	defer s.StopTasks()
+	s.startTasks()
+	s.setReady(true)
+	get := func(method, path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest(method, path, nil))
+		return resp
+	}
+	if resp := get("GET", "/commands/c/echo"); resp.Code != http.StatusOK {
+		t.Errorf("command should be served: %d", resp.Code)
+	}
+
+	s.SetMaintenance(true)
+	resp := get("GET", "/commands/c/echo")
+	if resp.Code != http.StatusServiceUnavailable || resp.Header().Get("Retry-After") != "30" {
+		t.Errorf("command should be rejected in maintenance: %d %q", resp.Code, resp.Header().Get("Retry-After"))
+	}
+	for _, path := range []string{HealthPath, "/metrics"} {
+		if resp := get("GET", path); resp.Code != http.StatusOK {
+			t.Errorf("%s should be served in maintenance: %d", path, resp.Code)
+		}
+	}
+	if resp := get("GET", ReadyPath); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("server should not be ready in maintenance: %d", resp.Code)
+	}
+	s.tasksLock.Lock()
+	daemons := len(s.daemons)
+	s.tasksLock.Unlock()
+	if daemons != 0 {
+		t.Errorf("daemons should be paused")
+	}
+
+	s.SetMaintenance(false)
+	s.tasksLock.Lock()
+	daemons = len(s.daemons)
+	s.tasksLock.Unlock()
+	if daemons != 1 {
+		t.Errorf("daemons should be resumed")
+	}
+
+	SetGlobalParam("servant.maintenance", "on")
+	if resp := get("GET", "/commands/c/echo"); resp.Code != http.StatusServiceUnavailable {
+		t.Errorf("command should be rejected by the param: %d", resp.Code)
+	}
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("PUT", "/vars/servant/maintenance", strings.NewReader("off")))
+	if resp.Code != http.StatusOK {
+		t.Errorf("maintenance var should be served in maintenance: %d", resp.Code)
+	}
+	if resp := get("GET", "/commands/c/echo"); resp.Code != http.StatusOK {
+		t.Errorf("maintenance should be off by the var api: %d", resp.Code)
+	}
+}
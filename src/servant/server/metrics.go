@@ -0,0 +1,207 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// metrics are exposed in the prometheus text format, label values are bounded by the config
+var (
+	requestsTotal = newCounterVec("servant_requests_total",
+		"Requests served by resource and status.", "resource", "status")
+	requestDuration = newHistogramVec("servant_request_duration_seconds",
+		"Request latencies by resource.", requestBuckets, "resource")
+	commandDuration = newHistogramVec("servant_command_duration_seconds",
+		"Command execution durations by command.", commandBuckets, "command")
+	commandExits = newCounterVec("servant_command_exits_total",
+		"Command executions by command and exit code.", "command", "code")
+	daemonRestarts = newCounterVec("servant_daemon_restarts_total",
+		"Daemon restarts by daemon.", "daemon")
+	activeSessions = &gauge{ name: "servant_active_sessions", help: "Sessions being served." }
+	activeConns = &gauge{ name: "servant_active_connections", help: "Connections open of all listeners." }
+)
+
+var requestBuckets = []float64{ .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10 }
+var commandBuckets = []float64{ .01, .1, .5, 1, 5, 10, 30, 60, 300 }
+
+type metric interface {
+	write(w io.Writer)
+}
+
+var allMetrics = []metric{ requestsTotal, requestDuration, commandDuration, commandExits, daemonRestarts, activeSessions, activeConns }
+
+// writeMetrics writes all metrics in the prometheus text exposition format
+func writeMetrics(w io.Writer) {
+	for _, m := range allMetrics {
+		m.write(w)
+	}
+}
+
+func formatLabels(names, values []string, extra ...string) string {
+	pairs := make([]string, 0, len(names) + 1)
+	for i, name := range names {
+		pairs = append(pairs, name + "=" + strconv.Quote(values[i]))
+	}
+	for i := 0; i + 1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i] + "=" + strconv.Quote(extra[i + 1]))
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+type counterVec struct {
+	name, help string
+	labels     []string
+	lock       sync.Mutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{ name: name, help: help, labels: labels, values: make(map[string]*counterValue) }
+}
+
+func (self *counterVec) inc(labels ...string) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	v, ok := self.values[key]
+	if !ok {
+		v = &counterValue{ labels: labels }
+		self.values[key] = v
+	}
+	v.value++
+}
+
+func (self *counterVec) get(labels ...string) float64 {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if v, ok := self.values[strings.Join(labels, "\xff")]; ok {
+		return v.value
+	}
+	return 0
+}
+
+func (self *counterVec) write(w io.Writer) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", self.name, self.help, self.name)
+	for _, key := range sortedKeys(self.values) {
+		v := self.values[key]
+		fmt.Fprintf(w, "%s%s %s\n", self.name, formatLabels(self.labels, v.labels), formatFloat(v.value))
+	}
+}
+
+type histogramVec struct {
+	name, help string
+	labels     []string
+	buckets    []float64
+	lock       sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // per bucket, not cumulative
+	count  uint64
+	sum    float64
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{ name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue) }
+}
+
+func (self *histogramVec) observe(d time.Duration, labels ...string) {
+	seconds := d.Seconds()
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	key := strings.Join(labels, "\xff")
+	v, ok := self.values[key]
+	if !ok {
+		v = &histogramValue{ labels: labels, counts: make([]uint64, len(self.buckets)) }
+		self.values[key] = v
+	}
+	if i := sort.SearchFloat64s(self.buckets, seconds); i < len(self.buckets) {
+		v.counts[i]++
+	}
+	v.count++
+	v.sum += seconds
+}
+
+func (self *histogramVec) write(w io.Writer) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", self.name, self.help, self.name)
+	for _, key := range sortedKeys(self.values) {
+		v := self.values[key]
+		var cumulative uint64
+		for i, le := range self.buckets {
+			cumulative += v.counts[i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, formatLabels(self.labels, v.labels, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", self.name, formatLabels(self.labels, v.labels, "le", "+Inf"), v.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", self.name, formatLabels(self.labels, v.labels), formatFloat(v.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", self.name, formatLabels(self.labels, v.labels), v.count)
+	}
+}
+
+type gauge struct {
+	name, help string
+	value      int64
+}
+
+func (self *gauge) add(n int64) {
+	atomic.AddInt64(&self.value, n)
+}
+
+func (self *gauge) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %d\n", self.name, self.help, self.name, self.name, atomic.LoadInt64(&self.value))
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// serveMetrics serves the metrics endpoint, authenticated like resources if configured
+func (self *Session) serveMetrics() {
+	if self.config.Server.Metrics.Auth {
+		if !self.authenticate() {
+			return
+		}
+	}
+	if self.req.Method != "GET" && self.req.Method != "HEAD" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not supported method %s", self.req.Method)
+		return
+	}
+	self.resp.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if self.req.Method == "GET" {
+		writeMetrics(self.resp)
+	}
+	self.GoodEnd("metrics served")
+}
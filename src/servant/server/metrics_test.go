@@ -0,0 +1,90 @@
+package server
+
+import (
+	"testing"
+	"servant/conf"
+	"bytes"
+	"strings"
+	"time"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestWriteMetrics(t *testing.T) {
+	counter := newCounterVec("test_total", "Test counter.", "a", "b")
+	counter.inc("x", "1")
+	counter.inc("x", "1")
+	counter.inc("y", "2")
+	histogram := newHistogramVec("test_seconds", "Test histogram.", []float64{ .1, 1 }, "a")
+	histogram.observe(50 * time.Millisecond, "x")
+	histogram.observe(500 * time.Millisecond, "x")
+	histogram.observe(5 * time.Second, "x")
+	out := &bytes.Buffer{}
+	counter.write(out)
+	histogram.write(out)
+	expected := `# HELP test_total Test counter.
+# TYPE test_total counter
+test_total{a="x",b="1"} 2
+test_total{a="y",b="2"} 1
+# HELP test_seconds Test histogram.
+# TYPE test_seconds histogram
+test_seconds_bucket{a="x",le="0.1"} 1
+test_seconds_bucket{a="x",le="1"} 2
+test_seconds_bucket{a="x",le="+Inf"} 3
+test_seconds_sum{a="x"} 5.55
+test_seconds_count{a="x"} 3
+`
+	if out.String() != expected {
+		t.Errorf("metrics output wrong:\n%s", out.String())
+	}
+}
+
+func TestServeMetrics(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ Metrics: conf.Metrics{ Enabled: true, Path: "/metrics" } },
+		Commands: map[string]*conf.Commands{
+			"m": &conf.Commands{ Commands: map[string]*conf.Command{
+				"fail": &conf.Command{ Lang: "bash", Code: "exit 3" },
+			} },
+		},
+	})
+	before := requestsTotal.get("commands", "502")
+	exitsBefore := commandExits.get("m.fail", "3")
+	req := httptest.NewRequest("GET", "/commands/m/fail", nil)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	req = httptest.NewRequest("GET", "/nonexistent/a/b", nil)
+	s.ServeHTTP(httptest.NewRecorder(), req)
+	if requestsTotal.get("commands", "502") != before + 1 || commandExits.get("m.fail", "3") != exitsBefore + 1 {
+		t.Errorf("command request should be counted")
+	}
+	if requestsTotal.get("unknown", "404") == 0 {
+		t.Errorf("unknown resource should be counted as unknown")
+	}
+
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	body := resp.Body.String()
+	for _, expected := range []string{
+		`servant_requests_total{resource="commands",status="502"}`,
+		`servant_request_duration_seconds_count{resource="commands"}`,
+		`servant_command_exits_total{command="m.fail",code="3"}`,
+		`servant_command_duration_seconds_bucket{command="m.fail",le="+Inf"}`,
+		"# TYPE servant_daemon_restarts_total counter",
+		"servant_active_sessions 1",
+	} {
+		if !strings.Contains(body, expected) {
+			t.Errorf("metrics should contain %s:\n%s", expected, body)
+		}
+	}
+	if !strings.HasPrefix(resp.Header().Get("Content-Type"), "text/plain") {
+		t.Errorf("content type wrong: %s", resp.Header().Get("Content-Type"))
+	}
+
+	s.config.Auth.Enabled = true
+	s.config.Server.Metrics.Auth = true
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", "/metrics", nil))
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("metrics should require auth: %d", resp.Code)
+	}
+}
@@ -0,0 +1,206 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// paramSource is what namespaced params like ${_header.X_Foo} are resolved from
+type paramSource struct {
+	req      *http.Request
+	clientIp string
+	now      time.Time
+}
+
+// paramNamespaces resolve params with a leading underscore by the namespace before the dot,
+// params of unknown namespaces are empty
+var paramNamespaces = map[string]func(src *paramSource, name string) (string, bool){
+	"_env": globalNamespaceParam("_env"),
+	"_arg": globalNamespaceParam("_arg"),
+	// header names are written with underscores for dashes, e.g. ${_header.X_Foo} for X-Foo
+	"_header": func(src *paramSource, name string) (string, bool) {
+		if src.req == nil {
+			return "", false
+		}
+		vs := src.req.Header.Values(strings.ReplaceAll(name, "_", "-"))
+		if len(vs) == 0 {
+			return "", false
+		}
+		return vs[0], true
+	},
+	"_remote": func(src *paramSource, name string) (string, bool) {
+		if name != "ip" || src.clientIp == "" {
+			return "", false
+		}
+		return src.clientIp, true
+	},
+	"_time": func(src *paramSource, name string) (string, bool) {
+		switch name {
+		case "unix":
+			return strconv.FormatInt(src.now.Unix(), 10), true
+		case "unix_ms":
+			return strconv.FormatInt(src.now.UnixMilli(), 10), true
+		case "rfc3339":
+			return src.now.Format(time.RFC3339), true
+		}
+		return "", false
+	},
+}
+
+// globalNamespaceParam resolves params set at start, like process environments and arguments
+func globalNamespaceParam(ns string) func(*paramSource, string) (string, bool) {
+	return func(src *paramSource, name string) (string, bool) {
+		return GetGlobalParam(ns + "." + name)
+	}
+}
+
+func (self *paramSource) namespaceParam(k string) (string, bool) {
+	ns, name, _ := strings.Cut(k, ".")
+	resolve, ok := paramNamespaces[ns]
+	if !ok {
+		return "", true
+	}
+	return resolve(self, name)
+}
+
+// requestParams resolves ${aaa} ${foo.bar} ${_env.PATH} params of a request, the request is nil for timers and
+// daemons. Namespaced params are resolved first, then global params, then the query string and the body.
+func requestParams(req *http.Request, clientIp string) ParamFunc {
+	var q url.Values // should be out of the closure, to avoid parse query many times
+	var body map[string]string
+	if req != nil {
+		q = req.URL.Query()
+		body = bodyParams(req)
+	}
+	src := &paramSource{ req: req, clientIp: clientIp, now: time.Now() }
+	var ret func(k string) (string, bool)
+	d := 0
+	ret = func(k string) (string, bool) {
+		if strings.HasPrefix(k, "_") {
+			return src.namespaceParam(k)
+		}
+		if v, ok := GetGlobalParam(k); ok {
+			// only global params can be expanded
+			if GetVarCanExpand(k) {
+				d++
+				if d > MaxVarExpandDepth {
+					return "", false
+				}
+				var exists bool
+				v, exists = replaceCmdParams(v, ret)
+				if !exists {
+					return "", false
+				}
+			}
+			return v, true
+		}
+		if req == nil {
+			return "", false
+		}
+		// the query string overrides the body
+		if paramNameRe.MatchString(k) {
+			if vs, ok := q[k]; ok && len(vs) > 0 {
+				return vs[0], true
+			}
+		}
+		if bodyParamNameRe.MatchString(k) {
+			v, ok := body[k]
+			return v, ok
+		}
+		return "", false
+	}
+	return ret
+}
+
+// maxParamBodyBytes bounds the body parsed for params, larger bodies are left for the handler only
+const maxParamBodyBytes = 1 << 20
+
+// bodyParams parses an application/x-www-form-urlencoded or application/json request body as params.
+// The body is restored after reading, so it is still available e.g. as stdin of a command.
+// Nested json objects are indexed by dotted names like foo.bar.
+func bodyParams(req *http.Request) map[string]string {
+	if req == nil || req.Body == nil || req.Body == http.NoBody {
+		return nil
+	}
+	mediaType, _, _ := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	if mediaType != "application/x-www-form-urlencoded" && mediaType != "application/json" {
+		return nil
+	}
+	body := req.Body
+	data, err := io.ReadAll(io.LimitReader(body, maxParamBodyBytes + 1))
+	req.Body = struct {
+		io.Reader
+		io.Closer
+	}{ io.MultiReader(bytes.NewReader(data), body), body }
+	if err != nil || len(data) > maxParamBodyBytes {
+		return nil
+	}
+	if mediaType == "application/json" {
+		return jsonParams(data)
+	}
+	values, err := url.ParseQuery(string(data))
+	if err != nil {
+		return nil
+	}
+	ret := make(map[string]string)
+	for k, vs := range values {
+		if len(vs) > 0 {
+			ret[k] = vs[0]
+		}
+	}
+	return ret
+}
+
+// jsonParams flattens a json object into params, objects and arrays not indexed are kept as json text
+func jsonParams(data []byte) map[string]string {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var obj map[string]interface{}
+	if err := decoder.Decode(&obj); err != nil {
+		return nil
+	}
+	ret := make(map[string]string)
+	for k, v := range obj {
+		if s, ok := jsonParamValue(v); ok {
+			ret[k] = s
+		}
+		if nested, ok := v.(map[string]interface{}); ok {
+			for nk, nv := range nested {
+				if s, ok := jsonParamValue(nv); ok {
+					ret[k + "." + nk] = s
+				}
+			}
+		}
+	}
+	return ret
+}
+
+// jsonParamValue formats a json value as a param, null is taken as missing
+func jsonParamValue(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case nil:
+		return "", false
+	case string:
+		return v, true
+	case json.Number:
+		return v.String(), true
+	case bool:
+		if v {
+			return "true", true
+		}
+		return "false", true
+	default:
+		buf, err := json.Marshal(v)
+		if err != nil {
+			return "", false
+		}
+		return string(buf), true
+	}
+}
@@ -0,0 +1,88 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBodyParams(t *testing.T) {
+	req, _ := http.NewRequest("POST", "/commands/a/b?a=query", strings.NewReader("a=form&b=form+b"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	params := requestParams(req, "")
+	if v, _ := params("a"); v != "query" {
+		t.Errorf("query should override body: %q", v)
+	}
+	if v, _ := params("b"); v != "form b" {
+		t.Errorf("form param should be read: %q", v)
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != "a=form&b=form+b" {
+		t.Errorf("body should be kept for later readers: %q", body)
+	}
+
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader(`{"s":"x","n":1.50,"t":true,"z":null,"o":{"k":"v","i":[1,2]}}`))
+	req.Header.Set("Content-Type", "application/json; charset=utf-8")
+	params = requestParams(req, "")
+	expects := map[string]string{ "s": "x", "n": "1.50", "t": "true", "o.k": "v", "o.i": "[1,2]", "o": `{"i":[1,2],"k":"v"}` }
+	for k, expect := range expects {
+		if v, ok := params(k); !ok || v != expect {
+			t.Errorf("json param %s should be %q: %q %v", k, expect, v, ok)
+		}
+	}
+	if _, ok := params("z"); ok {
+		t.Errorf("null should be missing")
+	}
+
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader(`a=1`))
+	req.Header.Set("Content-Type", "text/plain")
+	if _, ok := requestParams(req, "")("a"); ok {
+		t.Errorf("other content types should not be parsed")
+	}
+
+	large := "a=" + strings.Repeat("x", maxParamBodyBytes)
+	req, _ = http.NewRequest("POST", "/commands/a/b", strings.NewReader(large))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	if _, ok := requestParams(req, "")("a"); ok {
+		t.Errorf("too large body should not be parsed")
+	}
+	if body, _ := io.ReadAll(req.Body); string(body) != large {
+		t.Errorf("too large body should be kept whole: %d", len(body))
+	}
+}
+
+func TestNamespaceParams(t *testing.T) {
+	os.Setenv("SERVANT_TEST_NS", "env")
+	SetEnvVars()
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	req.Header.Set("X-Foo-Bar", "header")
+	params := requestParams(req, "10.0.0.1")
+	expects := map[string]string{
+		"_env.SERVANT_TEST_NS": "env",
+		"_header.X_Foo_Bar": "header",
+		"_header.x_foo_bar": "header",
+		"_remote.ip": "10.0.0.1",
+		"_unknown.x": "",
+	}
+	for k, expect := range expects {
+		if v, ok := params(k); !ok || v != expect {
+			t.Errorf("%s should be %q: %q %v", k, expect, v, ok)
+		}
+	}
+	if v, ok := params("_time.unix"); !ok || v == "" {
+		t.Errorf("_time.unix should be set")
+	} else if n, _ := strconv.ParseInt(v, 10, 64); time.Since(time.Unix(n, 0)) > time.Minute {
+		t.Errorf("_time.unix should be now: %s", v)
+	}
+	for _, k := range []string{"_header.X_Missing", "_remote.port", "_time.unknown", "_env.SERVANT_TEST_MISSING"} {
+		if _, ok := params(k); ok {
+			t.Errorf("%s should be missing", k)
+		}
+	}
+	if _, ok := requestParams(nil, "")("_header.X_Foo_Bar"); ok {
+		t.Errorf("headers should be missing without a request")
+	}
+}
@@ -0,0 +1,34 @@
+package server
+
+import (
+	"net/http"
+	"net/http/pprof"
+)
+
+// servePprof serves a profile of net/http/pprof by its name under the pprof path, the index for an empty name.
+// Profiles are sensitive, so authentication is always checked.
+func (self *Session) servePprof(name string) {
+	if !self.authenticate() {
+		return
+	}
+	switch name {
+	case "":
+		pprof.Index(self.resp, self.req)
+	case "cmdline":
+		pprof.Cmdline(self.resp, self.req)
+	case "profile":
+		pprof.Profile(self.resp, self.req)
+	case "symbol":
+		pprof.Symbol(self.resp, self.req)
+	case "trace":
+		pprof.Trace(self.resp, self.req)
+	default:
+		// heap, goroutine, block, mutex, allocs and threadcreate
+		pprof.Handler(name).ServeHTTP(self.resp, self.req)
+	}
+	if status := self.responseStatus(); status >= http.StatusBadRequest {
+		self.BadEnd("pprof %s failed with %d", name, status)
+		return
+	}
+	self.GoodEnd("pprof %s served", name)
+}
@@ -0,0 +1,41 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"servant/conf"
+)
+
+func TestServePprof(t *testing.T) {
+	config := &conf.Config{ Server: conf.Server{ Pprof: conf.Pprof{ Path: "/debug/pprof/" } } }
+	s := NewServer(config)
+	get := func(path string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, httptest.NewRequest("GET", path, nil))
+		return resp
+	}
+	if resp := get("/debug/pprof/"); resp.Code == http.StatusOK {
+		t.Errorf("pprof should be off by default")
+	}
+
+	config.Server.Pprof.Enabled = true
+	if resp := get("/debug/pprof/"); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "goroutine") {
+		t.Errorf("index should be served: %d", resp.Code)
+	}
+	if resp := get("/debug/pprof/goroutine?debug=1"); resp.Code != http.StatusOK || !strings.Contains(resp.Body.String(), "goroutine profile") {
+		t.Errorf("goroutine profile should be served: %d", resp.Code)
+	}
+	if resp := get("/debug/pprof/heap"); resp.Code != http.StatusOK {
+		t.Errorf("heap profile should be served: %d", resp.Code)
+	}
+	if resp := get("/debug/pprof/nonexistent"); resp.Code != http.StatusNotFound {
+		t.Errorf("unknown profile should be not found: %d", resp.Code)
+	}
+
+	config.Auth.Enabled = true
+	if resp := get("/debug/pprof/heap"); resp.Code != http.StatusUnauthorized {
+		t.Errorf("pprof should need auth: %d", resp.Code)
+	}
+}
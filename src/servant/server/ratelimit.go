@@ -0,0 +1,102 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+	"servant/conf"
+)
+
+// rateLimitCleanupInterval is how often idle buckets are dropped
+var rateLimitCleanupInterval = time.Minute
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+	limit  conf.RateLimit
+}
+
+// refill adds tokens for the time passed since the last call
+func (self *tokenBucket) refill(now time.Time) {
+	self.tokens = math.Min(float64(self.limit.Burst), self.tokens + now.Sub(self.last).Seconds() * self.limit.Rate)
+	self.last = now
+}
+
+// rateLimiter keeps token buckets by key, buckets refilled to full are dropped periodically
+type rateLimiter struct {
+	lock      sync.Mutex
+	buckets   map[string]*tokenBucket
+	cleanedAt time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{ buckets: make(map[string]*tokenBucket), cleanedAt: time.Now() }
+}
+
+// take takes a token from the bucket of key, or returns how long to wait for one
+func (self *rateLimiter) take(key string, limit conf.RateLimit, now time.Time) (bool, time.Duration) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	if now.Sub(self.cleanedAt) >= rateLimitCleanupInterval {
+		self.cleanup(now)
+	}
+	bucket, ok := self.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{ tokens: float64(limit.Burst), last: now, limit: limit }
+		self.buckets[key] = bucket
+	}
+	// the limit may be changed by reloading
+	bucket.limit = limit
+	bucket.refill(now)
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		return true, 0
+	}
+	wait := time.Duration((1 - bucket.tokens) / limit.Rate * float64(time.Second))
+	return false, wait
+}
+
+func (self *rateLimiter) cleanup(now time.Time) {
+	self.cleanedAt = now
+	for key, bucket := range self.buckets {
+		bucket.refill(now)
+		if bucket.tokens >= float64(bucket.limit.Burst) {
+			delete(self.buckets, key)
+		}
+	}
+}
+
+// checkRateLimit takes tokens of the client, by username or client ip if not authenticated.
+// It ends the session with 429 and returns false if over the limit.
+func (self *Session) checkRateLimit() bool {
+	key := "ip:" + self.remoteHost()
+	if self.username != "" {
+		key = "user:" + self.username
+	}
+	limit := self.config.Server.RateLimit
+	if user := self.UserConfig(); user != nil && user.RateLimit != nil {
+		limit = user.RateLimit
+	}
+	now := time.Now()
+	limiter := self.server.rateLimiter
+	if limit != nil {
+		if ok, wait := limiter.take(key, *limit, now); !ok {
+			self.tooManyRequests(wait)
+			return false
+		}
+	}
+	if limit := self.config.Server.ResourceRateLimits[self.resource]; limit != nil {
+		if ok, wait := limiter.take(key + "/" + self.resource, *limit, now); !ok {
+			self.tooManyRequests(wait)
+			return false
+		}
+	}
+	return true
+}
+
+func (self *Session) tooManyRequests(wait time.Duration) {
+	self.resp.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	self.ErrorEnd(http.StatusTooManyRequests, "rate limit exceeded, retry after %s", wait.Round(time.Millisecond))
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"testing"
+	"servant/conf"
+	"time"
+	"net/http"
+	"net/http/httptest"
+)
+
+func TestRateLimiter(t *testing.T) {
+	limiter := newRateLimiter()
+	limit := conf.RateLimit{ Rate: 2, Burst: 3 }
+	now := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := limiter.take("a", limit, now); !ok {
+			t.Errorf("burst should be allowed: %d", i)
+		}
+	}
+	ok, wait := limiter.take("a", limit, now)
+	if ok || wait != 500 * time.Millisecond {
+		t.Errorf("over burst should wait: %v %s", ok, wait)
+	}
+	if ok, _ := limiter.take("b", limit, now); !ok {
+		t.Errorf("buckets should be by key")
+	}
+	if ok, _ := limiter.take("a", limit, now.Add(500 * time.Millisecond)); !ok {
+		t.Errorf("token should be refilled")
+	}
+	// full buckets are dropped later
+	limiter.take("a", limit, now.Add(rateLimitCleanupInterval + time.Second))
+	if len(limiter.buckets) != 1 {
+		t.Errorf("idle buckets should be cleaned: %d", len(limiter.buckets))
+	}
+}
+
+func TestServeRateLimit(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			RateLimit: &conf.RateLimit{ Rate: 0.1, Burst: 3 },
+			ResourceRateLimits: map[string]*conf.RateLimit{ "vars": &conf.RateLimit{ Rate: 0.1, Burst: 1 } },
+		},
+	})
+	get := func(path, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", path, nil)
+		req.RemoteAddr = ip + ":1234"
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := get("/vars/a/b", "192.0.2.1"); resp.Code == http.StatusTooManyRequests {
+		t.Errorf("first request should not be limited")
+	}
+	resp := get("/vars/a/b", "192.0.2.1")
+	if resp.Code != http.StatusTooManyRequests || resp.Header().Get("Retry-After") != "10" || resp.Header().Get(ServantErrHeader) == "" {
+		t.Errorf("resource limit should be applied: %d %v", resp.Code, resp.Header())
+	}
+	if resp := get("/files/a/b", "192.0.2.1"); resp.Code == http.StatusTooManyRequests {
+		t.Errorf("other resources should be limited by the server limit only")
+	}
+	if resp := get("/files/a/b", "192.0.2.1"); resp.Code != http.StatusTooManyRequests {
+		t.Errorf("server limit should be applied: %d", resp.Code)
+	}
+	if resp := get("/files/a/b", "192.0.2.2"); resp.Code == http.StatusTooManyRequests {
+		t.Errorf("clients should be limited separately")
+	}
+}
+
+func TestServeRateLimitAuthFailed(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ RateLimit: &conf.RateLimit{ Rate: 0.1, Burst: 2 } },
+		Auth: conf.Auth{ Enabled: true },
+		Users: map[string]*conf.User{ "u": &conf.User{ Key: "k" } },
+	})
+	// auth failures are delayed, so the requests are concurrent
+	guess := func(path, ip string) map[int]int {
+		codes := make(chan int, 3)
+		for i := 0; i < 3; i++ {
+			go func() {
+				req := httptest.NewRequest("GET", path, nil)
+				req.RemoteAddr = ip + ":1234"
+				req.Header.Set("Authorization", "u 0 wrong")
+				resp := httptest.NewRecorder()
+				s.ServeHTTP(resp, req)
+				codes <- resp.Code
+			}()
+		}
+		counts := make(map[int]int)
+		for i := 0; i < 3; i++ {
+			counts[<-codes]++
+		}
+		return counts
+	}
+	if counts := guess("/vars/a/b", "192.0.2.1"); counts[http.StatusUnauthorized] != 2 || counts[http.StatusTooManyRequests] != 1 {
+		t.Errorf("failed logins should be rate limited by ip: %v", counts)
+	}
+	// endpoints authenticating themselves are limited too
+	if counts := guess(StatusPath, "192.0.2.2"); counts[http.StatusUnauthorized] != 2 || counts[http.StatusTooManyRequests] != 1 {
+		t.Errorf("failed logins to status should be rate limited by ip: %v", counts)
+	}
+}
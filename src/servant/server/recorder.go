@@ -0,0 +1,61 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+)
+
+// responseRecorder records the final status and the bytes written of a response, for logs and metrics.
+// Flushing and hijacking pass through to the underlying writer.
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (self *responseRecorder) WriteHeader(code int) {
+	// informational responses are followed by the final one
+	if self.status == 0 && code >= 200 {
+		self.status = code
+	}
+	self.ResponseWriter.WriteHeader(code)
+}
+
+func (self *responseRecorder) Write(p []byte) (int, error) {
+	if self.status == 0 {
+		self.status = http.StatusOK
+	}
+	n, err := self.ResponseWriter.Write(p)
+	self.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap makes http.ResponseController reach the underlying writer
+func (self *responseRecorder) Unwrap() http.ResponseWriter {
+	return self.ResponseWriter
+}
+
+func (self *responseRecorder) Flush() {
+	http.NewResponseController(self.ResponseWriter).Flush()
+}
+
+func (self *responseRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(self.ResponseWriter).Hijack()
+}
+
+// responseStatus returns the status written so far, 200 if not written yet
+func (self *Session) responseStatus() int {
+	if self.recorder != nil && self.recorder.status != 0 {
+		return self.recorder.status
+	}
+	return http.StatusOK
+}
+
+// responseBytes returns the bytes of the body written so far, after compression if gzipped
+func (self *Session) responseBytes() int64 {
+	if self.recorder == nil {
+		return 0
+	}
+	return self.recorder.bytes
+}
@@ -0,0 +1,44 @@
+package server
+
+import (
+	"bufio"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"servant/conf"
+	"testing"
+)
+
+type hijackableWriter struct {
+	*httptest.ResponseRecorder
+	hijacked bool
+}
+
+func (self *hijackableWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	self.hijacked = true
+	return nil, nil, nil
+}
+
+func TestResponseRecorder(t *testing.T) {
+	resp := &hijackableWriter{ ResponseRecorder: httptest.NewRecorder() }
+	sess := NewServer(&conf.Config{}).newSession(resp, httptest.NewRequest("GET", "/", nil))
+	if sess.responseStatus() != http.StatusOK || sess.responseBytes() != 0 {
+		t.Errorf("status should default to 200: %d %d", sess.responseStatus(), sess.responseBytes())
+	}
+	sess.resp.WriteHeader(http.StatusCreated)
+	sess.resp.Write([]byte("hello"))
+	sess.resp.Write([]byte(" world"))
+	if sess.responseStatus() != http.StatusCreated || sess.responseBytes() != 11 {
+		t.Errorf("final status and bytes should be recorded: %d %d", sess.responseStatus(), sess.responseBytes())
+	}
+	if flusher, ok := sess.resp.(http.Flusher); !ok {
+		t.Errorf("recorder should be a flusher")
+	} else if flusher.Flush(); !resp.Flushed {
+		t.Errorf("flush should pass through")
+	}
+	if hijacker, ok := sess.resp.(http.Hijacker); !ok {
+		t.Errorf("recorder should be a hijacker")
+	} else if hijacker.Hijack(); !resp.hijacked {
+		t.Errorf("hijack should pass through")
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"net/url"
+	"servant/conf"
+	"sort"
+	"strings"
+)
+
+// redactedSecret replaces values of secret params and passwords of dsns in logs and errors
+const redactedSecret = "***"
+
+// addSecret marks a value to be redacted from logs and errors of the session from now on
+func (self *Session) addSecret(v string) {
+	if v == "" || contains(self.secrets, v) {
+		return
+	}
+	self.secrets = append(self.secrets, v)
+	// longer first, so a secret containing another is redacted as a whole
+	sort.Slice(self.secrets, func(i, j int) bool { return len(self.secrets[i]) > len(self.secrets[j]) })
+}
+
+// redact replaces secrets of the session in a log or error message
+func (self *Session) redact(s string) string {
+	return redactSecrets(s, self.secrets...)
+}
+
+func redactSecrets(s string, secrets ...string) string {
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, redactedSecret)
+		}
+	}
+	return s
+}
+
+// declaredParams resolves params of the request by declarations of the item,
+// values of secret params are redacted from logs and errors of the session
+func (self *Session) declaredParams(ps conf.Params) (ParamFunc, *ServantError) {
+	params, perr := declaredParams(ps, requestParams(self.req, self.remoteHost()))
+	if perr != nil {
+		return nil, perr
+	}
+	for name, p := range ps {
+		if !p.Secret {
+			continue
+		}
+		if v, ok := params(name); ok {
+			self.addSecret(v)
+		}
+	}
+	return params, nil
+}
+
+// itemParams returns param declarations of the requested item, nil if unknown
+func (self *Session) itemParams() conf.Params {
+	switch self.resource {
+	case "commands":
+		if cmdConf := (CommandServer{ Session: self }).findCommandConfig(); cmdConf != nil {
+			return cmdConf.Params
+		}
+	case "databases":
+		if _, queryConf := (DatabaseServer{ Session: self }).findDatabaseQueryConfig(); queryConf != nil {
+			return queryConf.Params
+		}
+	case "files":
+		if dirConf := (FileServer{ Session: self }).findDirConfig(); dirConf != nil {
+			return dirConf.Params
+		}
+	}
+	return nil
+}
+
+// redactedUri returns the uri with values of secret params of the item in the query string redacted,
+// for logs written before params are resolved
+func (self *Session) redactedUri(uri string) string {
+	path, query, ok := strings.Cut(uri, "?")
+	if !ok {
+		return self.redact(uri)
+	}
+	ps := self.itemParams()
+	pairs := strings.Split(query, "&")
+	for i, pair := range pairs {
+		k, _, _ := strings.Cut(pair, "=")
+		if name, err := url.QueryUnescape(k); err == nil && ps[name].Secret {
+			pairs[i] = k + "=" + redactedSecret
+		}
+	}
+	return self.redact(path + "?" + strings.Join(pairs, "&"))
+}
+
+// dsnPassword returns the password in a dsn in url, mysql or key=value forms, empty if none
+func dsnPassword(dsn string) string {
+	if u, err := url.Parse(dsn); err == nil && u.Scheme != "" && u.User != nil {
+		if password, ok := u.User.Password(); ok {
+			return password
+		}
+	}
+	if m := dsnUserRe.FindStringSubmatch(dsn); m != nil {
+		return m[2]
+	}
+	if m := dsnPasswordRe.FindStringSubmatch(dsn); m != nil {
+		return strings.Trim(m[2], "'")
+	}
+	return ""
+}
@@ -3,27 +3,78 @@ package server
 import (
 	"servant/conf"
 	"net/http"
+	"net"
 	"sync/atomic"
 	"time"
 	"regexp"
 	"fmt"
 	"os"
 	"net/url"
+	"context"
+	"sync"
+	"os/signal"
+	"syscall"
+	"crypto/tls"
+	"crypto/x509"
+	"io/ioutil"
+	"encoding/json"
+	"strings"
+	"reflect"
+	"strconv"
+	"runtime"
+	"runtime/debug"
+	"crypto/rand"
+	"errors"
 )
 
 const ServantErrHeader = "X-Servant-Err"
+const RequestIdHeader = "X-Request-Id"
 
 type Server struct {
 	config          *conf.Config
+	configLock      sync.RWMutex
+	configLoader    func() (*conf.Config, error)
+	daemons         map[string]*runningTask
+	timers          map[string]*runningTask
+	tasksLock       sync.Mutex
 	resources       map[string]HandlerFactory
 	nextSessionId   uint64
+	httpServers     []*http.Server
+	httpServerLock  sync.Mutex
+	shutdowns       sync.WaitGroup // Shutdown calls in progress, waited by RunWithSignals
+	shutdownErr     error // of the last Shutdown, guarded by httpServerLock
+	semaphores      map[string]ChanLock
+	semaphoresLock  sync.Mutex
+	databases       map[string]*dbPool
+	unreachableDbs  map[string]bool // databases failed the last ping
+	databasesLock   sync.Mutex
+	ready           int32
+	maintenance     int32
+	tasksPaused     bool
+	maintenanceLock sync.Mutex
+	startedAt       time.Time
+	loadedAt        time.Time // when the config was loaded, guarded by configLock
+	rateLimiter     *rateLimiter
+	cache           *responseCache // nil if caching is disabled
+	idempotency     *idempotencyStore // nil if idempotency keys are disabled
+	jobs            map[string]*job // of async commands by id
+	jobsLock        sync.Mutex
 }
 
 type Session struct {
 	id       uint64
+	requestId string
+	server   *Server
 	config   *conf.Config
 	resource, group, item, tail string
 	username string
+	clientIp string
+	secrets  []string // values redacted from logs and errors
+	errMessage string // of the error ended the session in detail, as logged
+	auditBody map[string]string // body params kept for the audit log, before the body is consumed
+	ended    bool // the end of the session is logged
+	start    time.Time
+	recorder *responseRecorder
 	resp     http.ResponseWriter
 	req      *http.Request
 }
@@ -50,15 +101,28 @@ func NewServer(config *conf.Config) *Server {
 		config:         config,
 		nextSessionId:  0,
 		resources:      make(map[string]HandlerFactory),
+		semaphores:     make(map[string]ChanLock),
+		daemons:        make(map[string]*runningTask),
+		timers:         make(map[string]*runningTask),
+		databases:      make(map[string]*dbPool),
+		unreachableDbs: make(map[string]bool),
+		jobs:           make(map[string]*job),
+		rateLimiter:    newRateLimiter(),
+		startedAt:      time.Now(),
+		loadedAt:       time.Now(),
 	}
 	ret.loadVars()
-	if config.Log != "" {
-		file, err := os.OpenFile(config.Log, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0664)
-		if err == nil {
-			logger.SetOutput(file)
-		} else {
-			logger.Printf("can not open log file %s", config.Log)
-		}
+	if config.Server.CacheMaxBytes > 0 {
+		ret.cache = newResponseCache(config.Server.CacheMaxBytes)
+	}
+	if config.Server.IdempotencyMaxBytes > 0 {
+		ret.idempotency = newIdempotencyStore(config.Server.IdempotencyMaxBytes)
+	}
+	if config.Server.Pprof.Enabled {
+		runtime.SetBlockProfileRate(config.Server.Pprof.BlockRate)
+	}
+	if config.Log.File != "" || config.Log.Format != "" || config.Log.AccessFormat != "" || config.Log.AuditFile != "" {
+		configureLogger(config.Log)
 	}
 	ret.resources["commands"] = NewCommandServer
 	ret.resources["files"] = NewFileServer
@@ -67,34 +131,113 @@ func NewServer(config *conf.Config) *Server {
 	return ret
 }
 
+// commandSemaphore returns the semaphore limiting concurrent executions of a command item. It is kept
+// across reloads, so executions in progress hold their slots, unless the limit is changed, then
+// executions in progress are not counted by the new one.
+func (self *Server) commandSemaphore(name string, n int) Lock {
+	self.semaphoresLock.Lock()
+	defer self.semaphoresLock.Unlock()
+	sem, ok := self.semaphores[name]
+	if !ok || cap(sem) != n {
+		sem = NewChanSemaphore(n)
+		self.semaphores[name] = sem
+	}
+	return sem
+}
+
 func (self *Server) loadVars() {
-	for vgn, vg := range self.config.Vars {
+	for vgn, vg := range self.Config().Vars {
 		for vin, vi := range vg.Vars {
 			globalKey := vgn + "." + vin
-			SetGlobalParam(globalKey, vi.Value)
-			if vi.Expand {
-				SetVarCanExpand(globalKey, true)
+			// keep values updated online when reloading
+			if !GlobalParamExists(globalKey) {
+				SetGlobalParam(globalKey, vi.Value)
 			}
+			SetVarCanExpand(globalKey, vi.Expand)
 		}
 	}
 }
 
+// Config returns the current config. Sessions keep the config they started with.
+func (self *Server) Config() *conf.Config {
+	self.configLock.RLock()
+	defer self.configLock.RUnlock()
+	return self.config
+}
+
+// SetConfigLoader sets the function to load config on SIGHUP
+func (self *Server) SetConfigLoader(loader func() (*conf.Config, error)) {
+	self.configLoader = loader
+}
+
+// Reload loads the config by the config loader and swaps it in. On failure the old config is kept.
+// Daemons and timers with changed definitions are restarted. Server settings are not reloaded.
+func (self *Server) Reload() error {
+	if self.configLoader == nil {
+		return fmt.Errorf("config loader not set")
+	}
+	config, err := self.configLoader()
+	if err != nil {
+		logger.Printf("WARN (_) [server] reload config failed, keep the old one: %s", err)
+		return err
+	}
+	config.Server = self.Config().Server
+	config.Log = self.Config().Log
+	self.configLock.Lock()
+	self.config = config
+	self.loadedAt = time.Now()
+	self.configLock.Unlock()
+	self.loadVars()
+	self.cache.clear()
+	self.openDatabases()
+	self.startTasks()
+	logger.Println("INFO (_) [server] config reloaded")
+	return nil
+}
+
 func (self *Server) newSession(resp http.ResponseWriter, req *http.Request) *Session {
 	resource, group, item, tail := parseUriPath(req.URL.Path)
+	config := self.Config()
+	recorder := &responseRecorder{ ResponseWriter: resp }
 	sess := Session {
 		id:       atomic.AddUint64(&(self.nextSessionId), 1),
-		config:   self.config,
+		server:   self,
+		start:    time.Now(),
+		config:   config,
 		req:      req,
-		resp:     resp,
+		resp:     recorder,
+		recorder: recorder,
 		resource: resource,
 		group:    group,
 		item:     item,
 		tail:     tail,
 	}
+	sess.clientIp = resolveClientIp(req, config.Server.TrustedProxies)
+	sess.requestId = requestId(req)
+	resp.Header().Set(RequestIdHeader, sess.requestId)
 	return &sess
 }
 
 
+var requestIdRe = regexp.MustCompile(`^[\w.:@=+/-]{1,128}$`)
+
+// requestId returns the request id from the client or proxy if it is sane, or generates a new one
+func requestId(req *http.Request) string {
+	if id := req.Header.Get(RequestIdHeader); requestIdRe.MatchString(id) {
+		return id
+	}
+	return newUuid()
+}
+
+// newUuid returns a random version 4 uuid
+func newUuid() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6] & 0x0f | 0x40
+	b[8] = b[8] & 0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
 var uriRe, _ = regexp.Compile(`^/([a-zA-Z]\w*)/([a-zA-Z]\w*)/([a-zA-Z]\w*)((?:/.*)?)$`)
 func parseUriPath(path string) (resource, group, item, tail string) {
 	m := uriRe.FindStringSubmatch(path)
@@ -105,72 +248,130 @@ func parseUriPath(path string) (resource, group, item, tail string) {
 	return
 }
 
-var paramRe, _ = regexp.Compile(`\${[a-zA-Z_]\w*(?:\.[a-zA-Z_]\w*)?}`)
-var varExpr, _ = regexp.Compile(`^[a-zA-Z_]\w*(?:\.[a-zA-Z_]\w*)?$`)
-var paramNameRe, _ = regexp.Compile(`^[a-zA-Z]\w*$`)
-type ParamFunc func(string)(string, bool)
-
-func requestParams(req *http.Request) ParamFunc {
-	// ${aaa} ${foo.bar} ${_env.PATH}
-	var q url.Values // should be out of the closure, to avoid parse query many times
-	if req != nil {
-		q = req.URL.Query()
-	}
-	var ret func(k string) (string, bool)
-	d := 0
-	ret = func(k string) (string, bool) {
-		if v, ok := GetGlobalParam(k); ok {
-			// only global params can be expanded
-			if GetVarCanExpand(k) {
-				d++
-				if d > MaxVarExpandDepth {
-					return "", false
-				}
-				var exists bool
-				v, exists = replaceCmdParams(v, ret)
-				if !exists {
-					return "", false
-				}
-			}
-			return v, true
-		}
-		if req == nil {
-			return "", false
+// parseTailSegments splits an escaped tail of uri path into unescaped segments. Empty segments
+// are skipped, while "." and ".." or segments containing an encoded "/" are rejected
+func parseTailSegments(escapedTail string) ([]string, error) {
+	ret := make([]string, 0, 4)
+	for _, seg := range strings.Split(escapedTail, "/") {
+		if seg == "" {
+			continue
 		}
-		if ok := paramNameRe.MatchString(k); !ok {
-			return "", false
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, err
 		}
-		vs, ok := q[k]
-		if !ok || len(vs) == 0 {
-			return "", false
+		if seg == "." || seg == ".." || strings.ContainsAny(seg, "/\x00") {
+			return nil, fmt.Errorf("bad path segment %q", seg)
 		}
-		v := vs[0]
-		return v, true
+		ret = append(ret, seg)
 	}
-	return ret
+	return ret, nil
 }
 
+// tailSegments returns the segments of the uri path after /<resource>/<group>/<item>
+func (self *Session) tailSegments() ([]string, error) {
+	_, _, _, tail := parseUriPath(self.req.URL.EscapedPath())
+	return parseTailSegments(tail)
+}
 
+var paramRe, _ = regexp.Compile(`\${[a-zA-Z_]\w*(?:\.[a-zA-Z_]\w*)?}`)
+var varExpr, _ = regexp.Compile(`^[a-zA-Z_]\w*(?:\.[a-zA-Z_]\w*)?$`)
+var paramNameRe, _ = regexp.Compile(`^[a-zA-Z]\w*$`)
+var bodyParamNameRe, _ = regexp.Compile(`^[a-zA-Z]\w*(?:\.[a-zA-Z_]\w*)?$`)
+type ParamFunc func(string)(string, bool)
 
-func globalParam() func(string)string {
-	return func(k string) string {
-		v, _ := GetGlobalParam(k)
-		return v
-	}
-}
 
 func (self *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 	defer req.Body.Close()
+	activeSessions.add(1)
+	defer activeSessions.add(-1)
 	sess := self.newSession(resp, req)
-	sess.info("+ %s %s %s", req.RemoteAddr, req.Method, req.URL.String())
-	username, err := sess.auth()
-	if err != nil {
-		sess.ErrorEnd(http.StatusForbidden, "auth failed: %s", err)
+	// panics of the probes and the metrics, pprof, status and config endpoints are logged and responded as 500 too
+	defer sess.recoverPanic()
+	// probes are frequent, they are neither logged nor counted
+	switch req.URL.Path {
+	case HealthPath:
+		sess.serveHealth()
+		return
+	case ReadyPath:
+		sess.serveReady()
+		return
+	}
+	defer sess.writeAccessLog(time.Now())
+	if !sess.listenerAllows() {
+		sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+		sess.ErrorEnd(http.StatusNotFound, "%s not served on this listener", req.URL.Path)
+		return
+	}
+	if metricsConf := sess.config.Server.Metrics; metricsConf.Enabled && req.URL.Path == metricsConf.Path {
+		sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+		sess.serveMetrics()
+		return
+	}
+	if pprofConf := sess.config.Server.Pprof; pprofConf.Enabled && strings.HasPrefix(req.URL.Path, pprofConf.Path) {
+		sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+		sess.servePprof(strings.TrimPrefix(req.URL.Path, pprofConf.Path))
+		return
+	}
+	if req.URL.Path == StatusPath {
+		sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+		sess.serveStatus()
 		return
 	}
-	sess.username = username
-	if ! sess.checkPermission() {
-		sess.ErrorEnd(http.StatusForbidden, "access of %s forbidden", req.URL.Path)
+	if req.URL.Path == ConfigPath {
+		sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+		sess.serveConfig()
+		return
+	}
+	t0 := time.Now()
+	defer func() {
+		// resources are bounded by the config, unknown names are not kept as labels
+		resource := sess.resource
+		if _, ok := self.resources[resource]; !ok {
+			resource = "unknown"
+		}
+		requestsTotal.inc(resource, strconv.Itoa(sess.responseStatus()))
+		requestDuration.observe(time.Since(t0), resource)
+	}()
+	if gzipConf := sess.config.Server.Gzip; gzipConf.Enabled && req.Method != "HEAD" && acceptsGzip(req) {
+		gw := newGzipWriter(resp, gzipConf.MinSize)
+		defer gw.Close()
+		sess.resp = gw
+	}
+	sess.info("+ %s %s %s", sess.remoteHost(), req.Method, sess.redactedUri(req.URL.String()))
+	defer sess.writeAuditLog(time.Now())
+	// panics of resources are recovered before the audit, access logs and metrics are written, so they see the 500
+	defer sess.recoverPanic()
+	if self.inMaintenance() && !sess.isMaintenanceVar() {
+		sess.resp.Header().Set("Retry-After", strconv.FormatUint(uint64(sess.config.Server.Maintenance.RetryAfter), 10))
+		sess.ErrorEnd(http.StatusServiceUnavailable, "in maintenance")
+		return
+	}
+	if sess.cors() {
+		return
+	}
+	// limited before auth, which reads the body to verify signatures
+	if !sess.limitBody() {
+		return
+	}
+	if !sess.authenticate() {
+		return
+	}
+	if ! sess.checkRateLimit() {
+		return
+	}
+	// describing an item needs no permission of invoking it unless configured
+	describing := sess.describing()
+	if (!describing || sess.config.Server.Describe.Permission) && ! sess.checkPermission() {
+		sess.ErrorEnd(http.StatusForbidden, "user %s has no permission to access %s", sess.username, req.URL.Path)
+		return
+	}
+	if ! sess.checkGroupHosts() {
+		sess.ErrorEnd(http.StatusForbidden, "access of %s from %s forbidden", req.URL.Path, sess.remoteHost())
+		return
+	}
+	if describing {
+		sess.serveDescription()
 		return
 	}
 	handlerFactory, ok := self.resources[sess.resource]
@@ -178,7 +379,37 @@ func (self *Server) ServeHTTP(resp http.ResponseWriter, req *http.Request) {
 		sess.ErrorEnd(http.StatusNotFound, "unknown resource")
 		return
 	}
-	handlerFactory(sess).serve()
+	handler := handlerFactory(sess)
+	sess.captureAuditBody()
+	sess.withItemHeaders()
+	if ttl := sess.idempotencyTtl(); ttl > 0 {
+		sess.serveIdempotent(handler, ttl)
+		return
+	}
+	if ttl := sess.cacheTtl(); ttl > 0 {
+		sess.serveCached(handler, ttl)
+		return
+	}
+	handler.serve()
+}
+
+// recoverPanic ends the session panicked with 500, so a bug of a handler fails only its request.
+// The panic is only logged if the response started, as its status is sent.
+func (self *Session) recoverPanic() {
+	r := recover()
+	if r == nil {
+		return
+	}
+	// the http server aborts the response on purpose by it
+	if r == http.ErrAbortHandler {
+		panic(r)
+	}
+	self.crit("panic: %v\n%s", r, debug.Stack())
+	if self.recorder != nil && self.recorder.status != 0 {
+		self.BadEnd("panic after the response started")
+		return
+	}
+	self.ErrorEnd(http.StatusInternalServerError, "internal server error")
 }
 
 type Handler interface {
@@ -188,19 +419,179 @@ type Handler interface {
 type HandlerFactory func(sess *Session) Handler
 
 
+type jsonError struct {
+	Error jsonErrorDetail `json:"error"`
+}
+
+type jsonErrorDetail struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// authenticate sets the username of the session, or ends it and returns false if authentication failed.
+// Failed logins take from the rate limit bucket of the client ip, so guessing credentials is limited too.
+func (self *Session) authenticate() bool {
+	username, err := self.auth()
+	if err != nil {
+		if self.checkRateLimit() {
+			self.authFailed(username, err)
+		}
+		return false
+	}
+	self.username = username
+	return true
+}
+
+// authFailed ends the session with 401 and the challenge, or 403 if the user is known but denied from the host
+func (self *Session) authFailed(username string, err error) {
+	var denied hostDeniedError
+	if errors.As(err, &denied) {
+		self.ErrorEnd(http.StatusForbidden, "user %s forbidden: %s", username, err)
+		return
+	}
+	self.authChallenge()
+	self.ErrorEnd(http.StatusUnauthorized, "authentication failed: %s", err)
+}
+
+// exposedError returns the message of an error for the client. Without verbose errors, details of
+// server errors like paths and sql errors are only logged, the client gets the status text and the
+// request id to find them in the log. Messages of client errors are always responded.
+func (self *Session) exposedError(code int, msg string) string {
+	if self.config.Server.VerboseErrors || code < http.StatusInternalServerError {
+		return msg
+	}
+	msg = strings.ToLower(http.StatusText(code))
+	if self.requestId != "" {
+		msg += ", request id " + self.requestId
+	}
+	return msg
+}
+
+// setError reports the error in the ServantErrHeader as exposed to the client, and returns the message exposed
+func (self *Session) setError(code int, msg string) string {
+	self.errMessage = msg
+	exposed := self.exposedError(code, msg)
+	self.resp.Header().Set(ServantErrHeader, exposed)
+	return exposed
+}
+
 func (self *Session) ErrorEnd(code int, format string, v ...interface{}) {
-	msg := fmt.Sprintf(format, v...)
-	self.warn("- " + msg)
-	self.resp.Header().Set(ServantErrHeader, msg)
+	msg := self.redact(fmt.Sprintf(format, v...))
+	level := "WARN"
+	if code >= http.StatusInternalServerError {
+		level = "ERROR"
+	}
+	self.logStatus(self.resource, level, code, "- %s", msg)
+	self.logIfSlow()
+	msg = self.setError(code, msg)
+	if !self.wantsJsonError() {
+		self.resp.WriteHeader(code)
+		return
+	}
+	buf, _ := json.Marshal(jsonError{ Error: jsonErrorDetail{ Code: code, Message: msg } })
+	self.resp.Header().Set("Content-Type", "application/json")
 	self.resp.WriteHeader(code)
+	self.resp.Write(buf)
+}
+
+// wantsJsonError reports whether errors are returned in a json body besides the header
+func (self *Session) wantsJsonError() bool {
+	if self.config.Server.ErrorFormat == "json" {
+		return true
+	}
+	return self.req != nil && strings.Contains(self.req.Header.Get("Accept"), "application/json")
 }
 
 func (self *Session) BadEnd(format string, v ...interface{}) {
-	self.warn("- " + format, v...)
+	self.logStatus(self.resource, "WARN", self.responseStatus(), "- " + format, v...)
+	self.logIfSlow()
 }
 
 func (self *Session) GoodEnd(format string, v ...interface{}) {
-	self.info("- " + format, v...)
+	self.logStatus(self.resource, "INFO", self.responseStatus(), "- " + format, v...)
+	self.logIfSlow()
+}
+
+// slowThreshold returns the duration a request of the resource type takes to be slow, 0 for never
+func (self *Session) slowThreshold() time.Duration {
+	threshold := self.config.Server.SlowThreshold
+	if t, ok := self.config.Server.ResourceSlowThresholds[self.resource]; ok {
+		threshold = t
+	}
+	return time.Duration(threshold * float64(time.Second))
+}
+
+// logIfSlow warns once the session ended if it took longer than the threshold, with the request to find out why
+func (self *Session) logIfSlow() {
+	if self.ended {
+		return
+	}
+	self.ended = true
+	threshold := self.slowThreshold()
+	if threshold <= 0 || self.req == nil {
+		return
+	}
+	if d := time.Since(self.start); d > threshold {
+		self.warn("slow request %s %s took %.3fs, threshold %s", self.req.Method, self.redactedUri(self.req.URL.String()), d.Seconds(), threshold)
+	}
+}
+
+// methodAllowed reports whether the request method is allowed, otherwise ends the session with 405
+// and the allowed methods in the Allow header
+func (self *Session) methodAllowed(allowed []string) bool {
+	for _, method := range allowed {
+		if method == self.req.Method {
+			return true
+		}
+	}
+	self.resp.Header().Set("Allow", strings.Join(allowed, ", "))
+	self.ErrorEnd(http.StatusMethodNotAllowed, "method %s not allowed, allowed: %s", self.req.Method, strings.Join(allowed, ", "))
+	return false
+}
+
+// maxBodyBytes returns the body limit of the resource type of the session, 0 for unlimited
+func (self *Session) maxBodyBytes() int64 {
+	if limit, ok := self.config.Server.ResourceMaxBodyBytes[self.resource]; ok {
+		return limit
+	}
+	return self.config.Server.MaxBodyBytes
+}
+
+// limitBody rejects a request declaring a body larger than the limit with 413, and caps reading
+// of the body, so handlers reading it in any way get an *http.MaxBytesError beyond the limit.
+func (self *Session) limitBody() bool {
+	limit := self.maxBodyBytes()
+	if limit <= 0 || self.req.Body == nil || self.req.Body == http.NoBody {
+		return true
+	}
+	if self.req.ContentLength > limit {
+		self.ErrorEnd(http.StatusRequestEntityTooLarge, "request body of %d bytes exceeds limit %d", self.req.ContentLength, limit)
+		return false
+	}
+	self.req.Body = http.MaxBytesReader(self.resp, self.req.Body, limit)
+	return true
+}
+
+// resetWriteDeadline moves the write deadline of the connection to WriteTimeout from now,
+// so that long responses written piece by piece are not cut by the server-wide timeout.
+func (self *Session) resetWriteDeadline() {
+	var deadline time.Time
+	if timeout := self.config.Server.WriteTimeout; timeout > 0 {
+		deadline = time.Now().Add(time.Duration(timeout) * time.Second)
+	}
+	// not all ResponseWriters support deadlines, ignore the error
+	http.NewResponseController(self.resp).SetWriteDeadline(deadline)
+}
+
+// deadlineWriter is a ResponseWriter resetting the write deadline of the session before each write
+type deadlineWriter struct {
+	http.ResponseWriter
+	sess *Session
+}
+
+func (self deadlineWriter) Write(p []byte) (int, error) {
+	self.sess.resetWriteDeadline()
+	return self.ResponseWriter.Write(p)
 }
 
 func (self *Session) UserConfig() *conf.User {
@@ -208,29 +599,325 @@ func (self *Session) UserConfig() *conf.User {
 	return ret
 }
 
+type runningTask struct {
+	conf   interface{}
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// startTask runs the task in a goroutine, which closes done when it returns
+func startTask(c interface{}, run func(ctx context.Context)) *runningTask {
+	ctx, cancel := context.WithCancel(context.Background())
+	task := &runningTask{ conf: c, cancel: cancel, done: make(chan struct{}) }
+	go func() {
+		defer close(task.done)
+		run(ctx)
+	}()
+	return task
+}
+
+// StopTasks stops all daemons and timers, and waits for them to exit.
+// Daemons are terminated, then killed after their stop timeout.
+func (self *Server) StopTasks() {
+	self.tasksLock.Lock()
+	tasks := make([]*runningTask, 0, len(self.daemons) + len(self.timers))
+	for name, task := range self.daemons {
+		task.cancel()
+		tasks = append(tasks, task)
+		delete(self.daemons, name)
+	}
+	for name, task := range self.timers {
+		task.cancel()
+		tasks = append(tasks, task)
+		delete(self.timers, name)
+	}
+	self.tasksLock.Unlock()
+	for _, task := range tasks {
+		<-task.done
+	}
+}
+
+// StartDaemons starts daemons not running, and restarts daemons whose definitions changed
 func (self *Server) StartDaemons() {
-	for name, conf := range(self.config.Daemons) {
-		go RunDaemon(name, conf)
+	self.tasksLock.Lock()
+	defer self.tasksLock.Unlock()
+	daemons := self.Config().Daemons
+	for name, task := range self.daemons {
+		if c, ok := daemons[name]; !ok || !reflect.DeepEqual(c, task.conf) {
+			logger.Printf("INFO (_) [daemon] stopping daemon %s", name)
+			task.cancel()
+			delete(self.daemons, name)
+		}
+	}
+	for name, c := range daemons {
+		if _, ok := self.daemons[name]; ok {
+			continue
+		}
+		name, c := name, c
+		self.daemons[name] = startTask(c, func(ctx context.Context) {
+			RunDaemon(ctx, name, c)
+		})
 	}
 }
 
+// StartTimers starts timers not running, and restarts timers whose definitions changed
 func (self *Server) StartTimers() {
-	for name, conf := range(self.config.Timers) {
-		go RunTimer(name, conf)
+	self.tasksLock.Lock()
+	defer self.tasksLock.Unlock()
+	timers := self.Config().Timers
+	for name, task := range self.timers {
+		if c, ok := timers[name]; !ok || !reflect.DeepEqual(c, task.conf) {
+			logger.Printf("INFO (_) [timer] stopping timer %s", name)
+			task.cancel()
+			delete(self.timers, name)
+		}
+	}
+	for name, c := range timers {
+		if _, ok := self.timers[name]; ok {
+			continue
+		}
+		name, c := name, c
+		self.timers[name] = startTask(c, func(ctx context.Context) {
+			RunTimer(ctx, name, c)
+		})
 	}
 }
 
 func (self *Server) Run() error {
+	serverConf := &self.Config().Server
+	listenerConfs := self.listenerConfs()
+	servers := make([]*http.Server, 0, len(listenerConfs))
+	lns := make([]net.Listener, 0, len(listenerConfs))
+	// the limit is of all listeners together, as file descriptors are
+	var slots chan struct{}
+	if serverConf.MaxConns > 0 {
+		slots = make(chan struct{}, serverConf.MaxConns)
+	}
+	for _, listenerConf := range listenerConfs {
+		s, err := self.newHttpServer(listenerConf)
+		var ln net.Listener
+		if err == nil {
+			ln, err = listen(listenerConf.Listen, listenerConf.SocketMode)
+		}
+		if err == nil && serverConf.Backlog > 0 {
+			if err = setBacklog(ln, serverConf.Backlog); err != nil {
+				ln.Close()
+			}
+		}
+		if err != nil {
+			for _, ln := range lns {
+				ln.Close()
+			}
+			return err
+		}
+		ln = newConnLimitListener(ln, slots, serverConf.MaxConnsMode == "refuse")
+		servers, lns = append(servers, s), append(lns, ln)
+	}
+	for _, listenerConf := range listenerConfs {
+		if activated(listenerConf.Listen) {
+			unsetListenEnv()
+			break
+		}
+	}
+	return self.serve(servers, lns)
+}
+
+// newHttpServer creates the http server of a listener per the server config
+func (self *Server) newHttpServer(listenerConf conf.Listener) (*http.Server, error) {
+	serverConf := &self.Config().Server
 	s := &http.Server{
-		Addr:           self.config.Server.Listen,
-		Handler:        self,
-		ReadTimeout:    10 * time.Second,
-		WriteTimeout:   10 * time.Second,
-		MaxHeaderBytes: 8192,
-	}
-	self.StartDaemons()
-	self.StartTimers()
-	logger.Printf("INFO (_) [server] starting listen at %s", s.Addr)
-	return s.ListenAndServe()
+		Addr:              listenerConf.Listen,
+		Handler:           self,
+		ReadTimeout:       time.Duration(serverConf.ReadTimeout) * time.Second,
+		WriteTimeout:      time.Duration(serverConf.WriteTimeout) * time.Second,
+		IdleTimeout:       time.Duration(serverConf.IdleTimeout) * time.Second,
+		ReadHeaderTimeout: time.Duration(serverConf.ReadHeaderTimeout) * time.Second,
+		MaxHeaderBytes:    8192,
+	}
+	// keep-alive connections are closed after idle for IdleTimeout, which falls back to ReadTimeout if 0
+	s.Protocols = new(http.Protocols)
+	s.Protocols.SetHTTP1(true)
+	s.Protocols.SetHTTP2(serverConf.Http2)
+	tlsConf := listenerConf.TLS
+	if tlsConf.CertFile != "" || tlsConf.KeyFile != "" {
+		tlsConfig, err := newTLSConfig(&tlsConf)
+		if err != nil {
+			return nil, err
+		}
+		s.TLSConfig = tlsConfig
+	}
+	if len(listenerConf.Resources) > 0 {
+		resources := listenerConf.Resources
+		s.BaseContext = func(net.Listener) context.Context {
+			return context.WithValue(context.Background(), listenerResourcesKey{}, resources)
+		}
+	}
+	return s, nil
+}
+
+// serve serves each listener by its http server until all are shut down. If a listener fails,
+// the others are closed too, and the errors are returned together.
+func (self *Server) serve(servers []*http.Server, lns []net.Listener) error {
+	serverConf := &self.Config().Server
+	self.httpServerLock.Lock()
+	self.httpServers = servers
+	self.httpServerLock.Unlock()
+	self.openDatabases()
+	self.applyMaintenance()
+	self.startTasks()
+	if maintenanceConf := serverConf.Maintenance; maintenanceConf.Param != "" && maintenanceConf.PauseTasks {
+		go self.watchMaintenance()
+	}
+	self.setReady(true)
+	errs := make(chan error, len(servers))
+	for i := range servers {
+		s, ln := servers[i], lns[i]
+		go func() {
+			if s.TLSConfig != nil {
+				logger.Printf("INFO (_) [server] starting listen at %s (tls)", ln.Addr())
+				// certificates are already loaded into TLSConfig
+				errs <- s.ServeTLS(ln, "", "")
+				return
+			}
+			logger.Printf("INFO (_) [server] starting listen at %s", ln.Addr())
+			errs <- s.Serve(ln)
+		}()
+	}
+	var failures []error
+	for range servers {
+		if err := <-errs; err != http.ErrServerClosed {
+			failures = append(failures, err)
+			for _, s := range servers {
+				s.Close()
+			}
+		}
+	}
+	if len(failures) == 0 {
+		return http.ErrServerClosed
+	}
+	return errors.Join(failures...)
+}
+
+func newTLSConfig(tlsConf *conf.TLS) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(tlsConf.CertFile, tlsConf.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("load tls cert %s and key %s failed: %s", tlsConf.CertFile, tlsConf.KeyFile, err)
+	}
+	ret := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+	}
+	if tlsConf.ClientCA != "" {
+		pem, err := ioutil.ReadFile(tlsConf.ClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("load tls client ca %s failed: %s", tlsConf.ClientCA, err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("load tls client ca %s failed: no certificate found", tlsConf.ClientCA)
+		}
+		ret.ClientCAs = pool
+		ret.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return ret, nil
+}
+
+// Shutdown stops accepting new connections and waits for in-flight sessions
+// until ctx is done, then force-closes the remaining connections.
+func (self *Server) Shutdown(ctx context.Context) (err error) {
+	// counted before the listeners are closed, so RunWithSignals returned from Run waits for it
+	self.shutdowns.Add(1)
+	defer self.shutdowns.Done()
+	self.httpServerLock.Lock()
+	servers := self.httpServers
+	self.httpServerLock.Unlock()
+	if len(servers) == 0 {
+		return nil
+	}
+	defer func() {
+		self.httpServerLock.Lock()
+		self.shutdownErr = err
+		self.httpServerLock.Unlock()
+	}()
+	self.setReady(false)
+	// listeners are drained at the same time, within the same deadline
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	for i, s := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if errs[i] = s.Shutdown(ctx); errs[i] != nil {
+				logger.Printf("WARN (_) [server] graceful shutdown of %s failed: %s, closing connections", s.Addr, errs[i])
+				s.Close()
+			}
+		}()
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// RunWithSignals runs the server and drains it gracefully on SIGTERM/SIGINT, or by Shutdown,
+// then stops daemons and timers. Log files are reopened on SIGHUP, which reloads the config too,
+// and on SIGUSR2. Signals are handled until it returns.
+func (self *Server) RunWithSignals() error {
+	hupChan := make(chan os.Signal, 1)
+	signal.Notify(hupChan, syscall.SIGHUP, syscall.SIGUSR2)
+	go func() {
+		for sig := range hupChan {
+			reopenLog()
+			if sig != syscall.SIGHUP || self.configLoader == nil {
+				logger.Printf("INFO (_) [server] got signal %s, log files reopened", sig.String())
+				continue
+			}
+			logger.Println("INFO (_) [server] got signal hangup, reloading config")
+			self.Reload()
+		}
+	}()
+	usr1Chan := make(chan os.Signal, 1)
+	signal.Notify(usr1Chan, syscall.SIGUSR1)
+	go func() {
+		for range usr1Chan {
+			on := atomic.LoadInt32(&self.maintenance) == 0
+			logger.Printf("INFO (_) [server] got signal user defined signal 1, maintenance mode %v", on)
+			self.SetMaintenance(on)
+		}
+	}()
+	atomic.StoreInt32(&serverHandlesSignals, 1)
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
+	stopped := make(chan struct{})
+	go func() {
+		select {
+		case sig := <-sigChan:
+			grace := time.Duration(self.Config().Server.GracePeriod) * time.Second
+			logger.Printf("INFO (_) [server] got signal %s, shutting down in %s", sig.String(), grace)
+			ctx, cancel := context.WithTimeout(context.Background(), grace)
+			defer cancel()
+			self.Shutdown(ctx)
+		case <-stopped:
+		}
+	}()
+	defer func() {
+		signal.Stop(hupChan)
+		signal.Stop(usr1Chan)
+		signal.Stop(sigChan)
+		close(hupChan)
+		close(usr1Chan)
+		close(stopped)
+	}()
+	err := self.Run()
+	if err != http.ErrServerClosed {
+		return err
+	}
+	// the servers are closed once Shutdown started, which still drains sessions
+	self.shutdowns.Wait()
+	self.httpServerLock.Lock()
+	err = self.shutdownErr
+	self.httpServerLock.Unlock()
+	self.StopTasks()
+	cleanupProcesses()
+	self.closeDatabases()
+	logger.Println("INFO (_) [server] shutdown done")
+	return err
 }
 
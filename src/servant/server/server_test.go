@@ -2,6 +2,31 @@ package server
 
 import (
 	"testing"
+	"servant/conf"
+	"context"
+	"net/http"
+	"time"
+	"net/http/httptest"
+	"fmt"
+	"reflect"
+	"runtime"
+	"bytes"
+	"strings"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http/httptrace"
+	"os"
+	"syscall"
+	"sync/atomic"
+	"path/filepath"
 )
 
 func TestParseUriPath(t *testing.T) {
@@ -25,4 +50,456 @@ func TestParseUriPath(t *testing.T) {
 	if r != "" || g != "" || i != "" || l != "" {
 		t.Fail()
 	}
- }
\ No newline at end of file
+ }
+
+func TestShutdown(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ Listen: "127.0.0.1:0" },
+	})
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown before run should be ok: %s", err)
+	}
+	ch := make(chan error, 1)
+	go func() {
+		ch <- s.Run()
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Errorf("shutdown failed: %s", err)
+	}
+	if err := <-ch; err != http.ErrServerClosed {
+		t.Errorf("run should return ErrServerClosed: %v", err)
+	}
+}
+
+func TestRunWithSignals(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ Listen: "127.0.0.1:0", GracePeriod: 1 },
+	})
+	// processes are cleaned up on shutdown, which marks the process exiting for other tests
+	defer func() {
+		taskProcessesLock.Lock()
+		_isExiting = false
+		taskProcessesLock.Unlock()
+		atomic.StoreInt32(&serverHandlesSignals, 0)
+	}()
+	run := func(stop func()) {
+		ch := make(chan error, 1)
+		go func() {
+			ch <- s.RunWithSignals()
+		}()
+		time.Sleep(100 * time.Millisecond)
+		stop()
+		select {
+		case err := <-ch:
+			if err != nil {
+				t.Errorf("run with signals should shut down cleanly: %v", err)
+			}
+		case <-time.After(3 * time.Second):
+			t.Fatal("run with signals should return after shutdown")
+		}
+	}
+	// shut down by a direct call, then by a signal in a second run
+	run(func() { s.Shutdown(context.Background()) })
+	time.Sleep(100 * time.Millisecond)
+	before := runtime.NumGoroutine()
+	run(func() { syscall.Kill(os.Getpid(), syscall.SIGTERM) })
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("signal handlers should be stopped: %d goroutines before, %d after", before, after)
+	}
+}
+
+func TestRunBadTLSCert(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Server: conf.Server{
+			Listen: "127.0.0.1:0",
+			TLS: conf.TLS{ CertFile: "/nonexistent.crt", KeyFile: "/nonexistent.key" },
+		},
+	})
+	if err := s.Run(); err == nil || err == http.ErrServerClosed {
+		t.Errorf("run with bad cert should fail: %v", err)
+	}
+}
+
+func TestErrorEndJson(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	resp := httptest.NewRecorder()
+	sess := Session{ config: &conf.Config{}, req: req, resp: resp }
+	sess.ErrorEnd(http.StatusForbidden, "access of %s forbidden", "x")
+	if resp.Code != http.StatusForbidden || resp.Body.Len() != 0 || resp.Header().Get(ServantErrHeader) != "access of x forbidden" {
+		t.Errorf("plain error wrong")
+	}
+
+	req.Header.Set("Accept", "application/json")
+	resp = httptest.NewRecorder()
+	sess.resp = resp
+	sess.ErrorEnd(http.StatusForbidden, "access of %s forbidden", "x")
+	if resp.Code != http.StatusForbidden || resp.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("json error header wrong")
+	}
+	if resp.Body.String() != `{"error":{"code":403,"message":"access of x forbidden"}}` {
+		t.Errorf("json error body wrong: %s", resp.Body.String())
+	}
+	if resp.Header().Get(ServantErrHeader) != "access of x forbidden" {
+		t.Errorf("error header should be kept")
+	}
+}
+
+func TestErrorEndVerbose(t *testing.T) {
+	req, _ := http.NewRequest("GET", "/commands/a/b", nil)
+	req.Header.Set("Accept", "application/json")
+	resp := httptest.NewRecorder()
+	sess := Session{ config: &conf.Config{}, req: req, resp: resp, requestId: "r1" }
+	sess.ErrorEnd(http.StatusBadGateway, "execution error: %s", "/secret/path")
+	if resp.Header().Get(ServantErrHeader) != "bad gateway, request id r1" || resp.Body.String() != `{"error":{"code":502,"message":"bad gateway, request id r1"}}` {
+		t.Errorf("server error detail should be hidden: %q %s", resp.Header().Get(ServantErrHeader), resp.Body.String())
+	}
+	if sess.errMessage != "execution error: /secret/path" {
+		t.Errorf("detail should be kept for logs: %s", sess.errMessage)
+	}
+	sess.ErrorEnd(http.StatusNotFound, "command %s not found", "a.b")
+	if resp.Header().Get(ServantErrHeader) != "command a.b not found" {
+		t.Errorf("client error should be in detail: %s", resp.Header().Get(ServantErrHeader))
+	}
+
+	sess.config.Server.VerboseErrors = true
+	resp = httptest.NewRecorder()
+	sess.resp = resp
+	sess.ErrorEnd(http.StatusBadGateway, "execution error: %s", "/secret/path")
+	if resp.Header().Get(ServantErrHeader) != "execution error: /secret/path" {
+		t.Errorf("verbose server error should be in detail: %s", resp.Header().Get(ServantErrHeader))
+	}
+}
+
+func TestReload(t *testing.T) {
+	s := NewServer(&conf.Config{})
+	if err := s.Reload(); err == nil {
+		t.Error("reload without loader should fail")
+	}
+	timer := &conf.Timer{ Lang: "bash", Code: "true", Tick: 3600 }
+	var loaded *conf.Config
+	var loadErr error
+	s.SetConfigLoader(func() (*conf.Config, error) {
+		return loaded, loadErr
+	})
+	loaded = &conf.Config{ Timers: map[string]*conf.Timer{ "t": timer } }
+	if err := s.Reload(); err != nil || s.Config() != loaded {
+		t.Errorf("config should be swapped: %v", err)
+	}
+	task := s.timers["t"]
+	if task == nil {
+		t.Fatal("timer should be started")
+	}
+	loaded = &conf.Config{ Timers: map[string]*conf.Timer{ "t": &conf.Timer{ Lang: "bash", Code: "true", Tick: 3600 } } }
+	s.Reload()
+	if s.timers["t"] != task {
+		t.Error("unchanged timer should not be restarted")
+	}
+	loaded = &conf.Config{ Timers: map[string]*conf.Timer{ "t": &conf.Timer{ Lang: "bash", Code: "false", Tick: 3600 } } }
+	s.Reload()
+	if s.timers["t"] == task {
+		t.Error("changed timer should be restarted")
+	}
+	old := s.Config()
+	loaded, loadErr = nil, fmt.Errorf("bad config")
+	if err := s.Reload(); err == nil || s.Config() != old {
+		t.Error("old config should be kept on failure")
+	}
+	loaded, loadErr = &conf.Config{}, nil
+	s.Reload()
+	if len(s.timers) != 0 {
+		t.Error("removed timer should be stopped")
+	}
+}
+
+func TestReloadKeepsSemaphores(t *testing.T) {
+	s := NewServer(&conf.Config{})
+	s.SetConfigLoader(func() (*conf.Config, error) { return &conf.Config{}, nil })
+	sem := s.commandSemaphore("c.slow", 1)
+	if !sem.TryWith(func() {
+		s.Reload()
+		// the execution in progress still holds the slot after reloading
+		if s.commandSemaphore("c.slow", 1).TryWith(func() {}) {
+			t.Error("slot in use should be kept across reloads")
+		}
+	}) {
+		t.Fatal("slot should be free")
+	}
+	if s.commandSemaphore("c.slow", 2) == sem {
+		t.Error("semaphore should be replaced when the limit is changed")
+	}
+}
+
+func TestParseTailSegments(t *testing.T) {
+	segs, err := parseTailSegments("/2024/my%20report.pdf")
+	if err != nil || !reflect.DeepEqual(segs, []string{"2024", "my report.pdf"}) {
+		t.Errorf("segments wrong: %v %v", segs, err)
+	}
+	segs, err = parseTailSegments("")
+	if err != nil || len(segs) != 0 {
+		t.Errorf("empty tail wrong: %v %v", segs, err)
+	}
+	segs, err = parseTailSegments("//a/")
+	if err != nil || !reflect.DeepEqual(segs, []string{"a"}) {
+		t.Errorf("empty segments should be skipped: %v %v", segs, err)
+	}
+	for _, tail := range []string{"/a/../b", "/a/%2e%2e/b", "/a/%2E%2E", "/./a", "/a%2Fb", "/%zz"} {
+		if _, err = parseTailSegments(tail); err == nil {
+			t.Errorf("%s should be rejected", tail)
+		}
+	}
+}
+
+func TestStopTasks(t *testing.T) {
+	// the signal handler goroutine is started once, before counting
+	cleanupOnExit()
+	before := runtime.NumGoroutine()
+	timerTickUnit = 100 * time.Millisecond
+	defer func() {
+		timerTickUnit = time.Second
+	}()
+	pidFile := filepath.Join(t.TempDir(), "pid")
+	s := NewServer(&conf.Config{
+		Daemons: map[string]*conf.Daemon{
+			"d": &conf.Daemon{ Lang: "bash", Code: "sleep 30", Live: 3600, Restart: "always", StopTimeout: 1 },
+			"stubborn": &conf.Daemon{ Lang: "bash", Code: "trap '' TERM; sleep 30", Live: 3600, Restart: "always", StopTimeout: 1 },
+		},
+		Timers: map[string]*conf.Timer{
+			"t": &conf.Timer{ Lang: "bash", Code: "true", Tick: 36000 },
+			"fork": &conf.Timer{ Lang: "bash", Code: "sleep 30 & echo $! > " + pidFile + "; wait", Tick: 1 },
+		},
+	})
+	s.StartDaemons()
+	s.StartTimers()
+	time.Sleep(500 * time.Millisecond)
+	start := time.Now()
+	s.StopTasks()
+	if d := time.Since(start); d < time.Second || d > 5 * time.Second {
+		t.Errorf("stubborn daemon should be killed after stop timeout: %s", d)
+	}
+	if len(s.daemons) != 0 || len(s.timers) != 0 {
+		t.Errorf("tasks should be removed")
+	}
+	time.Sleep(100 * time.Millisecond)
+	data, err := os.ReadFile(pidFile)
+	if err != nil {
+		t.Fatalf("timer command should have run: %v", err)
+	}
+	// the child is not reaped if the test runs as pid 1, a zombie is dead too
+	stat, err := os.ReadFile("/proc/" + strings.TrimSpace(string(data)) + "/stat")
+	if err == nil && !strings.Contains(string(stat), ") Z ") {
+		t.Errorf("child of timer command should be stopped: %s", stat)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("goroutines leaked: %d > %d", after, before)
+	}
+}
+
+func TestRequestId(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Commands: map[string]*conf.Commands{
+			"r": &conf.Commands{ Commands: map[string]*conf.Command{
+				"id": &conf.Command{ Lang: "bash", Code: "echo $" + RequestIdEnv },
+			} },
+		},
+	})
+	out := &bytes.Buffer{}
+	logger.SetOutput(out)
+	req := httptest.NewRequest("GET", "/commands/r/id", nil)
+	req.Header.Set(RequestIdHeader, "abc-123")
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, req)
+	if resp.Header().Get(RequestIdHeader) != "abc-123" || resp.Body.String() != "abc-123\n" {
+		t.Errorf("request id should be honored and passed to command: %v %q", resp.Header(), resp.Body.String())
+	}
+	if !strings.Contains(out.String(), " abc-123) [commands] ") {
+		t.Errorf("request id should be logged: %s", out.String())
+	}
+
+	for _, id := range []string{"", "bad id\n", strings.Repeat("x", 200)} {
+		req = httptest.NewRequest("GET", "/commands/r/id", nil)
+		req.Header.Set(RequestIdHeader, id)
+		resp = httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		generated := resp.Header().Get(RequestIdHeader)
+		if generated == id || len(generated) != 36 || resp.Body.String() != generated + "\n" {
+			t.Errorf("request id should be generated for %q: %q", id, generated)
+		}
+	}
+}
+
+func TestMaxBodyBytes(t *testing.T) {
+	root := t.TempDir()
+	s := NewServer(&conf.Config{
+		Server: conf.Server{ MaxBodyBytes: 4, ResourceMaxBodyBytes: map[string]int64{ "files": 8 } },
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{ "cat": &conf.Command{ Lang: "exec", Code: "cat", Stdin: true } } },
+		},
+		Files: map[string]*conf.Files{
+			"f": &conf.Files{ Dirs: map[string]*conf.Dir{ "d": &conf.Dir{ Root: root, Allows: []string{"PUT"}, Writable: true } } },
+		},
+	})
+	serve := func(method, path, body string, chunked bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader(body))
+		if chunked {
+			req.ContentLength = -1
+		}
+		resp := httptest.NewRecorder()
+		s.ServeHTTP(resp, req)
+		return resp
+	}
+	if resp := serve("POST", "/commands/c/cat", "abcd", false); resp.Code != http.StatusOK || resp.Body.String() != "abcd" {
+		t.Errorf("body within the limit should be piped: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := serve("POST", "/commands/c/cat", "abcde", false); resp.Code != http.StatusRequestEntityTooLarge ||
+		!strings.Contains(resp.Header().Get(ServantErrHeader), "exceeds limit 4") {
+		t.Errorf("declared large body should be rejected: %d %q", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	resp := serve("POST", "/commands/c/cat", "abcde", true)
+	if resp.Body.String() == "abcde" || !strings.Contains(resp.Result().Trailer.Get(ServantErrHeader) + resp.Header().Get(ServantErrHeader), "too large") {
+		t.Errorf("streamed large body should be cut: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := serve("PUT", "/files/f/d/a", "abcdefgh", false); resp.Code != http.StatusCreated {
+		t.Errorf("files should have their own limit: %d %q", resp.Code, resp.Body.String())
+	}
+	if resp := serve("PUT", "/files/f/d/b", "abcdefghi", true); resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("streamed large upload should be rejected: %d %q", resp.Code, resp.Body.String())
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1, returns the cert and key files
+func writeTestCert(t *testing.T) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject: pkix.Name{ CommonName: "servant" },
+		IPAddresses: []net.IP{ net.ParseIP("127.0.0.1") },
+		NotBefore: time.Now().Add(-time.Hour),
+		NotAfter: time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	certFile, keyFile := dir + "/servant.crt", dir + "/servant.key"
+	os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{ Type: "CERTIFICATE", Bytes: der }), 0600)
+	os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{ Type: "EC PRIVATE KEY", Bytes: keyDer }), 0600)
+	return certFile, keyFile
+}
+
+func TestKeepAliveHttp2(t *testing.T) {
+	certFile, keyFile := writeTestCert(t)
+	for _, http2 := range []bool{ true, false } {
+		s := NewServer(&conf.Config{
+			Server: conf.Server{
+				Listen: "127.0.0.1:0",
+				TLS: conf.TLS{ CertFile: certFile, KeyFile: keyFile },
+				IdleTimeout: 60,
+				Http2: http2,
+			},
+		})
+		hs, err := s.newHttpServer(s.listenerConfs()[0])
+		if err != nil {
+			t.Fatalf("create http server failed: %s", err)
+		}
+		ln, err := net.Listen("tcp", hs.Addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		go s.serve([]*http.Server{ hs }, []net.Listener{ ln })
+
+		pool := x509.NewCertPool()
+		certPem, _ := os.ReadFile(certFile)
+		pool.AppendCertsFromPEM(certPem)
+		transport := &http.Transport{ TLSClientConfig: &tls.Config{ RootCAs: pool }, ForceAttemptHTTP2: true }
+		client := &http.Client{ Transport: transport }
+		var reused []bool
+		var protos []string
+		for i := 0; i < 2; i++ {
+			trace := &httptrace.ClientTrace{
+				GotConn: func(info httptrace.GotConnInfo) {
+					reused = append(reused, info.Reused)
+				},
+			}
+			req, _ := http.NewRequest("GET", "https://" + ln.Addr().String() + "/healthz", nil)
+			resp, err := client.Do(req.WithContext(httptrace.WithClientTrace(req.Context(), trace)))
+			if err != nil {
+				t.Fatalf("request failed: %s", err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			protos = append(protos, resp.Proto)
+		}
+		if !reflect.DeepEqual(reused, []bool{ false, true }) {
+			t.Errorf("second request should reuse the connection: %v", reused)
+		}
+		expect := "HTTP/1.1"
+		if http2 {
+			expect = "HTTP/2.0"
+		}
+		if protos[0] != expect || protos[1] != expect {
+			t.Errorf("protocol should be %s: %v", expect, protos)
+		}
+		transport.CloseIdleConnections()
+		s.Shutdown(context.Background())
+	}
+}
+
+type panicHandler struct {
+	sess  *Session
+	write bool
+}
+
+func (self panicHandler) serve() {
+	if self.write {
+		self.sess.resp.Write([]byte("partial"))
+	}
+	var m map[string]*conf.Command
+	m["x"].Code = "boom"
+}
+
+func TestRecoverPanic(t *testing.T) {
+	bb := &bytes.Buffer{}
+	out := logger.Writer()
+	logger.SetOutput(bb)
+	defer logger.SetOutput(out)
+	s := NewServer(&conf.Config{})
+	s.resources["boom"] = func(sess *Session) Handler { return panicHandler{ sess: sess } }
+	s.resources["partial"] = func(sess *Session) Handler { return panicHandler{ sess: sess, write: true } }
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+	resp, err := http.Get(ts.URL + "/boom/a/b")
+	if err != nil {
+		t.Fatalf("request should be responded: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || !strings.HasPrefix(resp.Header.Get(ServantErrHeader), "internal server error, request id ") {
+		t.Errorf("panic should be responded as 500: %d %q", resp.StatusCode, resp.Header.Get(ServantErrHeader))
+	}
+	if logs := bb.String(); !strings.Contains(logs, "CRIT") || !strings.Contains(logs, "nil pointer dereference") || !strings.Contains(logs, "panicHandler.serve") {
+		t.Errorf("panic should be logged with the stack: %s", logs)
+	}
+	resp, err = http.Get(ts.URL + "/partial/a/b")
+	if err != nil {
+		t.Fatalf("request should be responded: %s", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("status of a started response should be kept: %d", resp.StatusCode)
+	}
+	// the server keeps serving
+	resp, err = http.Get(ts.URL + "/commands/none/x")
+	if err != nil || resp.StatusCode != http.StatusNotFound {
+		t.Errorf("server should serve after panics: %v", err)
+	}
+}
@@ -5,14 +5,25 @@ import (
 	"servant/conf"
 	"net/http"
 	"encoding/json"
+	"encoding/csv"
+	"strconv"
+	"strings"
+	"time"
+	"fmt"
+	"io"
+	"context"
+	"errors"
+	"sort"
+	"sync"
 )
 
+const TruncatedHeader = "X-Servant-Truncated"
+const NextOffsetHeader = "X-Servant-Next-Offset"
+
 type DatabaseServer struct {
 	*Session
 }
 
-type sqlResult []map[string]string
-
 func NewDatabaseServer(sess *Session) Handler {
 	return DatabaseServer{
 		Session:sess,
@@ -31,12 +42,18 @@ func (self DatabaseServer) findDatabaseQueryConfig() (*conf.Database, *conf.Quer
 	return dbConf, qConf
 }
 
-func (self DatabaseServer) serve() {
-	method := self.req.Method
-	if method != "GET" {
-		self.ErrorEnd(http.StatusMethodNotAllowed, "not allow method: %s", method)
-		return
+// queryMethods returns the methods allowed of the query, transactions write, so are not allowed by GET by default
+func queryMethods(queryConf *conf.Query) []string {
+	if len(queryConf.Methods) > 0 {
+		return queryConf.Methods
 	}
+	if queryConf.Transaction || queryConf.Write {
+		return conf.DefaultTransactionMethods
+	}
+	return conf.DefaultQueryMethods
+}
+
+func (self DatabaseServer) serve() {
 	dbConf, queryConf := self.findDatabaseQueryConfig()
 	if dbConf == nil {
 		self.ErrorEnd(http.StatusNotFound, "database not found")
@@ -46,80 +63,660 @@ func (self DatabaseServer) serve() {
 		self.ErrorEnd(http.StatusNotFound, "query not found")
 		return
 	}
+	// drivers may echo the dsn in errors
+	self.addSecret(dsnPassword(dbConf.Dsn))
+	if !self.methodAllowed(queryMethods(queryConf)) {
+		return
+	}
 	//dsn := replaceCmdParams(dbConf.Dsn, globalParams())
-	reqParams := requestParams(self.req)
+	reqParams, perr := self.declaredParams(queryConf.Params)
+	if perr != nil {
+		self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
+		return
+	}
 	if !ValidateParams(queryConf.Validators, reqParams) {
 		self.ErrorEnd(http.StatusBadRequest, "validate params failed")
 		return
 	}
-	db, err := sql.Open(dbConf.Driver, dbConf.Dsn)
+	if queryConf.Transaction || queryConf.Write {
+		self.serveExec(dbConf, queryConf, reqParams)
+		return
+	}
+	page, perr := self.sqlPage(queryConf.Paginate)
+	if perr != nil {
+		self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
+		return
+	}
+	writerFactory, ok := rowWriters[self.req.URL.Query().Get("format")]
+	if !ok {
+		self.ErrorEnd(http.StatusBadRequest, "unknown format %s", self.req.URL.Query().Get("format"))
+		return
+	}
+	db, err := self.server.database(self.group, dbConf)
 	if err != nil {
-		self.ErrorEnd(http.StatusInternalServerError, "driver init failed")
+		self.ErrorEnd(http.StatusInternalServerError, "driver init failed: %s", err)
 		return
 	}
-	defer db.Close()
-	data := make([]sqlResult, 0, 1)
+	out := &startedWriter{ w: deadlineWriter{ self.resp, self.Session } }
+	writer, contentType := writerFactory(out)
+	// errors after the output started can only be reported in the trailer
+	fail := func(code int, format string, v ...interface{}) {
+		if out.started {
+			msg := self.redact(fmt.Sprintf(format, v...))
+			self.setError(code, msg)
+			self.BadEnd("%s", msg)
+		} else {
+			self.ErrorEnd(code, format, v...)
+		}
+	}
+	self.resp.Header().Set("Content-Type", contentType)
+	// the truncated and next offset headers are known after rows are written
+	trailer := ServantErrHeader + ", " + TruncatedHeader
+	if page != nil {
+		trailer += ", " + NextOffsetHeader
+	}
+	self.resp.Header().Set("Trailer", trailer)
+	// cancelling the context cancels the query on server side, for drivers supporting it
+	ctx := self.req.Context()
+	if queryConf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(queryConf.Timeout) * time.Second)
+		defer cancel()
+	}
 
 	for _, sql := range(queryConf.Sqls) {
-		sql, sqlParams, ok := replaceSqlParams(sql, reqParams)
-		if !ok {
-			self.ErrorEnd(http.StatusInternalServerError, "parse sql params failed. sql: %s, params: %v", sql, reqParams)
+		query, sqlParams, bindErr := bindSqlParams(sql, reqParams, dbConf.Driver, page)
+		if bindErr != nil {
+			fail(bindErr.HttpCode, "%s", bindErr.Message)
+			return
+		}
+		self.debug("query: %s, args: %v", query, sqlParams)
+		rows, err := db.QueryContext(ctx, query, sqlParams...)
+		if err != nil {
+			fail(queryErrorCode(err), "query %s failed: %s", query, err)
+			return
 		}
-		result, err := dbQuery(db, sql, sqlParams)
+		truncated, err := writeRows(writer, rows, queryConf.MaxRows, page, queryConf.Render)
+		rows.Close()
 		if err != nil {
-			self.ErrorEnd(http.StatusInternalServerError, "query %s failed: %s", sql, err)
+			fail(queryErrorCode(err), "query %s failed: %s", query, err)
 			return
 		}
-		data = append(data, result)
+		if truncated {
+			self.resp.Header().Set(TruncatedHeader, "true")
+			self.warn("result of %s truncated to %d rows", query, queryConf.MaxRows)
+		}
 	}
-	buf, err := json.Marshal(data)
-	if err != nil {
-		self.ErrorEnd(http.StatusInternalServerError, "json marshal failed: %s", err)
+	if page != nil && page.nextOffset >= 0 {
+		self.resp.Header().Set(NextOffsetHeader, strconv.Itoa(page.nextOffset))
+	}
+	if err = writer.finish(); err != nil {
+		fail(http.StatusInternalServerError, "write result failed: %s", err)
 		return
 	}
-	self.resp.Write(buf)
 	self.GoodEnd("execution done")
 }
 
-func replaceSqlParams(inSql string, query ParamFunc) (string, []interface{}, bool){
-	params := make([]interface{}, 0, 4)
-	outSql, ok := VarExpand(inSql, query, func(s string)string {
-		params = append(params, s)
-		return "?"
-	})
-	return outSql, params, ok
+// execResult is the result of write sqls, last_insert_id is of the last sql if the driver supports it
+type execResult struct {
+	RowsAffected int64  `json:"rows_affected"`
+	LastInsertId *int64 `json:"last_insert_id,omitempty"`
 }
 
-func dbQuery(db *sql.DB, sql string, params []interface{}) (sqlResult, error) {
-	rows, err := db.Query(sql, params...)
+// sqlExecer is a database or a transaction
+type sqlExecer interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+}
+
+// serveExec executes the sqls as writes. In a transaction, it commits if all succeed, or rolls back.
+// Otherwise the sqls are executed one by one, and those before a failed one are not undone.
+func (self DatabaseServer) serveExec(dbConf *conf.Database, queryConf *conf.Query, reqParams ParamFunc) {
+	db, err := self.server.database(self.group, dbConf)
 	if err != nil {
-		return nil, err
+		self.ErrorEnd(http.StatusInternalServerError, "driver init failed: %s", err)
+		return
+	}
+	ctx := self.req.Context()
+	if queryConf.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(queryConf.Timeout) * time.Second)
+		defer cancel()
+	}
+	var execer sqlExecer = db
+	var tx *sql.Tx
+	rolledBack := ""
+	if queryConf.Transaction {
+		tx, err = db.BeginTx(ctx, nil)
+		if err != nil {
+			self.ErrorEnd(queryErrorCode(err), "begin transaction failed: %s", err)
+			return
+		}
+		// no-op after commit
+		defer tx.Rollback()
+		execer, rolledBack = tx, ", rolled back"
+	}
+	result := execResult{}
+	for _, sql := range(queryConf.Sqls) {
+		query, sqlParams, bindErr := bindSqlParams(sql, reqParams, dbConf.Driver, nil)
+		if bindErr != nil {
+			self.ErrorEnd(bindErr.HttpCode, "%s", bindErr.Message)
+			return
+		}
+		self.debug("exec: %s, args: %v", query, sqlParams)
+		r, err := execer.ExecContext(ctx, query, sqlParams...)
+		if err != nil {
+			self.ErrorEnd(queryErrorCode(err), "exec %s failed%s: %s", query, rolledBack, err)
+			return
+		}
+		if n, err := r.RowsAffected(); err == nil {
+			result.RowsAffected += n
+		}
+		if id, err := r.LastInsertId(); err == nil {
+			result.LastInsertId = &id
+		}
+	}
+	if tx != nil {
+		if err = tx.Commit(); err != nil {
+			self.ErrorEnd(queryErrorCode(err), "commit failed: %s", err)
+			return
+		}
+	}
+	buf, _ := json.Marshal(result)
+	self.resp.Header().Set("Content-Type", "application/json")
+	self.resp.Write(buf)
+	self.GoodEnd("exec done")
+}
+
+// sqlPage is the page of a paginated query requested, nextOffset is of the last sql paginated,
+// -1 if there are no more rows
+type sqlPage struct {
+	limit      int
+	offset     int
+	used       bool // whether the current sql binds ${limit}
+	nextOffset int
+}
+
+// sqlPage returns the page requested by the limit and offset params, nil if the query is not paginated
+func (self DatabaseServer) sqlPage(paginate *conf.Paginate) (*sqlPage, *ServantError) {
+	if paginate == nil {
+		return nil, nil
+	}
+	page := &sqlPage{ limit: paginate.Limit, nextOffset: -1 }
+	query := self.req.URL.Query()
+	for _, p := range []struct{ name string; v *int }{ { "limit", &page.limit }, { "offset", &page.offset } } {
+		s := query.Get(p.name)
+		if s == "" {
+			continue
+		}
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 0 {
+			err := NewServantError(http.StatusBadRequest, "param %s=%s is not a non-negative integer", p.name, s)
+			return nil, &err
+		}
+		*p.v = n
+	}
+	if page.limit > paginate.MaxLimit {
+		err := NewServantError(http.StatusBadRequest, "param limit=%d exceeds %d", page.limit, paginate.MaxLimit)
+		return nil, &err
+	}
+	return page, nil
+}
+
+// param returns the value of the limit or offset param, false for other params or without a page
+func (self *sqlPage) param(name string) (int64, bool) {
+	if self == nil {
+		return 0, false
+	}
+	switch name {
+	case "limit":
+		self.used = true
+		return int64(self.limit), true
+	case "offset":
+		return int64(self.offset), true
+	}
+	return 0, false
+}
+
+// next returns the offset of the next page after n rows of the current sql, -1 if the page is not full
+func (self *sqlPage) next(n int) int {
+	if self.limit == 0 || n < self.limit {
+		return -1
+	}
+	return self.offset + self.limit
+}
+
+// bindSqlParams replaces params in the sql with placeholders of the driver, and returns them as bind args.
+// With a page, ${limit} and ${offset} are bound as integers, as drivers may not take strings for LIMIT.
+func bindSqlParams(sql string, reqParams ParamFunc, driver string, page *sqlPage) (string, []interface{}, *ServantError) {
+	missing := ""
+	if page != nil {
+		page.used = false
 	}
-	defer rows.Close()
-	return rowsToResult(rows)
+	trackedParams := func(k string) (string, bool) {
+		if n, ok := page.param(k); ok {
+			return strconv.FormatInt(n, 10), true
+		}
+		v, ok := reqParams(k)
+		if !ok && missing == "" {
+			missing = k
+		}
+		return v, ok
+	}
+	arg := func(name, v string) interface{} {
+		if n, ok := page.param(name); ok {
+			return n
+		}
+		return v
+	}
+	query, sqlParams, ok := replaceSqlParamsNamed(sql, trackedParams, sqlPlaceholder(driver), arg)
+	if !ok && missing != "" {
+		err := NewServantError(http.StatusBadRequest, "param %s missing", missing)
+		return "", nil, &err
+	} else if !ok {
+		err := NewServantError(http.StatusInternalServerError, "parse sql params failed. sql: %s", sql)
+		return "", nil, &err
+	}
+	return query, sqlParams, nil
+}
+
+func queryErrorCode(err error) int {
+	if errors.Is(err, context.DeadlineExceeded) {
+		return http.StatusGatewayTimeout
+	}
+	return http.StatusInternalServerError
+}
+
+// startedWriter records whether anything is written
+type startedWriter struct {
+	w       io.Writer
+	started bool
+}
+
+func (self *startedWriter) Write(p []byte) (int, error) {
+	self.started = true
+	return self.w.Write(p)
 }
 
-func rowsToResult(rows *sql.Rows) (sqlResult, error) {
+// rowWriter writes results of sqls in a format. Rows are written as they are read, so memory stays flat.
+type rowWriter interface {
+	// begin starts the result of a sql
+	begin(columns []string) error
+	row(values []interface{}) error
+	// truncated marks the result truncated by max rows
+	truncated() error
+	// nextPage marks the result a full page, followed by the page at the offset
+	nextPage(offset int) error
+	// end ends the result of a sql
+	end() error
+	// finish is called after all results written
+	finish() error
+}
+
+var rowWriters = map[string]func(w io.Writer) (rowWriter, string) {
+	"": newJsonRowWriter,
+	"json": newJsonRowWriter,
+	"csv": func(w io.Writer) (rowWriter, string) {
+		return newCsvRowWriter(w, ','), "text/csv; charset=utf-8"
+	},
+	"tsv": func(w io.Writer) (rowWriter, string) {
+		return newCsvRowWriter(w, '\t'), "text/tab-separated-values; charset=utf-8"
+	},
+}
+
+// writeRows reads the rows into the writer as a result, at most maxRows rows if it is positive.
+// With a page, the offset of the next page is written if the page is full.
+func writeRows(writer rowWriter, rows *sql.Rows, maxRows int, page *sqlPage, render conf.Render) (truncated bool, err error) {
 	columns, err := rows.Columns()
 	if err != nil {
-		return nil, err
+		return
 	}
-	ret := make([]map[string]string, 0, 1)
-	row := make([]interface{}, len(columns))
-	for i, _ := range(row) {
-		row[i] = new(string)
+	columnTypes, err := rows.ColumnTypes()
+	if err != nil {
+		return
+	}
+	values := make([]interface{}, len(columns))
+	ptrs := make([]interface{}, len(columns))
+	for i := range values {
+		ptrs[i] = &values[i]
+	}
+	if err = writer.begin(columns); err != nil {
+		return
 	}
+	n := 0
 	for rows.Next() {
-		err = rows.Scan(row...)
+		if maxRows > 0 && n == maxRows {
+			truncated = true
+			if err = writer.truncated(); err != nil {
+				return
+			}
+			break
+		}
+		if err = rows.Scan(ptrs...); err != nil {
+			return
+		}
+		for i, v := range values {
+			values[i] = sqlValue(v, columnTypes[i], render)
+		}
+		if err = writer.row(values); err != nil {
+			return
+		}
+		n++
+	}
+	if err = rows.Err(); err != nil {
+		return
+	}
+	if page != nil && page.used {
+		// a page truncated by max rows is not complete to be followed
+		if page.nextOffset = page.next(n); page.nextOffset >= 0 && !truncated {
+			if err = writer.nextPage(page.nextOffset); err != nil {
+				return
+			}
+		} else {
+			page.nextOffset = -1
+		}
+	}
+	err = writer.end()
+	return
+}
+
+// sqlValue converts bytes from drivers to string, or to number if the column is numeric,
+// then renders nulls, numbers and times as configured
+func sqlValue(v interface{}, columnType *sql.ColumnType, render conf.Render) interface{} {
+	if b, ok := v.([]byte); ok {
+		if isNumericColumn(columnType) {
+			v = json.Number(b)
+		} else {
+			v = string(b)
+		}
+	}
+	switch value := v.(type) {
+	case nil:
+		if render.Nulls == "empty" {
+			return ""
+		}
+	case json.Number:
+		if render.Numbers == "string" {
+			return string(value)
+		}
+	case int64, uint64:
+		if render.Numbers == "string" {
+			return fmt.Sprint(value)
+		}
+	case float64:
+		if render.Numbers == "string" {
+			return strconv.FormatFloat(value, 'f', -1, 64)
+		}
+	case time.Time:
+		if render.Times == "unix" {
+			return value.Unix()
+		}
+	}
+	return v
+}
+
+func isNumericColumn(columnType *sql.ColumnType) bool {
+	name := strings.ToUpper(columnType.DatabaseTypeName())
+	for _, t := range []string{"INT", "DECIMAL", "NUMERIC", "FLOAT", "DOUBLE", "REAL"} {
+		if strings.Contains(name, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// jsonRowWriter writes an array of results, each is an array of objects keyed by column name
+type jsonRowWriter struct {
+	w        io.Writer
+	columns  [][]byte
+	results  int
+	rows     int
+}
+
+func newJsonRowWriter(w io.Writer) (rowWriter, string) {
+	return &jsonRowWriter{ w: w }, "application/json"
+}
+
+func (self *jsonRowWriter) begin(columns []string) error {
+	self.columns = make([][]byte, len(columns))
+	for i, column := range columns {
+		self.columns[i], _ = json.Marshal(column)
+	}
+	self.rows = 0
+	sep := ","
+	if self.results == 0 {
+		sep = "["
+	}
+	_, err := io.WriteString(self.w, sep + "[")
+	return err
+}
+
+func (self *jsonRowWriter) row(values []interface{}) error {
+	buf := make([]byte, 0, 64)
+	if self.rows > 0 {
+		buf = append(buf, ',')
+	}
+	buf = append(buf, '{')
+	for i, v := range values {
+		if i > 0 {
+			buf = append(buf, ',')
+		}
+		buf = append(buf, self.columns[i]...)
+		buf = append(buf, ':')
+		value, err := json.Marshal(v)
 		if err != nil {
-			return ret, err
+			// e.g. malformed numbers
+			value, _ = json.Marshal(fmt.Sprint(v))
+		}
+		buf = append(buf, value...)
+	}
+	buf = append(buf, '}')
+	self.rows++
+	_, err := self.w.Write(buf)
+	return err
+}
+
+func (self *jsonRowWriter) truncated() error {
+	s := `{"_truncated":true}`
+	if self.rows > 0 {
+		s = "," + s
+	}
+	_, err := io.WriteString(self.w, s)
+	return err
+}
+
+func (self *jsonRowWriter) nextPage(offset int) error {
+	s := `{"_next_offset":` + strconv.Itoa(offset) + "}"
+	if self.rows > 0 {
+		s = "," + s
+	}
+	_, err := io.WriteString(self.w, s)
+	return err
+}
+
+func (self *jsonRowWriter) end() error {
+	self.results++
+	_, err := io.WriteString(self.w, "]")
+	return err
+}
+
+func (self *jsonRowWriter) finish() error {
+	s := "]"
+	if self.results == 0 {
+		s = "[]"
+	}
+	_, err := io.WriteString(self.w, s)
+	return err
+}
+
+// csvRowWriter writes a header row and rows of each result, results are separated by an empty line
+type csvRowWriter struct {
+	w        *csv.Writer
+	results  int
+}
+
+func newCsvRowWriter(w io.Writer, comma rune) rowWriter {
+	writer := csv.NewWriter(w)
+	writer.Comma = comma
+	return &csvRowWriter{ w: writer }
+}
+
+func (self *csvRowWriter) begin(columns []string) error {
+	if self.results > 0 {
+		self.w.Write(nil)
+	}
+	return self.w.Write(columns)
+}
+
+func (self *csvRowWriter) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case nil:
+			record[i] = ""
+		case time.Time:
+			record[i] = v.Format(time.RFC3339Nano)
+		default:
+			record[i] = fmt.Sprint(v)
+		}
+	}
+	return self.w.Write(record)
+}
+
+func (self *csvRowWriter) truncated() error {
+	return self.w.Write([]string{"#truncated"})
+}
+
+func (self *csvRowWriter) nextPage(offset int) error {
+	return self.w.Write([]string{"#next_offset=" + strconv.Itoa(offset)})
+}
+
+func (self *csvRowWriter) end() error {
+	self.results++
+	self.w.Flush()
+	return self.w.Error()
+}
+
+func (self *csvRowWriter) finish() error {
+	self.w.Flush()
+	return self.w.Error()
+}
+
+// dbPool is a connection pool of a database, with the config it is opened by
+type dbPool struct {
+	conf  conf.Database
+	db    *sql.DB
+}
+
+func samePoolConf(a, b *conf.Database) bool {
+	return a.Driver == b.Driver && a.Dsn == b.Dsn && a.MaxOpenConns == b.MaxOpenConns &&
+		a.MaxIdleConns == b.MaxIdleConns && a.ConnMaxLifetime == b.ConnMaxLifetime
+}
+
+// database returns the connection pool of a database, (re)opens it if not opened or the config changed
+func (self *Server) database(name string, dbConf *conf.Database) (*sql.DB, error) {
+	self.databasesLock.Lock()
+	defer self.databasesLock.Unlock()
+	pool, ok := self.databases[name]
+	if ok && samePoolConf(&pool.conf, dbConf) {
+		return pool.db, nil
+	}
+	db, err := sql.Open(dbConf.Driver, dbConf.Dsn)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(dbConf.MaxOpenConns)
+	db.SetMaxIdleConns(dbConf.MaxIdleConns)
+	db.SetConnMaxLifetime(time.Duration(dbConf.ConnMaxLifetime) * time.Second)
+	if ok {
+		// Close waits for in-flight queries of the old pool
+		go pool.db.Close()
+	}
+	self.databases[name] = &dbPool{ conf: *dbConf, db: db }
+	return db, nil
+}
+
+// openDatabases opens the pools of all configured databases and pings them, so requests reuse the
+// pools from the start. Pools of databases removed from the config are closed.
+func (self *Server) openDatabases() {
+	config := self.Config()
+	self.databasesLock.Lock()
+	for name, pool := range self.databases {
+		if _, ok := config.Databases[name]; !ok {
+			go pool.db.Close()
+			delete(self.databases, name)
+		}
+	}
+	for name := range self.unreachableDbs {
+		if _, ok := config.Databases[name]; !ok {
+			delete(self.unreachableDbs, name)
+		}
+	}
+	self.databasesLock.Unlock()
+	var wg sync.WaitGroup
+	for name := range config.Databases {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := self.pingDatabase(context.Background(), name); err != nil {
+				logger.Printf("WARN (_) [server] database %s unreachable: %s", name, redactSecrets(err.Error(), dsnPassword(config.Databases[name].Dsn)))
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// unreachableDatabases returns configured databases failed the last ping
+func (self *Server) unreachableDatabases() []string {
+	config := self.Config()
+	self.databasesLock.Lock()
+	defer self.databasesLock.Unlock()
+	ret := make([]string, 0, len(self.unreachableDbs))
+	for name := range self.unreachableDbs {
+		if _, ok := config.Databases[name]; ok {
+			ret = append(ret, name)
+		}
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+func (self *Server) closeDatabases() {
+	self.databasesLock.Lock()
+	defer self.databasesLock.Unlock()
+	for name, pool := range self.databases {
+		pool.db.Close()
+		delete(self.databases, name)
+	}
+}
+
+// sqlPlaceholder returns the bind placeholder style of the driver, $1, $2... for postgresql, ? for others
+func sqlPlaceholder(driver string) func(n int) string {
+	switch driver {
+	case "postgres", "pgx":
+		return func(n int) string {
+			return "$" + strconv.Itoa(n)
 		}
-		mapRow := make(map[string]string)
-		for i, column := range(columns) {
-			mapRow[column] = *(row[i]).(*string)
+	default:
+		return func(int) string {
+			return "?"
 		}
-		ret = append(ret, mapRow)
 	}
-	return ret, nil
 }
 
+func replaceSqlParams(inSql string, query ParamFunc) (string, []interface{}, bool){
+	return replaceSqlParamsWith(inSql, query, sqlPlaceholder(""))
+}
+
+func replaceSqlParamsWith(inSql string, query ParamFunc, placeholder func(n int) string) (string, []interface{}, bool){
+	return replaceSqlParamsNamed(inSql, query, placeholder, func(name, v string) interface{} { return v })
+}
+
+// replaceSqlParamsNamed is replaceSqlParamsWith converting values of params into bind args by their names
+func replaceSqlParamsNamed(inSql string, query ParamFunc, placeholder func(n int) string, arg func(name, v string) interface{}) (string, []interface{}, bool){
+	params := make([]interface{}, 0, 4)
+	outSql, ok := varExpandNamed(inSql, query, func(name, v string)string {
+		params = append(params, arg(name, v))
+		return placeholder(len(params))
+	})
+	return outSql, params, ok
+}
@@ -3,6 +3,18 @@ import (
 	"testing"
 	"gopkg.in/DATA-DOG/go-sqlmock.v1"
 	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"servant/conf"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"bytes"
+	"context"
+	"strings"
+	"time"
 )
 
 func TestReplaceSqlParams(t *testing.T) {
@@ -43,6 +55,357 @@ func TestReplaceSqlParams(t *testing.T) {
 	}
 }
 
+func TestSqlPlaceholder(t *testing.T) {
+	p := func(k string)(string,bool) {
+		return k, true
+	}
+	s, params, ok := replaceSqlParamsWith("select ${a}, ${b}", p, sqlPlaceholder("postgres"))
+	if !ok || s != "select $1, $2" || len(params) != 2 || params[1] != "b" {
+		t.Errorf("postgres placeholders wrong: %s %v", s, params)
+	}
+	s, _, _ = replaceSqlParamsWith("select ${a}, ${b}", p, sqlPlaceholder("mysql"))
+	if s != "select ?, ?" {
+		t.Errorf("mysql placeholders wrong: %s", s)
+	}
+}
+
+// fakeDriver echoes the query and its bind args as a row of columns query and args.
+// Query "repeat N" echoes N rows, "sleep" blocks until the context done, "page" echoes rows of a table
+// of 5 rows by int64 args limit and offset, "types" a row of typed values.
+// Exec affects 1 row, or fails with "fail". Transactions are logged in fakeTxLog.
+type fakeDriver struct{}
+type fakeConn struct{}
+type fakeTx struct{}
+type fakeStmt struct{ query string }
+type fakeRows struct{
+	values []driver.Value
+	n      int
+}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) { return fakeConn{}, nil }
+func (fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{ query: query }, nil }
+func (fakeConn) Close() error { return nil }
+func (fakeConn) Begin() (driver.Tx, error) {
+	fakeTxLog = append(fakeTxLog, "begin")
+	return fakeTx{}, nil
+}
+func (fakeTx) Commit() error {
+	fakeTxLog = append(fakeTxLog, "commit")
+	return nil
+}
+func (fakeTx) Rollback() error {
+	fakeTxLog = append(fakeTxLog, "rollback")
+	return nil
+}
+
+var fakeTxLog []string
+
+func (self *fakeStmt) Close() error { return nil }
+func (self *fakeStmt) NumInput() int { return -1 }
+func (self *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if self.query == "fail" {
+		return nil, fmt.Errorf("failed")
+	}
+	fakeTxLog = append(fakeTxLog, self.query + " " + fmt.Sprint(args))
+	return driver.RowsAffected(1), nil
+}
+func (self *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	n := 1
+	fmt.Sscanf(self.query, "repeat %d", &n)
+	if strings.HasPrefix(self.query, "page") && len(args) == 2 {
+		limit, _ := args[0].(int64)
+		offset, _ := args[1].(int64)
+		n = max(min(int(limit), 5 - int(offset)), 0)
+	}
+	return &fakeRows{ values: []driver.Value{ self.query, fmt.Sprint(args) }, n: n }, nil
+}
+func (self *fakeStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	if self.query == "sleep" {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	}
+	if self.query == "types" {
+		return &fakeTypedRows{}, nil
+	}
+	values := make([]driver.Value, len(args))
+	for i, arg := range args {
+		values[i] = arg.Value
+	}
+	return self.Query(values)
+}
+func (self *fakeRows) Columns() []string { return []string{"query", "args"} }
+func (self *fakeRows) Close() error { return nil }
+func (self *fakeRows) Next(dest []driver.Value) error {
+	if self.n == 0 {
+		return io.EOF
+	}
+	copy(dest, self.values)
+	self.n--
+	return nil
+}
+
+// fakeTypedRows is a row of a big int, a decimal as bytes, a null and a timestamp, with database types
+type fakeTypedRows struct{ done bool }
+
+func (self *fakeTypedRows) Columns() []string { return []string{"id", "price", "note", "at"} }
+func (self *fakeTypedRows) Close() error { return nil }
+func (self *fakeTypedRows) ColumnTypeDatabaseTypeName(i int) string {
+	return []string{"BIGINT", "DECIMAL", "TEXT", "TIMESTAMP"}[i]
+}
+func (self *fakeTypedRows) Next(dest []driver.Value) error {
+	if self.done {
+		return io.EOF
+	}
+	self.done = true
+	copy(dest, []driver.Value{ int64(9007199254740993), []byte("1.50"), nil, time.Unix(1700000000, 0).UTC() })
+	return nil
+}
+
+func init() {
+	sql.Register("servanttest", fakeDriver{})
+}
+
+func TestDatabasePool(t *testing.T) {
+	server := NewServer(&conf.Config{})
+	dbConf := &conf.Database{ Driver: "servanttest", Dsn: "a", MaxOpenConns: 3 }
+	db1, err := server.database("db", dbConf)
+	if err != nil || db1.Stats().MaxOpenConnections != 3 {
+		t.Fatalf("open pool failed: %v", err)
+	}
+	if db2, _ := server.database("db", dbConf); db2 != db1 {
+		t.Errorf("pool should be reused")
+	}
+	if db3, _ := server.database("db", &conf.Database{ Driver: "servanttest", Dsn: "b" }); db3 == db1 {
+		t.Errorf("pool should be reopened when config changed")
+	}
+	if _, err := server.database("other", &conf.Database{ Driver: "nosuchdriver" }); err == nil {
+		t.Errorf("unknown driver should fail")
+	}
+	server.closeDatabases()
+}
+
+func TestServeDatabaseBindParams(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"q": &conf.Query{ Sqls: []string{"select * from users where name = ${name}"} },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := query("/databases/db/q?name=" + url.QueryEscape("'; DROP TABLE users; --"))
+	var data [][]map[string]interface{}
+	if err := json.Unmarshal(resp.Body.Bytes(), &data); err != nil || resp.Code != http.StatusOK || len(data) != 1 || len(data[0]) != 1 {
+		t.Fatalf("query failed: %d %s", resp.Code, resp.Body.String())
+	}
+	if data[0][0]["query"] != "select * from users where name = ?" || data[0][0]["args"] != "['; DROP TABLE users; --]" {
+		t.Errorf("param should be a bind arg: %v", data[0][0])
+	}
+	if resp = query("/databases/db/q"); resp.Code != http.StatusBadRequest {
+		t.Errorf("missing param should be 400: %d", resp.Code)
+	}
+}
+
+func TestServeDatabaseFormats(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"q": &conf.Query{ Sqls: []string{"select 1", "select ${a}"} },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := query("/databases/db/q?a=x")
+	if resp.Body.String() != `[[{"query":"select 1","args":"[]"}],[{"query":"select ?","args":"[x]"}]]` || resp.Header().Get("Content-Type") != "application/json" {
+		t.Errorf("json wrong: %s", resp.Body.String())
+	}
+	resp = query("/databases/db/q?a=x&format=csv")
+	if resp.Body.String() != "query,args\nselect 1,[]\n\nquery,args\nselect ?,[x]\n" || resp.Header().Get("Content-Type") != "text/csv; charset=utf-8" {
+		t.Errorf("csv wrong: %q", resp.Body.String())
+	}
+	resp = query("/databases/db/q?a=x%09y&format=tsv")
+	if resp.Body.String() != "query\targs\nselect 1\t[]\n\nquery\targs\nselect ?\t\"[x\ty]\"\n" {
+		t.Errorf("tsv wrong: %q", resp.Body.String())
+	}
+	if resp = query("/databases/db/q?a=x&format=xml"); resp.Code != http.StatusBadRequest {
+		t.Errorf("unknown format should be 400: %d", resp.Code)
+	}
+	// the second sql fails after the output started
+	resp = query("/databases/db/q")
+	if resp.Code != http.StatusOK || resp.Header().Get(ServantErrHeader) == "" {
+		t.Errorf("error after output started should be in trailer: %d %v", resp.Code, resp.Header())
+	}
+}
+
+func TestServeDatabaseLimits(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"rows": &conf.Query{ Sqls: []string{"repeat 3"}, MaxRows: 2 },
+				"enough": &conf.Query{ Sqls: []string{"repeat 2"}, MaxRows: 2 },
+				"slow": &conf.Query{ Sqls: []string{"sleep"}, Timeout: 1 },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := query("/databases/db/rows")
+	row := `{"query":"repeat 3","args":"[]"}`
+	if resp.Body.String() != "[[" + row + "," + row + `,{"_truncated":true}]]` || resp.Header().Get(TruncatedHeader) != "true" {
+		t.Errorf("rows should be truncated: %s", resp.Body.String())
+	}
+	resp = query("/databases/db/rows?format=csv")
+	if resp.Body.String() != "query,args\nrepeat 3,[]\nrepeat 3,[]\n#truncated\n" {
+		t.Errorf("csv rows should be truncated: %q", resp.Body.String())
+	}
+	if resp = query("/databases/db/enough"); resp.Header().Get(TruncatedHeader) != "" {
+		t.Errorf("rows not more than max should not be truncated: %s", resp.Body.String())
+	}
+	start := time.Now()
+	if resp = query("/databases/db/slow"); resp.Code != http.StatusGatewayTimeout || time.Since(start) > 3 * time.Second {
+		t.Errorf("slow query should time out: %d", resp.Code)
+	}
+}
+
+func TestServeDatabasePaginate(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"q": &conf.Query{ Sqls: []string{"page limit ${limit} offset ${offset}"}, Paginate: &conf.Paginate{ Limit: 2, MaxLimit: 3 } },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(uri string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	row := func(args string) string {
+		return `{"query":"page limit ? offset ?","args":"[` + args + `]"}`
+	}
+	resp := query("/databases/db/q")
+	if resp.Body.String() != "[[" + row("2 0") + "," + row("2 0") + `,{"_next_offset":2}]]` || resp.Header().Get(NextOffsetHeader) != "2" {
+		t.Errorf("first page wrong: %s %v", resp.Body.String(), resp.Header())
+	}
+	resp = query("/databases/db/q?limit=3&offset=3")
+	if resp.Body.String() != "[[" + row("3 3") + "," + row("3 3") + "]]" || resp.Header().Get(NextOffsetHeader) != "" {
+		t.Errorf("last page should not have a next offset: %s %v", resp.Body.String(), resp.Header())
+	}
+	resp = query("/databases/db/q?offset=2&format=csv")
+	if resp.Body.String() != "query,args\npage limit ? offset ?,[2 2]\npage limit ? offset ?,[2 2]\n#next_offset=4\n" {
+		t.Errorf("csv page wrong: %q", resp.Body.String())
+	}
+	for _, q := range []string{"limit=4", "limit=-1", "offset=x", "offset=-2"} {
+		if resp = query("/databases/db/q?" + q); resp.Code != http.StatusBadRequest {
+			t.Errorf("%s should be rejected: %d", q, resp.Code)
+		}
+	}
+}
+
+func TestServeDatabaseRender(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"default": &conf.Query{ Sqls: []string{"types"}, Render: conf.DefaultRender },
+				"js": &conf.Query{ Sqls: []string{"types"}, Render: conf.Render{ Nulls: "empty", Numbers: "string", Times: "unix" } },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(uri string) string {
+		req, _ := http.NewRequest("GET", uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp.Body.String()
+	}
+	if body := query("/databases/db/default"); body != `[[{"id":9007199254740993,"price":1.50,"note":null,"at":"2023-11-14T22:13:20Z"}]]` {
+		t.Errorf("default rendering wrong: %s", body)
+	}
+	if body := query("/databases/db/js"); body != `[[{"id":"9007199254740993","price":"1.50","note":"","at":1700000000}]]` {
+		t.Errorf("overridden rendering wrong: %s", body)
+	}
+	if body := query("/databases/db/js?format=csv"); body != "id,price,note,at\n9007199254740993,1.50,,1700000000\n" {
+		t.Errorf("csv rendering wrong: %q", body)
+	}
+}
+
+func TestServeDatabaseTransaction(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"ok": &conf.Query{ Sqls: []string{"insert ${a}", "update ${a}"}, Transaction: true },
+				"bad": &conf.Query{ Sqls: []string{"insert ${a}", "fail"}, Transaction: true },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(method, uri string) *httptest.ResponseRecorder {
+		fakeTxLog = nil
+		req, _ := http.NewRequest(method, uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := query("POST", "/databases/db/ok?a=x")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"rows_affected":2}` || fmt.Sprint(fakeTxLog) != "[begin insert ? [x] update ? [x] commit]" {
+		t.Errorf("transaction wrong: %d %s %v", resp.Code, resp.Body.String(), fakeTxLog)
+	}
+	resp = query("POST", "/databases/db/bad?a=x")
+	if resp.Code != http.StatusInternalServerError || resp.Header().Get(ServantErrHeader) == "" || fmt.Sprint(fakeTxLog) != "[begin insert ? [x] rollback]" {
+		t.Errorf("transaction should be rolled back: %d %v", resp.Code, fakeTxLog)
+	}
+	if resp = query("POST", "/databases/db/ok"); resp.Code != http.StatusBadRequest || fmt.Sprint(fakeTxLog) != "[begin rollback]" {
+		t.Errorf("missing param should roll back: %d %v", resp.Code, fakeTxLog)
+	}
+	if resp = query("GET", "/databases/db/ok?a=x"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("transaction by GET should not be allowed: %d", resp.Code)
+	}
+}
+
+func TestServeDatabaseWrite(t *testing.T) {
+	server := NewServer(&conf.Config{
+		Databases: map[string]*conf.Database{
+			"db": &conf.Database{ Driver: "servanttest", Queries: map[string]*conf.Query{
+				"w": &conf.Query{ Sqls: []string{"insert ${a}", "update ${a}"}, Write: true },
+			} },
+		},
+	})
+	defer server.closeDatabases()
+	query := func(method, uri string) *httptest.ResponseRecorder {
+		fakeTxLog = nil
+		req, _ := http.NewRequest(method, uri, nil)
+		resp := httptest.NewRecorder()
+		NewDatabaseServer(server.newSession(resp, req)).serve()
+		return resp
+	}
+	resp := query("POST", "/databases/db/w?a=x")
+	if resp.Code != http.StatusOK || resp.Body.String() != `{"rows_affected":2}` || fmt.Sprint(fakeTxLog) != "[insert ? [x] update ? [x]]" {
+		t.Errorf("write wrong: %d %s %v", resp.Code, resp.Body.String(), fakeTxLog)
+	}
+	if resp = query("GET", "/databases/db/w?a=x"); resp.Code != http.StatusMethodNotAllowed {
+		t.Errorf("write by GET should not be allowed: %d", resp.Code)
+	}
+}
+
 func mockRowsToSqlRows(mockRows sqlmock.Rows) *sql.Rows {
 	db, mock, _ := sqlmock.New()
 	mock.ExpectQuery("select").WillReturnRows(mockRows)
@@ -51,19 +414,29 @@ func mockRowsToSqlRows(mockRows sqlmock.Rows) *sql.Rows {
 }
 
 
-func TestRowToResult(t *testing.T) {
+func TestWriteRows(t *testing.T) {
 	mockRows := sqlmock.NewRows([]string{"a","b","c"})
-	mockRows.AddRow(1, 2, 3)
-	result, err := rowsToResult(mockRowsToSqlRows(mockRows))
-	if err != nil {
+	mockRows.AddRow(1, nil, "x,y")
+	mockRows.AddRow(2, "z", "")
+	buf := &bytes.Buffer{}
+	writer, _ := newJsonRowWriter(buf)
+	if _, err := writeRows(writer, mockRowsToSqlRows(mockRows), 0, nil, conf.Render{}); err != nil {
 		t.Error(err)
 	}
-	if len(result) != 1 || len(result[0]) != 3 {
-		t.Fail()
-	}
-	if result[0]["a"] != "1" || result[0]["b"] != "2" || result[0]["c"] != "3" {
-		t.Fail()
+	writer.finish()
+	if buf.String() != `[[{"a":1,"b":null,"c":"x,y"},{"a":2,"b":"z","c":""}]]` {
+		t.Errorf("json rows wrong: %s", buf.String())
 	}
 
+	mockRows = sqlmock.NewRows([]string{"a","b","c"})
+	mockRows.AddRow(1, nil, "x,y")
+	buf.Reset()
+	writer = newCsvRowWriter(buf, ',')
+	if _, err := writeRows(writer, mockRowsToSqlRows(mockRows), 0, nil, conf.Render{}); err != nil {
+		t.Error(err)
+	}
+	writer.finish()
+	if buf.String() != "a,b,c\n1,,\"x,y\"\n" {
+		t.Errorf("csv rows wrong: %q", buf.String())
+	}
 }
-
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"servant/conf"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sseHeartbeatInterval is how often a comment is sent while a command is silent,
+// so proxies do not close the idle connection
+const sseHeartbeatInterval = 15 * time.Second
+
+// wantsEventStream reports whether the client asks for command output as server-sent events
+func wantsEventStream(req *http.Request) bool {
+	return req != nil && strings.Contains(req.Header.Get("Accept"), "text/event-stream")
+}
+
+// sseExit is the data of the final event of a command
+type sseExit struct {
+	ExitCode *int   `json:"exit_code,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// sseWriter writes each chunk of output as a data event, lines of the chunk as data lines of the event
+type sseWriter struct {
+	lock sync.Mutex
+	sess *Session
+}
+
+func (self *sseWriter) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	var buf bytes.Buffer
+	for _, line := range strings.Split(strings.TrimSuffix(string(p), "\n"), "\n") {
+		buf.WriteString("data: ")
+		buf.WriteString(strings.TrimSuffix(line, "\r"))
+		buf.WriteByte('\n')
+	}
+	buf.WriteByte('\n')
+	if _, err := self.send(buf.Bytes()); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send writes raw event stream lines and flushes them at once
+func (self *sseWriter) send(p []byte) (int, error) {
+	self.lock.Lock()
+	defer self.lock.Unlock()
+	self.sess.resetWriteDeadline()
+	n, err := self.sess.resp.Write(p)
+	http.NewResponseController(self.sess.resp).Flush()
+	return n, err
+}
+
+// serveEventStream executes the command streaming its output as server-sent events. The stream starts
+// before execution, so the outcome, successful or not, is sent as a final exit event rather than the status.
+// A heartbeat comment is sent every heartbeat.
+func (self CommandServer) serveEventStream(cmdConf *conf.Command, heartbeat time.Duration) {
+	header := self.resp.Header()
+	header.Set("Content-Type", "text/event-stream")
+	header.Set("Cache-Control", "no-cache")
+	header.Set("X-Accel-Buffering", "no")
+	self.resp.WriteHeader(http.StatusOK)
+	out := &sseWriter{ sess: self.Session }
+	out.send([]byte(":\n\n"))
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				out.send([]byte(":\n\n"))
+			case <-done:
+				return
+			}
+		}
+	}()
+	err := self.execCommand(cmdConf, out)
+	// no heartbeat is sent after the exit event
+	close(done)
+	<-stopped
+	exit := sseExit{}
+	if code, convErr := strconv.Atoi(header.Get(ExitCodeHeader)); convErr == nil {
+		exit.ExitCode = &code
+	}
+	if err != nil {
+		servantErr := err.(ServantError)
+		exit.Error = self.exposedError(servantErr.HttpCode, self.redact(servantErr.Message))
+	}
+	data, _ := json.Marshal(exit)
+	out.send([]byte("event: exit\ndata: " + string(data) + "\n\n"))
+	if err != nil {
+		self.BadEnd("%s", self.redact(err.(ServantError).Message))
+		return
+	}
+	self.GoodEnd("execution done")
+}
@@ -0,0 +1,45 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"servant/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServeEventStream(t *testing.T) {
+	serve := func(cmdConf *conf.Command, uri string, heartbeat time.Duration) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", uri, nil)
+		req.Header.Set("Accept", "text/event-stream")
+		resp := httptest.NewRecorder()
+		s := CommandServer{ Session: &Session{ config: &conf.Config{ Server: conf.Server{ VerboseErrors: true } }, req: req, resp: resp } }
+		if heartbeat > 0 {
+			s.serveEventStream(cmdConf, heartbeat)
+		} else {
+			s.serveCommand(cmdConf)
+		}
+		return resp
+	}
+	resp := serve(&conf.Command{ Lang: "bash", Code: "echo a; sleep 0.35; printf 'b\\nc\\n'; exit 2" }, "/commands/a/b", 100 * time.Millisecond)
+	body := resp.Body.String()
+	if resp.Code != http.StatusOK || resp.Header().Get("Content-Type") != "text/event-stream" {
+		t.Errorf("event stream should be served: %d %v", resp.Code, resp.Header())
+	}
+	if !strings.Contains(body, "data: a\n\n") || !strings.Contains(body, "data: b\ndata: c\n\n") {
+		t.Errorf("output should be data events: %q", body)
+	}
+	if strings.Count(body, ":\n\n") < 3 {
+		t.Errorf("heartbeats should be sent while the command is silent: %q", body)
+	}
+	if !strings.HasSuffix(body, "event: exit\ndata: {\"exit_code\":2,\"error\":\"execution error: exit status 2\"}\n\n") {
+		t.Errorf("exit event should end the stream: %q", body)
+	}
+
+	// served as events by the Accept header
+	resp = serve(&conf.Command{ Lang: "exec", Code: "echo ${a}" }, "/commands/a/b", 0)
+	if body = resp.Body.String(); !strings.HasSuffix(body, "event: exit\ndata: {\"error\":\"some params missing\"}\n\n") {
+		t.Errorf("failure to start should be in the exit event: %q", body)
+	}
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"servant/conf"
+	"sync/atomic"
+	"time"
+)
+
+const StatusPath = "/status"
+
+// statusReport is the introspection of the running server, cheap to build from in-memory state
+type statusReport struct {
+	Version        string                  `json:"version"`
+	Uptime         float64                 `json:"uptime"`
+	Started        time.Time               `json:"started"`
+	ConfigPaths    []string                `json:"config_paths"`
+	ConfigLoaded   time.Time               `json:"config_loaded"`
+	Maintenance    bool                    `json:"maintenance"`
+	ActiveSessions int64                   `json:"active_sessions"`
+	Connections    int64                   `json:"connections"`
+	MaxConnections int                     `json:"max_connections,omitempty"`
+	Resources      map[string]int          `json:"resources"`
+	Daemons        map[string]DaemonStatus `json:"daemons"`
+	Timers         map[string]TimerStatus  `json:"timers"`
+	Databases      map[string]dbPoolStatus `json:"databases"`
+}
+
+// dbPoolStatus is a subset of sql.DBStats of an opened database
+type dbPoolStatus struct {
+	MaxOpen      int     `json:"max_open"`
+	Open         int     `json:"open"`
+	InUse        int     `json:"in_use"`
+	Idle         int     `json:"idle"`
+	WaitCount    int64   `json:"wait_count"`
+	WaitDuration float64 `json:"wait_duration"`
+	Reachable    bool    `json:"reachable"` // by the last ping
+}
+
+// serveStatus serves the status of the server in json, authenticated like resources
+func (self *Session) serveStatus() {
+	if !self.authenticate() {
+		return
+	}
+	if self.req.Method != "GET" && self.req.Method != "HEAD" {
+		self.ErrorEnd(http.StatusMethodNotAllowed, "not supported method %s", self.req.Method)
+		return
+	}
+	buf, err := json.MarshalIndent(self.server.statusReport(), "", "  ")
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "encode status failed: %s", err)
+		return
+	}
+	self.resp.Header().Set("Content-Type", "application/json")
+	if self.req.Method == "GET" {
+		self.resp.Write(append(buf, '\n'))
+	}
+	self.GoodEnd("status served")
+}
+
+func (self *Server) statusReport() *statusReport {
+	self.configLock.RLock()
+	config, loadedAt := self.config, self.loadedAt
+	self.configLock.RUnlock()
+	ret := &statusReport{
+		Version:        conf.Version,
+		Uptime:         time.Since(self.startedAt).Seconds(),
+		Started:        self.startedAt,
+		ConfigPaths:    config.Paths,
+		ConfigLoaded:   loadedAt,
+		Maintenance:    self.inMaintenance(),
+		ActiveSessions: atomic.LoadInt64(&activeSessions.value),
+		Connections:    atomic.LoadInt64(&activeConns.value),
+		MaxConnections: config.Server.MaxConns,
+		Resources:      configResourceCounts(config),
+		Daemons:        make(map[string]DaemonStatus),
+		Timers:         make(map[string]TimerStatus),
+		Databases:      self.databaseStatuses(),
+	}
+	// only tasks of the current config are reported, statuses of removed ones are kept where they stopped
+	daemonStatuses := DaemonStatuses()
+	for name := range config.Daemons {
+		ret.Daemons[name] = daemonStatuses[name]
+	}
+	timerStatuses := TimerStatuses()
+	for name := range config.Timers {
+		ret.Timers[name] = timerStatuses[name]
+	}
+	return ret
+}
+
+// configResourceCounts returns the number of items by resource type
+func configResourceCounts(config *conf.Config) map[string]int {
+	ret := map[string]int{
+		"commands":  0,
+		"files":     0,
+		"databases": 0,
+		"vars":      0,
+		"users":     len(config.Users),
+		"timers":    len(config.Timers),
+		"daemons":   len(config.Daemons),
+	}
+	for _, commands := range config.Commands {
+		ret["commands"] += len(commands.Commands)
+	}
+	for _, files := range config.Files {
+		ret["files"] += len(files.Dirs)
+	}
+	for _, database := range config.Databases {
+		ret["databases"] += len(database.Queries)
+	}
+	for _, vars := range config.Vars {
+		ret["vars"] += len(vars.Vars)
+	}
+	return ret
+}
+
+// databaseStatuses returns pool stats of databases opened so far
+func (self *Server) databaseStatuses() map[string]dbPoolStatus {
+	pools := make(map[string]*dbPool)
+	unreachable := make(map[string]bool)
+	self.databasesLock.Lock()
+	for name, pool := range self.databases {
+		pools[name] = pool
+		unreachable[name] = self.unreachableDbs[name]
+	}
+	self.databasesLock.Unlock()
+	ret := make(map[string]dbPoolStatus, len(pools))
+	for name, pool := range pools {
+		stats := pool.db.Stats()
+		ret[name] = dbPoolStatus{
+			MaxOpen:      stats.MaxOpenConnections,
+			Open:         stats.OpenConnections,
+			InUse:        stats.InUse,
+			Idle:         stats.Idle,
+			WaitCount:    stats.WaitCount,
+			WaitDuration: stats.WaitDuration.Seconds(),
+			Reachable:    !unreachable[name],
+		}
+	}
+	return ret
+}
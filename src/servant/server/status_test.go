@@ -0,0 +1,50 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"servant/conf"
+)
+
+func TestServeStatus(t *testing.T) {
+	s := NewServer(&conf.Config{
+		Auth: conf.Auth{ Enabled: true },
+		Paths: []string{"/etc/servant/servant.xml"},
+		Commands: map[string]*conf.Commands{
+			"c": &conf.Commands{ Commands: map[string]*conf.Command{ "a": &conf.Command{}, "b": &conf.Command{} } },
+		},
+		Daemons: map[string]*conf.Daemon{ "status_d": &conf.Daemon{} },
+		Timers: map[string]*conf.Timer{ "status_t": &conf.Timer{} },
+	})
+	resp := httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", StatusPath, nil))
+	if resp.Code != http.StatusUnauthorized {
+		t.Errorf("status should need auth: %d", resp.Code)
+	}
+
+	s.config.Auth.Enabled = false
+	updateDaemonStatus("status_d", func(status *DaemonStatus) { status.Restarts, status.LastExitCode = 2, 1 })
+	resp = httptest.NewRecorder()
+	s.ServeHTTP(resp, httptest.NewRequest("GET", StatusPath, nil))
+	var report statusReport
+	if err := json.Unmarshal(resp.Body.Bytes(), &report); err != nil || resp.Code != http.StatusOK {
+		t.Fatalf("status should be json: %d %s", resp.Code, err)
+	}
+	if len(report.ConfigPaths) != 1 || report.ConfigLoaded.IsZero() || report.Uptime <= 0 {
+		t.Errorf("config and uptime should be reported: %+v", report)
+	}
+	if report.Resources["commands"] != 2 || report.Resources["daemons"] != 1 {
+		t.Errorf("resources should be counted: %v", report.Resources)
+	}
+	if d, ok := report.Daemons["status_d"]; !ok || d.Restarts != 2 || d.LastExitCode != 1 {
+		t.Errorf("daemon status should be reported: %v", report.Daemons)
+	}
+	if _, ok := report.Timers["status_t"]; !ok {
+		t.Errorf("timers should be reported: %v", report.Timers)
+	}
+	if report.ActiveSessions != 1 {
+		t.Errorf("the status session itself should be active: %d", report.ActiveSessions)
+	}
+}
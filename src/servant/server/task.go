@@ -4,16 +4,25 @@ import (
 	"time"
 	"os/exec"
 	"sync"
+	"sync/atomic"
 	"syscall"
 	"os/signal"
 	"os"
+	"context"
+	"math"
+	"math/rand"
+	"hash/fnv"
+	"net/http"
+	"fmt"
 )
 
 
 var taskProcesses = make(map[int] *exec.Cmd)
 var taskProcessesLock sync.Mutex
 var _isExiting bool = false
-var sigHandlerOnce sync.Once
+var cleanupHandlerOnce sync.Once
+// serverHandlesSignals is set by RunWithSignals, which cleans up processes itself after shutting down
+var serverHandlesSignals int32
 
 func registerProcess(cmd *exec.Cmd) {
 	taskProcessesLock.Lock()
@@ -34,11 +43,45 @@ func isExiting() bool {
 	return ret
 }
 
-func RunTimer(name string, timerConf *conf.Timer) {
-	if timerConf.Tick <= 0 {
-		logger.Printf("WARN (_) [timer] %s tick not set", name)
-		return
+// timerLocation returns the timezone of the timer, local by default
+func timerLocation(timerConf *conf.Timer) (*time.Location, error) {
+	if timerConf.Timezone == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(timerConf.Timezone)
+}
+
+// timerSchedule returns the function computing the next fire time after a time, by cron or every tick
+func timerSchedule(timerConf *conf.Timer) (func(time.Time) time.Time, error) {
+	if timerConf.Cron == "" {
+		if timerConf.Tick <= 0 {
+			return nil, fmt.Errorf("tick not set")
+		}
+		return func(t time.Time) time.Time {
+			return t.Add(time.Duration(timerConf.Tick) * timerTickUnit)
+		}, nil
+	}
+	loc, err := timerLocation(timerConf)
+	if err != nil {
+		return nil, err
 	}
+	schedule, err := conf.ParseCron(timerConf.Cron, loc)
+	if err != nil {
+		return nil, err
+	}
+	return schedule.Next, nil
+}
+
+// unit of timer ticks and jitter, shorter in tests
+var timerTickUnit = time.Second
+
+// max runs waiting by the queue overlap policy
+const timerQueueSize = 16
+
+// RunTimer triggers the timer command on schedule until ctx is done.
+// The overlap policy decides what to do if the previous run is not finished.
+// A timer with at runs once at the time instead.
+func RunTimer(ctx context.Context, name string, timerConf *conf.Timer) {
 	cmdConf := conf.Command {
 		Lang: timerConf.Lang,
 		Code: timerConf.Code,
@@ -46,73 +89,221 @@ func RunTimer(name string, timerConf *conf.Timer) {
 		Background: true,
 		Timeout: timerConf.Deadline,
 	}
-	ticker := time.NewTicker(time.Duration(timerConf.Tick) * time.Second)
+	if timerConf.At != "" {
+		runTimerOnce(ctx, name, timerConf, &cmdConf)
+		return
+	}
+	next, err := timerSchedule(timerConf)
+	if err != nil {
+		logger.Printf("WARN (_) [timer] %s schedule invalid: %s", name, err)
+		return
+	}
 	logger.Printf("INFO (_) [timer] starting timer %s", name)
-	for range(ticker.C) {
-		if isExiting() {
-			break
+	// wait for running commands after they are killed by stop
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	ctx, stop := context.WithCancel(ctx)
+	defer stop()
+	run := func() {
+		updateTimerStatus(name, func(status *TimerStatus) { status.LastRun = time.Now() })
+		if !runTimerCommand(ctx, name, &cmdConf) {
+			stop()
 		}
-		cmd, out, err := cmdFromConf(&cmdConf, requestParams(nil), nil)
-		if err != nil {
-			logger.Printf("WARN (_) [timer] create %s command failed: %s", name, err.Error())
-			break
+	}
+	// the worker runs commands one by one. by skip, a run is accepted only if the worker is idle
+	runs := make(chan struct{})
+	if timerConf.Overlap == "queue" {
+		runs = make(chan struct{}, timerQueueSize)
+	}
+	if timerConf.Overlap != "allow" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-runs:
+					run()
+				}
+			}
+		}()
+	}
+	// seeded per timer and host, so timers of many hosts fire at different offsets
+	rng := rand.New(rand.NewSource(time.Now().UnixNano() ^ int64(os.Getpid()) ^ int64(stringHash(name))))
+	jitter := time.Duration(timerConf.Jitter) * timerTickUnit
+	last := time.Now()
+	for {
+		fireAt := next(last)
+		// ticks missed while the command running are dropped
+		if now := time.Now(); fireAt.Before(now) {
+			fireAt = next(now)
 		}
-		if out != nil {
-			out.Close()
+		if fireAt.IsZero() {
+			logger.Printf("WARN (_) [timer] %s never fires again", name)
+			updateTimerStatus(name, func(status *TimerStatus) { status.NextRun = time.Time{} })
+			return
 		}
-		logger.Printf("INFO (_) [timer] command: %v", cmd.Args)
-		err = cmd.Start()
-		if err != nil {
-			logger.Printf("WARN (_) [timer] start %s command failed: %s", name, err.Error())
-			break
+		delay := time.Until(fireAt) + timerJitter(rng, jitter, next(fireAt).Sub(fireAt))
+		updateTimerStatus(name, func(status *TimerStatus) { status.NextRun = time.Now().Add(delay) })
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			logger.Printf("INFO (_) [timer] timer %s stopped", name)
+			return
+		case <-timer.C:
+		}
+		last = fireAt
+		if isExiting() {
+			return
+		}
+		if timerConf.Overlap == "allow" {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				run()
+			}()
+			continue
 		}
-		//registerProcess(cmd)
-		ch := make(chan error, 1)
-		go func() {
-			err = cmd.Wait()
-			ch <- err
-		}()
-		timeout := time.Duration(cmdConf.Timeout)
 		select {
-		case err = <-ch:
-			if err != nil {
-				logger.Printf("WARN (_) [timer] %s command execution failed: %s", name, err.Error())
-			}
-		case <-time.After(timeout * time.Second):
-			cmd.Process.Kill()
-			logger.Printf("WARN (_) [timer] %s command execution timeout: %d", name, timeout)
+		case runs <- struct{}{}:
+		default:
+			logger.Printf("WARN (_) [timer] %s previous run not finished, skipped", name)
 		}
-		//unregisterProcess(cmd)
 	}
-	ticker = nil
 }
 
-func RunDaemon(name string, daemonConf *conf.Daemon) {
+// runTimerOnce runs the command of a one-shot timer at its time, or at once if the time passed and the
+// missed policy is run, then the timer stops
+func runTimerOnce(ctx context.Context, name string, timerConf *conf.Timer, cmdConf *conf.Command) {
+	loc, err := timerLocation(timerConf)
+	var at time.Time
+	if err == nil {
+		at, err = conf.ParseAt(timerConf.At, loc)
+	}
+	if err != nil {
+		logger.Printf("WARN (_) [timer] %s schedule invalid: %s", name, err)
+		return
+	}
+	delay := time.Until(at)
+	if delay < 0 {
+		if timerConf.Missed != "run" {
+			logger.Printf("WARN (_) [timer] %s missed its time %s, skipped", name, at.Format(time.RFC3339))
+			return
+		}
+		logger.Printf("WARN (_) [timer] %s missed its time %s, running now", name, at.Format(time.RFC3339))
+		delay = 0
+	}
+	logger.Printf("INFO (_) [timer] starting timer %s, fires once at %s", name, at.Format(time.RFC3339))
+	updateTimerStatus(name, func(status *TimerStatus) { status.NextRun = time.Now().Add(delay) })
+	timer := time.NewTimer(delay)
+	select {
+	case <-ctx.Done():
+		timer.Stop()
+		logger.Printf("INFO (_) [timer] timer %s stopped", name)
+		return
+	case <-timer.C:
+	}
+	if isExiting() {
+		return
+	}
+	updateTimerStatus(name, func(status *TimerStatus) { status.LastRun, status.NextRun = time.Now(), time.Time{} })
+	runTimerCommand(ctx, name, cmdConf)
+	logger.Printf("INFO (_) [timer] timer %s done, it runs once", name)
+}
+
+// timerJitter returns a random delay in [0, jitter), and less than the interval to the next fire, so runs keep in order
+func timerJitter(rng *rand.Rand, jitter, interval time.Duration) time.Duration {
+	if interval < jitter {
+		jitter = interval
+	}
+	if jitter <= 0 {
+		return 0
+	}
+	return time.Duration(rng.Int63n(int64(jitter)))
+}
+
+func stringHash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	return h.Sum32()
+}
+
+// runTimerCommand runs the command once, returns false if the timer should stop
+func runTimerCommand(ctx context.Context, name string, cmdConf *conf.Command) bool {
+	// the running command is killed if ctx is done or the deadline passed
+	if cmdConf.Timeout > 0 && cmdConf.Timeout != math.MaxUint32 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(cmdConf.Timeout) * time.Second)
+		defer cancel()
+	}
+	cmd, err := cmdFromConf(ctx, cmdConf, requestParams(nil, ""), nil, nil)
+	if err != nil {
+		logger.Printf("WARN (_) [timer] create %s command failed: %s", name, err.Error())
+		return false
+	}
+	// the command runs in its own session, terminate the whole session so its children are stopped too
+	waited := killGroupOnCancel(cmd, cmdKillGrace)
+	logger.Printf("INFO (_) [timer] command: %v", cmd.Args)
+	err = startCmd(cmd, cmdConf.Umask)
+	if err != nil {
+		logger.Printf("WARN (_) [timer] start %s command failed: %s", name, err.Error())
+		return false
+	}
+	err = cmd.Wait()
+	waited()
+	if ctx.Err() == context.DeadlineExceeded {
+		logger.Printf("WARN (_) [timer] %s command execution timeout: %d", name, cmdConf.Timeout)
+	} else if err != nil {
+		logger.Printf("WARN (_) [timer] %s command execution failed: %s", name, err.Error())
+	}
+	return true
+}
+
+// backoff of daemon restarts, doubles each restart up to the max
+var daemonBackoffBase = time.Second
+var daemonBackoffMax = time.Minute
+
+// daemonBackoff returns the delay before the nth restart, with jitter of half of it
+func daemonBackoff(n int) time.Duration {
+	d := daemonBackoffMax
+	if n < 30 && daemonBackoffBase << uint(n) < daemonBackoffMax {
+		d = daemonBackoffBase << uint(n)
+	}
+	return d / 2 + time.Duration(rand.Int63n(int64(d / 2) + 1))
+}
+
+// RunDaemon runs the daemon command and restarts it per the restart policy, until ctx is done.
+// Retries limits restarts in a row, which are reset if the daemon lives long enough, negative means unlimited.
+func RunDaemon(ctx context.Context, name string, daemonConf *conf.Daemon) {
 	cmdConf := conf.Command {
 		Lang: daemonConf.Lang,
 		Code: daemonConf.Code,
 		User: daemonConf.User,
 		Background: true,
 	}
-	if daemonConf.Retries < 0 {
-		daemonConf.Retries = 0
-	}
 	logger.Printf("INFO (_) [daemon] starting daemon %s", name)
 	cleanupOnExit()
-	for i := 0; i < daemonConf.Retries + 1; i++ {
+	restarts := 0
+	for {
 		if isExiting() {
 			return
 		}
-		cmd, out, err := cmdFromConf(&cmdConf, requestParams(nil), nil)
-		if out != nil {
-			out.Close()
+		if ctx.Err() != nil {
+			logger.Printf("INFO (_) [daemon] %s stopped", name)
+			return
 		}
+		cmd, err := cmdFromConf(ctx, &cmdConf, requestParams(nil, ""), nil, nil)
 		if err != nil {
 			logger.Printf("WARN (_) [daemon] create %s command failed: %s", name, err.Error())
 			return
 		}
+		// the daemon runs in its own session, terminate the whole session when stopped,
+		// and kill it if still alive after the stop timeout
+		waited := killGroupOnCancel(cmd, time.Duration(daemonConf.StopTimeout) * time.Second)
 		logger.Printf("INFO (_) [daemon] command: %v", cmd.Args)
-		err = cmd.Start()
+		err = startCmd(cmd, cmdConf.Umask)
 		if err != nil {
 			logger.Printf("WARN (_) [daemon] start %s failed: %s", name, err.Error())
 			return
@@ -120,26 +311,198 @@ func RunDaemon(name string, daemonConf *conf.Daemon) {
 		logger.Printf("INFO (_) [daemon] %s started. pid: %d", name, cmd.Process.Pid)
 		t0 := time.Now()
 		registerProcess(cmd)
+		updateDaemonStatus(name, func(status *DaemonStatus) { status.Running = true })
+		probeCtx, stopProbe := context.WithCancel(ctx)
+		if daemonConf.Health != nil {
+			go probeDaemon(probeCtx, name, daemonConf, cmd.Process.Pid)
+		}
 		err = cmd.Wait()
+		waited()
+		stopProbe()
 		unregisterProcess(cmd)
+		exitCode := cmd.ProcessState.ExitCode()
+		updateDaemonStatus(name, func(status *DaemonStatus) {
+			status.Running, status.LastExit, status.LastExitCode = false, time.Now(), exitCode
+		})
+		uptime := time.Since(t0)
+		if ctx.Err() != nil || isExiting() {
+			logger.Printf("INFO (_) [daemon] %s stopped", name)
+			return
+		}
+		if daemonConf.Restart == "never" || (err == nil && daemonConf.Restart != "always") {
+			logger.Printf("WARN (_) [daemon] %s exited with code %d after %s", name, exitCode, uptime)
+			return
+		}
+		if uptime >= time.Duration(daemonConf.Live) * time.Second {
+			restarts = 0
+		}
+		if daemonConf.Retries >= 0 && restarts >= daemonConf.Retries {
+			logger.Printf("WARN (_) [daemon] %s exited with code %d after %s, give up after %d retries", name, exitCode, uptime, restarts)
+			return
+		}
+		delay := daemonBackoff(restarts)
+		restarts++
+		daemonRestarts.inc(name)
+		updateDaemonStatus(name, func(status *DaemonStatus) { status.Restarts++ })
+		logger.Printf("WARN (_) [daemon] %s exited with code %d after %s, restarting in %s (%d)", name, exitCode, uptime, delay, restarts)
+		select {
+		case <-ctx.Done():
+			logger.Printf("INFO (_) [daemon] %s stopped", name)
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// DaemonStatus is whether the daemon process is running and the last health check result
+type DaemonStatus struct {
+	Running   bool      `json:"running"`
+	Healthy   bool      `json:"healthy"`
+	Failures  int       `json:"failures"`
+	LastCheck time.Time `json:"last_check"`
+	Restarts  int       `json:"restarts"`
+	LastExit  time.Time `json:"last_exit"`
+	LastExitCode int    `json:"last_exit_code"`
+}
+
+var daemonStatuses = make(map[string]DaemonStatus)
+var daemonStatusesLock sync.Mutex
+
+// DaemonStatuses returns status of daemons started, health fields are set only for daemons with health checks
+func DaemonStatuses() map[string]DaemonStatus {
+	daemonStatusesLock.Lock()
+	defer daemonStatusesLock.Unlock()
+	ret := make(map[string]DaemonStatus, len(daemonStatuses))
+	for name, status := range daemonStatuses {
+		ret[name] = status
+	}
+	return ret
+}
+
+func updateDaemonStatus(name string, update func(status *DaemonStatus)) {
+	daemonStatusesLock.Lock()
+	defer daemonStatusesLock.Unlock()
+	status := daemonStatuses[name]
+	update(&status)
+	daemonStatuses[name] = status
+}
+
+// TimerStatus is when the timer ran last and will run next
+type TimerStatus struct {
+	LastRun time.Time `json:"last_run"`
+	NextRun time.Time `json:"next_run"`
+}
+
+var timerStatuses = make(map[string]TimerStatus)
+var timerStatusesLock sync.Mutex
+
+// TimerStatuses returns status of timers started
+func TimerStatuses() map[string]TimerStatus {
+	timerStatusesLock.Lock()
+	defer timerStatusesLock.Unlock()
+	ret := make(map[string]TimerStatus, len(timerStatuses))
+	for name, status := range timerStatuses {
+		ret[name] = status
+	}
+	return ret
+}
+
+func updateTimerStatus(name string, update func(status *TimerStatus)) {
+	timerStatusesLock.Lock()
+	defer timerStatusesLock.Unlock()
+	status := timerStatuses[name]
+	update(&status)
+	timerStatuses[name] = status
+}
+
+// probeDaemon checks health of the daemon every interval until ctx is done,
+// and kills the daemon's session after threshold failures in a row, so it is restarted per the restart policy
+func probeDaemon(ctx context.Context, name string, daemonConf *conf.Daemon, pid int) {
+	health := daemonConf.Health
+	ticker := time.NewTicker(time.Duration(health.Interval) * time.Second)
+	defer ticker.Stop()
+	failures := 0
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		probeCtx, cancel := context.WithTimeout(ctx, time.Duration(health.Timeout) * time.Second)
+		err := probeHealth(probeCtx, daemonConf)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
 		if err == nil {
-			logger.Printf("WARN (_) [daemon] %s normal exit", name)
+			failures = 0
+		} else {
+			failures++
+			logger.Printf("WARN (_) [daemon] %s health check failed (%d/%d): %s", name, failures, health.Threshold, err)
+		}
+		updateDaemonStatus(name, func(status *DaemonStatus) {
+			status.Healthy, status.Failures, status.LastCheck = err == nil, failures, time.Now()
+		})
+		if failures >= health.Threshold {
+			logger.Printf("WARN (_) [daemon] %s unhealthy, killing process %d", name, pid)
+			syscall.Kill(-pid, syscall.SIGKILL)
 			return
 		}
-		t1 := time.Now()
-		if t1.Sub(t0) >= time.Duration(daemonConf.Live) * time.Second {
-			i = 0
+	}
+}
+
+// probeHealth gets the url expecting a 2xx or 3xx status, or runs the code expecting exit code 0
+func probeHealth(ctx context.Context, daemonConf *conf.Daemon) error {
+	health := daemonConf.Health
+	if health.Url != "" {
+		req, err := http.NewRequestWithContext(ctx, "GET", health.Url, nil)
+		if err != nil {
+			return err
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 400 {
+			return fmt.Errorf("status %d", resp.StatusCode)
 		}
+		return nil
+	}
+	cmdConf := conf.Command {
+		Lang: daemonConf.Lang,
+		Code: health.Code,
+		User: daemonConf.User,
+		Background: true,
+	}
+	cmd, err := cmdFromConf(ctx, &cmdConf, requestParams(nil, ""), nil, nil)
+	if err != nil {
+		return err
+	}
+	// a hung probe is stopped with its children like the daemon
+	waited := killGroupOnCancel(cmd, time.Duration(daemonConf.StopTimeout) * time.Second)
+	if err = startCmd(cmd, cmdConf.Umask); err != nil {
+		return err
 	}
-	logger.Printf("WARN (_) [daemon] %s give up after %d retries", name, daemonConf.Retries)
+	defer waited()
+	return cmd.Wait()
 }
 
+// cleanupOnExit terminates task processes and exits on SIGTERM or SIGINT, unless the server handles them
+// by RunWithSignals, which may be called after tasks are started
 func cleanupOnExit() {
-	sigHandlerOnce.Do(func(){
+	if atomic.LoadInt32(&serverHandlesSignals) == 1 {
+		return
+	}
+	cleanupHandlerOnce.Do(func(){
 		sigChan := make(chan os.Signal, 1)
 		signal.Notify(sigChan, syscall.SIGTERM, syscall.SIGINT)
 		go func() {
 			sig := <- sigChan
+			if atomic.LoadInt32(&serverHandlesSignals) == 1 {
+				signal.Stop(sigChan)
+				return
+			}
 			logger.Printf("INFO (_) [daemon] got signal %s", sig.String())
 			cleanupProcesses()
 			logger.Println("INFO (_) [daemon] cleaning up done")
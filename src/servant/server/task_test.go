@@ -0,0 +1,200 @@
+package server
+
+import (
+	"testing"
+	"servant/conf"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+	"net/http"
+	"net/http/httptest"
+	"math/rand"
+)
+
+func TestDaemonBackoff(t *testing.T) {
+	for n, expected := range map[int]time.Duration{ 0: daemonBackoffBase, 3: daemonBackoffBase * 8, 100: daemonBackoffMax } {
+		d := daemonBackoff(n)
+		if d < expected / 2 || d > expected {
+			t.Errorf("backoff %d should be in [%s, %s]: %s", n, expected / 2, expected, d)
+		}
+	}
+}
+
+func TestRunDaemonRestart(t *testing.T) {
+	daemonBackoffBase, daemonBackoffMax = time.Millisecond, 10 * time.Millisecond
+	defer func() {
+		daemonBackoffBase, daemonBackoffMax = time.Second, time.Minute
+	}()
+	dir := t.TempDir()
+	runs := func(restart string, code string, retries int) int {
+		out := filepath.Join(dir, restart + code)
+		RunDaemon(context.Background(), "d", &conf.Daemon{
+			Lang: "bash",
+			Code: "echo >> " + out + "; exit " + code,
+			Retries: retries,
+			Live: 3600,
+			Restart: restart,
+		})
+		data, _ := os.ReadFile(out)
+		return strings.Count(string(data), "\n")
+	}
+	if n := runs("on-failure", "1", 2); n != 3 {
+		t.Errorf("on-failure should restart on failure until retries: %d", n)
+	}
+	if n := runs("on-failure", "0", 2); n != 1 {
+		t.Errorf("on-failure should not restart on clean exit: %d", n)
+	}
+	if n := runs("always", "0", 1); n != 2 {
+		t.Errorf("always should restart on clean exit: %d", n)
+	}
+	if n := runs("never", "1", 2); n != 1 {
+		t.Errorf("never should not restart: %d", n)
+	}
+}
+
+func TestRunDaemonHealth(t *testing.T) {
+	start := time.Now()
+	RunDaemon(context.Background(), "unhealthy", &conf.Daemon{
+		Lang: "bash",
+		Code: "sleep 30",
+		Live: 3600,
+		Restart: "on-failure",
+		Health: &conf.Health{ Code: "false", Interval: 1, Threshold: 1, Timeout: 1 },
+	})
+	if time.Since(start) > 10 * time.Second {
+		t.Errorf("unhealthy daemon should be killed")
+	}
+	if status := DaemonStatuses()["unhealthy"]; status.Healthy || status.Failures != 1 {
+		t.Errorf("status should be unhealthy: %v", status)
+	}
+
+	probed := make(chan bool, 10)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probed <- true
+	}))
+	defer ts.Close()
+	RunDaemon(context.Background(), "healthy", &conf.Daemon{
+		Lang: "bash",
+		Code: "sleep 1.5",
+		Live: 3600,
+		Restart: "on-failure",
+		Health: &conf.Health{ Url: ts.URL, Interval: 1, Threshold: 1, Timeout: 1 },
+	})
+	if status := DaemonStatuses()["healthy"]; !status.Healthy || len(probed) != 1 {
+		t.Errorf("status should be healthy: %v", status)
+	}
+}
+
+func TestTimerSchedule(t *testing.T) {
+	now := time.Date(2024, 3, 1, 10, 7, 30, 0, time.UTC)
+	next, err := timerSchedule(&conf.Timer{ Tick: 60 })
+	if err != nil || !next(now).Equal(now.Add(time.Minute)) {
+		t.Errorf("tick schedule wrong: %v", err)
+	}
+	next, err = timerSchedule(&conf.Timer{ Cron: "*/15 * * * *", Timezone: "UTC" })
+	if err != nil || !next(now).Equal(time.Date(2024, 3, 1, 10, 15, 0, 0, time.UTC)) {
+		t.Errorf("cron schedule wrong: %v", err)
+	}
+	if _, err = timerSchedule(&conf.Timer{ Cron: "* * *" }); err == nil {
+		t.Errorf("bad cron should fail")
+	}
+	if _, err = timerSchedule(&conf.Timer{}); err == nil {
+		t.Errorf("no tick should fail")
+	}
+}
+
+func TestRunTimerOverlap(t *testing.T) {
+	timerTickUnit = 200 * time.Millisecond
+	defer func() {
+		timerTickUnit = time.Second
+	}()
+	dir := t.TempDir()
+	runs := func(overlap string) (starts, overlaps int) {
+		out := filepath.Join(dir, overlap)
+		lock := filepath.Join(dir, overlap + ".lock")
+		ctx, cancel := context.WithTimeout(context.Background(), 1300 * time.Millisecond)
+		defer cancel()
+		RunTimer(ctx, "t", &conf.Timer{
+			Lang: "bash",
+			Code: "echo start >> " + out + "; mkdir " + lock + " || echo overlap >> " + out + "; sleep 0.21; rmdir " + lock,
+			Tick: 1,
+			Deadline: 10,
+			Overlap: overlap,
+		})
+		data, _ := os.ReadFile(out)
+		return strings.Count(string(data), "start"), strings.Count(string(data), "overlap")
+	}
+	skipStarts, skipOverlaps := runs("skip")
+	queueStarts, queueOverlaps := runs("queue")
+	_, allowOverlaps := runs("allow")
+	if skipOverlaps != 0 || queueOverlaps != 0 || allowOverlaps == 0 {
+		t.Errorf("overlaps wrong: skip %d, queue %d, allow %d", skipOverlaps, queueOverlaps, allowOverlaps)
+	}
+	// skip runs every other tick, queue runs back to back
+	if skipStarts < 2 || skipStarts > 4 || queueStarts < 5 {
+		t.Errorf("runs wrong: skip %d, queue %d", skipStarts, queueStarts)
+	}
+}
+
+func TestRunTimerOnce(t *testing.T) {
+	dir := t.TempDir()
+	run := func(name string, at time.Time, missed string) int {
+		out := filepath.Join(dir, name)
+		start := time.Now()
+		RunTimer(context.Background(), name, &conf.Timer{
+			Lang: "bash",
+			Code: "echo run >> " + out,
+			Deadline: 10,
+			At: at.Format(time.RFC3339Nano),
+			Missed: missed,
+		})
+		if time.Since(start) > 2 * time.Second {
+			t.Errorf("timer %s should return after it runs once", name)
+		}
+		data, _ := os.ReadFile(out)
+		return strings.Count(string(data), "run")
+	}
+	at := time.Now().Add(300 * time.Millisecond)
+	if n := run("future", at, "skip"); n != 1 || time.Now().Before(at) {
+		t.Errorf("timer should run once at the time: %d", n)
+	}
+	if status := TimerStatuses()["future"]; status.LastRun.Before(at) || !status.NextRun.IsZero() {
+		t.Errorf("status of a timer done wrong: %v", status)
+	}
+	if n := run("skipped", time.Now().Add(-time.Hour), "skip"); n != 0 {
+		t.Errorf("missed timer should be skipped: %d", n)
+	}
+	if n := run("late", time.Now().Add(-time.Hour), "run"); n != 1 {
+		t.Errorf("missed timer should run at once: %d", n)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100 * time.Millisecond)
+	defer cancel()
+	RunTimer(ctx, "stopped", &conf.Timer{ Lang: "bash", Code: "echo run >> " + filepath.Join(dir, "stopped"), At: time.Now().Add(time.Hour).Format(time.RFC3339) })
+	if _, err := os.Stat(filepath.Join(dir, "stopped")); !os.IsNotExist(err) {
+		t.Errorf("timer stopped before its time should not run")
+	}
+}
+
+func TestTimerJitter(t *testing.T) {
+	rng := rand.New(rand.NewSource(1))
+	if timerJitter(rng, 0, time.Minute) != 0 {
+		t.Errorf("no jitter should be 0")
+	}
+	seen := make(map[time.Duration]bool)
+	for i := 0; i < 100; i++ {
+		d := timerJitter(rng, 10 * time.Second, time.Minute)
+		if d < 0 || d >= 10 * time.Second {
+			t.Errorf("jitter out of range: %s", d)
+		}
+		seen[d] = true
+		if d = timerJitter(rng, 10 * time.Second, time.Second); d >= time.Second {
+			t.Errorf("jitter should not pass the next fire: %s", d)
+		}
+	}
+	if len(seen) < 50 {
+		t.Errorf("jitter should be randomized each time")
+	}
+}
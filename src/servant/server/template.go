@@ -0,0 +1,82 @@
+package server
+
+import (
+	"bytes"
+	"net/http"
+	"servant/conf"
+	"strconv"
+	"time"
+)
+
+// responseData is what the response template of a command is applied to
+type responseData struct {
+	Output   string
+	ExitCode int     // -1 if killed
+	Duration float64 // seconds of the execution
+	Params   map[string]string
+}
+
+// serveResponseTemplate executes the command with the output buffered, and responds the output shaped by
+// the template. Failed executions are shaped too, responded with the error status, unless not started at all.
+func (self CommandServer) serveResponseTemplate(cmdConf *conf.Command) {
+	params, perr := self.templateParams(cmdConf)
+	if perr != nil {
+		self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
+		return
+	}
+	var out bytes.Buffer
+	t0 := time.Now()
+	err := self.execCommand(cmdConf, &out)
+	duration := time.Since(t0)
+	header := self.resp.Header()
+	exitCode, convErr := strconv.Atoi(header.Get(ExitCodeHeader))
+	if err != nil && convErr != nil {
+		servantErr := err.(ServantError)
+		self.ErrorEnd(servantErr.HttpCode, "%s", servantErr.Message)
+		return
+	}
+	data := responseData{ Output: out.String(), ExitCode: exitCode, Duration: duration.Seconds(), Params: params }
+	var body bytes.Buffer
+	if terr := cmdConf.Response.Execute(&body, data); terr != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "render response failed: %s", terr)
+		return
+	}
+	if cmdConf.ResponseContentType != "" {
+		header.Set("Content-Type", cmdConf.ResponseContentType)
+	}
+	if err != nil {
+		servantErr := err.(ServantError)
+		self.setError(servantErr.HttpCode, self.redact(servantErr.Message))
+		self.resp.WriteHeader(servantErr.HttpCode)
+		self.resp.Write(body.Bytes())
+		self.BadEnd("%s", servantErr.Message)
+		return
+	}
+	self.resp.Write(body.Bytes())
+	self.GoodEnd("execution done")
+}
+
+// templateParams returns the declared params and the params of the query string and the body
+func (self CommandServer) templateParams(cmdConf *conf.Command) (map[string]string, *ServantError) {
+	params, perr := self.declaredParams(cmdConf.Params)
+	if perr != nil {
+		return nil, perr
+	}
+	names := make([]string, 0, len(cmdConf.Params))
+	for name := range cmdConf.Params {
+		names = append(names, name)
+	}
+	for name := range self.req.URL.Query() {
+		names = append(names, name)
+	}
+	for name := range bodyParams(self.req) {
+		names = append(names, name)
+	}
+	ret := make(map[string]string, len(names))
+	for _, name := range names {
+		if v, ok := params(name); ok && bodyParamNameRe.MatchString(name) {
+			ret[name] = v
+		}
+	}
+	return ret, nil
+}
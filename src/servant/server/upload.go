@@ -0,0 +1,232 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// UploadOffsetHeader is the bytes of a resumable upload received so far
+const UploadOffsetHeader = "X-Servant-Upload-Offset"
+
+// uploadPath returns the partial file of a resumable upload, in the same directory so it is renamed into place
+func uploadPath(filePath string) string {
+	return filepath.Join(filepath.Dir(filePath), "." + filepath.Base(filePath) + ".upload")
+}
+
+// uploadTotalPath returns the file keeping the total size of a resumable upload declared by its first chunk
+func uploadTotalPath(filePath string) string {
+	return uploadPath(filePath) + ".total"
+}
+
+// removeUpload removes the partial file of an upload and its total
+func removeUpload(partial string) error {
+	os.Remove(partial + ".total")
+	return os.Remove(partial)
+}
+
+// uploadTotal returns the total size of an upload, which is the total of the chunk if the upload has none yet
+func uploadTotal(filePath string, total int64) (int64, error) {
+	totalPath := uploadTotalPath(filePath)
+	data, err := os.ReadFile(totalPath)
+	if err != nil && !os.IsNotExist(err) {
+		return 0, err
+	}
+	if kept, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64); err == nil {
+		return kept, nil
+	}
+	// a broken total is replaced rather than failing the upload forever
+	return total, os.WriteFile(totalPath, []byte(strconv.FormatInt(total, 10)), 0600)
+}
+
+// parseContentRange parses a Content-Range header of a chunk, as "bytes <start>-<end>/<total>"
+func parseContentRange(s string) (start, end, total int64, err error) {
+	err = fmt.Errorf("invalid Content-Range %s", s)
+	spec, ok := strings.CutPrefix(s, "bytes ")
+	if !ok {
+		return
+	}
+	rng, size, ok := strings.Cut(spec, "/")
+	if !ok {
+		return
+	}
+	first, last, ok := strings.Cut(rng, "-")
+	if !ok {
+		return
+	}
+	var e1, e2, e3 error
+	start, e1 = strconv.ParseInt(first, 10, 64)
+	end, e2 = strconv.ParseInt(last, 10, 64)
+	total, e3 = strconv.ParseInt(size, 10, 64)
+	if e1 != nil || e2 != nil || e3 != nil || start < 0 || end < start || end >= total {
+		return
+	}
+	return start, end, total, nil
+}
+
+// uploadExpired reports whether a partial upload is untouched longer than the ttl, 0 for never
+func uploadExpired(info os.FileInfo, ttl uint32) bool {
+	return ttl > 0 && time.Since(info.ModTime()) > time.Duration(ttl) * time.Second
+}
+
+// removeExpiredUploads removes partial uploads abandoned in the directory. It runs on uploads to the
+// directory rather than by a timer, as roots may depend on params.
+func (self FileServer) removeExpiredUploads(dir string, ttl uint32) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if !strings.HasPrefix(name, ".") {
+			continue
+		}
+		// totals are not touched by chunks, so they are removed along with their partial files,
+		// or if left without one
+		if partial, ok := strings.CutSuffix(name, ".total"); ok && strings.HasSuffix(partial, ".upload") {
+			if _, err := os.Stat(filepath.Join(dir, partial)); os.IsNotExist(err) {
+				if info, err := entry.Info(); err == nil && uploadExpired(info, ttl) {
+					os.Remove(filepath.Join(dir, name))
+				}
+			}
+			continue
+		}
+		if !strings.HasSuffix(name, ".upload") {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && uploadExpired(info, ttl) {
+			if err = removeUpload(filepath.Join(dir, name)); err == nil {
+				self.info("abandoned upload %s removed", name)
+			}
+		}
+	}
+}
+
+// serveUpload appends a chunk of a resumable upload by PUT with Content-Range. Chunks must be sent in order,
+// a chunk not starting at the offset received is rejected with 409 and the offset, so the client resumes from it.
+// The total size is kept by the first chunk, a chunk of another total is rejected with 409.
+// The partial file is moved into place when the last byte is received.
+func (self FileServer) serveUpload(filePath string) {
+	dirConf := self.findDirConfig()
+	header := self.resp.Header()
+	start, end, total, err := parseContentRange(self.req.Header.Get("Content-Range"))
+	if err != nil {
+		self.ErrorEnd(http.StatusBadRequest, "%s", err)
+		return
+	}
+	if dirConf.MaxSize > 0 && total > dirConf.MaxSize {
+		self.ErrorEnd(http.StatusRequestEntityTooLarge, "file size %d exceeds limit %d", total, dirConf.MaxSize)
+		return
+	}
+	// checksums of the last chunk are of the whole file
+	var sums *checksums
+	if end == total - 1 {
+		var perr *ServantError
+		if sums, perr = requestChecksums(self.req); perr != nil {
+			self.ErrorEnd(perr.HttpCode, "%s", perr.Message)
+			return
+		}
+	}
+	length := end - start + 1
+	if self.req.ContentLength >= 0 && self.req.ContentLength != length {
+		self.ErrorEnd(http.StatusBadRequest, "body of %d bytes does not match Content-Range of %d", self.req.ContentLength, length)
+		return
+	}
+	self.removeExpiredUploads(filepath.Dir(filePath), dirConf.UploadTtl)
+	partial := uploadPath(filePath)
+	file, err := os.OpenFile(partial, os.O_RDWR | os.O_CREATE, 0600)
+	if err != nil {
+		self.openFileError(err, "PUT", partial)
+		return
+	}
+	defer file.Close()
+	// a chunk sent again while the first is still being received must not interleave with it
+	if err = syscall.Flock(int(file.Fd()), syscall.LOCK_EX | syscall.LOCK_NB); err != nil {
+		self.ErrorEnd(http.StatusConflict, "upload of %s in progress", filePath)
+		return
+	}
+	offset, err := file.Seek(0, io.SeekEnd)
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	}
+	header.Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	// the size limit is checked by the total, so it must not change during the upload
+	if kept, err := uploadTotal(filePath, total); err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	} else if kept != total {
+		self.ErrorEnd(http.StatusConflict, "chunk of %d bytes in total, but the upload is of %d", total, kept)
+		return
+	}
+	if start != offset {
+		self.ErrorEnd(http.StatusConflict, "chunk starts at %d, but %d bytes uploaded", start, offset)
+		return
+	}
+	// bytes received before a broken link are kept, so the client resumes after them
+	n, err := io.Copy(file, io.LimitReader(self.req.Body, length))
+	offset += n
+	header.Set(UploadOffsetHeader, strconv.FormatInt(offset, 10))
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	}
+	if n < length {
+		self.ErrorEnd(http.StatusBadRequest, "chunk short of %d bytes", length - n)
+		return
+	}
+	if offset < total {
+		self.resp.WriteHeader(http.StatusAccepted)
+		self.GoodEnd("chunk %d-%d/%d uploaded", start, end, total)
+		return
+	}
+	if sums != nil {
+		if _, err = file.Seek(0, io.SeekStart); err == nil {
+			_, err = io.Copy(sums.tee(io.Discard), file)
+		}
+		if err != nil {
+			self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+			return
+		}
+		if err = sums.verify(); err != nil {
+			// the whole upload is restarted, as the corrupted chunk is unknown
+			removeUpload(partial)
+			self.ErrorEnd(http.StatusUnprocessableEntity, "upload of %s corrupted: %s", filePath, err)
+			return
+		}
+	}
+	if err = file.Sync(); err == nil {
+		err = file.Chmod(0664)
+	}
+	if err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "io error: %s", err)
+		return
+	}
+	status := http.StatusCreated
+	if _, statErr := os.Stat(filePath); statErr == nil {
+		status = http.StatusNoContent
+	}
+	// renamed while locked, so a late chunk opens a new partial file, and a new total
+	os.Remove(uploadTotalPath(filePath))
+	if err = os.Rename(partial, filePath); err != nil {
+		self.ErrorEnd(http.StatusInternalServerError, "move file %s into place failed: %s", filePath, err)
+		return
+	}
+	self.resp.WriteHeader(status)
+	self.GoodEnd("upload of %d bytes done", total)
+}
+
+// uploadOffset returns the bytes received of an upload in progress to the file, false if there is none
+func (self FileServer) uploadOffset(filePath string) (int64, bool) {
+	info, err := os.Stat(uploadPath(filePath))
+	if err != nil || uploadExpired(info, self.findDirConfig().UploadTtl) {
+		return 0, false
+	}
+	return info.Size(), true
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"servant/conf"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseContentRange(t *testing.T) {
+	if start, end, total, err := parseContentRange("bytes 5-9/20"); err != nil || start != 5 || end != 9 || total != 20 {
+		t.Errorf("content range parse wrong: %d %d %d %v", start, end, total, err)
+	}
+	for _, s := range []string{ "", "5-9/20", "bytes 5-9", "bytes 9-5/20", "bytes 5-20/20", "bytes */20", "bytes a-9/20" } {
+		if _, _, _, err := parseContentRange(s); err == nil {
+			t.Errorf("%q should be invalid", s)
+		}
+	}
+}
+
+func TestServeUpload(t *testing.T) {
+	root := t.TempDir()
+	server := NewServer(&conf.Config{
+		Files: map[string]*conf.Files{
+			"g": &conf.Files{ Dirs: map[string]*conf.Dir{
+				"rw": &conf.Dir{ Root: root, Allows: []string{"GET", "PUT"}, Writable: true, MaxSize: 10, UploadTtl: 60 },
+			} },
+		},
+	})
+	put := func(uri, contentRange, body string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("PUT", uri, strings.NewReader(body))
+		req.Header.Set("Content-Range", contentRange)
+		resp := httptest.NewRecorder()
+		server.ServeHTTP(resp, req)
+		return resp
+	}
+	head := func(uri string) *httptest.ResponseRecorder {
+		resp := httptest.NewRecorder()
+		server.ServeHTTP(resp, httptest.NewRequest("HEAD", uri, nil))
+		return resp
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 0-3/8", "0123"); resp.Code != http.StatusAccepted || resp.Header().Get(UploadOffsetHeader) != "4" {
+		t.Errorf("first chunk should be accepted: %d %v", resp.Code, resp.Header())
+	}
+	if _, err := os.Stat(filepath.Join(root, "a.txt")); !os.IsNotExist(err) {
+		t.Errorf("partial upload should not be in place")
+	}
+	if resp := head("/files/g/rw/a.txt"); resp.Code != http.StatusNoContent || resp.Header().Get(UploadOffsetHeader) != "4" {
+		t.Errorf("head should tell the offset: %d %v", resp.Code, resp.Header())
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 2-5/8", "2345"); resp.Code != http.StatusConflict || resp.Header().Get(UploadOffsetHeader) != "4" {
+		t.Errorf("chunk not at the offset should conflict: %d %v", resp.Code, resp.Header())
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 4-7/9", "4567"); resp.Code != http.StatusConflict {
+		t.Errorf("chunk of another total should conflict: %d", resp.Code)
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 4-7/8", "45"); resp.Code != http.StatusBadRequest {
+		t.Errorf("body not matching the range should be rejected: %d", resp.Code)
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 4-7/8", "4567"); resp.Code != http.StatusCreated {
+		t.Errorf("last chunk should create the file: %d %s", resp.Code, resp.Header().Get(ServantErrHeader))
+	}
+	if data, _ := os.ReadFile(filepath.Join(root, "a.txt")); string(data) != "01234567" {
+		t.Errorf("uploaded content wrong: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(root, ".a.txt.upload.total")); !os.IsNotExist(err) {
+		t.Errorf("total should be removed after the upload")
+	}
+	if resp := head("/files/g/rw/a.txt"); resp.Code != http.StatusOK || resp.Header().Get(UploadOffsetHeader) != "" {
+		t.Errorf("head after upload should be of the file: %d %v", resp.Code, resp.Header())
+	}
+	if resp := put("/files/g/rw/a.txt", "bytes 0-10/11", "0123456789a"); resp.Code != http.StatusRequestEntityTooLarge {
+		t.Errorf("upload larger than max size should be 413: %d", resp.Code)
+	}
+
+	abandoned := filepath.Join(root, ".b.txt.upload")
+	os.WriteFile(abandoned, []byte("x"), 0600)
+	os.WriteFile(abandoned + ".total", []byte("2"), 0600)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(abandoned, old, old)
+	if resp := head("/files/g/rw/b.txt"); resp.Header().Get(UploadOffsetHeader) != "" {
+		t.Errorf("expired upload should not be resumed: %v", resp.Header())
+	}
+	if resp := put("/files/g/rw/c.txt", "bytes 0-0/2", "c"); resp.Code != http.StatusAccepted {
+		t.Errorf("chunk should be accepted: %d", resp.Code)
+	}
+	if _, err := os.Stat(abandoned); !os.IsNotExist(err) {
+		t.Errorf("expired upload should be removed")
+	}
+	if _, err := os.Stat(abandoned + ".total"); !os.IsNotExist(err) {
+		t.Errorf("total of expired upload should be removed")
+	}
+}
@@ -1,15 +1,22 @@
 package server
 import (
+	"errors"
 	"strings"
 	"regexp"
 	"os"
 	"sync"
+	"sync/atomic"
 	"servant/conf"
 	"net/http"
 	"io/ioutil"
 )
 
-var globalParams = map[string]string {}
+// globalParams is replaced as a whole on writes under varsLock, so reads on every request take no lock
+var globalParams atomic.Pointer[map[string]string]
+
+func init() {
+	globalParams.Store(&map[string]string{})
+}
 
 type VarServer struct {
 	*Session
@@ -45,8 +52,12 @@ func (self *VarServer) serve() {
 			self.ErrorEnd(http.StatusForbidden, "var %s.%s is readonly", self.group, self.item)
 			return
 		}
-		value, err := ioutil.ReadAll(self.req.Body)
-		if err != nil {
+		value, err := ioutil.ReadAll(http.MaxBytesReader(self.resp, self.req.Body, MaxVarValueSize))
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) {
+			self.ErrorEnd(http.StatusBadRequest, "var value too large")
+			return
+		} else if err != nil {
 			self.ErrorEnd(http.StatusInternalServerError, "read var value failed: %s", err.Error())
 			return
 		}
@@ -72,12 +83,18 @@ func SetArgVars(params []string) {
 }
 
 func setVars(params []string, prefix string) {
+	vars := make(map[string]string)
 	for _, s := range(params) {
 		kv := strings.SplitN(s, "=", 2)
-		if match, _ := regexp.MatchString(`^[a-zA-Z]\w*$`, kv[0]); match {
-			globalParams[prefix + kv[0]] = kv[1]
+		if match, _ := regexp.MatchString(`^[a-zA-Z]\w*$`, kv[0]); match && len(kv) == 2 {
+			vars[prefix + kv[0]] = kv[1]
 		}
 	}
+	updateGlobalParams(func(params map[string]string) {
+		for k, v := range vars {
+			params[k] = v
+		}
+	})
 }
 
 func SetEnvVars() {
@@ -96,16 +113,31 @@ func UserVarExists(group, name string) bool {
 	return GlobalParamExists(k)
 }
 
-func SetGlobalParam(k string, value string) {
+// updateGlobalParams applies the update to a copy of global params, then publishes the copy
+func updateGlobalParams(update func(map[string]string)) {
 	varsLock.Lock()
-	globalParams[k] = value
-	varsLock.Unlock()
+	defer varsLock.Unlock()
+	params := CloneGlobalParams()
+	update(params)
+	globalParams.Store(&params)
+}
+
+// SetGlobalParam sets a global param, it is safe to be called while serving
+func SetGlobalParam(k string, value string) {
+	updateGlobalParams(func(params map[string]string) {
+		params[k] = value
+	})
+}
+
+// DeleteGlobalParam deletes a global param, it is safe to be called while serving
+func DeleteGlobalParam(k string) {
+	updateGlobalParams(func(params map[string]string) {
+		delete(params, k)
+	})
 }
 
 func GlobalParamExists(k string) bool {
-	varsLock.Lock()
-	_, ok := globalParams[k]
-	varsLock.Unlock()
+	_, ok := (*globalParams.Load())[k]
 	return ok
 }
 
@@ -115,9 +147,7 @@ func GetUserVar(group, name string) (string, bool) {
 }
 
 func GetGlobalParam(k string) (string, bool) {
-	varsLock.Lock()
-	ret, ok := globalParams[k]
-	varsLock.Unlock()
+	ret, ok := (*globalParams.Load())[k]
 	return ret, ok
 }
 
@@ -144,11 +174,9 @@ func SetVarCanExpand(k string, b bool) {
 
 func CloneGlobalParams() map[string]string {
 	ret := make(map[string]string)
-	varsLock.Lock()
-	for k, v := range(globalParams) {
+	for k, v := range(*globalParams.Load()) {
 		ret[k] = v
 	}
-	varsLock.Unlock()
 	return ret
 }
 
@@ -161,15 +189,77 @@ func ValidateParams(vs conf.Validators, params ParamFunc) bool {
 		if !ok {
 			return false
 		}
-		ret, err := regexp.MatchString(vd.Pattern, v)
-		if err != nil || !ret{
+		if !validateParam(&vd, v) {
 			return false
 		}
 	}
 	return true
 }
 
+// declaredParams applies param declarations, absent params take their defaults,
+// and an absent required param is a bad request. Values of typed params are normalized,
+// a value not of the type is a bad request.
+func declaredParams(ps conf.Params, params ParamFunc) (ParamFunc, *ServantError) {
+	if len(ps) == 0 {
+		return params, nil
+	}
+	coerced := make(map[string]string)
+	for name, p := range ps {
+		v, ok := params(name)
+		if !ok && p.Required {
+			err := NewServantError(http.StatusBadRequest, "param %s is required", name)
+			return nil, &err
+		}
+		if p.Type == "" || p.Type == "string" {
+			continue
+		}
+		if !ok {
+			if !p.HasDefault {
+				continue
+			}
+			v = p.Default
+		}
+		c, cerr := p.Coerce(v)
+		if cerr != nil {
+			err := NewServantError(http.StatusBadRequest, "param %s %s", name, cerr)
+			return nil, &err
+		}
+		coerced[name] = c
+	}
+	return func(k string) (string, bool) {
+		if v, ok := coerced[k]; ok {
+			return v, true
+		}
+		v, ok := params(k)
+		if !ok {
+			if p, declared := ps[k]; declared && p.HasDefault {
+				return p.Default, true
+			}
+		}
+		return v, ok
+	}, nil
+}
+
+func validateParam(vd *conf.Validator, v string) bool {
+	if vd.Class == "enum" {
+		for _, value := range vd.Values {
+			if v == value {
+				return true
+			}
+		}
+		return false
+	}
+	// anchored, so a pattern like [a-z]+ does not pass values only containing a match
+	ret, err := regexp.MatchString("^(?:" + vd.Pattern + ")$", v)
+	return err == nil && ret
+}
+
 func VarExpand(s string, query ParamFunc, replace func(string)string) (string, bool) {
+	return varExpandNamed(s, query, func(name, v string) string { return replace(v) })
+}
+
+// varExpandNamed is VarExpand replacing outermost params by their names too
+func varExpandNamed(s string, query ParamFunc, replace func(name, v string) string) (string, bool) {
 	const maxDepth = 10
 	stack := make([][]byte, maxDepth)
 	stack[0] = make([]byte, 0, len(s))
@@ -197,7 +287,7 @@ func VarExpand(s string, query ParamFunc, replace func(string)string) (string, b
 				return "", false
 			}
 			if sp == 1 {
-				stack[0] = append(stack[0], []byte(replace(v))...)
+				stack[0] = append(stack[0], []byte(replace(string(n), v))...)
 			} else {
 				stack[sp - 1] = append(stack[sp - 1], []byte(v)...)
 			}
@@ -1,9 +1,12 @@
 package server
 import (
 	"testing"
+	"strconv"
+	"strings"
+	"servant/conf"
 )
 func TestExpand(t *testing.T) {
-	reqParams := requestParams(nil)
+	reqParams := requestParams(nil, "")
 	SetGlobalParam("hello", "hello ${w}")
 	SetGlobalParam("w", "world")
 	SetVarCanExpand("hello", true)
@@ -88,4 +91,133 @@ func TestVarExpand(t *testing.T) {
 	if !ok || ret != "!variable!" {
 		t.Errorf("fail: %s", ret)
 	}
-}
\ No newline at end of file
+}
+func TestValidateParams(t *testing.T) {
+	params := func(k string) (string, bool) {
+		if k == "a" {
+			return "eu", true
+		}
+		return "", false
+	}
+	vs := conf.Validators{
+		"a": conf.Validator{ Name: "a", Class: "enum", Values: []string{"us", "eu"} },
+	}
+	if !ValidateParams(vs, params) {
+		t.Error("eu should be valid")
+	}
+	vs["a"] = conf.Validator{ Name: "a", Class: "enum", Values: []string{"us"} }
+	if ValidateParams(vs, params) {
+		t.Error("eu should be invalid")
+	}
+	vs["a"] = conf.Validator{ Name: "a", Class: "regexp", Pattern: `^e\w$` }
+	if !ValidateParams(vs, params) {
+		t.Error("eu should match")
+	}
+	// the whole value must match
+	vs["a"] = conf.Validator{ Name: "a", Class: "regexp", Pattern: `[a-z]` }
+	if ValidateParams(vs, params) {
+		t.Error("eu should not match a single letter")
+	}
+	vs["a"] = conf.Validator{ Name: "a", Class: "regexp", Pattern: `us|eu` }
+	if !ValidateParams(vs, params) {
+		t.Error("eu should match an alternative")
+	}
+	vs["b"] = conf.Validator{ Name: "b", Class: "regexp", Pattern: `.*` }
+	if ValidateParams(vs, params) {
+		t.Error("missing param should be invalid")
+	}
+}
+
+func TestDeclaredParams(t *testing.T) {
+	params := func(k string) (string, bool) {
+		if k == "a" {
+			return "given", true
+		}
+		return "", false
+	}
+	ps := conf.Params{
+		"a": conf.Param{ Default: "default", HasDefault: true },
+		"b": conf.Param{ Default: "", HasDefault: true },
+		"c": conf.Param{},
+	}
+	declared, err := declaredParams(ps, params)
+	if err != nil {
+		t.Fatalf("no param is required: %v", err)
+	}
+	if v, ok := declared("a"); !ok || v != "given" {
+		t.Errorf("given param should not be defaulted: %q", v)
+	}
+	if v, ok := declared("b"); !ok || v != "" {
+		t.Errorf("empty default should be used: %q %v", v, ok)
+	}
+	if _, ok := declared("c"); ok {
+		t.Error("param without default should stay missing")
+	}
+
+	ps["c"] = conf.Param{ Required: true }
+	if _, err := declaredParams(ps, params); err == nil || err.HttpCode != 400 || !strings.Contains(err.Message, "param c") {
+		t.Errorf("missing required param should be named: %v", err)
+	}
+	ps["a"] = conf.Param{ Required: true }
+	delete(ps, "c")
+	if _, err := declaredParams(ps, params); err != nil {
+		t.Errorf("given required param should pass: %v", err)
+	}
+}
+
+func TestDeclaredParamsTypes(t *testing.T) {
+	values := map[string]string{ "n": " 42", "on": "1", "color": "red" }
+	params := func(k string) (string, bool) {
+		v, ok := values[k]
+		return v, ok
+	}
+	ps := conf.Params{
+		"n": conf.Param{ Type: "int" },
+		"on": conf.Param{ Type: "bool" },
+		"color": conf.Param{ Type: "enum", Values: []string{"red", "green"} },
+		"ratio": conf.Param{ Type: "float", Default: "0.50", HasDefault: true },
+	}
+	declared, err := declaredParams(ps, params)
+	if err != nil {
+		t.Fatalf("params of the types should pass: %v", err)
+	}
+	for k, expected := range map[string]string{ "n": "42", "on": "true", "color": "red", "ratio": "0.5" } {
+		if v, _ := declared(k); v != expected {
+			t.Errorf("%s should be normalized to %q: %q", k, expected, v)
+		}
+	}
+	values["color"] = "blue"
+	if _, err := declaredParams(ps, params); err == nil || err.HttpCode != 400 || err.Message != "param color should be one of red, green" {
+		t.Errorf("enum mismatch should tell the allowed values: %v", err)
+	}
+	values["color"], values["n"] = "red", "abc"
+	if _, err := declaredParams(ps, params); err == nil || err.HttpCode != 400 || err.Message != "param n should be an integer" {
+		t.Errorf("int mismatch should be a bad request: %v", err)
+	}
+}
+
+func TestGlobalParams(t *testing.T) {
+	SetGlobalParam("flags.maintenance", "on")
+	if v, ok := GetGlobalParam("flags.maintenance"); !ok || v != "on" {
+		t.Errorf("param should be set: %q %v", v, ok)
+	}
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			SetGlobalParam("flags.counter", strconv.Itoa(i))
+		}
+		close(done)
+	}()
+	for i := 0; i < 1000; i++ {
+		GetGlobalParam("flags.counter")
+	}
+	<-done
+	if v, _ := GetGlobalParam("flags.counter"); v != "999" {
+		t.Errorf("last set should win: %q", v)
+	}
+	DeleteGlobalParam("flags.maintenance")
+	if GlobalParamExists("flags.maintenance") {
+		t.Errorf("param should be deleted")
+	}
+	DeleteGlobalParam("flags.counter")
+}